@@ -147,7 +147,7 @@ func main() {
 		defer unannounceHTTP()
 	}
 
-	qm, err := quota.NewManager(*quotaSystem)
+	qm, err := quota.NewManagerWithMetrics(*quotaSystem, mf)
 	if err != nil {
 		klog.Exitf("Error creating quota manager: %v", err)
 	}
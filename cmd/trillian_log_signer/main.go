@@ -152,7 +152,7 @@ func main() {
 		klog.Exit("Either --force_master or --etcd_servers must be supplied")
 	}
 
-	qm, err := quota.NewManager(*quotaSystem)
+	qm, err := quota.NewManagerWithMetrics(*quotaSystem, mf)
 	if err != nil {
 		klog.Exitf("Error creating quota manager: %v", err)
 	}
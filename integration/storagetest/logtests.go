@@ -632,3 +632,56 @@ func (*logTests) TestAddSequencedLeavesAndDequeueLeaves(ctx context.Context, t *
 		t.Errorf("dequeueLeaves() diff: %v", diff)
 	}
 }
+
+// TestGetActiveLogIDs checks that GetActiveLogIDs returns non-deleted LOG and
+// PREORDERED_LOG trees that are ACTIVE or DRAINING, and no others. The storage
+// may hold trees from other tests, so only the trees created here are checked.
+func (*logTests) TestGetActiveLogIDs(ctx context.Context, t *testing.T, s storage.LogStorage, as storage.AdminStorage) {
+	activeLog := mustCreateTree(ctx, t, as, storageto.LogTree)
+	preorderedLog := mustCreateTree(ctx, t, as, storageto.PreorderedLogTree)
+	drainingLog := mustCreateTree(ctx, t, as, storageto.LogTree)
+	frozenLog := mustCreateTree(ctx, t, as, storageto.LogTree)
+	deletedLog := mustCreateTree(ctx, t, as, storageto.LogTree)
+
+	// DRAINING and FROZEN are not valid initial states.
+	for treeID, state := range map[int64]trillian.TreeState{
+		drainingLog.TreeId: trillian.TreeState_DRAINING,
+		frozenLog.TreeId:   trillian.TreeState_FROZEN,
+	} {
+		if _, err := storage.UpdateTree(ctx, as, treeID, func(tree *trillian.Tree) {
+			tree.TreeState = state
+		}); err != nil {
+			t.Fatalf("UpdateTree(%v): %v", treeID, err)
+		}
+	}
+	if err := as.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+		_, err := tx.SoftDeleteTree(ctx, deletedLog.TreeId)
+		return err
+	}); err != nil {
+		t.Fatalf("SoftDeleteTree(%v): %v", deletedLog.TreeId, err)
+	}
+
+	ids, err := s.GetActiveLogIDs(ctx)
+	if err != nil {
+		t.Fatalf("GetActiveLogIDs(): %v", err)
+	}
+	got := make(map[int64]bool)
+	for _, id := range ids {
+		got[id] = true
+	}
+	for _, tc := range []struct {
+		desc string
+		id   int64
+		want bool
+	}{
+		{desc: "active", id: activeLog.TreeId, want: true},
+		{desc: "preordered", id: preorderedLog.TreeId, want: true},
+		{desc: "draining", id: drainingLog.TreeId, want: true},
+		{desc: "frozen", id: frozenLog.TreeId, want: false},
+		{desc: "deleted", id: deletedLog.TreeId, want: false},
+	} {
+		if got[tc.id] != tc.want {
+			t.Errorf("GetActiveLogIDs() includes %s tree = %t, want %t", tc.desc, got[tc.id], tc.want)
+		}
+	}
+}
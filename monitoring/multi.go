@@ -0,0 +1,126 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitoring
+
+// MultiMetricFactory is a MetricFactory whose metrics fan out to the metrics
+// of each of its factories, e.g. to export metrics to two monitoring systems
+// during a migration. Values are read back from the first factory.
+type MultiMetricFactory []MetricFactory
+
+// NewMultiMetricFactory returns a MetricFactory which fans out to each of
+// factories, of which there must be at least one.
+func NewMultiMetricFactory(factories ...MetricFactory) MultiMetricFactory {
+	if len(factories) == 0 {
+		panic("monitoring: NewMultiMetricFactory needs at least one factory")
+	}
+	return MultiMetricFactory(factories)
+}
+
+// NewCounter creates a Counter in each of the factories.
+func (mmf MultiMetricFactory) NewCounter(name, help string, labelNames ...string) Counter {
+	m := make(multiCounter, len(mmf))
+	for i, f := range mmf {
+		m[i] = f.NewCounter(name, help, labelNames...)
+	}
+	return m
+}
+
+// NewGauge creates a Gauge in each of the factories.
+func (mmf MultiMetricFactory) NewGauge(name, help string, labelNames ...string) Gauge {
+	m := make(multiGauge, len(mmf))
+	for i, f := range mmf {
+		m[i] = f.NewGauge(name, help, labelNames...)
+	}
+	return m
+}
+
+// NewHistogram creates a Histogram in each of the factories.
+func (mmf MultiMetricFactory) NewHistogram(name, help string, labelNames ...string) Histogram {
+	m := make(multiHistogram, len(mmf))
+	for i, f := range mmf {
+		m[i] = f.NewHistogram(name, help, labelNames...)
+	}
+	return m
+}
+
+// NewHistogramWithBuckets creates a Histogram with the given buckets in each
+// of the factories.
+func (mmf MultiMetricFactory) NewHistogramWithBuckets(name, help string, buckets []float64, labelNames ...string) Histogram {
+	m := make(multiHistogram, len(mmf))
+	for i, f := range mmf {
+		m[i] = f.NewHistogramWithBuckets(name, help, buckets, labelNames...)
+	}
+	return m
+}
+
+type multiCounter []Counter
+
+func (m multiCounter) Inc(labelVals ...string) {
+	for _, c := range m {
+		c.Inc(labelVals...)
+	}
+}
+
+func (m multiCounter) Add(val float64, labelVals ...string) {
+	for _, c := range m {
+		c.Add(val, labelVals...)
+	}
+}
+
+func (m multiCounter) Value(labelVals ...string) float64 {
+	return m[0].Value(labelVals...)
+}
+
+type multiGauge []Gauge
+
+func (m multiGauge) Inc(labelVals ...string) {
+	for _, g := range m {
+		g.Inc(labelVals...)
+	}
+}
+
+func (m multiGauge) Dec(labelVals ...string) {
+	for _, g := range m {
+		g.Dec(labelVals...)
+	}
+}
+
+func (m multiGauge) Add(val float64, labelVals ...string) {
+	for _, g := range m {
+		g.Add(val, labelVals...)
+	}
+}
+
+func (m multiGauge) Set(val float64, labelVals ...string) {
+	for _, g := range m {
+		g.Set(val, labelVals...)
+	}
+}
+
+func (m multiGauge) Value(labelVals ...string) float64 {
+	return m[0].Value(labelVals...)
+}
+
+type multiHistogram []Histogram
+
+func (m multiHistogram) Observe(val float64, labelVals ...string) {
+	for _, h := range m {
+		h.Observe(val, labelVals...)
+	}
+}
+
+func (m multiHistogram) Info(labelVals ...string) (uint64, float64) {
+	return m[0].Info(labelVals...)
+}
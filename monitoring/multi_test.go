@@ -0,0 +1,82 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitoring_test
+
+import (
+	"testing"
+
+	"github.com/google/trillian/monitoring"
+	"github.com/google/trillian/monitoring/testonly"
+)
+
+func newMulti() monitoring.MultiMetricFactory {
+	return monitoring.NewMultiMetricFactory(monitoring.InertMetricFactory{}, monitoring.InertMetricFactory{})
+}
+
+func TestMultiCounter(t *testing.T) {
+	testonly.TestCounter(t, newMulti())
+}
+
+func TestMultiGauge(t *testing.T) {
+	testonly.TestGauge(t, newMulti())
+}
+
+func TestMultiHistogram(t *testing.T) {
+	testonly.TestHistogram(t, newMulti())
+}
+
+// recordingFactory is an InertMetricFactory which keeps the metrics it
+// creates.
+type recordingFactory struct {
+	monitoring.InertMetricFactory
+	counter   monitoring.Counter
+	gauge     monitoring.Gauge
+	histogram monitoring.Histogram
+}
+
+func (f *recordingFactory) NewCounter(name, help string, labelNames ...string) monitoring.Counter {
+	f.counter = f.InertMetricFactory.NewCounter(name, help, labelNames...)
+	return f.counter
+}
+
+func (f *recordingFactory) NewGauge(name, help string, labelNames ...string) monitoring.Gauge {
+	f.gauge = f.InertMetricFactory.NewGauge(name, help, labelNames...)
+	return f.gauge
+}
+
+func (f *recordingFactory) NewHistogramWithBuckets(name, help string, buckets []float64, labelNames ...string) monitoring.Histogram {
+	f.histogram = f.InertMetricFactory.NewHistogramWithBuckets(name, help, buckets, labelNames...)
+	return f.histogram
+}
+
+func TestMultiFansOut(t *testing.T) {
+	factories := []*recordingFactory{{}, {}}
+	mmf := monitoring.NewMultiMetricFactory(factories[0], factories[1])
+	mmf.NewCounter("c", "counter", "l").Add(2, "x")
+	mmf.NewGauge("g", "gauge", "l").Set(3, "x")
+	mmf.NewHistogramWithBuckets("h", "histogram", []float64{1, 2}, "l").Observe(4, "x")
+
+	for i, f := range factories {
+		if got := f.counter.Value("x"); got != 2 {
+			t.Errorf("factory %d: counter Value() = %v, want 2", i, got)
+		}
+		if got := f.gauge.Value("x"); got != 3 {
+			t.Errorf("factory %d: gauge Value() = %v, want 3", i, got)
+		}
+		if count, sum := f.histogram.Info("x"); count != 1 || sum != 4 {
+			t.Errorf("factory %d: histogram Info() = %d, %v, want 1, 4", i, count, sum)
+		}
+	}
+}
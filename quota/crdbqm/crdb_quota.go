@@ -54,6 +54,9 @@ type QuotaManager struct {
 // It doesn't actually reserve or retrieve tokens, instead it allows access based on the number of
 // rows in the Unsequenced table.
 func (m *QuotaManager) GetTokens(ctx context.Context, numTokens int, specs []quota.Spec) error {
+	if err := validateSpecs(specs); err != nil {
+		return err
+	}
 	for _, spec := range specs {
 		if spec.Group != quota.Global || spec.Kind != quota.Write {
 			continue
@@ -71,14 +74,25 @@ func (m *QuotaManager) GetTokens(ctx context.Context, numTokens int, specs []quo
 }
 
 // PutTokens implements quota.Manager.PutTokens.
-// It's a noop for QuotaManager.
+// It's a noop for QuotaManager, other than validating specs.
 func (m *QuotaManager) PutTokens(ctx context.Context, numTokens int, specs []quota.Spec) error {
-	return nil
+	return validateSpecs(specs)
 }
 
 // ResetQuota implements quota.Manager.ResetQuota.
-// It's a noop for QuotaManager.
+// It's a noop for QuotaManager, other than validating specs.
 func (m *QuotaManager) ResetQuota(ctx context.Context, specs []quota.Spec) error {
+	return validateSpecs(specs)
+}
+
+// validateSpecs returns an error if any of specs is malformed, so that a
+// zero TreeID or empty User isn't silently treated as an unlimited quota.
+func validateSpecs(specs []quota.Spec) error {
+	for _, spec := range specs {
+		if err := spec.Validate(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
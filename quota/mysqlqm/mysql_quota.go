@@ -20,8 +20,12 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/google/trillian/monitoring"
 	"github.com/google/trillian/quota"
+	"github.com/google/trillian/util/clock"
 	"k8s.io/klog/v2"
 )
 
@@ -39,10 +43,48 @@ const (
 	countFromUnsequencedQuery = "SELECT COUNT(*) FROM Unsequenced"
 )
 
+var (
+	once                 sync.Once
+	unsequencedRowsGauge monitoring.Gauge
+	deniedCounter        monitoring.Counter
+)
+
+func createMetrics(mf monitoring.MetricFactory) {
+	unsequencedRowsGauge = mf.NewGauge("mysqlqm_unsequenced_rows", "Number of unsequenced rows last counted by the quota manager")
+	deniedCounter = mf.NewCounter("mysqlqm_denied_requests", "Number of token requests denied by the quota manager", "kind")
+}
+
 // ErrTooManyUnsequencedRows is returned when tokens are requested but Unsequenced has grown
 // beyond the configured limit.
 var ErrTooManyUnsequencedRows = errors.New("too many unsequenced rows")
 
+// SpecError is returned by GetTokens when the quota of one of the requested
+// specs is exhausted. It identifies the spec that denied the request and its
+// state, and wraps ErrTooManyUnsequencedRows, ErrReadQuotaExhausted or
+// ErrReadRequestTooLarge, so that callers can still match those with
+// errors.Is.
+type SpecError struct {
+	// Spec is the spec that denied the request.
+	Spec quota.Spec
+	// Requested is the number of tokens requested.
+	Requested int
+	// Available is the number of tokens the spec had available.
+	Available int
+	// Max is the maximum number of tokens the spec may have available.
+	Max int
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *SpecError) Error() string {
+	return fmt.Sprintf("%v: %v: requested %d tokens, %d of %d available", e.Spec, e.Err, e.Requested, e.Available, e.Max)
+}
+
+// Unwrap returns the underlying error.
+func (e *SpecError) Unwrap() error {
+	return e.Err
+}
+
 // QuotaManager is a MySQL-based quota.Manager implementation.
 //
 // It has two working modes: one queries the information schema for the number of Unsequenced rows,
@@ -50,49 +92,208 @@ var ErrTooManyUnsequencedRows = errors.New("too many unsequenced rows")
 // default, even though they are approximate, as they're constant time (select count(*) on InnoDB
 // based MySQL needs to traverse the index and may take quite a while to complete).
 //
+// The information schema count is InnoDB's estimate of the table's size, which is derived from
+// sampled index pages and refreshed as the table changes, so it can be off by a large fraction
+// of the true count and may lag behind recent inserts. QuotaManager turns off the MySQL 8
+// statistics cache (information_schema_stats_expiry) for its sessions, but operators should still
+// expect writes to be admitted somewhat beyond MaxUnsequencedRows, or denied somewhat before it,
+// and size the limit with that margin in mind.
+//
 // QuotaManager only implements Global/Write quotas, which is based on the number of Unsequenced
 // rows (to be exact, tokens = MaxUnsequencedRows - actualUnsequencedRows).
-// Other quotas are considered infinite.
+// If ReadRate is positive, Read quotas are also enforced, using an in-process
+// leaky bucket per spec. Other quotas are considered infinite.
 type QuotaManager struct {
 	DB                 *sql.DB
 	MaxUnsequencedRows int
 	UseSelectCount     bool
+
+	// SelectCountTreeIDs overrides UseSelectCount for requests whose Tree spec
+	// names one of these trees, so that they use the exact select count(*).
+	// The quota is global, so the count is still of the whole Unsequenced
+	// table, not just the tree's rows: the override makes these trees' writes
+	// admitted on an exact count, but each of them pays for a full count, so
+	// it's only cheap while the table as a whole is small.
+	SelectCountTreeIDs map[int64]bool
+
+	// ReadRate is the number of Read tokens replenished per second for each
+	// Read spec. Zero (the default) leaves Read quotas unlimited.
+	ReadRate float64
+	// ReadBurst is the maximum number of Read tokens a spec may accumulate.
+	// If not positive, ReadRate rounded up is used.
+	ReadBurst int
+	// TimeSource is used to refill Read buckets and to age counts of
+	// Unsequenced rows. Defaults to clock.System.
+	TimeSource clock.TimeSource
+
+	// StaleCountTolerance is how old the last successful count of Unsequenced
+	// rows may be for GetTokens to fall back to it when counting fails, e.g.
+	// while the database is briefly unavailable. Writes admitted on a stale
+	// count aren't reflected in it, so over-admission may grow by however
+	// many writes arrive in this window. Zero (the default) fails requests
+	// whose count fails.
+	StaleCountTolerance time.Duration
+
+	mf    monitoring.MetricFactory
+	reads readBuckets
+
+	countMu       sync.Mutex
+	lastCount     int
+	lastCountTime time.Time
+}
+
+// QuotaManagerOptions holds the settings of a QuotaManager created with
+// NewQuotaManager. See QuotaManager for the meaning of each field.
+type QuotaManagerOptions struct {
+	// MetricFactory is used to create the quota metrics. If nil, metrics are
+	// not exported.
+	MetricFactory       monitoring.MetricFactory
+	MaxUnsequencedRows  int
+	UseSelectCount      bool
+	SelectCountTreeIDs  map[int64]bool
+	ReadRate            float64
+	ReadBurst           int
+	StaleCountTolerance time.Duration
+}
+
+// NewQuotaManager creates a QuotaManager backed by db.
+func NewQuotaManager(db *sql.DB, opts QuotaManagerOptions) *QuotaManager {
+	mf := opts.MetricFactory
+	if mf == nil {
+		mf = monitoring.InertMetricFactory{}
+	}
+	return &QuotaManager{
+		DB:                  db,
+		MaxUnsequencedRows:  opts.MaxUnsequencedRows,
+		UseSelectCount:      opts.UseSelectCount,
+		SelectCountTreeIDs:  opts.SelectCountTreeIDs,
+		ReadRate:            opts.ReadRate,
+		ReadBurst:           opts.ReadBurst,
+		StaleCountTolerance: opts.StaleCountTolerance,
+		mf:                  mf,
+	}
 }
 
 // GetTokens implements quota.Manager.GetTokens.
-// It doesn't actually reserve or retrieve tokens, instead it allows access based on the number of
-// rows in the Unsequenced table.
+// It doesn't actually reserve or retrieve Write tokens, instead it allows access based on the
+// number of rows in the Unsequenced table. Read tokens are debited from the buckets of all the Read
+// specs if Read quotas are enforced, and only if none of the specs deny the request.
 func (m *QuotaManager) GetTokens(ctx context.Context, numTokens int, specs []quota.Spec) error {
+	once.Do(func() {
+		mf := m.mf
+		if mf == nil {
+			mf = monitoring.InertMetricFactory{}
+		}
+		createMetrics(mf)
+	})
+	if err := validateSpecs(specs); err != nil {
+		return err
+	}
+	var readSpecs []quota.Spec
 	for _, spec := range specs {
-		if spec.Group != quota.Global || spec.Kind != quota.Write {
+		if spec.Kind == quota.Read {
+			if m.readEnforced() {
+				readSpecs = append(readSpecs, spec)
+			}
+			continue
+		}
+		if spec.Group != quota.Global {
 			continue
 		}
 		// Only allow global writes if Unsequenced is under the expected limit
-		count, err := m.countUnsequenced(ctx)
+		count, err := m.countUnsequencedOrStale(ctx, m.useSelectCount(specs))
 		if err != nil {
 			return err
 		}
+		unsequencedRowsGauge.Set(float64(count))
 		if count+numTokens > m.MaxUnsequencedRows {
-			return ErrTooManyUnsequencedRows
+			deniedCounter.Inc("write")
+			return &SpecError{
+				Spec:      spec,
+				Requested: numTokens,
+				Available: max(m.MaxUnsequencedRows-count, 0),
+				Max:       m.MaxUnsequencedRows,
+				Err:       ErrTooManyUnsequencedRows,
+			}
+		}
+	}
+	if len(readSpecs) > 0 {
+		if err := m.reads.take(readSpecs, numTokens, m.ReadRate, m.readBurst(), m.timeSource().Now()); err != nil {
+			deniedCounter.Inc("read")
+			return err
 		}
 	}
 	return nil
 }
 
 // PutTokens implements quota.Manager.PutTokens.
-// It's a noop for QuotaManager.
+// It's a noop for QuotaManager, other than validating specs. Read buckets refill
+// over time instead.
 func (m *QuotaManager) PutTokens(ctx context.Context, numTokens int, specs []quota.Spec) error {
-	return nil
+	return validateSpecs(specs)
 }
 
 // ResetQuota implements quota.Manager.ResetQuota.
-// It's a noop for QuotaManager.
+// It refills the buckets of Read specs; it's a noop for other specs.
 func (m *QuotaManager) ResetQuota(ctx context.Context, specs []quota.Spec) error {
+	if err := validateSpecs(specs); err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if spec.Kind == quota.Read {
+			m.reads.reset(spec)
+		}
+	}
+	return nil
+}
+
+// validateSpecs returns an error if any of specs is malformed, so that a
+// zero TreeID or empty User isn't silently treated as an unlimited quota.
+func validateSpecs(specs []quota.Spec) error {
+	for _, spec := range specs {
+		if err := spec.Validate(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (m *QuotaManager) countUnsequenced(ctx context.Context) (int, error) {
+// useSelectCount returns whether Unsequenced rows should be counted exactly
+// for a request made of specs.
+func (m *QuotaManager) useSelectCount(specs []quota.Spec) bool {
 	if m.UseSelectCount {
+		return true
+	}
+	for _, spec := range specs {
+		if spec.Group == quota.Tree && m.SelectCountTreeIDs[spec.TreeID] {
+			return true
+		}
+	}
+	return false
+}
+
+// countUnsequencedOrStale counts Unsequenced rows like countUnsequenced. If
+// that fails, it returns the last successful count instead, provided that's
+// within StaleCountTolerance.
+func (m *QuotaManager) countUnsequencedOrStale(ctx context.Context, useSelectCount bool) (int, error) {
+	count, err := m.countUnsequenced(ctx, useSelectCount)
+	now := m.timeSource().Now()
+
+	m.countMu.Lock()
+	defer m.countMu.Unlock()
+	if err == nil {
+		m.lastCount, m.lastCountTime = count, now
+		return count, nil
+	}
+	if age := now.Sub(m.lastCountTime); m.StaleCountTolerance > 0 && !m.lastCountTime.IsZero() && age <= m.StaleCountTolerance {
+		klog.Warningf("Failed to count unsequenced rows, using count from %v ago: %v", age, err)
+		return m.lastCount, nil
+	}
+	return 0, err
+}
+
+func (m *QuotaManager) countUnsequenced(ctx context.Context, useSelectCount bool) (int, error) {
+	if useSelectCount {
 		return countFromTable(ctx, m.DB)
 	}
 	return countFromInformationSchema(ctx, m.DB)
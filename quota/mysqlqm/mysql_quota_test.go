@@ -18,6 +18,7 @@ import (
 	"context"
 	"crypto"
 	"database/sql"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -29,6 +30,7 @@ import (
 	"github.com/google/trillian/storage/mysql"
 	"github.com/google/trillian/storage/testdb"
 	"github.com/google/trillian/types"
+	"github.com/google/trillian/util/clock"
 
 	stestonly "github.com/google/trillian/storage/testonly"
 )
@@ -108,7 +110,7 @@ func TestQuotaManager_GetTokens(t *testing.T) {
 		// See TestQuotaManager_GetTokens_InformationSchema for information schema tests.
 		qm := &mysqlqm.QuotaManager{DB: db, MaxUnsequencedRows: test.maxUnsequencedRows, UseSelectCount: true}
 		err := qm.GetTokens(ctx, test.numTokens, test.specs)
-		if hasErr := err == mysqlqm.ErrTooManyUnsequencedRows; hasErr != test.wantErr {
+		if hasErr := errors.Is(err, mysqlqm.ErrTooManyUnsequencedRows); hasErr != test.wantErr {
 			t.Errorf("%v: GetTokens() returned err = %q, wantErr = %v", test.desc, err, test.wantErr)
 		}
 	}
@@ -171,13 +173,47 @@ func TestQuotaManager_GetTokens_InformationSchema(t *testing.T) {
 					stop = true
 				default:
 					// An error means that GetTokens is working correctly
-					stop = qm.GetTokens(ctx, 1 /* numTokens */, globalWriteSpec) == mysqlqm.ErrTooManyUnsequencedRows
+					stop = errors.Is(qm.GetTokens(ctx, 1 /* numTokens */, globalWriteSpec), mysqlqm.ErrTooManyUnsequencedRows)
 				}
 			}
 		})
 	}
 }
 
+func TestQuotaManager_StaleCountTolerance(t *testing.T) {
+	testdb.SkipIfNoMySQL(t)
+	ctx := context.Background()
+
+	db, done, err := testdb.NewTrillianDB(ctx, testdb.DriverMySQL)
+	if err != nil {
+		t.Fatalf("NewTrillianDB() returned err = %v", err)
+	}
+	defer done(ctx)
+
+	ts := clock.NewFake(time.Unix(1000, 0))
+	qm := &mysqlqm.QuotaManager{DB: db, MaxUnsequencedRows: 20, UseSelectCount: true, TimeSource: ts, StaleCountTolerance: time.Minute}
+	globalWriteSpec := []quota.Spec{{Group: quota.Global, Kind: quota.Write}}
+
+	// A cancelled context makes counting fail.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := qm.GetTokens(cancelled, 1 /* numTokens */, globalWriteSpec); err == nil {
+		t.Error("GetTokens() without a previous count returned err = nil, want error")
+	}
+
+	if err := qm.GetTokens(ctx, 1 /* numTokens */, globalWriteSpec); err != nil {
+		t.Fatalf("GetTokens() returned err = %v", err)
+	}
+	ts.Set(ts.Now().Add(time.Minute))
+	if err := qm.GetTokens(cancelled, 1 /* numTokens */, globalWriteSpec); err != nil {
+		t.Errorf("GetTokens() within tolerance returned err = %v", err)
+	}
+	ts.Set(ts.Now().Add(time.Second))
+	if err := qm.GetTokens(cancelled, 1 /* numTokens */, globalWriteSpec); err == nil {
+		t.Error("GetTokens() beyond tolerance returned err = nil, want error")
+	}
+}
+
 func TestQuotaManager_Noops(t *testing.T) {
 	testdb.SkipIfNoMySQL(t)
 	ctx := context.Background()
@@ -215,6 +251,139 @@ func TestQuotaManager_Noops(t *testing.T) {
 	}
 }
 
+func TestQuotaManager_InvalidSpecs(t *testing.T) {
+	ctx := context.Background()
+	// Specs are validated before the database is touched, so no DB is needed.
+	qm := &mysqlqm.QuotaManager{MaxUnsequencedRows: 1000}
+
+	for _, spec := range []quota.Spec{
+		{Group: quota.Tree, Kind: quota.Write},
+		{Group: quota.User, Kind: quota.Read},
+	} {
+		specs := []quota.Spec{{Group: quota.Global, Kind: quota.Read}, spec}
+		if err := qm.GetTokens(ctx, 1 /* numTokens */, specs); err == nil {
+			t.Errorf("GetTokens(%v) returned nil err, want non-nil", spec)
+		}
+		if err := qm.PutTokens(ctx, 1 /* numTokens */, specs); err == nil {
+			t.Errorf("PutTokens(%v) returned nil err, want non-nil", spec)
+		}
+		if err := qm.ResetQuota(ctx, specs); err == nil {
+			t.Errorf("ResetQuota(%v) returned nil err, want non-nil", spec)
+		}
+	}
+}
+
+func TestQuotaManager_SpecError(t *testing.T) {
+	ctx := context.Background()
+	ts := clock.NewFake(time.Unix(1000, 0))
+	qm := &mysqlqm.QuotaManager{ReadRate: 2, ReadBurst: 4, TimeSource: ts}
+	global := quota.Spec{Group: quota.Global, Kind: quota.Read}
+	alice := quota.Spec{Group: quota.User, Kind: quota.Read, User: "alice"}
+
+	if err := qm.GetTokens(ctx, 3 /* numTokens */, []quota.Spec{alice}); err != nil {
+		t.Fatalf("GetTokens(alice, 3) returned err = %v", err)
+	}
+	err := qm.GetTokens(ctx, 2 /* numTokens */, []quota.Spec{global, alice})
+	var specErr *mysqlqm.SpecError
+	if !errors.As(err, &specErr) {
+		t.Fatalf("GetTokens(global+alice, 2) returned err = %v, want a SpecError", err)
+	}
+	want := mysqlqm.SpecError{Spec: alice, Requested: 2, Available: 1, Max: 4, Err: mysqlqm.ErrReadQuotaExhausted}
+	if *specErr != want {
+		t.Errorf("GetTokens(global+alice, 2) returned err = %+v, want %+v", *specErr, want)
+	}
+	// The denied request took no tokens from global.
+	if err := qm.GetTokens(ctx, 4 /* numTokens */, []quota.Spec{global}); err != nil {
+		t.Errorf("GetTokens(global, 4) returned err = %v", err)
+	}
+}
+
+func TestQuotaManager_DefaultReadBurst(t *testing.T) {
+	ctx := context.Background()
+	ts := clock.NewFake(time.Unix(1000, 0))
+	qm := mysqlqm.NewQuotaManager(nil, mysqlqm.QuotaManagerOptions{ReadRate: 2.5})
+	qm.TimeSource = ts
+	alice := []quota.Spec{{Group: quota.User, Kind: quota.Read, User: "alice"}}
+
+	// Without ReadBurst, buckets hold ReadRate rounded up.
+	if err := qm.GetTokens(ctx, 3 /* numTokens */, alice); err != nil {
+		t.Fatalf("GetTokens(alice, 3) returned err = %v", err)
+	}
+	if err := qm.GetTokens(ctx, 1 /* numTokens */, alice); !errors.Is(err, mysqlqm.ErrReadQuotaExhausted) {
+		t.Errorf("GetTokens(alice, 1) returned err = %v, want %v", err, mysqlqm.ErrReadQuotaExhausted)
+	}
+	ts.Set(ts.Now().Add(time.Hour))
+	if err := qm.GetTokens(ctx, 3 /* numTokens */, alice); err != nil {
+		t.Errorf("GetTokens(alice, 3) after 1h returned err = %v", err)
+	}
+}
+
+func TestQuotaManager_ReadQuota(t *testing.T) {
+	ctx := context.Background()
+	ts := clock.NewFake(time.Unix(1000, 0))
+	// Read quotas are kept in-process, so no DB is needed.
+	qm := &mysqlqm.QuotaManager{ReadRate: 2, ReadBurst: 4, TimeSource: ts}
+	alice := []quota.Spec{{Group: quota.User, Kind: quota.Read, User: "alice"}}
+	bob := []quota.Spec{{Group: quota.User, Kind: quota.Read, User: "bob"}}
+
+	if err := qm.GetTokens(ctx, 4 /* numTokens */, alice); err != nil {
+		t.Fatalf("GetTokens(alice, 4) returned err = %v", err)
+	}
+	if err := qm.GetTokens(ctx, 1 /* numTokens */, alice); !errors.Is(err, mysqlqm.ErrReadQuotaExhausted) {
+		t.Errorf("GetTokens(alice, 1) returned err = %v, want %v", err, mysqlqm.ErrReadQuotaExhausted)
+	}
+	// Buckets are per spec.
+	if err := qm.GetTokens(ctx, 1 /* numTokens */, bob); err != nil {
+		t.Errorf("GetTokens(bob, 1) returned err = %v", err)
+	}
+	// PutTokens doesn't refill Read buckets.
+	if err := qm.PutTokens(ctx, 4 /* numTokens */, alice); err != nil {
+		t.Fatalf("PutTokens(alice, 4) returned err = %v", err)
+	}
+	if err := qm.GetTokens(ctx, 1 /* numTokens */, alice); !errors.Is(err, mysqlqm.ErrReadQuotaExhausted) {
+		t.Errorf("GetTokens(alice, 1) after PutTokens returned err = %v, want %v", err, mysqlqm.ErrReadQuotaExhausted)
+	}
+
+	// One second replenishes ReadRate tokens.
+	ts.Set(ts.Now().Add(time.Second))
+	if err := qm.GetTokens(ctx, 2 /* numTokens */, alice); err != nil {
+		t.Errorf("GetTokens(alice, 2) after 1s returned err = %v", err)
+	}
+	if err := qm.GetTokens(ctx, 1 /* numTokens */, alice); !errors.Is(err, mysqlqm.ErrReadQuotaExhausted) {
+		t.Errorf("GetTokens(alice, 1) after 1s returned err = %v, want %v", err, mysqlqm.ErrReadQuotaExhausted)
+	}
+
+	// Replenishment is capped at ReadBurst.
+	ts.Set(ts.Now().Add(time.Hour))
+	if err := qm.GetTokens(ctx, 3 /* numTokens */, alice); err != nil {
+		t.Errorf("GetTokens(alice, 3) after 1h returned err = %v", err)
+	}
+	if err := qm.GetTokens(ctx, 2 /* numTokens */, alice); !errors.Is(err, mysqlqm.ErrReadQuotaExhausted) {
+		t.Errorf("GetTokens(alice, 2) after 1h returned err = %v, want %v", err, mysqlqm.ErrReadQuotaExhausted)
+	}
+
+	// Requests for more than ReadBurst can never be granted.
+	ts.Set(ts.Now().Add(time.Hour))
+	err := qm.GetTokens(ctx, 5 /* numTokens */, alice)
+	if !errors.Is(err, mysqlqm.ErrReadRequestTooLarge) {
+		t.Errorf("GetTokens(alice, 5) returned err = %v, want %v", err, mysqlqm.ErrReadRequestTooLarge)
+	}
+	if errors.Is(err, mysqlqm.ErrReadQuotaExhausted) {
+		t.Errorf("GetTokens(alice, 5) returned err = %v, want distinct from %v", err, mysqlqm.ErrReadQuotaExhausted)
+	}
+	if err := qm.GetTokens(ctx, 4 /* numTokens */, alice); err != nil {
+		t.Errorf("GetTokens(alice, 4) after a too large request returned err = %v", err)
+	}
+
+	// ResetQuota refills the bucket.
+	if err := qm.ResetQuota(ctx, alice); err != nil {
+		t.Fatalf("ResetQuota(alice) returned err = %v", err)
+	}
+	if err := qm.GetTokens(ctx, 4 /* numTokens */, alice); err != nil {
+		t.Errorf("GetTokens(alice, 4) after ResetQuota returned err = %v", err)
+	}
+}
+
 func allSpecs(_ context.Context, _ quota.Manager, treeID int64) []quota.Spec {
 	return []quota.Spec{
 		{Group: quota.User, Kind: quota.Read, User: "florence"},
@@ -16,7 +16,11 @@ package mysqlqm
 
 import (
 	"flag"
+	"fmt"
+	"strconv"
+	"strings"
 
+	"github.com/google/trillian/monitoring"
 	"github.com/google/trillian/quota"
 	"github.com/google/trillian/storage/mysql"
 	"k8s.io/klog/v2"
@@ -28,21 +32,60 @@ const QuotaManagerName = "mysql"
 var maxUnsequencedRows = flag.Int("max_unsequenced_rows", DefaultMaxUnsequenced, "Max number of unsequenced rows before rate limiting kicks in. "+
 	"Only effective for quota_system=mysql.")
 
+var selectCountTreeIDs = flag.String("mysql_quota_select_count_tree_ids", "", "Comma-separated IDs of trees whose write requests count unsequenced rows exactly with select count(*), "+
+	"rather than using the information schema estimate. The count is of all trees' unsequenced rows, so each such request pays for a full count of the table. "+
+	"Only effective for quota_system=mysql.")
+
+var (
+	readRate = flag.Float64("mysql_quota_read_rate", 0, "Read tokens replenished per second for each Read quota spec (user or tree). "+
+		"Zero leaves Read quotas unlimited. Only effective for quota_system=mysql.")
+	readBurst = flag.Int("mysql_quota_read_burst", 0, "Max Read tokens each Read quota spec may accumulate. "+
+		"Zero uses mysql_quota_read_rate rounded up. Only effective for quota_system=mysql with a non-zero mysql_quota_read_rate.")
+)
+
+var staleCountTolerance = flag.Duration("mysql_quota_stale_count_tolerance", 0, "How old the last count of unsequenced rows may be and still be used if counting fails. "+
+	"Zero fails write requests whose count fails. Only effective for quota_system=mysql.")
+
 func init() {
-	if err := quota.RegisterProvider(QuotaManagerName, newMySQLQuotaManager); err != nil {
+	if err := quota.RegisterProviderWithMetrics(QuotaManagerName, newMySQLQuotaManager); err != nil {
 		klog.Fatalf("Failed to register quota manager %v: %v", QuotaManagerName, err)
 	}
 }
 
-func newMySQLQuotaManager() (quota.Manager, error) {
+func newMySQLQuotaManager(mf monitoring.MetricFactory) (quota.Manager, error) {
 	db, err := mysql.GetDatabase()
 	if err != nil {
 		return nil, err
 	}
-	qm := &QuotaManager{
-		DB:                 db,
-		MaxUnsequencedRows: *maxUnsequencedRows,
+	treeIDs, err := parseTreeIDs(*selectCountTreeIDs)
+	if err != nil {
+		return nil, err
 	}
+	qm := NewQuotaManager(db, QuotaManagerOptions{
+		MetricFactory:       mf,
+		MaxUnsequencedRows:  *maxUnsequencedRows,
+		SelectCountTreeIDs:  treeIDs,
+		ReadRate:            *readRate,
+		ReadBurst:           *readBurst,
+		StaleCountTolerance: *staleCountTolerance,
+	})
 	klog.Info("Using MySQL QuotaManager")
 	return qm, nil
 }
+
+// parseTreeIDs parses a comma-separated list of tree IDs into a set.
+func parseTreeIDs(list string) (map[int64]bool, error) {
+	ids := make(map[int64]bool)
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tree ID %q: %v", field, err)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysqlqm
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseTreeIDs(t *testing.T) {
+	for _, tc := range []struct {
+		list    string
+		want    map[int64]bool
+		wantErr bool
+	}{
+		{list: "", want: map[int64]bool{}},
+		{list: "12", want: map[int64]bool{12: true}},
+		{list: "12, 34,", want: map[int64]bool{12: true, 34: true}},
+		{list: "12,abc", wantErr: true},
+	} {
+		got, err := parseTreeIDs(tc.list)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("parseTreeIDs(%q) = %v, wantErr %v", tc.list, err, tc.wantErr)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); !tc.wantErr && diff != "" {
+			t.Errorf("parseTreeIDs(%q) diff (-want +got):\n%s", tc.list, diff)
+		}
+	}
+}
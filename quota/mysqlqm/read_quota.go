@@ -0,0 +1,148 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysqlqm
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/google/trillian/quota"
+	"github.com/google/trillian/util/clock"
+)
+
+// ErrReadQuotaExhausted is returned when Read tokens are requested but the
+// leaky bucket for the spec doesn't hold enough tokens.
+var ErrReadQuotaExhausted = errors.New("read quota exhausted")
+
+// ErrReadRequestTooLarge is returned when more Read tokens are requested than
+// the leaky bucket for the spec can hold, so that the request can never be
+// granted.
+var ErrReadRequestTooLarge = errors.New("read request exceeds burst")
+
+// readBuckets holds an in-process leaky bucket per Read spec. Buckets aren't
+// shared between replicas, so limits are only exact for single-replica
+// deployments.
+type readBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*readBucket
+	// lastEviction is when idle buckets were last evicted.
+	lastEviction time.Time
+}
+
+type readBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take debits numTokens from each of the buckets identified by specs, first
+// refilling them at rate tokens per second (capped at burst) for the time
+// elapsed since they were last touched. New buckets start full. Either all the
+// buckets are debited, or, if any of them doesn't hold enough tokens, none
+// are. Requests for more than burst tokens fail with ErrReadRequestTooLarge.
+func (r *readBuckets) take(specs []quota.Spec, numTokens int, rate float64, burst int, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buckets == nil {
+		r.buckets = make(map[string]*readBucket)
+	}
+	r.evictIdle(rate, burst, now)
+
+	// Specs may repeat, so sum what's needed from each bucket before checking.
+	needed := make(map[string]float64)
+	for _, spec := range specs {
+		name := spec.Name()
+		b, ok := r.buckets[name]
+		if !ok {
+			b = &readBucket{tokens: float64(burst), last: now}
+			r.buckets[name] = b
+		}
+		if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+			b.tokens = math.Min(float64(burst), b.tokens+elapsed*rate)
+			b.last = now
+		}
+		if numTokens > burst {
+			return &SpecError{
+				Spec:      spec,
+				Requested: numTokens,
+				Available: int(b.tokens),
+				Max:       burst,
+				Err:       ErrReadRequestTooLarge,
+			}
+		}
+		needed[name] += float64(numTokens)
+		if b.tokens < needed[name] {
+			return &SpecError{
+				Spec:      spec,
+				Requested: numTokens,
+				Available: int(b.tokens),
+				Max:       burst,
+				Err:       ErrReadQuotaExhausted,
+			}
+		}
+	}
+	for name, n := range needed {
+		r.buckets[name].tokens -= n
+	}
+	return nil
+}
+
+// evictIdle drops the buckets which have been idle for long enough to refill,
+// since they behave the same as the full buckets that replace them. So that
+// this doesn't scan the buckets on every request, it runs at most once per
+// the time it takes to refill an empty bucket.
+func (r *readBuckets) evictIdle(rate float64, burst int, now time.Time) {
+	refill := time.Duration(float64(burst) / rate * float64(time.Second))
+	if now.Sub(r.lastEviction) < refill {
+		return
+	}
+	r.lastEviction = now
+	for name, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst) {
+			delete(r.buckets, name)
+		}
+	}
+}
+
+// reset refills the bucket identified by spec by dropping it; it is recreated
+// full on the next take.
+func (r *readBuckets) reset(spec quota.Spec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.buckets, spec.Name())
+}
+
+// readEnforced returns true if Read specs should be throttled.
+func (m *QuotaManager) readEnforced() bool {
+	return m.ReadRate > 0
+}
+
+// readBurst returns the capacity of Read buckets, which is ReadBurst if set,
+// or else ReadRate rounded up, so that buckets can always hold at least one
+// token.
+func (m *QuotaManager) readBurst() int {
+	if m.ReadBurst > 0 {
+		return m.ReadBurst
+	}
+	return int(math.Ceil(m.ReadRate))
+}
+
+func (m *QuotaManager) timeSource() clock.TimeSource {
+	if m.TimeSource != nil {
+		return m.TimeSource
+	}
+	return clock.System
+}
@@ -0,0 +1,64 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysqlqm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/trillian/quota"
+)
+
+func TestReadBucketsEvictIdle(t *testing.T) {
+	const rate, burst = 2, 4
+	now := time.Unix(1000, 0)
+	alice := quota.Spec{Group: quota.User, Kind: quota.Read, User: "alice"}
+	bob := quota.Spec{Group: quota.User, Kind: quota.Read, User: "bob"}
+
+	var r readBuckets
+	if err := r.take([]quota.Spec{alice}, 4, rate, burst, now); err != nil {
+		t.Fatalf("take(alice, 4) = %v", err)
+	}
+	// Bob's bucket is still refilling when alice's is full again.
+	now = now.Add(time.Second)
+	if err := r.take([]quota.Spec{bob}, 4, rate, burst, now); err != nil {
+		t.Fatalf("take(bob, 4) = %v", err)
+	}
+	if got, want := len(r.buckets), 2; got != want {
+		t.Fatalf("Got %d buckets, want %d", got, want)
+	}
+
+	// Two seconds refill an empty bucket, so the next take evicts alice's.
+	now = now.Add(time.Second)
+	carol := quota.Spec{Group: quota.User, Kind: quota.Read, User: "carol"}
+	if err := r.take([]quota.Spec{carol}, 1, rate, burst, now); err != nil {
+		t.Fatalf("take(carol, 1) = %v", err)
+	}
+	if _, ok := r.buckets[alice.Name()]; ok {
+		t.Errorf("Idle bucket of alice wasn't evicted")
+	}
+	if _, ok := r.buckets[bob.Name()]; !ok {
+		t.Errorf("Refilling bucket of bob was evicted")
+	}
+	// Bob's bucket has only refilled by two tokens.
+	if err := r.take([]quota.Spec{bob}, 3, rate, burst, now); err == nil {
+		t.Errorf("take(bob, 3) = nil, want error")
+	}
+
+	// An evicted bucket comes back full.
+	if err := r.take([]quota.Spec{alice}, 4, rate, burst, now); err != nil {
+		t.Errorf("take(alice, 4) after eviction = %v", err)
+	}
+}
@@ -17,24 +17,38 @@ package quota
 import (
 	"fmt"
 	"sync"
+
+	"github.com/google/trillian/monitoring"
 )
 
 var (
 	qpMu     sync.RWMutex
-	qpByName map[string]NewManagerFunc
+	qpByName map[string]NewManagerWithMetricsFunc
 )
 
 // NewManagerFunc is the signature of a function which can be registered
 // to provide instances of a quota manager.
 type NewManagerFunc func() (Manager, error)
 
+// NewManagerWithMetricsFunc is like NewManagerFunc, for quota managers which
+// create metrics using the given MetricFactory.
+type NewManagerWithMetricsFunc func(monitoring.MetricFactory) (Manager, error)
+
 // RegisterProvider registers a function that provides Manager instances.
 func RegisterProvider(name string, qp NewManagerFunc) error {
+	return RegisterProviderWithMetrics(name, func(monitoring.MetricFactory) (Manager, error) {
+		return qp()
+	})
+}
+
+// RegisterProviderWithMetrics registers a function that provides Manager
+// instances, which is passed the MetricFactory given to NewManagerWithMetrics.
+func RegisterProviderWithMetrics(name string, qp NewManagerWithMetricsFunc) error {
 	qpMu.Lock()
 	defer qpMu.Unlock()
 
 	if qpByName == nil {
-		qpByName = make(map[string]NewManagerFunc)
+		qpByName = make(map[string]NewManagerWithMetricsFunc)
 	}
 
 	_, exists := qpByName[name]
@@ -60,6 +74,12 @@ func Providers() []string {
 
 // NewManager returns a Manager implementation.
 func NewManager(name string) (Manager, error) {
+	return NewManagerWithMetrics(name, nil)
+}
+
+// NewManagerWithMetrics returns a Manager implementation, which uses mf to
+// create its metrics if it was registered with RegisterProviderWithMetrics.
+func NewManagerWithMetrics(name string, mf monitoring.MetricFactory) (Manager, error) {
 	qpMu.RLock()
 	defer qpMu.RUnlock()
 
@@ -67,5 +87,5 @@ func NewManager(name string) (Manager, error) {
 	if !exists {
 		return nil, fmt.Errorf("unknown quota system: %v", name)
 	}
-	return f()
+	return f(mf)
 }
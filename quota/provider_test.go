@@ -14,7 +14,11 @@
 
 package quota
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/google/trillian/monitoring"
+)
 
 func TestQuotaProviderRegistration(t *testing.T) {
 	for _, test := range []struct {
@@ -61,6 +65,33 @@ func TestQuotaProviderRegistration(t *testing.T) {
 	}
 }
 
+func TestQuotaProviderWithMetrics(t *testing.T) {
+	var gotMF monitoring.MetricFactory
+	if err := RegisterProviderWithMetrics("with metrics", func(mf monitoring.MetricFactory) (Manager, error) {
+		gotMF = mf
+		return nil, nil
+	}); err != nil {
+		t.Fatalf("RegisterProviderWithMetrics()=%v", err)
+	}
+	if err := RegisterProvider("with metrics", func() (Manager, error) { return nil, nil }); err == nil {
+		t.Error("RegisterProvider() with a name registered with metrics = no error, want error")
+	}
+
+	mf := monitoring.InertMetricFactory{}
+	if _, err := NewManagerWithMetrics("with metrics", mf); err != nil {
+		t.Fatalf("NewManagerWithMetrics()=%v", err)
+	}
+	if gotMF != mf {
+		t.Errorf("Provider got MetricFactory %v, want %v", gotMF, mf)
+	}
+	if _, err := NewManager("with metrics"); err != nil {
+		t.Fatalf("NewManager()=%v", err)
+	}
+	if gotMF != nil {
+		t.Errorf("Provider got MetricFactory %v from NewManager, want nil", gotMF)
+	}
+}
+
 func TestQuotaSystems(t *testing.T) {
 	if err := RegisterProvider("a", func() (Manager, error) { return nil, nil }); err != nil {
 		t.Fatalf("RegisterProvider(a)=%v", err)
@@ -96,6 +96,30 @@ func (s Spec) Name() string {
 	return fmt.Sprintf("%vs/%v/%v", group, user, kind)
 }
 
+// Validate returns an error if the Spec is not well-formed. Tree specs must
+// have a positive TreeID and User specs must have a non-empty User.
+func (s Spec) Validate() error {
+	switch s.Group {
+	case Global:
+	case Tree:
+		if s.TreeID <= 0 {
+			return fmt.Errorf("invalid quota spec %v: TreeID must be positive, got %v", s.Name(), s.TreeID)
+		}
+	case User:
+		if s.User == "" {
+			return fmt.Errorf("invalid quota spec %v: User must not be empty", s.Name())
+		}
+	default:
+		return fmt.Errorf("invalid quota spec: unknown group %v", s.Group)
+	}
+	switch s.Kind {
+	case Read, Write:
+	default:
+		return fmt.Errorf("invalid quota spec %v: unknown kind %v", s.Name(), s.Kind)
+	}
+	return nil
+}
+
 // String returns a description of Spec.
 func (s Spec) String() string {
 	return s.Name()
@@ -34,3 +34,25 @@ func TestSpec_Name(t *testing.T) {
 		}
 	}
 }
+
+func TestSpec_Validate(t *testing.T) {
+	tests := []struct {
+		spec    Spec
+		wantErr bool
+	}{
+		{spec: Spec{Group: Global, Kind: Read}},
+		{spec: Spec{Group: Global, Kind: Write}},
+		{spec: Spec{Group: Tree, Kind: Read, TreeID: 11}},
+		{spec: Spec{Group: User, Kind: Write, User: "llama"}},
+		{spec: Spec{Group: Tree, Kind: Read}, wantErr: true},
+		{spec: Spec{Group: Tree, Kind: Write, TreeID: -1}, wantErr: true},
+		{spec: Spec{Group: User, Kind: Read}, wantErr: true},
+		{spec: Spec{Group: Group(10), Kind: Read}, wantErr: true},
+		{spec: Spec{Group: Global, Kind: Kind(10)}, wantErr: true},
+	}
+	for _, test := range tests {
+		if err := test.spec.Validate(); (err != nil) != test.wantErr {
+			t.Errorf("%#v.Validate() = %v, wantErr = %v", test.spec, err, test.wantErr)
+		}
+	}
+}
@@ -155,6 +155,14 @@ func (s *SubtreeCache) cacheSubtree(t *storagepb.SubtreeProto) error {
 	return nil
 }
 
+// Preload loads the subtrees needed for the given nodes into the cache, so that
+// later GetNodes calls for them don't need to read storage. Unlike GetNodes, it
+// isn't an error for some of the subtrees not to exist.
+func (s *SubtreeCache) Preload(ids []compact.NodeID, getSubtrees GetSubtreesFunc) error {
+	_, err := s.preload(ids, getSubtrees)
+	return err
+}
+
 // GetNodes returns the requested nodes, calling the getSubtrees function if
 // they are not already cached.
 func (s *SubtreeCache) GetNodes(ids []compact.NodeID, getSubtrees GetSubtreesFunc) ([]tree.Node, error) {
@@ -122,6 +122,32 @@ func TestCacheGetNodesReadsSubtrees(t *testing.T) {
 	}
 }
 
+func TestCachePreload(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	m := NewMockNodeStorage(mockCtrl)
+	c := NewLogSubtreeCache(rfc6962.DefaultHasher)
+
+	found := compact.NewNodeID(0, 0x1234)
+	missing := compact.NewNodeID(0, 0x4567)
+	prefix := toPrefix(t, ancestor(found, 8))
+	m.EXPECT().GetSubtree(prefix).Return(&storagepb.SubtreeProto{
+		Depth:  logStrataDepth,
+		Prefix: prefix,
+	}, nil).Times(1)
+	m.EXPECT().GetSubtree(toPrefix(t, ancestor(missing, 8))).Return(nil, nil).Times(1)
+
+	// Missing subtrees are not an error.
+	if err := c.Preload([]compact.NodeID{found, missing}, getSubtrees(m)); err != nil {
+		t.Fatalf("Preload: %v", err)
+	}
+	// The preloaded subtree is served from the cache.
+	if _, err := c.GetNodes([]compact.NodeID{found}, getSubtrees(m)); err != nil {
+		t.Errorf("GetNodes: %v", err)
+	}
+}
+
 func TestCacheDirty(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
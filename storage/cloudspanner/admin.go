@@ -42,8 +42,9 @@ var (
 	TimeNow = time.Now
 
 	treeStateMap = map[trillian.TreeState]spannerpb.TreeState{
-		trillian.TreeState_ACTIVE: spannerpb.TreeState_ACTIVE,
-		trillian.TreeState_FROZEN: spannerpb.TreeState_FROZEN,
+		trillian.TreeState_ACTIVE:   spannerpb.TreeState_ACTIVE,
+		trillian.TreeState_FROZEN:   spannerpb.TreeState_FROZEN,
+		trillian.TreeState_DRAINING: spannerpb.TreeState_DRAINING,
 	}
 	treeTypeMap = map[trillian.TreeType]spannerpb.TreeType{
 		trillian.TreeType_LOG:            spannerpb.TreeType_LOG,
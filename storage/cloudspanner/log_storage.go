@@ -48,10 +48,10 @@ const (
 
 	// t.TreeType: 1 = Log, 3 = PreorderedLog.
 	// t.TreeState: 1 = Active, 5 = Draining.
-	getActiveLogIDsSQL = `SELECT t.TreeID FROM TreeRoots t
-WHERE (t.TreeType = 1 OR t.TreeType = 3)
-AND (t.TreeState = 1 OR t.TreeState = 5)
-AND t.Deleted=false`
+	getActiveLogIDsSQL = `SELECT TreeID FROM TreeRoots
+WHERE (TreeType = 1 OR TreeType = 3)
+AND (TreeState = 1 OR TreeState = 5)
+AND Deleted=false`
 )
 
 // LogStorageOptions are tuning, experiments and workarounds that can be used.
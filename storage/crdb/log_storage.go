@@ -84,6 +84,7 @@ const (
 	selectLeavesByMerkleHashOrderedBySequenceSQL = selectLeavesByMerkleHashSQL + orderBySequenceNumberSQL
 
 	logIDLabel = "logid"
+	txOpLabel  = "op"
 )
 
 var (
@@ -100,6 +101,7 @@ var (
 	dequeueLatency          monitoring.Histogram
 	dequeueSelectLatency    monitoring.Histogram
 	dequeueRemoveLatency    monitoring.Histogram
+	txDuration              monitoring.Histogram
 )
 
 func createMetrics(mf monitoring.MetricFactory) {
@@ -116,6 +118,8 @@ func createMetrics(mf monitoring.MetricFactory) {
 	dequeueLatency = mf.NewHistogram("crdb_dequeue_leaves_latency", "Latency of dequeue leaves operation in seconds", logIDLabel)
 	dequeueSelectLatency = mf.NewHistogram("crdb_dequeue_leaves_latency_select", "Latency of selection part of dequeue leaves operation in seconds", logIDLabel)
 	dequeueRemoveLatency = mf.NewHistogram("crdb_dequeue_leaves_latency_remove", "Latency of removal part of dequeue leaves operation in seconds", logIDLabel)
+
+	txDuration = mf.NewHistogram("crdb_tx_duration", "Wall time of read-write log transactions in seconds, from begin to commit or rollback", logIDLabel, txOpLabel)
 }
 
 func labelForTX(t *logTreeTX) string {
@@ -225,11 +229,22 @@ func (m *crdbLogStorage) beginInternal(ctx context.Context, tree *trillian.Tree)
 	return ltx, nil
 }
 
+// observeTx records the duration of a read-write transaction that started at
+// start.
+func (m *crdbLogStorage) observeTx(treeID int64, op string, start time.Time) {
+	d := time.Since(start)
+	once.Do(func() {
+		createMetrics(m.metricFactory)
+	})
+	txDuration.Observe(d.Seconds(), strconv.FormatInt(treeID, 10), op)
+}
+
 // TODO(pavelkalinnikov): This and many other methods of this storage
 // implementation can leak a specific sql.ErrTxDone all the way to the client,
 // if the transaction is rolled back as a result of a canceled context. It must
 // return "generic" errors, and only log the specific ones for debugging.
 func (m *crdbLogStorage) ReadWriteTransaction(ctx context.Context, tree *trillian.Tree, f storage.LogTXFunc) error {
+	defer m.observeTx(tree.TreeId, "ReadWriteTransaction", time.Now())
 	tx, err := m.beginInternal(ctx, tree)
 	if err != nil && err != storage.ErrTreeNeedsInit {
 		return err
@@ -246,6 +261,7 @@ func (m *crdbLogStorage) ReadWriteTransaction(ctx context.Context, tree *trillia
 }
 
 func (m *crdbLogStorage) AddSequencedLeaves(ctx context.Context, tree *trillian.Tree, leaves []*trillian.LogLeaf, timestamp time.Time) ([]*trillian.QueuedLogLeaf, error) {
+	defer m.observeTx(tree.TreeId, "AddSequencedLeaves", time.Now())
 	tx, err := m.beginInternal(ctx, tree)
 	if tx != nil {
 		// Ensure we don't leak the transaction. For example if we get an
@@ -279,6 +295,7 @@ func (m *crdbLogStorage) SnapshotForTree(ctx context.Context, tree *trillian.Tre
 }
 
 func (m *crdbLogStorage) QueueLeaves(ctx context.Context, tree *trillian.Tree, leaves []*trillian.LogLeaf, queueTimestamp time.Time) ([]*trillian.QueuedLogLeaf, error) {
+	defer m.observeTx(tree.TreeId, "QueueLeaves", time.Now())
 	tx, err := m.beginInternal(ctx, tree)
 	if tx != nil {
 		// Ensure we don't leak the transaction. For example if we get an
@@ -0,0 +1,190 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package migrate copies the leaves of a log between storage backends, using
+// only the storage interfaces, so that a tree can be moved from one backend to
+// another.
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian/storage"
+	"github.com/google/trillian/types"
+	"github.com/transparency-dev/merkle"
+	"github.com/transparency-dev/merkle/compact"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// DefaultBatchSize is the number of leaves copied at a time if
+// Options.BatchSize isn't set.
+const DefaultBatchSize = 1000
+
+// Options holds optional settings for CopyLog.
+type Options struct {
+	// BatchSize is the number of leaves read from the source, and added to the
+	// destination, at a time. Defaults to DefaultBatchSize.
+	BatchSize int64
+	// Hasher is the hasher of the source tree, used to check leaf hashes and
+	// recompute its root. Defaults to the RFC 6962 hasher.
+	Hasher merkle.LogHasher
+}
+
+// CopyLog copies the leaves covered by the latest root of the log read by src
+// to dstTree in dst, which must be an empty PREORDERED_LOG tree. Leaves are
+// added with AddSequencedLeaves at their source indices, so the destination's
+// sequencer integrates them into the same Merkle tree.
+//
+// The source is read twice. The first pass checks the Merkle leaf hashes of
+// the leaves against their values, and their root hash against the source
+// root, so that nothing is written if the source is corrupt. The second pass
+// copies the leaves. src should be a snapshot, so that the root and leaves it
+// reads are consistent; CopyLog doesn't commit or close it.
+//
+// The source root is returned. The destination's sequencer integrates the
+// copied leaves asynchronously, so CopyLog can't check the destination's root;
+// once the leaves are integrated, callers should check it with VerifyCopy.
+func CopyLog(ctx context.Context, src storage.ReadOnlyLogTreeTX, dst storage.LogStorage, dstTree *trillian.Tree, opts Options) (*types.LogRootV1, error) {
+	if dstTree.TreeType != trillian.TreeType_PREORDERED_LOG {
+		return nil, status.Errorf(codes.InvalidArgument, "destination tree %d has type %v, want %v", dstTree.TreeId, dstTree.TreeType, trillian.TreeType_PREORDERED_LOG)
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	hasher := opts.Hasher
+	if hasher == nil {
+		hasher = rfc6962.DefaultHasher
+	}
+
+	slr, err := src.LatestSignedLogRoot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source root: %w", err)
+	}
+	var root types.LogRootV1
+	if err := root.UnmarshalBinary(slr.LogRoot); err != nil {
+		return nil, fmt.Errorf("failed to parse source root: %w", err)
+	}
+	size := int64(root.TreeSize)
+
+	cr := (&compact.RangeFactory{Hash: hasher.HashChildren}).NewEmptyRange(0)
+	if err := readLeaves(ctx, src, size, batchSize, hasher, func(start int64, leaves []*trillian.LogLeaf) error {
+		for _, leaf := range leaves {
+			if err := cr.Append(leaf.MerkleLeafHash, nil); err != nil {
+				return fmt.Errorf("failed to append leaf %d to compact range: %w", leaf.LeafIndex, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	got, err := cr.GetRootHash(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute root hash: %w", err)
+	}
+	if size == 0 {
+		got = hasher.EmptyRoot()
+	}
+	if !bytes.Equal(got, root.RootHash) {
+		return nil, fmt.Errorf("root hash of source leaves is %x, want %x", got, root.RootHash)
+	}
+
+	if err := readLeaves(ctx, src, size, batchSize, hasher, func(start int64, leaves []*trillian.LogLeaf) error {
+		res, err := dst.AddSequencedLeaves(ctx, dstTree, leaves, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to add leaves from %d: %w", start, err)
+		}
+		for i, r := range res {
+			if r.GetStatus().GetCode() != int32(codes.OK) {
+				return fmt.Errorf("failed to add leaf %d: %v", start+int64(i), status.FromProto(r.Status).Err())
+			}
+		}
+		klog.V(1).Infof("CopyLog: copied %d of %d leaves to tree %d", start+int64(len(leaves)), size, dstTree.TreeId)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &root, nil
+}
+
+// readLeaves reads the first size leaves of src, batchSize at a time, and
+// calls fn with each batch and the index of its first leaf, after checking
+// that the leaves have the expected indices and Merkle leaf hashes.
+func readLeaves(ctx context.Context, src storage.ReadOnlyLogTreeTX, size, batchSize int64, hasher merkle.LogHasher, fn func(start int64, leaves []*trillian.LogLeaf) error) error {
+	for start := int64(0); start < size; {
+		leaves, err := src.GetLeavesByRange(ctx, start, min(batchSize, size-start))
+		if err != nil {
+			return fmt.Errorf("failed to read leaves from %d: %w", start, err)
+		}
+		if len(leaves) == 0 {
+			return fmt.Errorf("source has no leaf at index %d, want %d leaves", start, size)
+		}
+		for i, leaf := range leaves {
+			if want := start + int64(i); leaf.LeafIndex != want {
+				return fmt.Errorf("source returned leaf %d, want %d", leaf.LeafIndex, want)
+			}
+			if want := hasher.HashLeaf(leaf.LeafValue); !bytes.Equal(leaf.MerkleLeafHash, want) {
+				return fmt.Errorf("source leaf %d has MerkleLeafHash %x, want %x", leaf.LeafIndex, leaf.MerkleLeafHash, want)
+			}
+		}
+		if err := fn(start, leaves); err != nil {
+			return err
+		}
+		start += int64(len(leaves))
+	}
+	return nil
+}
+
+// VerifyCopy checks that the latest root of dstTree in dst matches want, the
+// source root returned by CopyLog. It fails with FailedPrecondition if the
+// destination's root has a different size, e.g. because its sequencer hasn't
+// integrated all the copied leaves yet, in which case it can be retried later.
+func VerifyCopy(ctx context.Context, dst storage.LogStorage, dstTree *trillian.Tree, want *types.LogRootV1) error {
+	tx, err := dst.SnapshotForTree(ctx, dstTree)
+	if tx != nil {
+		defer func() {
+			if err := tx.Close(); err != nil {
+				klog.Errorf("tx.Close(): %v", err)
+			}
+		}()
+	}
+	if err == storage.ErrTreeNeedsInit {
+		return status.Errorf(codes.FailedPrecondition, "destination tree %d has no root yet", dstTree.TreeId)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read destination tree: %w", err)
+	}
+	slr, err := tx.LatestSignedLogRoot(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read destination root: %w", err)
+	}
+	var root types.LogRootV1
+	if err := root.UnmarshalBinary(slr.LogRoot); err != nil {
+		return fmt.Errorf("failed to parse destination root: %w", err)
+	}
+	if root.TreeSize != want.TreeSize {
+		return status.Errorf(codes.FailedPrecondition, "destination tree %d has size %d, want %d", dstTree.TreeId, root.TreeSize, want.TreeSize)
+	}
+	if !bytes.Equal(root.RootHash, want.RootHash) {
+		return fmt.Errorf("destination tree %d has root hash %x, want %x", dstTree.TreeId, root.RootHash, want.RootHash)
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,197 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian/storage"
+	"github.com/google/trillian/types"
+	"github.com/transparency-dev/merkle/compact"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeSource serves leaves and a root from memory.
+type fakeSource struct {
+	storage.ReadOnlyLogTreeTX
+	leaves []*trillian.LogLeaf
+	root   types.LogRootV1
+}
+
+func (s *fakeSource) LatestSignedLogRoot(ctx context.Context) (*trillian.SignedLogRoot, error) {
+	logRoot, err := s.root.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &trillian.SignedLogRoot{LogRoot: logRoot}, nil
+}
+
+func (s *fakeSource) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (s *fakeSource) Close() error {
+	return nil
+}
+
+func (s *fakeSource) GetLeavesByRange(ctx context.Context, start, count int64) ([]*trillian.LogLeaf, error) {
+	// Return at most 3 leaves, to check that short reads are handled.
+	end := min(start+count, start+3, int64(len(s.leaves)))
+	return s.leaves[start:end], nil
+}
+
+// fakeDest records the leaves added to it, failing the leaf at index failAt
+// if that's positive. Its snapshots have root as their latest root.
+type fakeDest struct {
+	storage.LogStorage
+	leaves []*trillian.LogLeaf
+	failAt int64
+	root   types.LogRootV1
+}
+
+func (d *fakeDest) SnapshotForTree(ctx context.Context, tree *trillian.Tree) (storage.ReadOnlyLogTreeTX, error) {
+	return &fakeSource{root: d.root}, nil
+}
+
+func (d *fakeDest) AddSequencedLeaves(ctx context.Context, tree *trillian.Tree, leaves []*trillian.LogLeaf, timestamp time.Time) ([]*trillian.QueuedLogLeaf, error) {
+	res := make([]*trillian.QueuedLogLeaf, len(leaves))
+	for i, leaf := range leaves {
+		res[i] = &trillian.QueuedLogLeaf{Leaf: leaf}
+		if d.failAt > 0 && leaf.LeafIndex == d.failAt {
+			res[i].Status = status.New(codes.FailedPrecondition, "conflict").Proto()
+			continue
+		}
+		d.leaves = append(d.leaves, leaf)
+	}
+	return res, nil
+}
+
+func newFakeSource(t *testing.T, size int) *fakeSource {
+	t.Helper()
+	src := &fakeSource{}
+	cr := (&compact.RangeFactory{Hash: rfc6962.DefaultHasher.HashChildren}).NewEmptyRange(0)
+	for i := 0; i < size; i++ {
+		value := []byte(fmt.Sprintf("leaf %d", i))
+		leaf := &trillian.LogLeaf{LeafIndex: int64(i), LeafValue: value, MerkleLeafHash: rfc6962.DefaultHasher.HashLeaf(value)}
+		if err := cr.Append(leaf.MerkleLeafHash, nil); err != nil {
+			t.Fatalf("Append(): %v", err)
+		}
+		src.leaves = append(src.leaves, leaf)
+	}
+	rootHash, err := cr.GetRootHash(nil)
+	if err != nil {
+		t.Fatalf("GetRootHash(): %v", err)
+	}
+	if size == 0 {
+		rootHash = rfc6962.DefaultHasher.EmptyRoot()
+	}
+	src.root = types.LogRootV1{TreeSize: uint64(size), RootHash: rootHash}
+	return src
+}
+
+func TestCopyLog(t *testing.T) {
+	ctx := context.Background()
+	preordered := &trillian.Tree{TreeId: 1, TreeType: trillian.TreeType_PREORDERED_LOG}
+
+	for _, tc := range []struct {
+		desc    string
+		size    int
+		tree    *trillian.Tree
+		corrupt func(src *fakeSource)
+		failAt  int64
+		wantErr bool
+	}{
+		{desc: "empty", size: 0, tree: preordered},
+		{desc: "several-batches", size: 11, tree: preordered},
+		{desc: "log-tree", size: 1, tree: &trillian.Tree{TreeId: 1, TreeType: trillian.TreeType_LOG}, wantErr: true},
+		{desc: "dest-fails", size: 5, tree: preordered, failAt: 2, wantErr: true},
+		{
+			desc: "missing-leaves", size: 5, tree: preordered, wantErr: true,
+			corrupt: func(src *fakeSource) { src.leaves = src.leaves[:4] },
+		},
+		{
+			desc: "wrong-value", size: 5, tree: preordered, wantErr: true,
+			corrupt: func(src *fakeSource) { src.leaves[3].LeafValue = []byte("tampered") },
+		},
+		{
+			desc: "wrong-root", size: 5, tree: preordered, wantErr: true,
+			corrupt: func(src *fakeSource) { src.root.RootHash = rfc6962.DefaultHasher.EmptyRoot() },
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			src := newFakeSource(t, tc.size)
+			if tc.corrupt != nil {
+				tc.corrupt(src)
+			}
+			dst := &fakeDest{failAt: tc.failAt}
+
+			root, err := CopyLog(ctx, src, dst, tc.tree, Options{BatchSize: 4})
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("CopyLog() = %v, want err %v", err, tc.wantErr)
+			}
+			if err != nil {
+				// A corrupt source is detected before anything is written.
+				if tc.corrupt != nil && len(dst.leaves) > 0 {
+					t.Errorf("CopyLog() added %d leaves from a corrupt source", len(dst.leaves))
+				}
+				return
+			}
+			if got, want := root.TreeSize, uint64(tc.size); got != want {
+				t.Errorf("CopyLog() returned root of size %d, want %d", got, want)
+			}
+			if got, want := len(dst.leaves), tc.size; got != want {
+				t.Fatalf("CopyLog() added %d leaves, want %d", got, want)
+			}
+			for i, leaf := range dst.leaves {
+				if leaf.LeafIndex != int64(i) {
+					t.Errorf("CopyLog() added leaf %d at position %d", leaf.LeafIndex, i)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyCopy(t *testing.T) {
+	ctx := context.Background()
+	tree := &trillian.Tree{TreeId: 1, TreeType: trillian.TreeType_PREORDERED_LOG}
+	want := newFakeSource(t, 5).root
+
+	for _, tc := range []struct {
+		desc     string
+		root     types.LogRootV1
+		wantErr  bool
+		wantCode codes.Code
+	}{
+		{desc: "match", root: want},
+		{desc: "not-integrated", root: newFakeSource(t, 3).root, wantErr: true, wantCode: codes.FailedPrecondition},
+		{desc: "wrong-hash", root: types.LogRootV1{TreeSize: want.TreeSize, RootHash: rfc6962.DefaultHasher.EmptyRoot()}, wantErr: true, wantCode: codes.Unknown},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := VerifyCopy(ctx, &fakeDest{root: tc.root}, tree, &want)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("VerifyCopy() = %v, want err %v", err, tc.wantErr)
+			}
+			if got := status.Code(err); err != nil && got != tc.wantCode {
+				t.Errorf("VerifyCopy() = %v, want code %v", err, tc.wantCode)
+			}
+		})
+	}
+}
@@ -20,6 +20,10 @@ import (
 	"database/sql"
 	"encoding/gob"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -59,20 +63,61 @@ const (
 		FROM Trees`
 	selectNonDeletedTrees = selectTrees + nonDeletedWhere
 	selectTreeByID        = selectTrees + " WHERE TreeId = ?"
+	selectTreesAfterID    = selectNonDeletedTrees + " AND TreeId > ? ORDER BY TreeId"
+	selectTreesByName     = selectNonDeletedTrees + " AND DisplayName IN (" + placeholderSQL + ") ORDER BY TreeId"
+	selectTreesWithNoHead = selectNonDeletedTrees + `
+		AND NOT EXISTS (SELECT 1 FROM TreeHead WHERE TreeHead.TreeId = Trees.TreeId)
+		ORDER BY TreeId`
 
 	updateTreeSQL = `UPDATE Trees
 		SET TreeState = ?, TreeType = ?, DisplayName = ?, Description = ?, UpdateTimeMillis = ?, MaxRootDurationMillis = ?, PrivateKey = ?
 		WHERE TreeId = ?`
+	updateTreeMetadataSQL = `UPDATE Trees
+		SET DisplayName = ?, Description = ?, UpdateTimeMillis = ?
+		WHERE TreeId = ?`
+	upsertTreeAnnotationSQL = `INSERT INTO TreeAnnotations(TreeId, AnnotationKey, AnnotationValue)
+		VALUES(?, ?, ?)
+		ON DUPLICATE KEY UPDATE AnnotationValue = VALUES(AnnotationValue)`
+	selectTreeAnnotationsSQL = "SELECT AnnotationKey, AnnotationValue FROM TreeAnnotations WHERE TreeId = ?"
+	insertTreeAuditSQL       = "INSERT INTO TreeAudit(TreeId, Op, AtMillis, Details) VALUES(?, ?, ?, ?)"
+	selectTreeAuditSQL       = "SELECT Op, AtMillis, Details FROM TreeAudit WHERE TreeId = ? ORDER BY AuditId"
+	updateTreeDeletedSQL     = "UPDATE Trees SET Deleted = ?, DeleteTimeMillis = ? WHERE TreeId = ?"
+	selectTreeEnumsSQL       = "SELECT TreeId, TreeState, TreeType FROM Trees ORDER BY TreeId"
+	updateTreeEnumsSQL       = `UPDATE Trees
+		SET TreeState = ?, TreeType = ?, UpdateTimeMillis = ?
+		WHERE TreeId = ?`
+
+	countUnsequencedByHashSQL = "SELECT COUNT(*) FROM Unsequenced WHERE TreeId = ? AND LeafIdentityHash = ?"
+	countSequencedByHashSQL   = "SELECT COUNT(*) FROM SequencedLeafData WHERE TreeId = ? AND LeafIdentityHash = ?"
+	moveLeafDataSQL           = "UPDATE LeafData SET TreeId = ? WHERE TreeId = ? AND LeafIdentityHash = ?"
+	moveUnsequencedSQL        = "UPDATE Unsequenced SET TreeId = ? WHERE TreeId = ? AND LeafIdentityHash = ?"
 )
 
+// AdminStorageOptions are tuning options for the MySQL admin storage. The
+// zero value gives the defaults used by NewAdminStorage.
+type AdminStorageOptions struct {
+	// StrictModeAssured skips reading back each tree created by CreateTree,
+	// which otherwise guards against MySQL silently truncating enums when
+	// not in strict mode. Only set it if every connection is known to run
+	// in strict mode, e.g. because it's set by the server or the DSN.
+	StrictModeAssured bool
+}
+
 // NewAdminStorage returns a MySQL storage.AdminStorage implementation backed by DB.
 func NewAdminStorage(db *sql.DB) *mysqlAdminStorage {
-	return &mysqlAdminStorage{db}
+	return NewAdminStorageWithOptions(db, AdminStorageOptions{})
+}
+
+// NewAdminStorageWithOptions returns a MySQL storage.AdminStorage
+// implementation backed by db and tuned with opts.
+func NewAdminStorageWithOptions(db *sql.DB, opts AdminStorageOptions) *mysqlAdminStorage {
+	return &mysqlAdminStorage{db: db, opts: opts}
 }
 
 // mysqlAdminStorage implements storage.AdminStorage
 type mysqlAdminStorage struct {
-	db *sql.DB
+	db   *sql.DB
+	opts AdminStorageOptions
 }
 
 func (s *mysqlAdminStorage) Snapshot(ctx context.Context) (storage.ReadOnlyAdminTX, error) {
@@ -84,7 +129,7 @@ func (s *mysqlAdminStorage) beginInternal(ctx context.Context) (storage.AdminTX,
 	if err != nil {
 		return nil, err
 	}
-	return &adminTX{tx: tx}, nil
+	return &adminTX{tx: tx, strictModeAssured: s.opts.StrictModeAssured}, nil
 }
 
 func (s *mysqlAdminStorage) ReadWriteTransaction(ctx context.Context, f storage.AdminTXFunc) error {
@@ -109,6 +154,8 @@ func (s *mysqlAdminStorage) CheckDatabaseAccessible(ctx context.Context) error {
 
 type adminTX struct {
 	tx *sql.Tx
+	// strictModeAssured is AdminStorageOptions.StrictModeAssured.
+	strictModeAssured bool
 
 	// mu guards reads/writes on closed, which happen on Commit/Close methods.
 	//
@@ -195,6 +242,76 @@ func (t *adminTX) ListTrees(ctx context.Context, includeDeleted bool) ([]*trilli
 	return trees, nil
 }
 
+// ListTreesByStorageOption returns all non-deleted trees whose SubtreeRevisions
+// storage option matches subtreeRevisions. Storage options aren't a column, so
+// this decodes the settings of every tree.
+func (t *adminTX) ListTreesByStorageOption(ctx context.Context, subtreeRevisions bool) ([]*trillian.Tree, error) {
+	trees, err := t.ListTrees(ctx, false /* includeDeleted */)
+	if err != nil {
+		return nil, err
+	}
+	matched := []*trillian.Tree{}
+	for _, tree := range trees {
+		o := &mysqlpb.StorageOptions{}
+		if err := anypb.UnmarshalTo(tree.StorageSettings, o, proto.UnmarshalOptions{}); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal StorageSettings of tree %d: %v", tree.TreeId, err)
+		}
+		if o.SubtreeRevisions == subtreeRevisions {
+			matched = append(matched, tree)
+		}
+	}
+	return matched, nil
+}
+
+// ListTreesForMigration returns a page of at most pageSize non-deleted trees
+// whose storage options equal from, in TreeId order, so that trees can be
+// migrated to other options in bounded batches. pageToken is empty for the
+// first page, and otherwise the token returned with the previous page. The
+// returned token is empty once there are no more trees to list.
+func (t *adminTX) ListTreesForMigration(ctx context.Context, from *mysqlpb.StorageOptions, pageSize int, pageToken string) ([]*trillian.Tree, string, error) {
+	if pageSize <= 0 {
+		return nil, "", status.Errorf(codes.InvalidArgument, "invalid page size %d, want > 0", pageSize)
+	}
+	afterID := int64(math.MinInt64)
+	if pageToken != "" {
+		var err error
+		if afterID, err = strconv.ParseInt(pageToken, 10, 64); err != nil {
+			return nil, "", status.Errorf(codes.InvalidArgument, "invalid page token %q", pageToken)
+		}
+	}
+
+	rows, err := t.tx.QueryContext(ctx, selectTreesAfterID, afterID)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+	trees := []*trillian.Tree{}
+	for rows.Next() {
+		if len(trees) == pageSize {
+			return trees, strconv.FormatInt(trees[len(trees)-1].TreeId, 10), nil
+		}
+		tree, err := readTree(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		o := &mysqlpb.StorageOptions{}
+		if err := anypb.UnmarshalTo(tree.StorageSettings, o, proto.UnmarshalOptions{}); err != nil {
+			return nil, "", fmt.Errorf("failed to unmarshal StorageSettings of tree %d: %v", tree.TreeId, err)
+		}
+		if proto.Equal(o, from) {
+			trees = append(trees, tree)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return trees, "", nil
+}
+
 func (t *adminTX) CreateTree(ctx context.Context, tree *trillian.Tree) (*trillian.Tree, error) {
 	if err := storage.ValidateTreeForCreation(ctx, tree); err != nil {
 		return nil, err
@@ -251,8 +368,14 @@ func (t *adminTX) CreateTree(ctx context.Context, tree *trillian.Tree) (*trillia
 	if err := anypb.UnmarshalTo(newTree.StorageSettings, o, proto.UnmarshalOptions{}); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal StorageOptions: %v", err)
 	}
+	if _, err := logHasher(o.Hasher); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid StorageOptions: %v", err)
+	}
 	ss := storageSettings{
-		Revisioned: o.SubtreeRevisions,
+		Revisioned:       o.SubtreeRevisions,
+		CompressLeafData: o.CompressLeafData,
+		Hasher:           o.Hasher,
+		EncryptLeafValue: o.EncryptLeafValue,
 	}
 	buff := &bytes.Buffer{}
 	enc := gob.NewEncoder(buff)
@@ -308,11 +431,13 @@ func (t *adminTX) CreateTree(ctx context.Context, tree *trillian.Tree) (*trillia
 
 	// MySQL silently truncates data when running in non-strict mode.
 	// We shouldn't be using non-strict modes, but let's guard against it
-	// anyway.
-	if _, err := t.GetTree(ctx, newTree.TreeId); err != nil {
-		// GetTree will fail for truncated enums (they get recorded as
-		// empty strings, which will not match any known value).
-		return nil, fmt.Errorf("enum truncated: %v", err)
+	// anyway, unless we've been told that it can't happen.
+	if !t.strictModeAssured {
+		if _, err := t.GetTree(ctx, newTree.TreeId); err != nil {
+			// GetTree will fail for truncated enums (they get recorded as
+			// empty strings, which will not match any known value).
+			return nil, fmt.Errorf("enum truncated: %v", err)
+		}
 	}
 
 	insertControlStmt, err := t.tx.PrepareContext(
@@ -341,6 +466,9 @@ func (t *adminTX) CreateTree(ctx context.Context, tree *trillian.Tree) (*trillia
 	if err != nil {
 		return nil, err
 	}
+	if err := t.audit(ctx, newTree.TreeId, TreeAuditCreate, fmt.Sprintf("TreeState=%s TreeType=%s", newTree.TreeState, newTree.TreeType)); err != nil {
+		return nil, err
+	}
 
 	return newTree, nil
 }
@@ -359,6 +487,11 @@ func (t *adminTX) UpdateTree(ctx context.Context, treeID int64, updateFunc func(
 	if err := validateStorageSettings(tree); err != nil {
 		return nil, err
 	}
+	// StorageSettings are persisted only on creation, so reject changes rather
+	// than silently dropping them.
+	if !proto.Equal(beforeUpdate.StorageSettings, tree.StorageSettings) {
+		return nil, status.Error(codes.InvalidArgument, "StorageSettings cannot be changed after creation")
+	}
 
 	// TODO(pavelkalinnikov): When switching TreeType from PREORDERED_LOG to LOG,
 	// ensure all entries in SequencedLeafData are integrated.
@@ -400,10 +533,111 @@ func (t *adminTX) UpdateTree(ctx context.Context, treeID int64, updateFunc func(
 		tree.TreeId); err != nil {
 		return nil, err
 	}
+	if err := t.audit(ctx, tree.TreeId, TreeAuditUpdate, treeChanges(beforeUpdate, tree)); err != nil {
+		return nil, err
+	}
 
 	return tree, nil
 }
 
+// TreeMetadata holds the descriptive fields of a tree, which can be updated
+// in bulk by UpdateTreesMetadata.
+type TreeMetadata struct {
+	DisplayName string
+	Description string
+}
+
+// UpdateTreesMetadata sets the DisplayName and Description of all the trees in
+// updates, keyed by tree ID. Each updated tree is validated as per UpdateTree.
+// If any tree fails to update an error is returned, and the caller is expected
+// to roll back the transaction so that none of the trees are changed.
+func (t *adminTX) UpdateTreesMetadata(ctx context.Context, updates map[int64]TreeMetadata) error {
+	// Update trees in ID order so that concurrent batches lock rows in the
+	// same order.
+	ids := make([]int64, 0, len(updates))
+	for id := range updates {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	stmt, err := t.tx.PrepareContext(ctx, updateTreeMetadataSQL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := stmt.Close(); err != nil {
+			klog.Errorf("stmt.Close(): %v", err)
+		}
+	}()
+
+	nowMillis := toMillisSinceEpoch(time.Now())
+	for _, id := range ids {
+		tree, err := t.GetTree(ctx, id)
+		if err != nil {
+			return err
+		}
+		newTree := proto.Clone(tree).(*trillian.Tree)
+		newTree.DisplayName = updates[id].DisplayName
+		newTree.Description = updates[id].Description
+		if err := storage.ValidateTreeForUpdate(ctx, tree, newTree); err != nil {
+			return fmt.Errorf("tree %d: %w", id, err)
+		}
+		if _, err := stmt.ExecContext(ctx, newTree.DisplayName, newTree.Description, nowMillis, id); err != nil {
+			return err
+		}
+		if err := t.audit(ctx, id, TreeAuditUpdate, treeChanges(tree, newTree)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxAnnotationKeyLen is the size of the TreeAnnotations.AnnotationKey column.
+const maxAnnotationKeyLen = 255
+
+// SetTreeAnnotation sets the annotation key of the given tree to value,
+// replacing any previous value. Annotations are free-form notes that are
+// stored with the tree, and removed when it is hard-deleted.
+func (t *adminTX) SetTreeAnnotation(ctx context.Context, treeID int64, key, value string) error {
+	if key == "" {
+		return status.Error(codes.InvalidArgument, "annotation key must not be empty")
+	}
+	if len(key) > maxAnnotationKeyLen {
+		return status.Errorf(codes.InvalidArgument, "annotation key is %d bytes, want <= %d", len(key), maxAnnotationKeyLen)
+	}
+	if _, err := t.GetTree(ctx, treeID); err != nil {
+		return err
+	}
+	_, err := t.tx.ExecContext(ctx, upsertTreeAnnotationSQL, treeID, key, value)
+	return err
+}
+
+// GetTreeAnnotations returns all annotations of the given tree, keyed by
+// annotation key.
+func (t *adminTX) GetTreeAnnotations(ctx context.Context, treeID int64) (map[string]string, error) {
+	if _, err := t.GetTree(ctx, treeID); err != nil {
+		return nil, err
+	}
+	rows, err := t.tx.QueryContext(ctx, selectTreeAnnotationsSQL, treeID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+	annotations := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		annotations[key] = value
+	}
+	return annotations, rows.Err()
+}
+
 func (t *adminTX) SoftDeleteTree(ctx context.Context, treeID int64) (*trillian.Tree, error) {
 	return t.updateDeleted(ctx, treeID, true /* deleted */, toMillisSinceEpoch(time.Now()) /* deleteTimeMillis */)
 }
@@ -412,16 +646,110 @@ func (t *adminTX) UndeleteTree(ctx context.Context, treeID int64) (*trillian.Tre
 	return t.updateDeleted(ctx, treeID, false /* deleted */, nil /* deleteTimeMillis */)
 }
 
+// GetTreesByDisplayName returns the non-deleted trees whose DisplayName is one
+// of names, in TreeId order. Display names aren't unique, so there may be
+// several trees for a name, or none.
+func (t *adminTX) GetTreesByDisplayName(ctx context.Context, names []string) ([]*trillian.Tree, error) {
+	trees := []*trillian.Tree{}
+	if len(names) == 0 {
+		return trees, nil
+	}
+	args := make([]interface{}, len(names))
+	for i, name := range names {
+		args[i] = name
+	}
+	rows, err := t.tx.QueryContext(ctx, expandPlaceholderSQL(selectTreesByName, len(names), "?", "?"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+	for rows.Next() {
+		tree, err := readTree(rows)
+		if err != nil {
+			return nil, err
+		}
+		trees = append(trees, tree)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return trees, nil
+}
+
+// SoftDeleteTrees soft deletes all of the given trees, with the same delete
+// time, and returns the updated trees in the order given. It fails without
+// deleting any of them if a tree doesn't exist, is already soft deleted, or
+// is given more than once.
+func (t *adminTX) SoftDeleteTrees(ctx context.Context, ids []int64) ([]*trillian.Tree, error) {
+	return t.updateTreesDeleted(ctx, ids, true /* deleted */, toMillisSinceEpoch(time.Now()) /* deleteTimeMillis */)
+}
+
+// UndeleteTrees undeletes all of the given trees, e.g. to restore the trees of
+// a tenant decommissioned by mistake, and returns the updated trees in the
+// order given. It fails without undeleting any of them if a tree doesn't
+// exist, isn't soft deleted, or is given more than once.
+func (t *adminTX) UndeleteTrees(ctx context.Context, ids []int64) ([]*trillian.Tree, error) {
+	return t.updateTreesDeleted(ctx, ids, false /* deleted */, nil /* deleteTimeMillis */)
+}
+
+// updateTreesDeleted is like updateDeleted for several trees, all of which
+// are validated before any is updated.
+func (t *adminTX) updateTreesDeleted(ctx context.Context, ids []int64, deleted bool, deleteTimeMillis interface{}) ([]*trillian.Tree, error) {
+	// Update trees in ID order so that concurrent batches lock rows in the
+	// same order.
+	sorted := append([]int64(nil), ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, id := range sorted {
+		if i > 0 && id == sorted[i-1] {
+			return nil, status.Errorf(codes.InvalidArgument, "tree %v given more than once", id)
+		}
+		if err := validateDeleted(ctx, t.tx, id, !deleted /* wantDeleted */); err != nil {
+			return nil, err
+		}
+	}
+
+	op := TreeAuditUndelete
+	if deleted {
+		op = TreeAuditSoftDelete
+	}
+	for _, id := range sorted {
+		if _, err := t.tx.ExecContext(ctx, updateTreeDeletedSQL, deleted, deleteTimeMillis, id); err != nil {
+			return nil, err
+		}
+		if err := t.audit(ctx, id, op, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	trees := make([]*trillian.Tree, 0, len(ids))
+	for _, id := range ids {
+		tree, err := t.GetTree(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		trees = append(trees, tree)
+	}
+	return trees, nil
+}
+
 // updateDeleted updates the Deleted and DeleteTimeMillis fields of the specified tree.
 // deleteTimeMillis must be either an int64 (in millis since epoch) or nil.
 func (t *adminTX) updateDeleted(ctx context.Context, treeID int64, deleted bool, deleteTimeMillis interface{}) (*trillian.Tree, error) {
 	if err := validateDeleted(ctx, t.tx, treeID, !deleted); err != nil {
 		return nil, err
 	}
-	if _, err := t.tx.ExecContext(
-		ctx,
-		"UPDATE Trees SET Deleted = ?, DeleteTimeMillis = ? WHERE TreeId = ?",
-		deleted, deleteTimeMillis, treeID); err != nil {
+	if _, err := t.tx.ExecContext(ctx, updateTreeDeletedSQL, deleted, deleteTimeMillis, treeID); err != nil {
+		return nil, err
+	}
+	op := TreeAuditUndelete
+	if deleted {
+		op = TreeAuditSoftDelete
+	}
+	if err := t.audit(ctx, treeID, op, ""); err != nil {
 		return nil, err
 	}
 	return t.GetTree(ctx, treeID)
@@ -436,10 +764,264 @@ func (t *adminTX) HardDeleteTree(ctx context.Context, treeID int64) error {
 	if _, err := t.tx.ExecContext(ctx, "DELETE FROM TreeControl WHERE TreeId = ?", treeID); err != nil {
 		return err
 	}
-	_, err := t.tx.ExecContext(ctx, "DELETE FROM Trees WHERE TreeId = ?", treeID)
+	if _, err := t.tx.ExecContext(ctx, "DELETE FROM Trees WHERE TreeId = ?", treeID); err != nil {
+		return err
+	}
+	return t.audit(ctx, treeID, TreeAuditHardDelete, "")
+}
+
+// TreeAuditOp is the kind of admin mutation recorded in the audit log.
+type TreeAuditOp string
+
+// Values of TreeAuditOp.
+const (
+	TreeAuditCreate     TreeAuditOp = "CREATE"
+	TreeAuditUpdate     TreeAuditOp = "UPDATE"
+	TreeAuditSoftDelete TreeAuditOp = "SOFT_DELETE"
+	TreeAuditUndelete   TreeAuditOp = "UNDELETE"
+	TreeAuditHardDelete TreeAuditOp = "HARD_DELETE"
+	// TreeAuditMoveUnsequenced is recorded for both trees involved in a call
+	// to MoveUnsequencedLeaves.
+	TreeAuditMoveUnsequenced TreeAuditOp = "MOVE_UNSEQUENCED"
+)
+
+// TreeAuditEntry records an admin mutation of a tree, as returned by
+// GetTreeAuditLog.
+type TreeAuditEntry struct {
+	Op TreeAuditOp
+	At time.Time
+	// Details describes the change, e.g. the fields updated by UpdateTree.
+	Details string
+}
+
+// GetTreeAuditLog returns the admin mutations of the given tree, oldest first.
+// The log is kept after the tree is hard-deleted.
+func (t *adminTX) GetTreeAuditLog(ctx context.Context, treeID int64) ([]TreeAuditEntry, error) {
+	rows, err := t.tx.QueryContext(ctx, selectTreeAuditSQL, treeID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+	var entries []TreeAuditEntry
+	for rows.Next() {
+		var op string
+		var atMillis int64
+		var e TreeAuditEntry
+		if err := rows.Scan(&op, &atMillis, &e.Details); err != nil {
+			return nil, err
+		}
+		e.Op = TreeAuditOp(op)
+		e.At = fromMillisSinceEpoch(atMillis)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// audit records an admin mutation of the given tree in the audit log.
+func (t *adminTX) audit(ctx context.Context, treeID int64, op TreeAuditOp, details string) error {
+	_, err := t.tx.ExecContext(ctx, insertTreeAuditSQL, treeID, string(op), toMillisSinceEpoch(time.Now()), details)
 	return err
 }
 
+// treeChanges describes the differences between the mutable fields of before
+// and after, for the audit log.
+func treeChanges(before, after *trillian.Tree) string {
+	var changes []string
+	add := func(field string, from, to interface{}) {
+		if from != to {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", field, from, to))
+		}
+	}
+	add("TreeState", before.TreeState, after.TreeState)
+	add("TreeType", before.TreeType, after.TreeType)
+	add("DisplayName", before.DisplayName, after.DisplayName)
+	add("Description", before.Description, after.Description)
+	add("MaxRootDuration", before.MaxRootDuration.AsDuration(), after.MaxRootDuration.AsDuration())
+	return strings.Join(changes, "; ")
+}
+
+// UninitializedTree is a tree without any stored root, as returned by
+// ListUninitializedTrees.
+type UninitializedTree struct {
+	Tree *trillian.Tree
+	// Age is the time since the tree was created.
+	Age time.Duration
+}
+
+// ListUninitializedTrees returns the non-deleted trees which have no stored
+// root, in TreeId order. These are either new trees which the sequencer hasn't
+// initialized yet, or trees whose creation failed before it was, which can
+// be told apart by their Age.
+func (t *adminTX) ListUninitializedTrees(ctx context.Context) ([]UninitializedTree, error) {
+	rows, err := t.tx.QueryContext(ctx, selectTreesWithNoHead)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+	now := time.Now()
+	var trees []UninitializedTree
+	for rows.Next() {
+		tree, err := readTree(rows)
+		if err != nil {
+			return nil, err
+		}
+		trees = append(trees, UninitializedTree{Tree: tree, Age: now.Sub(tree.CreateTime.AsTime())})
+	}
+	return trees, rows.Err()
+}
+
+// CorruptTree describes a tree whose stored TreeState or TreeType isn't a
+// known enum value, e.g. because it was truncated to an empty string by MySQL
+// running in non-strict mode. Such trees can't be read by GetTree.
+type CorruptTree struct {
+	TreeID    int64
+	TreeState string
+	TreeType  string
+}
+
+// ListCorruptTrees returns all trees, including deleted ones, whose TreeState
+// or TreeType can't be parsed. They can be fixed with RepairTreeEnums.
+func (t *adminTX) ListCorruptTrees(ctx context.Context) ([]CorruptTree, error) {
+	rows, err := t.tx.QueryContext(ctx, selectTreeEnumsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+	var corrupt []CorruptTree
+	for rows.Next() {
+		var c CorruptTree
+		if err := rows.Scan(&c.TreeID, &c.TreeState, &c.TreeType); err != nil {
+			return nil, err
+		}
+		state, stateOK := trillian.TreeState_value[c.TreeState]
+		treeType, typeOK := trillian.TreeType_value[c.TreeType]
+		if !stateOK || !typeOK ||
+			trillian.TreeState(state) == trillian.TreeState_UNKNOWN_TREE_STATE ||
+			trillian.TreeType(treeType) == trillian.TreeType_UNKNOWN_TREE_TYPE {
+			corrupt = append(corrupt, c)
+		}
+	}
+	return corrupt, rows.Err()
+}
+
+// RepairTreeEnums overwrites the TreeState and TreeType of the given tree,
+// which is typically one returned by ListCorruptTrees, and returns the tree as
+// read back after the update.
+func (t *adminTX) RepairTreeEnums(ctx context.Context, treeID int64, state trillian.TreeState, treeType trillian.TreeType) (*trillian.Tree, error) {
+	if state == trillian.TreeState_UNKNOWN_TREE_STATE {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid tree_state: %v", state)
+	}
+	if treeType == trillian.TreeType_UNKNOWN_TREE_TYPE {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid tree_type: %v", treeType)
+	}
+	res, err := t.tx.ExecContext(ctx, updateTreeEnumsSQL, state.String(), treeType.String(), toMillisSinceEpoch(time.Now()), treeID)
+	if err != nil {
+		return nil, err
+	}
+	if rows, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if rows == 0 {
+		return nil, status.Errorf(codes.NotFound, "tree %v not found", treeID)
+	}
+	if err := t.audit(ctx, treeID, TreeAuditUpdate, fmt.Sprintf("repaired TreeState=%s TreeType=%s", state, treeType)); err != nil {
+		return nil, err
+	}
+	// Reading the tree back fails if the new values were truncated as well.
+	return t.GetTree(ctx, treeID)
+}
+
+// MoveUnsequencedLeaves moves the queued leaves with the given identity hashes,
+// i.e. their Unsequenced and LeafData rows in every deduplication namespace,
+// from one log tree to another, e.g. a dead-letter tree where poison leaves
+// which repeatedly fail integration can be inspected. Both trees must exist
+// and store leaf data in the same way, and the destination must not be soft
+// deleted. Either all of the leaves are moved, or none are: it fails if a leaf
+// isn't queued in the source tree, has already been sequenced there, or is
+// already in the destination tree.
+func (t *adminTX) MoveUnsequencedLeaves(ctx context.Context, fromTreeID, toTreeID int64, identityHashes [][]byte) error {
+	if fromTreeID == toTreeID {
+		return status.Errorf(codes.InvalidArgument, "can't move leaves from tree %v to itself", fromTreeID)
+	}
+	from, err := t.GetTree(ctx, fromTreeID)
+	if err != nil {
+		return err
+	}
+	to, err := t.GetTree(ctx, toTreeID)
+	if err != nil {
+		return err
+	}
+	if to.Deleted {
+		return status.Errorf(codes.FailedPrecondition, "tree %v is soft deleted", toTreeID)
+	}
+	for _, tree := range []*trillian.Tree{from, to} {
+		if tree.TreeType != trillian.TreeType_LOG && tree.TreeType != trillian.TreeType_PREORDERED_LOG {
+			return status.Errorf(codes.FailedPrecondition, "tree %v has type %v, want a log", tree.TreeId, tree.TreeType)
+		}
+	}
+	fromOpts, toOpts := &mysqlpb.StorageOptions{}, &mysqlpb.StorageOptions{}
+	if err := anypb.UnmarshalTo(from.StorageSettings, fromOpts, proto.UnmarshalOptions{}); err != nil {
+		return fmt.Errorf("failed to unmarshal StorageSettings of tree %d: %v", fromTreeID, err)
+	}
+	if err := anypb.UnmarshalTo(to.StorageSettings, toOpts, proto.UnmarshalOptions{}); err != nil {
+		return fmt.Errorf("failed to unmarshal StorageSettings of tree %d: %v", toTreeID, err)
+	}
+	// LeafData rows are moved as they are, so must be readable by both trees.
+	// Encrypted values can only be decrypted with their own tree's key.
+	if fromOpts.CompressLeafData != toOpts.CompressLeafData || fromOpts.Hasher != toOpts.Hasher || fromOpts.EncryptLeafValue || toOpts.EncryptLeafValue {
+		return status.Errorf(codes.FailedPrecondition, "trees %v and %v have incompatible storage options", fromTreeID, toTreeID)
+	}
+
+	// Move leaves in hash order so that concurrent moves lock rows in the
+	// same order.
+	sorted := append([][]byte(nil), identityHashes...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+	for i, hash := range sorted {
+		if i > 0 && bytes.Equal(hash, sorted[i-1]) {
+			return status.Errorf(codes.InvalidArgument, "leaf %x given more than once", hash)
+		}
+		var queued, sequenced int
+		if err := t.tx.QueryRowContext(ctx, countUnsequencedByHashSQL, fromTreeID, hash).Scan(&queued); err != nil {
+			return err
+		}
+		if queued == 0 {
+			return status.Errorf(codes.NotFound, "leaf %x isn't queued in tree %v", hash, fromTreeID)
+		}
+		if err := t.tx.QueryRowContext(ctx, countSequencedByHashSQL, fromTreeID, hash).Scan(&sequenced); err != nil {
+			return err
+		}
+		if sequenced > 0 {
+			return status.Errorf(codes.FailedPrecondition, "leaf %x has already been sequenced in tree %v", hash, fromTreeID)
+		}
+
+		if _, err := t.tx.ExecContext(ctx, moveLeafDataSQL, toTreeID, fromTreeID, hash); err != nil {
+			if isDuplicateErr(err) {
+				return status.Errorf(codes.AlreadyExists, "leaf %x already exists in tree %v", hash, toTreeID)
+			}
+			return err
+		}
+		if _, err := t.tx.ExecContext(ctx, moveUnsequencedSQL, toTreeID, fromTreeID, hash); err != nil {
+			return err
+		}
+	}
+
+	if err := t.audit(ctx, fromTreeID, TreeAuditMoveUnsequenced, fmt.Sprintf("moved %d leaves to tree %d", len(sorted), toTreeID)); err != nil {
+		return err
+	}
+	return t.audit(ctx, toTreeID, TreeAuditMoveUnsequenced, fmt.Sprintf("received %d leaves from tree %d", len(sorted), fromTreeID))
+}
+
 func validateDeleted(ctx context.Context, tx *sql.Tx, treeID int64, wantDeleted bool) error {
 	var nullDeleted sql.NullBool
 	switch err := tx.QueryRowContext(ctx, "SELECT Deleted FROM Trees WHERE TreeId = ?", treeID).Scan(&nullDeleted); {
@@ -475,5 +1057,8 @@ func validateStorageSettings(tree *trillian.Tree) error {
 // and a value that was written with the default values for each field.
 // Using an explicit struct and gob encoding allows us to tell the difference.
 type storageSettings struct {
-	Revisioned bool
+	Revisioned       bool
+	CompressLeafData bool
+	Hasher           mysqlpb.LogHasher
+	EncryptLeafValue bool
 }
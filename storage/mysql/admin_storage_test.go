@@ -20,12 +20,18 @@ import (
 	"database/sql"
 	"encoding/gob"
 	"fmt"
+	"sort"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/google/trillian"
 	"github.com/google/trillian/storage"
 	"github.com/google/trillian/storage/mysql/mysqlpb"
 	"github.com/google/trillian/storage/testonly"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
 )
@@ -40,6 +46,14 @@ func TestMysqlAdminStorage(t *testing.T) {
 	tester.RunAllTests(t)
 }
 
+func TestMysqlAdminStorageStrictModeAssured(t *testing.T) {
+	tester := &testonly.AdminStorageTester{NewAdminStorage: func() storage.AdminStorage {
+		cleanTestDB(DB)
+		return NewAdminStorageWithOptions(DB, AdminStorageOptions{StrictModeAssured: true})
+	}}
+	tester.RunAllTests(t)
+}
+
 func TestAdminTX_CreateTree_InitializesStorageStructures(t *testing.T) {
 	cleanTestDB(DB)
 	s := NewAdminStorage(DB)
@@ -131,6 +145,56 @@ func TestAdminTX_TreeWithNulls(t *testing.T) {
 	}
 }
 
+func TestAdminTX_GetTreeMaxRootDuration(t *testing.T) {
+	cleanTestDB(DB)
+	s := NewAdminStorage(DB)
+	ctx := context.Background()
+
+	// Legacy schemas allowed NULL MaxRootDurationMillis.
+	if _, err := DB.ExecContext(ctx, "ALTER TABLE Trees MODIFY MaxRootDurationMillis BIGINT NULL"); err != nil {
+		t.Fatalf("Failed to make MaxRootDurationMillis nullable: %v", err)
+	}
+	defer func() {
+		if _, err := DB.ExecContext(ctx, "DELETE FROM Trees WHERE MaxRootDurationMillis IS NULL OR MaxRootDurationMillis < 0"); err != nil {
+			t.Errorf("Failed to delete legacy trees: %v", err)
+		}
+		if _, err := DB.ExecContext(ctx, "ALTER TABLE Trees MODIFY MaxRootDurationMillis BIGINT NOT NULL"); err != nil {
+			t.Errorf("Failed to restore MaxRootDurationMillis: %v", err)
+		}
+	}()
+
+	for _, tc := range []struct {
+		desc    string
+		millis  interface{}
+		want    time.Duration
+		wantErr bool
+	}{
+		{desc: "null", millis: nil, want: DefaultMaxRootDuration},
+		{desc: "valid", millis: 1500, want: 1500 * time.Millisecond},
+		{desc: "negative", millis: -1, wantErr: true},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			tree, err := storage.CreateTree(ctx, s, testonly.LogTree)
+			if err != nil {
+				t.Fatalf("CreateTree() failed: %v", err)
+			}
+			if _, err := DB.ExecContext(ctx, "UPDATE Trees SET MaxRootDurationMillis = ? WHERE TreeId = ?", tc.millis, tree.TreeId); err != nil {
+				t.Fatalf("Failed to set MaxRootDurationMillis: %v", err)
+			}
+			got, err := storage.GetTree(ctx, s, tree.TreeId)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("GetTree() = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := got.MaxRootDuration.AsDuration(); got != tc.want {
+				t.Errorf("GetTree() MaxRootDuration = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
 func TestAdminTX_StorageSettings(t *testing.T) {
 	cleanTestDB(DB)
 	s := NewAdminStorage(DB)
@@ -194,6 +258,42 @@ func TestAdminTX_StorageSettings(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			desc: "UpdateTree unchanged Settings",
+			fn: func(s storage.AdminStorage) error {
+				tree, err := storage.CreateTree(ctx, s, testonly.LogTree)
+				if err != nil {
+					t.Fatalf("CreateTree() failed with err = %v", err)
+				}
+				_, err = storage.UpdateTree(ctx, s, tree.TreeId, func(tree *trillian.Tree) { tree.DisplayName = "renamed" })
+				return err
+			},
+			wantErr: false,
+		},
+		{
+			desc: "UpdateTree changed Settings",
+			fn: func(s storage.AdminStorage) error {
+				tree, err := storage.CreateTree(ctx, s, testonly.LogTree)
+				if err != nil {
+					t.Fatalf("CreateTree() failed with err = %v", err)
+				}
+				o := &mysqlpb.StorageOptions{}
+				if err := anypb.UnmarshalTo(tree.StorageSettings, o, proto.UnmarshalOptions{}); err != nil {
+					t.Fatalf("UnmarshalTo() failed with err = %v", err)
+				}
+				o.SubtreeRevisions = !o.SubtreeRevisions
+				changedSettings, err := anypb.New(o)
+				if err != nil {
+					t.Fatalf("Error marshaling proto: %v", err)
+				}
+				_, err = storage.UpdateTree(ctx, s, tree.TreeId, func(tree *trillian.Tree) { tree.StorageSettings = changedSettings })
+				if status.Code(err) != codes.InvalidArgument {
+					t.Errorf("UpdateTree() with changed settings = %v, want InvalidArgument", err)
+				}
+				return err
+			},
+			wantErr: true,
+		},
 	}
 	for _, test := range tests {
 		if err := test.fn(s); (err != nil) != test.wantErr {
@@ -280,6 +380,566 @@ func TestAdminTX_GetTreeLegacies(t *testing.T) {
 	}
 }
 
+func TestAdminTX_ListTreesByStorageOption(t *testing.T) {
+	cleanTestDB(DB)
+	s := NewAdminStorage(DB)
+	ctx := context.Background()
+
+	revisioned, err := storage.CreateTree(ctx, s, RevisionedLogTree)
+	if err != nil {
+		t.Fatalf("CreateTree() failed: %v", err)
+	}
+	revisionless, err := storage.CreateTree(ctx, s, testonly.LogTree)
+	if err != nil {
+		t.Fatalf("CreateTree() failed: %v", err)
+	}
+
+	err = s.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+		for _, tc := range []struct {
+			subtreeRevisions bool
+			wantID           int64
+		}{
+			{subtreeRevisions: true, wantID: revisioned.TreeId},
+			{subtreeRevisions: false, wantID: revisionless.TreeId},
+		} {
+			trees, err := tx.(*adminTX).ListTreesByStorageOption(ctx, tc.subtreeRevisions)
+			if err != nil {
+				t.Fatalf("ListTreesByStorageOption(%t) failed: %v", tc.subtreeRevisions, err)
+			}
+			if len(trees) != 1 || trees[0].TreeId != tc.wantID {
+				t.Errorf("ListTreesByStorageOption(%t) = %v, want only tree %d", tc.subtreeRevisions, trees, tc.wantID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadWriteTransaction() failed: %v", err)
+	}
+}
+
+func TestAdminTX_ListTreesForMigration(t *testing.T) {
+	cleanTestDB(DB)
+	s := NewAdminStorage(DB)
+	ctx := context.Background()
+
+	var wantIDs []int64
+	for i := 0; i < 7; i++ {
+		tree := RevisionedLogTree
+		if i%3 == 0 {
+			tree = testonly.LogTree
+		}
+		created, err := storage.CreateTree(ctx, s, tree)
+		if err != nil {
+			t.Fatalf("CreateTree() failed: %v", err)
+		}
+		if tree == RevisionedLogTree {
+			wantIDs = append(wantIDs, created.TreeId)
+		}
+	}
+	sort.Slice(wantIDs, func(i, j int) bool { return wantIDs[i] < wantIDs[j] })
+
+	from := &mysqlpb.StorageOptions{SubtreeRevisions: true}
+	err := s.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+		atx := tx.(*adminTX)
+		var gotIDs []int64
+		token := ""
+		for pages := 0; ; pages++ {
+			if pages > len(wantIDs) {
+				t.Fatalf("ListTreesForMigration() didn't finish after %d pages", pages)
+			}
+			trees, next, err := atx.ListTreesForMigration(ctx, from, 2, token)
+			if err != nil {
+				t.Fatalf("ListTreesForMigration(%q) failed: %v", token, err)
+			}
+			if len(trees) > 2 {
+				t.Errorf("ListTreesForMigration(%q) returned %d trees, want <= 2", token, len(trees))
+			}
+			for _, tree := range trees {
+				gotIDs = append(gotIDs, tree.TreeId)
+			}
+			if next == "" {
+				break
+			}
+			token = next
+		}
+		if diff := cmp.Diff(wantIDs, gotIDs); diff != "" {
+			t.Errorf("ListTreesForMigration() diff (-want +got):\n%s", diff)
+		}
+
+		if _, _, err := atx.ListTreesForMigration(ctx, from, 0, ""); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListTreesForMigration() with page size 0 = %v, want code %v", err, codes.InvalidArgument)
+		}
+		if _, _, err := atx.ListTreesForMigration(ctx, from, 2, "bad"); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListTreesForMigration() with bad token = %v, want code %v", err, codes.InvalidArgument)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadWriteTransaction() failed: %v", err)
+	}
+}
+
+func TestAdminTX_ListUninitializedTrees(t *testing.T) {
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	ctx := context.Background()
+
+	initialized := mustCreateTree(ctx, t, as, testonly.LogTree)
+	uninitialized := mustCreateTree(ctx, t, as, testonly.LogTree)
+	mustSignAndStoreLogRoot(ctx, t, NewLogStorage(DB, nil), initialized, 0)
+
+	err := as.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+		got, err := tx.(*adminTX).ListUninitializedTrees(ctx)
+		if err != nil {
+			t.Fatalf("ListUninitializedTrees() failed: %v", err)
+		}
+		if len(got) != 1 || got[0].Tree.TreeId != uninitialized.TreeId {
+			t.Fatalf("ListUninitializedTrees() = %v, want only tree %d", got, uninitialized.TreeId)
+		}
+		if age := got[0].Age; age < 0 || age > time.Minute {
+			t.Errorf("ListUninitializedTrees() returned age %v for new tree, want < 1m", age)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadWriteTransaction() returned err = %v", err)
+	}
+}
+
+func TestAdminTX_GetTreesByDisplayName(t *testing.T) {
+	cleanTestDB(DB)
+	s := NewAdminStorage(DB)
+	ctx := context.Background()
+
+	ids := make(map[string][]int64)
+	for _, name := range []string{"alpha", "beta", "alpha", "gamma", "alpha"} {
+		tree := proto.Clone(testonly.LogTree).(*trillian.Tree)
+		tree.DisplayName = name
+		created, err := storage.CreateTree(ctx, s, tree)
+		if err != nil {
+			t.Fatalf("CreateTree() failed: %v", err)
+		}
+		ids[name] = append(ids[name], created.TreeId)
+	}
+	// The last alpha tree is deleted, so isn't returned.
+	deleted := ids["alpha"][2]
+	wantIDs := []int64{ids["alpha"][0], ids["alpha"][1], ids["beta"][0]}
+	sort.Slice(wantIDs, func(i, j int) bool { return wantIDs[i] < wantIDs[j] })
+
+	err := s.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+		if _, err := tx.SoftDeleteTree(ctx, deleted); err != nil {
+			return err
+		}
+		atx := tx.(*adminTX)
+		trees, err := atx.GetTreesByDisplayName(ctx, []string{"alpha", "beta", "missing"})
+		if err != nil {
+			t.Fatalf("GetTreesByDisplayName() failed: %v", err)
+		}
+		var gotIDs []int64
+		for _, tree := range trees {
+			gotIDs = append(gotIDs, tree.TreeId)
+		}
+		if diff := cmp.Diff(wantIDs, gotIDs); diff != "" {
+			t.Errorf("GetTreesByDisplayName() diff (-want +got):\n%s", diff)
+		}
+
+		if trees, err := atx.GetTreesByDisplayName(ctx, nil); err != nil || len(trees) != 0 {
+			t.Errorf("GetTreesByDisplayName(nil) = %v, %v, want no trees", trees, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadWriteTransaction() returned err = %v", err)
+	}
+}
+
+func TestAdminTX_MoveUnsequencedLeaves(t *testing.T) {
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	ctx := context.Background()
+
+	from := mustCreateTree(ctx, t, as, testonly.LogTree)
+	to := mustCreateTree(ctx, t, as, testonly.LogTree)
+	ls := NewLogStorage(DB, nil)
+	mustSignAndStoreLogRoot(ctx, t, ls, from, 0)
+	leaves := createTestLeaves(3, 0)
+	if _, err := ls.QueueLeaves(ctx, from, leaves, fakeQueueTime); err != nil {
+		t.Fatalf("QueueLeaves() failed: %v", err)
+	}
+	moved := [][]byte{leaves[0].LeafIdentityHash, leaves[2].LeafIdentityHash}
+
+	for _, tc := range []struct {
+		desc     string
+		from, to int64
+		hashes   [][]byte
+		wantCode codes.Code
+	}{
+		{desc: "same-tree", from: from.TreeId, to: from.TreeId, hashes: moved, wantCode: codes.InvalidArgument},
+		{desc: "missing-tree", from: from.TreeId, to: to.TreeId + 1000, hashes: moved, wantCode: codes.NotFound},
+		{desc: "not-queued", from: from.TreeId, to: to.TreeId, hashes: [][]byte{moved[0], dummyHash}, wantCode: codes.NotFound},
+		{desc: "repeated", from: from.TreeId, to: to.TreeId, hashes: [][]byte{moved[0], moved[0]}, wantCode: codes.InvalidArgument},
+		{desc: "ok", from: from.TreeId, to: to.TreeId, hashes: moved, wantCode: codes.OK},
+		{desc: "already-moved", from: from.TreeId, to: to.TreeId, hashes: moved, wantCode: codes.NotFound},
+	} {
+		err := as.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+			return tx.(*adminTX).MoveUnsequencedLeaves(ctx, tc.from, tc.to, tc.hashes)
+		})
+		if got := status.Code(err); got != tc.wantCode {
+			t.Errorf("%s: MoveUnsequencedLeaves() = %v, want code %v", tc.desc, err, tc.wantCode)
+		}
+	}
+
+	// Failed moves are rolled back, so only the successful one took effect.
+	for _, table := range []string{"LeafData", "Unsequenced"} {
+		for treeID, want := range map[int64]int{from.TreeId: 1, to.TreeId: 2} {
+			var count int
+			if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+" WHERE TreeId = ?", treeID).Scan(&count); err != nil {
+				t.Fatalf("Could not query %s row count: %v", table, err)
+			}
+			if count != want {
+				t.Errorf("Got %d %s rows for tree %d, want %d", count, table, treeID, want)
+			}
+		}
+	}
+}
+
+func TestAdminTX_UpdateTreesMetadata(t *testing.T) {
+	cleanTestDB(DB)
+	s := NewAdminStorage(DB)
+	ctx := context.Background()
+
+	tree1, err := storage.CreateTree(ctx, s, testonly.LogTree)
+	if err != nil {
+		t.Fatalf("CreateTree() failed: %v", err)
+	}
+	tree2, err := storage.CreateTree(ctx, s, testonly.LogTree)
+	if err != nil {
+		t.Fatalf("CreateTree() failed: %v", err)
+	}
+
+	updates := map[int64]TreeMetadata{
+		tree1.TreeId: {DisplayName: "Alpacas Log", Description: "Registry of alpacas"},
+		tree2.TreeId: {DisplayName: "Vicunas Log", Description: "Registry of vicunas"},
+	}
+	if err := s.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+		return tx.(*adminTX).UpdateTreesMetadata(ctx, updates)
+	}); err != nil {
+		t.Fatalf("UpdateTreesMetadata() = %v", err)
+	}
+	for id, want := range updates {
+		tree, err := storage.GetTree(ctx, s, id)
+		if err != nil {
+			t.Fatalf("GetTree(%d) = %v", id, err)
+		}
+		if got := (TreeMetadata{DisplayName: tree.DisplayName, Description: tree.Description}); got != want {
+			t.Errorf("GetTree(%d) metadata = %+v, want %+v", id, got, want)
+		}
+	}
+
+	// A batch including a missing tree must not change any of the other trees.
+	badUpdates := map[int64]TreeMetadata{
+		tree1.TreeId: {DisplayName: "Llamas Log"},
+		12345:        {DisplayName: "Missing"},
+	}
+	if err := s.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+		return tx.(*adminTX).UpdateTreesMetadata(ctx, badUpdates)
+	}); err == nil {
+		t.Fatal("UpdateTreesMetadata() with missing tree = nil, want err")
+	}
+	tree, err := storage.GetTree(ctx, s, tree1.TreeId)
+	if err != nil {
+		t.Fatalf("GetTree() = %v", err)
+	}
+	if got, want := tree.DisplayName, updates[tree1.TreeId].DisplayName; got != want {
+		t.Errorf("DisplayName after failed batch = %q, want %q", got, want)
+	}
+}
+
+func TestAdminTX_SoftDeleteTrees(t *testing.T) {
+	cleanTestDB(DB)
+	s := NewAdminStorage(DB)
+	ctx := context.Background()
+
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		tree, err := storage.CreateTree(ctx, s, testonly.LogTree)
+		if err != nil {
+			t.Fatalf("CreateTree() failed: %v", err)
+		}
+		ids = append(ids, tree.TreeId)
+	}
+
+	// Batches which can't be applied in full must not delete any trees.
+	for _, bad := range [][]int64{
+		{ids[0], 12345},
+		{ids[0], ids[0]},
+	} {
+		if err := s.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+			_, err := tx.(*adminTX).SoftDeleteTrees(ctx, bad)
+			return err
+		}); err == nil {
+			t.Errorf("SoftDeleteTrees(%v) = nil, want err", bad)
+		}
+	}
+	tree, err := storage.GetTree(ctx, s, ids[0])
+	if err != nil {
+		t.Fatalf("GetTree() = %v", err)
+	}
+	if tree.Deleted {
+		t.Errorf("Tree %d deleted by failed batch", ids[0])
+	}
+
+	var deleted []*trillian.Tree
+	if err := s.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+		var err error
+		deleted, err = tx.(*adminTX).SoftDeleteTrees(ctx, []int64{ids[2], ids[0]})
+		return err
+	}); err != nil {
+		t.Fatalf("SoftDeleteTrees() = %v", err)
+	}
+	for i, want := range []int64{ids[2], ids[0]} {
+		if got := deleted[i]; got.TreeId != want || !got.Deleted || got.DeleteTime == nil {
+			t.Errorf("SoftDeleteTrees()[%d] = tree %d (deleted %v, DeleteTime %v), want deleted tree %d", i, got.TreeId, got.Deleted, got.DeleteTime, want)
+		}
+	}
+	if tree, err := storage.GetTree(ctx, s, ids[1]); err != nil || tree.Deleted {
+		t.Errorf("GetTree(%d) = %v, %v; want undeleted tree", ids[1], tree, err)
+	}
+
+	// Trees can't be soft deleted twice.
+	if err := s.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+		_, err := tx.(*adminTX).SoftDeleteTrees(ctx, []int64{ids[0], ids[1]})
+		return err
+	}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("SoftDeleteTrees() of deleted tree = %v, want FailedPrecondition", err)
+	}
+}
+
+func TestAdminTX_UndeleteTrees(t *testing.T) {
+	cleanTestDB(DB)
+	s := NewAdminStorage(DB)
+	ctx := context.Background()
+
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		tree, err := storage.CreateTree(ctx, s, testonly.LogTree)
+		if err != nil {
+			t.Fatalf("CreateTree() failed: %v", err)
+		}
+		ids = append(ids, tree.TreeId)
+	}
+	// ids[2] stays live.
+	if err := s.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+		_, err := tx.(*adminTX).SoftDeleteTrees(ctx, ids[:2])
+		return err
+	}); err != nil {
+		t.Fatalf("SoftDeleteTrees() = %v", err)
+	}
+
+	// Batches which can't be applied in full must not undelete any trees.
+	for _, bad := range [][]int64{
+		{ids[0], 12345},
+		{ids[0], ids[0]},
+		{ids[0], ids[2]},
+	} {
+		if err := s.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+			_, err := tx.(*adminTX).UndeleteTrees(ctx, bad)
+			return err
+		}); err == nil {
+			t.Errorf("UndeleteTrees(%v) = nil, want err", bad)
+		}
+	}
+	if tree, err := storage.GetTree(ctx, s, ids[0]); err != nil || !tree.Deleted {
+		t.Errorf("GetTree(%d) = %v, %v; want tree still deleted after failed batches", ids[0], tree, err)
+	}
+
+	var restored []*trillian.Tree
+	if err := s.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+		var err error
+		restored, err = tx.(*adminTX).UndeleteTrees(ctx, []int64{ids[1], ids[0]})
+		return err
+	}); err != nil {
+		t.Fatalf("UndeleteTrees() = %v", err)
+	}
+	for i, want := range []int64{ids[1], ids[0]} {
+		if got := restored[i]; got.TreeId != want || got.Deleted || got.DeleteTime != nil {
+			t.Errorf("UndeleteTrees()[%d] = tree %d (deleted %v, DeleteTime %v), want undeleted tree %d", i, got.TreeId, got.Deleted, got.DeleteTime, want)
+		}
+	}
+}
+
+func TestAdminTX_RepairTreeEnums(t *testing.T) {
+	cleanTestDB(DB)
+	s := NewAdminStorage(DB)
+	ctx := context.Background()
+
+	healthy, err := storage.CreateTree(ctx, s, testonly.LogTree)
+	if err != nil {
+		t.Fatalf("CreateTree() failed: %v", err)
+	}
+	corrupt, err := storage.CreateTree(ctx, s, testonly.LogTree)
+	if err != nil {
+		t.Fatalf("CreateTree() failed: %v", err)
+	}
+	// Non-strict mode truncates invalid enum values to empty strings.
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Conn() failed: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.ExecContext(ctx, "SET SESSION sql_mode = ''"); err != nil {
+		t.Fatalf("Failed to disable strict mode: %v", err)
+	}
+	if _, err := conn.ExecContext(ctx, "UPDATE Trees SET TreeState = 'BOGUS' WHERE TreeId = ?", corrupt.TreeId); err != nil {
+		t.Fatalf("Failed to corrupt tree: %v", err)
+	}
+	if _, err := storage.GetTree(ctx, s, corrupt.TreeId); err == nil {
+		t.Fatal("GetTree() of corrupt tree succeeded, want err")
+	}
+
+	err = s.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+		got, err := tx.(*adminTX).ListCorruptTrees(ctx)
+		if err != nil {
+			t.Fatalf("ListCorruptTrees() failed: %v", err)
+		}
+		want := []CorruptTree{{TreeID: corrupt.TreeId, TreeState: "", TreeType: trillian.TreeType_LOG.String()}}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("ListCorruptTrees() diff (-want +got):\n%s", diff)
+		}
+
+		if _, err := tx.(*adminTX).RepairTreeEnums(ctx, corrupt.TreeId, trillian.TreeState_UNKNOWN_TREE_STATE, trillian.TreeType_LOG); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("RepairTreeEnums() with unknown state = %v, want InvalidArgument", err)
+		}
+		repaired, err := tx.(*adminTX).RepairTreeEnums(ctx, corrupt.TreeId, trillian.TreeState_FROZEN, trillian.TreeType_LOG)
+		if err != nil {
+			t.Fatalf("RepairTreeEnums() failed: %v", err)
+		}
+		if got, want := repaired.TreeState, trillian.TreeState_FROZEN; got != want {
+			t.Errorf("RepairTreeEnums() TreeState = %v, want %v", got, want)
+		}
+
+		got, err = tx.(*adminTX).ListCorruptTrees(ctx)
+		if err != nil {
+			t.Fatalf("ListCorruptTrees() failed: %v", err)
+		}
+		if len(got) != 0 {
+			t.Errorf("ListCorruptTrees() after repair = %v, want none", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadWriteTransaction() failed: %v", err)
+	}
+	if _, err := storage.GetTree(ctx, s, healthy.TreeId); err != nil {
+		t.Errorf("GetTree() of healthy tree failed: %v", err)
+	}
+}
+
+func TestAdminTX_TreeAnnotations(t *testing.T) {
+	cleanTestDB(DB)
+	s := NewAdminStorage(DB)
+	ctx := context.Background()
+
+	tree, err := storage.CreateTree(ctx, s, testonly.LogTree)
+	if err != nil {
+		t.Fatalf("CreateTree() returned err = %v", err)
+	}
+
+	err = s.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+		atx := tx.(*adminTX)
+		for _, kv := range [][2]string{{"migrated", "2024-05"}, {"incident", "b/123"}, {"migrated", "2024-06"}} {
+			if err := atx.SetTreeAnnotation(ctx, tree.TreeId, kv[0], kv[1]); err != nil {
+				t.Fatalf("SetTreeAnnotation(%q, %q) returned err = %v", kv[0], kv[1], err)
+			}
+		}
+		if err := atx.SetTreeAnnotation(ctx, tree.TreeId, "", "value"); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("SetTreeAnnotation() with empty key returned err = %v, want InvalidArgument", err)
+		}
+		if err := atx.SetTreeAnnotation(ctx, tree.TreeId+1, "key", "value"); status.Code(err) != codes.NotFound {
+			t.Errorf("SetTreeAnnotation() on unknown tree returned err = %v, want NotFound", err)
+		}
+
+		got, err := atx.GetTreeAnnotations(ctx, tree.TreeId)
+		if err != nil {
+			t.Fatalf("GetTreeAnnotations() returned err = %v", err)
+		}
+		want := map[string]string{"migrated": "2024-06", "incident": "b/123"}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("GetTreeAnnotations() diff (-want +got):\n%s", diff)
+		}
+
+		if _, err := tx.SoftDeleteTree(ctx, tree.TreeId); err != nil {
+			return err
+		}
+		return tx.HardDeleteTree(ctx, tree.TreeId)
+	})
+	if err != nil {
+		t.Fatalf("ReadWriteTransaction() returned err = %v", err)
+	}
+
+	var count int
+	if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM TreeAnnotations WHERE TreeId = ?", tree.TreeId).Scan(&count); err != nil {
+		t.Fatalf("QueryRowContext() returned err = %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Got %d annotations after HardDeleteTree(), want 0", count)
+	}
+}
+
+func TestAdminTX_TreeAuditLog(t *testing.T) {
+	cleanTestDB(DB)
+	s := NewAdminStorage(DB)
+	ctx := context.Background()
+
+	tree, err := storage.CreateTree(ctx, s, testonly.LogTree)
+	if err != nil {
+		t.Fatalf("CreateTree() returned err = %v", err)
+	}
+	if _, err := storage.UpdateTree(ctx, s, tree.TreeId, func(tree *trillian.Tree) {
+		tree.TreeState = trillian.TreeState_FROZEN
+	}); err != nil {
+		t.Fatalf("UpdateTree() returned err = %v", err)
+	}
+	err = s.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+		if _, err := tx.SoftDeleteTree(ctx, tree.TreeId); err != nil {
+			return err
+		}
+		if _, err := tx.UndeleteTree(ctx, tree.TreeId); err != nil {
+			return err
+		}
+		if _, err := tx.SoftDeleteTree(ctx, tree.TreeId); err != nil {
+			return err
+		}
+		return tx.HardDeleteTree(ctx, tree.TreeId)
+	})
+	if err != nil {
+		t.Fatalf("ReadWriteTransaction() returned err = %v", err)
+	}
+
+	// The log outlives the tree.
+	err = s.ReadWriteTransaction(ctx, func(ctx context.Context, tx storage.AdminTX) error {
+		got, err := tx.(*adminTX).GetTreeAuditLog(ctx, tree.TreeId)
+		if err != nil {
+			t.Fatalf("GetTreeAuditLog() returned err = %v", err)
+		}
+		want := []TreeAuditEntry{
+			{Op: TreeAuditCreate, Details: "TreeState=ACTIVE TreeType=LOG"},
+			{Op: TreeAuditUpdate, Details: "TreeState: ACTIVE -> FROZEN"},
+			{Op: TreeAuditSoftDelete},
+			{Op: TreeAuditUndelete},
+			{Op: TreeAuditSoftDelete},
+			{Op: TreeAuditHardDelete},
+		}
+		if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(TreeAuditEntry{}, "At")); diff != "" {
+			t.Errorf("GetTreeAuditLog() diff (-want +got):\n%s", diff)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadWriteTransaction() returned err = %v", err)
+	}
+}
+
 func TestAdminTX_HardDeleteTree(t *testing.T) {
 	cleanTestDB(DB)
 	s := NewAdminStorage(DB)
@@ -0,0 +1,93 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// newDeadlockBackoff returns the backoff between retries of transactions
+// which deadlocked. It's jittered so that the transactions which deadlocked
+// with each other don't retry in lockstep and deadlock again.
+func newDeadlockBackoff() *backoff {
+	return &backoff{Initial: 10 * time.Millisecond, Max: time.Second, Multiplier: 2, Jitter: 0.5}
+}
+
+// backoff computes exponentially increasing, jittered delays between retries
+// of a storage operation. The zero value is not useful; set at least Initial.
+type backoff struct {
+	// Initial is the delay before the first retry.
+	Initial time.Duration
+	// Max caps the delay, before jitter is applied. If zero, delays are not
+	// capped.
+	Max time.Duration
+	// Multiplier scales the delay after each retry. Values below 1 are
+	// treated as 1.
+	Multiplier float64
+	// Jitter is the fraction, in [0, 1], of each delay that is randomized,
+	// so that retrying clients spread out rather than retrying in lockstep.
+	Jitter float64
+
+	next time.Duration
+}
+
+// Duration returns the delay before the next retry, and advances the backoff.
+func (b *backoff) Duration() time.Duration {
+	if b.next == 0 {
+		b.next = b.Initial
+	}
+	d := b.next
+
+	mult := b.Multiplier
+	if mult < 1 {
+		mult = 1
+	}
+	b.next = time.Duration(float64(b.next) * mult)
+	if b.Max > 0 && b.next > b.Max {
+		b.next = b.Max
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+
+	if b.Jitter > 0 {
+		jitter := b.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		d -= time.Duration(jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+// Reset restarts the backoff from Initial.
+func (b *backoff) Reset() {
+	b.next = 0
+}
+
+// Wait sleeps for the next delay, or until ctx is done, in which case it
+// returns ctx's error.
+func (b *backoff) Wait(ctx context.Context) error {
+	t := time.NewTimer(b.Duration())
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
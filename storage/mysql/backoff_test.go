@@ -0,0 +1,52 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoffDuration(t *testing.T) {
+	b := backoff{Initial: time.Second, Max: 5 * time.Second, Multiplier: 2}
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := b.Duration(); got != want {
+			t.Errorf("Duration() #%d = %v, want %v", i, got, want)
+		}
+	}
+	b.Reset()
+	if got, want := b.Duration(), time.Second; got != want {
+		t.Errorf("Duration() after Reset() = %v, want %v", got, want)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := backoff{Initial: time.Second, Multiplier: 1, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if got := b.Duration(); got < 500*time.Millisecond || got > time.Second {
+			t.Fatalf("Duration() = %v, want in [500ms, 1s]", got)
+		}
+	}
+}
+
+func TestBackoffWaitCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b := backoff{Initial: time.Hour}
+	if err := b.Wait(ctx); err != context.Canceled {
+		t.Errorf("Wait() = %v, want %v", err, context.Canceled)
+	}
+}
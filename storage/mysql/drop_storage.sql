@@ -6,4 +6,6 @@ DROP TABLE IF EXISTS SequencedLeafData;
 DROP TABLE IF EXISTS TreeHead;
 DROP TABLE IF EXISTS LeafData;
 DROP TABLE IF EXISTS TreeControl;
+DROP TABLE IF EXISTS TreeAnnotations;
+DROP TABLE IF EXISTS TreeAudit;
 DROP TABLE IF EXISTS Trees;
@@ -15,9 +15,14 @@
 package mysql
 
 import (
+	"context"
+	"errors"
+	"fmt"
+
 	"github.com/go-sql-driver/mysql"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
 )
 
 const (
@@ -25,8 +30,28 @@ const (
 	errNumDuplicate = 1062
 	// ER_LOCK_DEADLOCK: Error returned when there was a deadlock.
 	errNumDeadlock = 1213
+	// ER_NET_PACKET_TOO_LARGE: Error returned when a packet exceeds the
+	// server's max_allowed_packet.
+	errNumPacketTooLarge = 1153
+	// ER_PS_MANY_PARAM: Error returned when a prepared statement has more
+	// than 65535 placeholders.
+	errNumTooManyPlaceholders = 1390
 )
 
+// UnexpectedIndexError is returned when leaves read by range are missing or
+// out of order below the tree size, which means that the tree's storage is
+// corrupt. Callers can detect it with errors.As.
+type UnexpectedIndexError struct {
+	TreeID int64
+	// Got is the index of the leaf that was read, in place of Want.
+	Got  int64
+	Want int64
+}
+
+func (e *UnexpectedIndexError) Error() string {
+	return fmt.Sprintf("got unexpected index %d, want %d", e.Got, e.Want)
+}
+
 // mysqlToGRPC converts some types of MySQL errors to GRPC errors. This gives
 // clients more signal when the operation can be retried.
 func mysqlToGRPC(err error) error {
@@ -40,6 +65,43 @@ func mysqlToGRPC(err error) error {
 	return err
 }
 
+// tooLargeToGRPC returns a ResourceExhausted error in place of err if it
+// reports that a statement looking up numHashes hashes was too large for
+// MySQL or the driver, so that callers know to look up fewer at a time.
+func tooLargeToGRPC(err error, numHashes int) error {
+	tooLarge := errors.Is(err, mysql.ErrPktTooLarge)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		tooLarge = mysqlErr.Number == errNumPacketTooLarge || mysqlErr.Number == errNumTooManyPlaceholders
+	}
+	if !tooLarge {
+		return err
+	}
+	return status.Errorf(codes.ResourceExhausted, "statement for %d hashes is too large, use smaller batches: %v", numHashes, err)
+}
+
+// contextToGRPC returns the gRPC form of ctx's error in place of err if ctx
+// is done. A canceled context rolls back the transaction, so err is then
+// usually an uninformative sql.ErrTxDone; it is only logged for debugging.
+func contextToGRPC(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	klog.V(1).Infof("Transaction aborted by context: %v", err)
+	return status.FromContextError(ctx.Err()).Err()
+}
+
+// isDeadlockErr returns whether err reports that a transaction was rolled back
+// because of a deadlock, either as returned by MySQL or as the Aborted status
+// that mysqlToGRPC converts it to.
+func isDeadlockErr(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == errNumDeadlock
+	}
+	return status.Code(err) == codes.Aborted
+}
+
 func isDuplicateErr(err error) bool {
 	switch err := err.(type) {
 	case *mysql.MySQLError:
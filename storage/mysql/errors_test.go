@@ -0,0 +1,110 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTooLargeToGRPC(t *testing.T) {
+	otherErr := &mysql.MySQLError{Number: errNumDuplicate}
+	for _, tc := range []struct {
+		desc     string
+		err      error
+		wantCode codes.Code
+	}{
+		{desc: "placeholders", err: &mysql.MySQLError{Number: errNumTooManyPlaceholders}, wantCode: codes.ResourceExhausted},
+		{desc: "server packet", err: &mysql.MySQLError{Number: errNumPacketTooLarge}, wantCode: codes.ResourceExhausted},
+		{desc: "driver packet", err: fmt.Errorf("query: %w", mysql.ErrPktTooLarge), wantCode: codes.ResourceExhausted},
+		{desc: "other", err: otherErr},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := tooLargeToGRPC(tc.err, 10)
+			if tc.wantCode == codes.OK {
+				if err != tc.err {
+					t.Errorf("tooLargeToGRPC() = %v, want %v", err, tc.err)
+				}
+				return
+			}
+			if got := status.Code(err); got != tc.wantCode {
+				t.Errorf("tooLargeToGRPC() = %v, want code %v", err, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestContextToGRPC(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	otherErr := errors.New("boom")
+
+	for _, tc := range []struct {
+		desc     string
+		ctx      context.Context
+		err      error
+		wantCode codes.Code
+		wantErr  error
+	}{
+		{desc: "nil error", ctx: canceled, err: nil, wantErr: nil},
+		{desc: "live context", ctx: context.Background(), err: otherErr, wantErr: otherErr},
+		{desc: "canceled", ctx: canceled, err: sql.ErrTxDone, wantCode: codes.Canceled},
+		{desc: "deadline", ctx: expired, err: sql.ErrTxDone, wantCode: codes.DeadlineExceeded},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := contextToGRPC(tc.ctx, tc.err)
+			if tc.wantCode != codes.OK {
+				if got := status.Code(err); got != tc.wantCode {
+					t.Errorf("contextToGRPC() = %v, want code %v", err, tc.wantCode)
+				}
+				return
+			}
+			if err != tc.wantErr {
+				t.Errorf("contextToGRPC() = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsDeadlockErr(t *testing.T) {
+	deadlock := &mysql.MySQLError{Number: errNumDeadlock}
+	for _, tc := range []struct {
+		desc string
+		err  error
+		want bool
+	}{
+		{desc: "deadlock", err: deadlock, want: true},
+		{desc: "wrapped deadlock", err: fmt.Errorf("update: %w", deadlock), want: true},
+		{desc: "converted deadlock", err: mysqlToGRPC(deadlock), want: true},
+		{desc: "duplicate", err: &mysql.MySQLError{Number: errNumDuplicate}},
+		{desc: "other", err: errors.New("boom")},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := isDeadlockErr(tc.err); got != tc.want {
+				t.Errorf("isDeadlockErr(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"crypto"
+	_ "crypto/sha512" // Registers SHA-512/256.
+	"fmt"
+
+	"github.com/google/trillian/storage/mysql/mysqlpb"
+	"github.com/transparency-dev/merkle/rfc6962"
+)
+
+var sha512_256Hasher = rfc6962.New(crypto.SHA512_256)
+
+// logHasher returns the hasher identified by h.
+func logHasher(h mysqlpb.LogHasher) (*rfc6962.Hasher, error) {
+	switch h {
+	case mysqlpb.LogHasher_RFC6962_SHA256:
+		return rfc6962.DefaultHasher, nil
+	case mysqlpb.LogHasher_RFC6962_SHA512_256:
+		return sha512_256Hasher, nil
+	default:
+		return nil, fmt.Errorf("unknown hasher %v", h)
+	}
+}
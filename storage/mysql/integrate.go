@@ -0,0 +1,232 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian/storage/cache"
+	"github.com/google/trillian/storage/tree"
+	"github.com/google/trillian/types"
+	"github.com/transparency-dev/merkle/compact"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const selectSequencedMerkleHashesSQL = "SELECT SequenceNumber,MerkleLeafHash FROM SequencedLeafData WHERE TreeId=? ORDER BY SequenceNumber"
+
+// integrateSequencedLeaves integrates up to limit sequenced leaves, starting at
+// the current tree size, into the Merkle tree, and stores a root covering them
+// with the given timestamp. Only the contiguous run of leaves following the
+// tree is integrated, so leaves added past a gap wait for it to be filled.
+//
+// It does the same work as the log sequencer's IntegrateBatch, for the
+// IntegrateImmediately option, and the sequencer continues to integrate any
+// leaves which are left over.
+func (t *logTreeTX) integrateSequencedLeaves(ctx context.Context, limit int, now time.Time) error {
+	if limit <= 0 || t.root.RootHash == nil {
+		return nil
+	}
+	leaves, err := t.DequeueLeaves(ctx, limit, now)
+	if err != nil {
+		return fmt.Errorf("failed to read sequenced leaves: %v", err)
+	}
+	if len(leaves) == 0 {
+		return nil
+	}
+
+	cr, err := t.compactRange(ctx)
+	if err != nil {
+		return err
+	}
+	var nodes []tree.Node
+	store := func(id compact.NodeID, hash []byte) { nodes = append(nodes, tree.Node{ID: id, Hash: hash}) }
+	for _, leaf := range leaves {
+		if idx := leaf.LeafIndex; idx < 0 || uint64(idx) != cr.End() {
+			return fmt.Errorf("leaf index mismatch: got %d, want %d", idx, cr.End())
+		}
+		if err := cr.Append(leaf.MerkleLeafHash, store); err != nil {
+			return err
+		}
+	}
+	rootHash, err := cr.GetRootHash(nil)
+	if err != nil {
+		return err
+	}
+	newRoot := types.LogRootV1{
+		RootHash:       rootHash,
+		TimestampNanos: uint64(now.UnixNano()),
+		TreeSize:       cr.End(),
+	}
+	// Check before setting any nodes, so that the usual reason to skip
+	// integration leaves nothing behind in the subtree cache.
+	if newRoot.TimestampNanos <= t.root.TimestampNanos {
+		return status.Errorf(codes.FailedPrecondition, "refusing to store root with timestamp earlier than previous root (%d <= %d)", newRoot.TimestampNanos, t.root.TimestampNanos)
+	}
+	if err := t.SetMerkleNodes(ctx, nodes); err != nil {
+		return fmt.Errorf("failed to set Merkle nodes: %v", err)
+	}
+	logRoot, err := newRoot.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return t.StoreSignedLogRoot(ctx, &trillian.SignedLogRoot{LogRoot: logRoot})
+}
+
+// integrateOrSkip runs integrateSequencedLeaves within a savepoint. If
+// integration fails, e.g. because the clock went backwards or a concurrent
+// sequencer has already stored a root at this revision, its changes are rolled
+// back and the leaves are left for the sequencer, rather than failing the
+// whole transaction. Errors are only returned if the rollback itself fails.
+func (t *logTreeTX) integrateOrSkip(ctx context.Context, limit int, now time.Time) error {
+	sp := newSavepoint(t.tx, "IntegrateImmediately")
+	if err := sp.Set(ctx); err != nil {
+		klog.Errorf("%sError adding savepoint: %s", requestIDPrefix(ctx), err)
+		return mysqlToGRPC(err)
+	}
+	err := t.integrateSequencedLeaves(ctx, limit, now)
+	if err == nil {
+		return sp.Release(ctx)
+	}
+	if ctx.Err() != nil {
+		return err
+	}
+	if rbErr := sp.Rollback(ctx); rbErr != nil {
+		klog.Errorf("%sError rolling back to savepoint: %s", requestIDPrefix(ctx), rbErr)
+		return err
+	}
+	// Drop any Merkle nodes set by the failed attempt, which Commit would
+	// otherwise store. The transaction hasn't set any others.
+	t.treeTX.mu.Lock()
+	t.subtreeCache = cache.NewLogSubtreeCache(t.hasher)
+	t.treeTX.mu.Unlock()
+	klog.Warningf("%sSkipped integrating leaves of tree %d, leaving them to the sequencer: %v", requestIDPrefix(ctx), t.treeID, err)
+	return nil
+}
+
+// recomputeAndStoreRoot rebuilds the Merkle tree from the contiguous run of
+// sequenced leaves starting at index 0, stores its nodes, and stores a root
+// covering it at the next revision. This repairs the tree after leaves have
+// been backfilled into SequencedLeafData by hand. It refuses to shrink the
+// tree, so leaves must only be added, and returns the stored root.
+func (t *logTreeTX) recomputeAndStoreRoot(ctx context.Context, now time.Time) (*types.LogRootV1, error) {
+	cr := (&compact.RangeFactory{Hash: t.hasher.HashChildren}).NewEmptyRange(0)
+	var nodes []tree.Node
+	store := func(id compact.NodeID, hash []byte) { nodes = append(nodes, tree.Node{ID: id, Hash: hash}) }
+	if err := t.forEachSequencedHash(ctx, func(index int64, merkleHash []byte) (bool, error) {
+		if uint64(index) != cr.End() {
+			// Leaves past a gap can't be covered yet.
+			return false, nil
+		}
+		return true, cr.Append(merkleHash, store)
+	}); err != nil {
+		return nil, err
+	}
+	if size := cr.End(); size < t.root.TreeSize {
+		return nil, status.Errorf(codes.FailedPrecondition, "recomputed tree size %d is smaller than the current tree size %d", size, t.root.TreeSize)
+	}
+	rootHash, err := cr.GetRootHash(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.SetMerkleNodes(ctx, nodes); err != nil {
+		return nil, fmt.Errorf("failed to set Merkle nodes: %v", err)
+	}
+
+	newRoot := &types.LogRootV1{
+		RootHash:       rootHash,
+		TimestampNanos: uint64(now.UnixNano()),
+		TreeSize:       cr.End(),
+	}
+	if newRoot.TimestampNanos <= t.root.TimestampNanos {
+		newRoot.TimestampNanos = t.root.TimestampNanos + 1
+	}
+	logRoot, err := newRoot.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.StoreSignedLogRoot(ctx, &trillian.SignedLogRoot{LogRoot: logRoot}); err != nil {
+		return nil, err
+	}
+	return newRoot, nil
+}
+
+// forEachSequencedHash calls fn with the index and MerkleLeafHash of each
+// sequenced leaf, in index order, until fn returns false or an error.
+func (t *logTreeTX) forEachSequencedHash(ctx context.Context, fn func(index int64, merkleHash []byte) (bool, error)) error {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	rows, err := t.tx.QueryContext(ctx, selectSequencedMerkleHashesSQL, t.treeID)
+	if err != nil {
+		klog.Warningf("%sFailed to read sequenced leaf hashes: %s", requestIDPrefix(ctx), err)
+		return err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+	for rows.Next() {
+		var index int64
+		var merkleHash []byte
+		if err := rows.Scan(&index, &merkleHash); err != nil {
+			return err
+		}
+		if more, err := fn(index, merkleHash); err != nil || !more {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// compactRange returns the compact range of the tree at its current root,
+// having checked that it matches the root hash.
+func (t *logTreeTX) compactRange(ctx context.Context) (*compact.Range, error) {
+	fact := compact.RangeFactory{Hash: t.hasher.HashChildren}
+	size := t.root.TreeSize
+	if size == 0 {
+		return fact.NewEmptyRange(0), nil
+	}
+	ids := compact.RangeNodes(0, size, nil)
+	nodes, err := t.GetMerkleNodes(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tree nodes: %v", err)
+	}
+	if got, want := len(nodes), len(ids); got != want {
+		return nil, fmt.Errorf("failed to get %d nodes, got %d", want, got)
+	}
+	hashes := make([][]byte, len(nodes))
+	for i, node := range nodes {
+		hashes[i] = node.Hash
+	}
+	cr, err := fact.NewRange(0, size, hashes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compact.Range: %v", err)
+	}
+	hash, err := cr.GetRootHash(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute the root hash: %v", err)
+	}
+	if want := t.root.RootHash; !bytes.Equal(hash, want) {
+		return nil, fmt.Errorf("root hash mismatch: got %x, want %x", hash, want)
+	}
+	return cr, nil
+}
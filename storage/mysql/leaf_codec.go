@@ -0,0 +1,170 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Codec identifiers prefixed to LeafValue and ExtraData of trees with
+// CompressLeafData set.
+const (
+	codecIdentity byte = 0
+	codecGzip     byte = 1
+)
+
+// leafValueEncrypted is the version byte prefixed to the stored LeafValue of
+// trees with EncryptLeafValue set, so that other schemes can be told apart if
+// they're added. The LeafValue is encrypted after it's compressed.
+const leafValueEncrypted byte = 1
+
+// LeafCrypter encrypts and decrypts the LeafValue of leaves of trees with the
+// EncryptLeafValue storage option, using per-tree keys managed outside of
+// storage, e.g. by the personality. It must be safe for concurrent use.
+type LeafCrypter interface {
+	// Encrypt returns the ciphertext of plaintext for the given tree.
+	Encrypt(treeID int64, plaintext []byte) ([]byte, error)
+	// Decrypt returns the plaintext of ciphertext returned by Encrypt for the
+	// given tree.
+	Decrypt(treeID int64, ciphertext []byte) ([]byte, error)
+}
+
+// encryptLeafValue returns value as stored for tree treeID with
+// EncryptLeafValue set. It fails with FailedPrecondition if crypter is nil, so
+// that such trees never store new values in plaintext. Empty values are
+// stored as-is.
+func encryptLeafValue(crypter LeafCrypter, treeID int64, value []byte) ([]byte, error) {
+	if crypter == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "tree %d requires encrypted leaf values, but no LeafCrypter is configured", treeID)
+	}
+	if len(value) == 0 {
+		return value, nil
+	}
+	ciphertext, err := crypter.Encrypt(treeID, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt leaf value: %v", err)
+	}
+	return append([]byte{leafValueEncrypted}, ciphertext...), nil
+}
+
+// decryptLeafValue reverses encryptLeafValue. Encrypted values can't be read
+// without a crypter.
+func decryptLeafValue(crypter LeafCrypter, treeID int64, stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return stored, nil
+	}
+	if stored[0] != leafValueEncrypted {
+		return nil, fmt.Errorf("unknown leaf value version %d", stored[0])
+	}
+	if crypter == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "leaf value of tree %d is encrypted, but no LeafCrypter is configured", treeID)
+	}
+	value, err := crypter.Decrypt(treeID, stored[1:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt leaf value: %v", err)
+	}
+	return value, nil
+}
+
+// encodeLeafData returns data as stored for a tree with the given
+// compressLeafData setting. Data is gzipped and prefixed with codecGzip,
+// unless that doesn't make it smaller, in which case it's prefixed with
+// codecIdentity. Empty data is stored as-is.
+func encodeLeafData(compressLeafData bool, data []byte) ([]byte, error) {
+	if !compressLeafData || len(data) == 0 {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(codecGzip)
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() < len(data)+1 {
+		return buf.Bytes(), nil
+	}
+	return append([]byte{codecIdentity}, data...), nil
+}
+
+// decodeLeafData reverses encodeLeafData.
+func decodeLeafData(compressLeafData bool, stored []byte) ([]byte, error) {
+	if !compressLeafData || len(stored) == 0 {
+		return stored, nil
+	}
+	switch stored[0] {
+	case codecIdentity:
+		return stored[1:], nil
+	case codecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(stored[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress leaf data: %v", err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress leaf data: %v", err)
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unknown leaf data codec %d", stored[0])
+	}
+}
+
+// encodeLeaf returns the stored forms of leaf's LeafValue and ExtraData.
+func (t *treeTX) encodeLeaf(leafValue, extraData []byte) ([]byte, []byte, error) {
+	value, err := encodeLeafData(t.compressLeafData, leafValue)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.encryptLeafValue {
+		if value, err = encryptLeafValue(t.leafCrypter, t.treeID, value); err != nil {
+			return nil, nil, err
+		}
+	}
+	extra, err := encodeLeafData(t.compressLeafData, extraData)
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, extra, nil
+}
+
+// decodeLeaf replaces the stored forms of LeafValue and ExtraData in place.
+func (t *treeTX) decodeLeaf(leafValue, extraData *[]byte) error {
+	var err error
+	if *leafValue, err = t.decodeLeafValue(*leafValue); err != nil {
+		return err
+	}
+	*extraData, err = decodeLeafData(t.compressLeafData, *extraData)
+	return err
+}
+
+// decodeLeafValue returns the LeafValue whose stored form is stored.
+func (t *treeTX) decodeLeafValue(stored []byte) ([]byte, error) {
+	if t.encryptLeafValue {
+		var err error
+		if stored, err = decryptLeafValue(t.leafCrypter, t.treeID, stored); err != nil {
+			return nil, err
+		}
+	}
+	return decodeLeafData(t.compressLeafData, stored)
+}
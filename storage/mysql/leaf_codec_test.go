@@ -0,0 +1,154 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLeafDataCodec(t *testing.T) {
+	compressible := bytes.Repeat([]byte(`{"key":"value"}`), 100)
+	for _, tc := range []struct {
+		desc      string
+		compress  bool
+		data      []byte
+		wantCodec int // -1 if the data is stored as-is.
+	}{
+		{desc: "disabled", compress: false, data: compressible, wantCodec: -1},
+		{desc: "empty", compress: true, data: nil, wantCodec: -1},
+		{desc: "compressible", compress: true, data: compressible, wantCodec: int(codecGzip)},
+		{desc: "incompressible", compress: true, data: []byte("x"), wantCodec: int(codecIdentity)},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			stored, err := encodeLeafData(tc.compress, tc.data)
+			if err != nil {
+				t.Fatalf("encodeLeafData(): %v", err)
+			}
+			if tc.wantCodec < 0 {
+				if !bytes.Equal(stored, tc.data) {
+					t.Errorf("encodeLeafData() = %x, want %x", stored, tc.data)
+				}
+			} else if got := int(stored[0]); got != tc.wantCodec {
+				t.Errorf("encodeLeafData() codec = %d, want %d", got, tc.wantCodec)
+			}
+			got, err := decodeLeafData(tc.compress, stored)
+			if err != nil {
+				t.Fatalf("decodeLeafData(): %v", err)
+			}
+			if !bytes.Equal(got, tc.data) {
+				t.Errorf("decodeLeafData() = %x, want %x", got, tc.data)
+			}
+		})
+	}
+
+	if _, err := decodeLeafData(true, []byte{0xff, 1, 2}); err == nil {
+		t.Error("decodeLeafData() with unknown codec = nil, want err")
+	}
+}
+
+// xorCrypter is a LeafCrypter which XORs values with their tree ID, so that
+// values decrypted with the wrong tree's key are garbled.
+type xorCrypter struct{}
+
+func (xorCrypter) Encrypt(treeID int64, plaintext []byte) ([]byte, error) {
+	return xorTreeID(treeID, plaintext), nil
+}
+
+func (xorCrypter) Decrypt(treeID int64, ciphertext []byte) ([]byte, error) {
+	return xorTreeID(treeID, ciphertext), nil
+}
+
+func xorTreeID(treeID int64, data []byte) []byte {
+	key := []byte(fmt.Sprintf("%d", treeID))
+	ret := make([]byte, len(data))
+	for i, b := range data {
+		ret[i] = b ^ key[i%len(key)]
+	}
+	return ret
+}
+
+func TestLeafValueEncryption(t *testing.T) {
+	const treeID = 12345
+	value := []byte("leaf value")
+	for _, tc := range []struct {
+		desc        string
+		crypter     LeafCrypter
+		value       []byte
+		wantVersion int // -1 if the value is stored as-is.
+	}{
+		{desc: "empty", crypter: xorCrypter{}, value: nil, wantVersion: -1},
+		{desc: "encrypted", crypter: xorCrypter{}, value: value, wantVersion: int(leafValueEncrypted)},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			stored, err := encryptLeafValue(tc.crypter, treeID, tc.value)
+			if err != nil {
+				t.Fatalf("encryptLeafValue(): %v", err)
+			}
+			if tc.wantVersion < 0 {
+				if !bytes.Equal(stored, tc.value) {
+					t.Errorf("encryptLeafValue() = %x, want %x", stored, tc.value)
+				}
+			} else if got := int(stored[0]); got != tc.wantVersion {
+				t.Errorf("encryptLeafValue() version = %d, want %d", got, tc.wantVersion)
+			}
+			if tc.wantVersion == int(leafValueEncrypted) && bytes.Contains(stored, tc.value) {
+				t.Errorf("encryptLeafValue() = %x, which contains the plaintext", stored)
+			}
+			got, err := decryptLeafValue(xorCrypter{}, treeID, stored)
+			if err != nil {
+				t.Fatalf("decryptLeafValue(): %v", err)
+			}
+			if !bytes.Equal(got, tc.value) {
+				t.Errorf("decryptLeafValue() = %x, want %x", got, tc.value)
+			}
+		})
+	}
+
+	for _, v := range [][]byte{nil, value} {
+		if _, err := encryptLeafValue(nil, treeID, v); status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("encryptLeafValue(%q) without crypter = %v, want %v", v, err, codes.FailedPrecondition)
+		}
+	}
+	stored, err := encryptLeafValue(xorCrypter{}, treeID, value)
+	if err != nil {
+		t.Fatalf("encryptLeafValue(): %v", err)
+	}
+	if _, err := decryptLeafValue(nil, treeID, stored); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("decryptLeafValue() without crypter = %v, want %v", err, codes.FailedPrecondition)
+	}
+	// Trees are created with EncryptLeafValue, so every non-empty value
+	// carries the encrypted version.
+	for _, v := range []byte{0, 0xff} {
+		if _, err := decryptLeafValue(xorCrypter{}, treeID, append([]byte{v}, value...)); err == nil {
+			t.Errorf("decryptLeafValue() with version %d = nil, want err", v)
+		}
+	}
+}
+
+func TestEncodeLeafWithoutCrypter(t *testing.T) {
+	tx := &treeTX{treeID: 12345, compressLeafData: true, encryptLeafValue: true}
+	if _, _, err := tx.encodeLeaf([]byte("leaf value"), []byte("extra")); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("encodeLeaf() without crypter = %v, want %v", err, codes.FailedPrecondition)
+	}
+	tx.leafCrypter = xorCrypter{}
+	if _, _, err := tx.encodeLeaf([]byte("leaf value"), []byte("extra")); err != nil {
+		t.Errorf("encodeLeaf() with crypter = %v, want nil", err)
+	}
+}
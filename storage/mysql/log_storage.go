@@ -17,22 +17,28 @@ package mysql
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"hash"
+	"math"
+	"math/rand"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/trillian"
 	"github.com/google/trillian/monitoring"
 	"github.com/google/trillian/storage"
-	"github.com/google/trillian/storage/cache"
 	"github.com/google/trillian/storage/tree"
 	"github.com/google/trillian/types"
 	"github.com/transparency-dev/merkle/compact"
-	"github.com/transparency-dev/merkle/rfc6962"
+	"github.com/transparency-dev/merkle/proof"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -41,44 +47,253 @@ import (
 
 const (
 	valuesPlaceholder5 = "(?,?,?,?,?)"
+	valuesPlaceholder6 = "(?,?,?,?,?,?)"
+	// serverIntegrateValuesSQL is valuesPlaceholder6 for SequencedLeafData,
+	// with the database's current time in place of IntegrateTimestampNanos.
+	serverIntegrateValuesSQL = "(?,?,?,?,?,CAST(UNIX_TIMESTAMP(NOW(6))*1000000000 AS SIGNED))"
 
 	insertLeafDataSQL      = "INSERT INTO LeafData(TreeId,LeafIdentityHash,LeafValue,ExtraData,QueueTimestampNanos) VALUES" + valuesPlaceholder5
-	insertSequencedLeafSQL = "INSERT INTO SequencedLeafData(TreeId,LeafIdentityHash,MerkleLeafHash,SequenceNumber,IntegrateTimestampNanos) VALUES"
+	insertSequencedLeafSQL = "INSERT INTO SequencedLeafData(TreeId,LeafIdentityHash,MerkleLeafHash,SequenceNumber,DedupNamespace,IntegrateTimestampNanos) VALUES"
+
+	selectStaleQueuedLeavesSQL = `SELECT LeafIdentityHash,MerkleLeafHash,QueueTimestampNanos
+			FROM Unsequenced
+			WHERE TreeId=? AND Bucket=0 AND QueueTimestampNanos<?
+			ORDER BY QueueTimestampNanos,LeafIdentityHash LIMIT ?`
+
+	// The LeasedUntilNanos and LeaseID columns are only used by the lease
+	// methods, and by storage with HonorLeases set.
+	updateUnsequencedLeaseSQL = "UPDATE Unsequenced SET LeasedUntilNanos=?,LeaseID=? WHERE TreeId=? AND Bucket=0 AND QueueTimestampNanos=? AND LeafIdentityHash=? AND DedupNamespace=?"
+
+	// The LeafIndexKey and MerkleLeafHash columns are only written when
+	// needed, so that deployments which don't use them needn't add them, and
+	// DedupNamespace only when it isn't the default. See insertLeafData.
+	insertLeafDataColumnsSQL = "INSERT INTO LeafData(TreeId,LeafIdentityHash,LeafValue,ExtraData,QueueTimestampNanos"
 
 	selectNonDeletedTreeIDByTypeAndStateSQL = `
 		SELECT TreeId FROM Trees
 		  WHERE TreeType IN(?,?)
-		  AND TreeState IN(?,?)
+		  AND TreeState IN(` + placeholderSQL + `)
 		  AND (Deleted IS NULL OR Deleted = 'false')`
 
+	selectStorageTreeIDsSQL = `SELECT TreeId FROM Trees
+		UNION SELECT TreeId FROM LeafData
+		UNION SELECT TreeId FROM SequencedLeafData
+		UNION SELECT TreeId FROM Unsequenced
+		ORDER BY TreeId`
+
+	// Each of these returns the row count and the total size of the
+	// variable-length columns of a tree's rows in one table. Optional columns,
+	// such as LeafData.LeafIndexKey, are left out so that the estimate works
+	// on databases without them.
+	estimateLeafDataBytesSQL = `SELECT COUNT(*),COALESCE(SUM(LENGTH(LeafIdentityHash)+LENGTH(LeafValue)+COALESCE(LENGTH(ExtraData),0)),0)
+		FROM LeafData WHERE TreeId = ?`
+	estimateSequencedLeafDataBytesSQL = `SELECT COUNT(*),COALESCE(SUM(LENGTH(LeafIdentityHash)+LENGTH(MerkleLeafHash)),0)
+		FROM SequencedLeafData WHERE TreeId = ?`
+	estimateUnsequencedBytesSQL = `SELECT COUNT(*),COALESCE(SUM(LENGTH(LeafIdentityHash)+LENGTH(MerkleLeafHash)+COALESCE(LENGTH(QueueID),0)),0)
+		FROM Unsequenced WHERE TreeId = ?`
+	estimateSubtreeBytesSQL = `SELECT COUNT(*),COALESCE(SUM(LENGTH(SubtreeId)+LENGTH(Nodes)),0)
+		FROM Subtree WHERE TreeId = ?`
+	estimateTreeHeadBytesSQL = `SELECT COUNT(*),COALESCE(SUM(LENGTH(RootHash)+LENGTH(RootSignature)),0)
+		FROM TreeHead WHERE TreeId = ?`
+
 	selectLatestSignedLogRootSQL = `SELECT TreeHeadTimestamp,TreeSize,RootHash,TreeRevision,RootSignature
 			FROM TreeHead WHERE TreeId=?
 			ORDER BY TreeHeadTimestamp DESC LIMIT 1`
 
+	selectSignedLogRootAtRevisionSQL = `SELECT TreeHeadTimestamp,TreeSize,RootHash,TreeRevision,RootSignature
+			FROM TreeHead WHERE TreeId=? AND TreeRevision=?`
+
+	selectTreeHeadRevisionsSQL = `SELECT TreeHeadTimestamp,TreeRevision
+			FROM TreeHead WHERE TreeId=?
+			ORDER BY TreeHeadTimestamp`
+
+	selectTreeHeadsFromRevisionSQL = `SELECT TreeSize,TreeHeadTimestamp,RootHash,RootSignature
+			FROM TreeHead WHERE TreeId=? AND TreeRevision>=?
+			ORDER BY TreeRevision`
+
 	selectLeavesByRangeSQL = `SELECT s.MerkleLeafHash,l.LeafIdentityHash,l.LeafValue,s.SequenceNumber,l.ExtraData,l.QueueTimestampNanos,s.IntegrateTimestampNanos
 			FROM LeafData l,SequencedLeafData s
-			WHERE l.LeafIdentityHash = s.LeafIdentityHash
+			WHERE l.LeafIdentityHash = s.LeafIdentityHash AND l.DedupNamespace = s.DedupNamespace
 			AND s.SequenceNumber >= ? AND s.SequenceNumber < ? AND l.TreeId = ? AND s.TreeId = l.TreeId` + orderBySequenceNumberSQL
 
+	selectLeavesIntegratedSinceSQL = `SELECT s.MerkleLeafHash,l.LeafIdentityHash,l.LeafValue,s.SequenceNumber,l.ExtraData,l.QueueTimestampNanos,s.IntegrateTimestampNanos
+			FROM LeafData l,SequencedLeafData s
+			WHERE l.LeafIdentityHash = s.LeafIdentityHash AND l.DedupNamespace = s.DedupNamespace
+			AND s.TreeId = ? AND l.TreeId = s.TreeId AND s.SequenceNumber < ?
+			AND (s.IntegrateTimestampNanos > ? OR (s.IntegrateTimestampNanos = ? AND s.SequenceNumber > ?))
+			ORDER BY s.IntegrateTimestampNanos,s.SequenceNumber LIMIT ?`
+
+	selectLeavesIntegratedAtSQL = `SELECT s.MerkleLeafHash,l.LeafIdentityHash,l.LeafValue,s.SequenceNumber,l.ExtraData,l.QueueTimestampNanos,s.IntegrateTimestampNanos
+			FROM LeafData l,SequencedLeafData s
+			WHERE l.LeafIdentityHash = s.LeafIdentityHash AND l.DedupNamespace = s.DedupNamespace
+			AND s.TreeId = ? AND l.TreeId = s.TreeId AND s.SequenceNumber < ?
+			AND s.IntegrateTimestampNanos = ? AND s.SequenceNumber > ?` + orderBySequenceNumberSQL
+
+	countLeavesInRangeSQL = `SELECT COUNT(*) FROM SequencedLeafData
+			WHERE TreeId = ? AND SequenceNumber >= ? AND SequenceNumber < ?`
+
+	// LeafData rows are required by a foreign key, but are joined anyway in
+	// case it was disabled while the rows were written.
+	countLeavesWithDataSQL = `SELECT COUNT(*)
+			FROM SequencedLeafData s JOIN LeafData l ON (l.TreeId = s.TreeId AND l.LeafIdentityHash = s.LeafIdentityHash AND l.DedupNamespace = s.DedupNamespace)
+			WHERE s.TreeId = ? AND s.SequenceNumber >= 0 AND s.SequenceNumber < ?`
+	selectLeafIndicesWithDataSQL = `SELECT s.SequenceNumber
+			FROM SequencedLeafData s JOIN LeafData l ON (l.TreeId = s.TreeId AND l.LeafIdentityHash = s.LeafIdentityHash AND l.DedupNamespace = s.DedupNamespace)
+			WHERE s.TreeId = ? AND s.SequenceNumber >= 0 AND s.SequenceNumber < ?
+			ORDER BY s.SequenceNumber`
+
+	selectExtraDataByIndexSQL = `SELECT l.ExtraData
+			FROM LeafData l,SequencedLeafData s
+			WHERE l.LeafIdentityHash = s.LeafIdentityHash AND l.DedupNamespace = s.DedupNamespace
+			AND s.TreeId = ? AND l.TreeId = s.TreeId AND s.SequenceNumber = ?`
+
+	selectIdentityHashesFromSQL = `SELECT SequenceNumber,LeafIdentityHash
+			FROM SequencedLeafData
+			WHERE TreeId = ? AND SequenceNumber >= ? AND SequenceNumber < ?
+			ORDER BY SequenceNumber`
+
+	// The latest revision of each subtree of a tree at or before a revision.
+	dumpSubtreesAtRevisionSQL = `SELECT s.SubtreeId,s.Nodes
+			FROM Subtree s
+			JOIN (SELECT SubtreeId,MAX(SubtreeRevision) AS MaxRevision
+				FROM Subtree WHERE TreeId = ? AND SubtreeRevision <= ?
+				GROUP BY SubtreeId) x
+			ON (s.SubtreeId = x.SubtreeId AND s.SubtreeRevision = x.MaxRevision)
+			WHERE s.TreeId = ?
+			ORDER BY s.SubtreeId`
+	dumpSubtreesNoRevSQL = `SELECT SubtreeId,Nodes FROM Subtree WHERE TreeId = ? AND SubtreeRevision = 0 ORDER BY SubtreeId`
+
+	// The first MerkleLeafHashes, in order, shared by sequenced leaves with
+	// different LeafIdentityHashes, with each of those identity hashes.
+	selectMerkleHashCollisionsSQL = `SELECT DISTINCT s.MerkleLeafHash,s.LeafIdentityHash
+			FROM SequencedLeafData s
+			JOIN (SELECT MerkleLeafHash FROM SequencedLeafData
+				WHERE TreeId = ?
+				GROUP BY MerkleLeafHash HAVING COUNT(DISTINCT LeafIdentityHash) > 1
+				ORDER BY MerkleLeafHash LIMIT ?) c
+			ON (s.MerkleLeafHash = c.MerkleLeafHash)
+			WHERE s.TreeId = ?
+			ORDER BY s.MerkleLeafHash,s.LeafIdentityHash`
+
+	selectLeafStatusSQL = `SELECT s.SequenceNumber,u.LeafIdentityHash IS NOT NULL
+			FROM LeafData l
+			LEFT JOIN SequencedLeafData s ON (s.TreeId = l.TreeId AND s.LeafIdentityHash = l.LeafIdentityHash AND s.DedupNamespace = l.DedupNamespace)
+			LEFT JOIN Unsequenced u ON (u.TreeId = l.TreeId AND u.Bucket = 0
+				AND u.QueueTimestampNanos = l.QueueTimestampNanos AND u.LeafIdentityHash = l.LeafIdentityHash
+				AND u.DedupNamespace = l.DedupNamespace)
+			WHERE l.TreeId = ? AND l.LeafIdentityHash = ?
+			ORDER BY s.SequenceNumber LIMIT 1`
+
+	selectLeafProvenanceSQL = `SELECT l.QueueTimestampNanos,s.SequenceNumber,s.IntegrateTimestampNanos
+			FROM LeafData l
+			LEFT JOIN SequencedLeafData s ON (s.TreeId = l.TreeId AND s.LeafIdentityHash = l.LeafIdentityHash AND s.DedupNamespace = l.DedupNamespace)
+			WHERE l.TreeId = ? AND l.LeafIdentityHash = ?
+			ORDER BY s.SequenceNumber LIMIT 1`
+
+	selectFirstCoveringTreeHeadSQL = `SELECT TreeHeadTimestamp,TreeSize,RootHash,TreeRevision,RootSignature
+			FROM TreeHead WHERE TreeId=? AND TreeSize>? AND TreeRevision<=?
+			ORDER BY TreeRevision LIMIT 1`
+
+	selectRootHashAtSizeSQL = `SELECT RootHash
+			FROM TreeHead WHERE TreeId=? AND TreeSize=? AND TreeRevision<=?
+			ORDER BY TreeRevision DESC LIMIT 1`
+
+	backfillIntegrateTimestampsSQL = `UPDATE SequencedLeafData SET IntegrateTimestampNanos=?
+			WHERE TreeId=? AND IntegrateTimestampNanos=0
+			ORDER BY SequenceNumber LIMIT ?`
+
+	selectLeavesByIndexKeySQL = `SELECT s.MerkleLeafHash,l.LeafIdentityHash,l.LeafValue,s.SequenceNumber,l.ExtraData,l.QueueTimestampNanos,s.IntegrateTimestampNanos
+			FROM LeafData l,SequencedLeafData s
+			WHERE l.LeafIdentityHash = s.LeafIdentityHash AND l.DedupNamespace = s.DedupNamespace
+			AND l.TreeId = ? AND l.LeafIndexKey = ? AND s.TreeId = l.TreeId
+			ORDER BY s.SequenceNumber`
+
+	selectOldestQueueTimestampSQL = "SELECT MIN(QueueTimestampNanos) FROM Unsequenced WHERE TreeId=?"
+
+	// selectOrphanedLeavesSQL is a locking read, so that it waits for
+	// sequencers which have dequeued the leaves but not committed yet, and
+	// then sees the rows they committed rather than those of its snapshot.
+	selectOrphanedLeavesSQL = `SELECT l.LeafIdentityHash,l.MerkleLeafHash,l.QueueTimestampNanos,l.DedupNamespace
+			FROM LeafData l
+			LEFT JOIN SequencedLeafData s ON (s.TreeId = l.TreeId AND s.LeafIdentityHash = l.LeafIdentityHash AND s.DedupNamespace = l.DedupNamespace)
+			LEFT JOIN Unsequenced u ON (u.TreeId = l.TreeId AND u.Bucket = 0
+				AND u.QueueTimestampNanos = l.QueueTimestampNanos AND u.LeafIdentityHash = l.LeafIdentityHash
+				AND u.DedupNamespace = l.DedupNamespace)
+			WHERE l.TreeId = ? AND l.QueueTimestampNanos < ?
+			AND s.LeafIdentityHash IS NULL AND u.LeafIdentityHash IS NULL
+			FOR UPDATE`
+
+	selectTreesWithQueuedLeavesSQL = `SELECT DISTINCT TreeId FROM Unsequenced
+			WHERE TreeId IN (` + placeholderSQL + `)
+			AND Bucket=0
+			AND QueueTimestampNanos<=?`
+	// selectTreesWithUnleasedLeavesSQL is selectTreesWithQueuedLeavesSQL for
+	// storage with HonorLeases set.
+	selectTreesWithUnleasedLeavesSQL = selectTreesWithQueuedLeavesSQL + `
+			AND LeasedUntilNanos<=?`
+	// selectPreorderedTreesWithWorkSQL selects the trees with a sequenced leaf
+	// at the index following their latest root, i.e. with leaves that
+	// DequeueLeaves would return.
+	selectPreorderedTreesWithWorkSQL = `SELECT h.TreeId FROM TreeHead h
+			JOIN SequencedLeafData s ON (s.TreeId = h.TreeId AND s.SequenceNumber = h.TreeSize)
+			WHERE h.TreeId IN (` + placeholderSQL + `)
+			AND h.TreeHeadTimestamp = (SELECT MAX(TreeHeadTimestamp) FROM TreeHead WHERE TreeId = h.TreeId)`
+
 	// These statements need to be expanded to provide the correct number of parameter placeholders.
 	selectLeavesByMerkleHashSQL = `SELECT s.MerkleLeafHash,l.LeafIdentityHash,l.LeafValue,s.SequenceNumber,l.ExtraData,l.QueueTimestampNanos,s.IntegrateTimestampNanos
 			FROM LeafData l,SequencedLeafData s
-			WHERE l.LeafIdentityHash = s.LeafIdentityHash
+			WHERE l.LeafIdentityHash = s.LeafIdentityHash AND l.DedupNamespace = s.DedupNamespace
 			AND s.MerkleLeafHash IN (` + placeholderSQL + `) AND l.TreeId = ? AND s.TreeId = l.TreeId`
-	// TODO(#1548): rework the code so the dummy hash isn't needed (e.g. this assumes hash size is 32)
-	dummyMerkleLeafHash = "00000000000000000000000000000000"
-	// This statement returns a dummy Merkle leaf hash value (which must be
-	// of the right size) so that its signature matches that of the other
-	// leaf-selection statements.
-	selectLeavesByLeafIdentityHashSQL = `SELECT '` + dummyMerkleLeafHash + `',l.LeafIdentityHash,l.LeafValue,-1,l.ExtraData,l.QueueTimestampNanos,s.IntegrateTimestampNanos
-			FROM LeafData l LEFT JOIN SequencedLeafData s ON (l.LeafIdentityHash = s.LeafIdentityHash AND l.TreeID = s.TreeID)
-			WHERE l.LeafIdentityHash IN (` + placeholderSQL + `) AND l.TreeId = ?`
+	selectLeafDataByIdentityHashSQL = `SELECT LeafIdentityHash,LeafValue,ExtraData,QueueTimestampNanos
+			FROM LeafData
+			WHERE LeafIdentityHash IN (` + placeholderSQL + `) AND TreeId = ? AND DedupNamespace = ?`
+
+	// Unsequenced leaves have a NULL SequenceNumber, so sort first in their
+	// tree, and sequenced ones are ordered by position.
+	selectLeafByIdentityHashAcrossTreesSQL = `SELECT l.TreeId,s.MerkleLeafHash,l.LeafValue,s.SequenceNumber,l.ExtraData,l.QueueTimestampNanos,s.IntegrateTimestampNanos
+			FROM LeafData l LEFT JOIN SequencedLeafData s ON (l.LeafIdentityHash = s.LeafIdentityHash AND l.TreeId = s.TreeId AND l.DedupNamespace = s.DedupNamespace)
+			WHERE l.LeafIdentityHash = ? AND l.TreeId IN (` + placeholderSQL + `)
+			ORDER BY l.TreeId,s.SequenceNumber`
+
+	selectSequenceNumbersByIdentityHashSQL = `SELECT LeafIdentityHash,MerkleLeafHash,SequenceNumber,IntegrateTimestampNanos
+			FROM SequencedLeafData
+			WHERE TreeId = ? AND DedupNamespace = ? AND LeafIdentityHash IN (` + placeholderSQL + `)
+			ORDER BY SequenceNumber`
 
 	// Same as above except with leaves ordered by sequence so we only incur this cost when necessary
 	orderBySequenceNumberSQL                     = " ORDER BY s.SequenceNumber"
 	selectLeavesByMerkleHashOrderedBySequenceSQL = selectLeavesByMerkleHashSQL + orderBySequenceNumberSQL
-
-	logIDLabel = "logid"
+	// Sequence numbers are unique within a tree, so pages are deterministic.
+	selectLeavesByMerkleHashPageSQL = selectLeavesByMerkleHashOrderedBySequenceSQL + " LIMIT ? OFFSET ?"
+
+	logIDLabel   = "logid"
+	txOpLabel    = "op"
+	dupTypeLabel = "type"
+
+	// Values of dupTypeLabel. Duplicates of an earlier leaf in the same
+	// QueueLeaves batch are intraBatchDup, and duplicates of leaves already in
+	// storage are existingDup.
+	intraBatchDup = "intra_batch"
+	existingDup   = "existing"
+
+	// maxIndexKeyLen is the size of the LeafData.LeafIndexKey column.
+	maxIndexKeyLen = 255
+	// maxDedupNamespaceLen is the size of the DedupNamespace columns.
+	maxDedupNamespaceLen = 255
+
+	// maxMissingIndices is the number of missing leaf indices reported by
+	// CanAdvanceToSize.
+	maxMissingIndices = 10
+
+	// DefaultMaxHashesPerQuery is the default limit on the number of hashes
+	// looked up by a single GetLeavesByHash statement.
+	DefaultMaxHashesPerQuery = 1000
+	// DefaultStreamLeavesPageSize is the default number of leaves read by
+	// each statement of StreamAllLeaves.
+	DefaultStreamLeavesPageSize = 1000
+	// MinStatementPlaceholders is the smallest MaxStatementPlaceholders
+	// allowed, which is the number of placeholders needed to store a subtree.
+	MinStatementPlaceholders = 4
 )
 
 var (
@@ -95,11 +310,14 @@ var (
 	dequeueLatency          monitoring.Histogram
 	dequeueSelectLatency    monitoring.Histogram
 	dequeueRemoveLatency    monitoring.Histogram
+	txDuration              monitoring.Histogram
+
+	stmtPlaceholdersGauge monitoring.Gauge
 )
 
 func createMetrics(mf monitoring.MetricFactory) {
 	queuedCounter = mf.NewCounter("mysql_queued_leaves", "Number of leaves queued", logIDLabel)
-	queuedDupCounter = mf.NewCounter("mysql_queued_dup_leaves", "Number of duplicate leaves queued", logIDLabel)
+	queuedDupCounter = mf.NewCounter("mysql_queued_dup_leaves", "Number of duplicate leaves queued, by whether the duplicate was within the batch or of a stored leaf", logIDLabel, dupTypeLabel)
 	dequeuedCounter = mf.NewCounter("mysql_dequeued_leaves", "Number of leaves dequeued", logIDLabel)
 
 	queueLatency = mf.NewHistogram("mysql_queue_leaves_latency", "Latency of queue leaves operation in seconds", logIDLabel)
@@ -111,6 +329,10 @@ func createMetrics(mf monitoring.MetricFactory) {
 	dequeueLatency = mf.NewHistogram("mysql_dequeue_leaves_latency", "Latency of dequeue leaves operation in seconds", logIDLabel)
 	dequeueSelectLatency = mf.NewHistogram("mysql_dequeue_leaves_latency_select", "Latency of selection part of dequeue leaves operation in seconds", logIDLabel)
 	dequeueRemoveLatency = mf.NewHistogram("mysql_dequeue_leaves_latency_remove", "Latency of removal part of dequeue leaves operation in seconds", logIDLabel)
+
+	txDuration = mf.NewHistogram("mysql_tx_duration", "Wall time of read-write log transactions in seconds, from begin to commit or rollback", logIDLabel, txOpLabel)
+
+	stmtPlaceholdersGauge = mf.NewGauge("mysql_statement_placeholders_max", "Largest number of placeholders a prepared statement has been expanded to")
 }
 
 func labelForTX(t *logTreeTX) string {
@@ -121,22 +343,171 @@ func observe(hist monitoring.Histogram, duration time.Duration, label string) {
 	hist.Observe(duration.Seconds(), label)
 }
 
+// LogStorageOptions are tuning options for the MySQL log storage. The zero
+// value gives the defaults used by NewLogStorage.
+type LogStorageOptions struct {
+	// MetricFactory is used to create the storage metrics. If nil, metrics
+	// are not exported.
+	MetricFactory monitoring.MetricFactory
+	// ReadOnlyIsolation is the isolation level of SnapshotForTree
+	// transactions. The default, sql.LevelDefault, uses the server setting.
+	ReadOnlyIsolation sql.IsolationLevel
+	// ReadWriteIsolation is the isolation level of all other transactions.
+	// sql.LevelDefault is treated as sql.LevelRepeatableRead.
+	ReadWriteIsolation sql.IsolationLevel
+	// MaxHashesPerQuery is the maximum number of hashes looked up by a single
+	// statement. Larger lookups are split into several statements. If not
+	// positive, DefaultMaxHashesPerQuery is used.
+	MaxHashesPerQuery int
+	// SlowTxThreshold is the duration above which read-write transactions
+	// are logged as slow. If zero, slow transactions are not logged.
+	SlowTxThreshold time.Duration
+	// ReadWriteTxBudget, if positive, is the default budget of
+	// ReadWriteTransaction; see ReadWriteTransactionWithBudget.
+	ReadWriteTxBudget time.Duration
+	// DeadlockRetries is the number of times ReadWriteTransaction reruns a
+	// transaction which failed because of a deadlock, after a jittered
+	// backoff, before returning the error. The transaction function must be
+	// safe to run again. The retries count against the transaction's budget.
+	// If zero, deadlocks aren't retried.
+	DeadlockRetries int
+	// VerifyMerkleLeafHash makes QueueLeaves reject leaves of LOG trees whose
+	// MerkleLeafHash isn't the RFC 6962 hash of their LeafValue.
+	VerifyMerkleLeafHash bool
+	// SkipReadHashValidation disables checking the length of the Merkle leaf
+	// hashes of leaves read from the database. This saves work on trusted,
+	// high-throughput read paths, at the cost of not detecting corrupt rows.
+	// Hashes passed in by callers are still checked.
+	SkipReadHashValidation bool
+	// EnforceMonotonicRoots makes StoreSignedLogRoot reject roots whose
+	// TreeSize is smaller, or whose TimestampNanos is not larger, than those
+	// of the latest stored root.
+	EnforceMonotonicRoots bool
+	// MaxSequencedLeafIndex, if positive, is the exclusive upper bound on the
+	// LeafIndex of leaves added by AddSequencedLeaves.
+	MaxSequencedLeafIndex int64
+	// RejectFutureDequeueCutoff makes DequeueLeaves return InvalidArgument for
+	// a cutoff time in the future. By default such cutoffs are clamped to the
+	// current time, so that leaves are never dequeued early.
+	RejectFutureDequeueCutoff bool
+	// IntegrateImmediately makes AddSequencedLeaves for PREORDERED_LOG trees
+	// also integrate the added leaves into the Merkle tree and store a new
+	// root, in the same transaction, so that they can be read back at once
+	// without waiting for the sequencer. If integration fails, e.g. because
+	// the new root wouldn't be newer than the latest one, it's skipped and the
+	// leaves are still added, for the sequencer to integrate.
+	IntegrateImmediately bool
+	// NormalizeEmptyExtraData makes QueueLeaves and AddSequencedLeaves store
+	// an empty ExtraData for leaves without any, rather than storing nil
+	// ExtraData as NULL and empty ExtraData as empty bytes.
+	NormalizeEmptyExtraData bool
+	// TimestampResolution, if greater than a nanosecond, is the resolution
+	// to which queue and integration timestamps are truncated before being
+	// stored, e.g. time.Microsecond for readers which can't handle
+	// nanoseconds. By default timestamps are stored with full precision.
+	TimestampResolution time.Duration
+	// AddSequencedBatchSize, if positive, makes AddSequencedLeaves
+	// commit each batch of this many leaves in its own transaction, so that
+	// large imports don't hold locks for long. Larger calls are then not
+	// atomic, see AddSequencedLeaves.
+	AddSequencedBatchSize int
+	// ServerIntegrateTimestamp makes UpdateSequencedLeaves and
+	// AddSequencedLeaves store the database's current time, with microsecond
+	// precision, as the IntegrateTimestamp of leaves, rather than the time
+	// supplied by the caller. This avoids clock skew between sequencers.
+	ServerIntegrateTimestamp bool
+	// MaxStatementPlaceholders, if positive, caps the number of placeholders
+	// that statements with a variable number of them, such as lookups by hash,
+	// may be built with. Each hash looked up takes one placeholder, and each
+	// subtree stored takes four. Larger requests fail with InvalidArgument
+	// before the statement is built, except for statements made by storage
+	// itself, such as reading and storing subtrees or removing sequenced
+	// leaves from the queue, which are split into statements within the cap.
+	// Caps below MinStatementPlaceholders are raised to it.
+	MaxStatementPlaceholders int
+	// PhasedQueueInserts makes QueueLeaves insert the LeafData rows of all
+	// leaves in a batch before any of their Unsequenced rows, rather than
+	// inserting both rows for each leaf in turn. Both phases insert in
+	// LeafIdentityHash order, so concurrent batches lock each table's rows
+	// in the same order.
+	PhasedQueueInserts bool
+	// SkipDequeueTracking saves the memory used to remember the leaves
+	// dequeued by a transaction, for callers which dequeue at most once per
+	// transaction, like the sequencer. Repeated DequeueLeaves calls in a
+	// transaction may then return the same leaves again, and
+	// UpdateSequencedLeaves finds the queue entries of leaves from their
+	// QueueTimestamp and LeafIdentityHash, which must be as dequeued, in the
+	// default deduplication namespace. It mustn't be set by any server of a
+	// tree with leaves queued by QueueLeavesInNamespace.
+	SkipDequeueTracking bool
+	// StreamLeavesPageSize is the number of leaves read by each statement of
+	// StreamAllLeaves. If not positive, DefaultStreamLeavesPageSize is used.
+	StreamLeavesPageSize int
+	// LeafCrypter encrypts and decrypts the LeafValue of leaves of trees
+	// with the EncryptLeafValue storage option. If nil, leaves of such trees
+	// can't be written or read.
+	LeafCrypter LeafCrypter
+	// AllowTimestampBackfill enables BackfillIntegrateTimestamps, which
+	// rewrites stored leaves and so is refused unless opted into.
+	AllowTimestampBackfill bool
+	// Replicas are connections to read replicas of the database, by name,
+	// which LatestSignedLogRootFrom can read from.
+	Replicas map[string]*sql.DB
+	// RecordMerkleLeafHash makes QueueLeaves and AddSequencedLeaves also
+	// store the MerkleLeafHash of leaves in LeafData, so that
+	// RequeueOrphanedDequeued can requeue them if their queue entry is lost.
+	// It requires the MerkleLeafHash column of LeafData.
+	RecordMerkleLeafHash bool
+	// DuplicatePositionDetails makes QueueLeaves and QueueLeavesInNamespace
+	// attach a detail describing the existing leaf to the AlreadyExists
+	// status of each duplicate, as QueueLeavesWithPositions always does. It
+	// costs one more statement for each batch with duplicates, to look up
+	// their positions.
+	DuplicatePositionDetails bool
+	// HonorLeases makes DequeueLeaves and DequeueLeavesMulti skip leaves
+	// leased by DequeueLeavesLease until their lease expires. It requires the
+	// LeasedUntilNanos and LeaseID columns of Unsequenced, which are otherwise
+	// only needed by the lease methods.
+	HonorLeases bool
+}
+
 type mySQLLogStorage struct {
 	*mySQLTreeStorage
-	admin         storage.AdminStorage
-	metricFactory monitoring.MetricFactory
+	admin storage.AdminStorage
+	opts  LogStorageOptions
 }
 
 // NewLogStorage creates a storage.LogStorage instance for the specified MySQL URL.
 // It assumes storage.AdminStorage is backed by the same MySQL database as well.
 func NewLogStorage(db *sql.DB, mf monitoring.MetricFactory) storage.LogStorage {
-	if mf == nil {
-		mf = monitoring.InertMetricFactory{}
+	return NewLogStorageWithOptions(db, LogStorageOptions{MetricFactory: mf})
+}
+
+// NewLogStorageWithOptions is like NewLogStorage, but allows the storage to be
+// tuned with opts.
+func NewLogStorageWithOptions(db *sql.DB, opts LogStorageOptions) storage.LogStorage {
+	if opts.MetricFactory == nil {
+		opts.MetricFactory = monitoring.InertMetricFactory{}
+	}
+	if opts.ReadWriteIsolation == sql.LevelDefault {
+		opts.ReadWriteIsolation = sql.LevelRepeatableRead
+	}
+	if opts.MaxHashesPerQuery <= 0 {
+		opts.MaxHashesPerQuery = DefaultMaxHashesPerQuery
 	}
+	if opts.StreamLeavesPageSize <= 0 {
+		opts.StreamLeavesPageSize = DefaultStreamLeavesPageSize
+	}
+	if opts.MaxStatementPlaceholders > 0 && opts.MaxStatementPlaceholders < MinStatementPlaceholders {
+		opts.MaxStatementPlaceholders = MinStatementPlaceholders
+	}
+	once.Do(func() {
+		createMetrics(opts.MetricFactory)
+	})
 	return &mySQLLogStorage{
 		admin:            NewAdminStorage(db),
-		mySQLTreeStorage: newTreeStorage(db),
-		metricFactory:    mf,
+		mySQLTreeStorage: newTreeStorage(db, opts.MaxStatementPlaceholders),
+		opts:             opts,
 	}
 }
 
@@ -144,6 +515,71 @@ func (m *mySQLLogStorage) CheckDatabaseAccessible(ctx context.Context) error {
 	return m.db.PingContext(ctx)
 }
 
+// LatestSignedLogRootFrom returns the latest log root of tree as read from the
+// named replica in Replicas, rather than from the primary database. Comparing
+// the roots read from each replica detects replicas which have diverged.
+func (m *mySQLLogStorage) LatestSignedLogRootFrom(ctx context.Context, tree *trillian.Tree, replicaName string) (*trillian.SignedLogRoot, error) {
+	db, ok := m.opts.Replicas[replicaName]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown replica %q", replicaName)
+	}
+	slr, _, _, err := scanSignedLogRoot(db.QueryRowContext(ctx, selectLatestSignedLogRootSQL, tree.TreeId))
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrTreeNeedsInit
+	} else if err != nil {
+		klog.Warningf("%sFailed to read root from replica %q: %s", requestIDPrefix(ctx), replicaName, err)
+		return nil, mysqlToGRPC(err)
+	}
+	return slr, nil
+}
+
+// RecomputeAndStoreRoot rebuilds tree's Merkle tree from its sequenced leaves
+// and stores a root covering them, for operators to repair the tree after
+// backfilling leaves by hand. The tree mustn't be ACTIVE, so that the
+// sequencer can't store roots concurrently. It returns the stored root.
+func (m *mySQLLogStorage) RecomputeAndStoreRoot(ctx context.Context, tree *trillian.Tree) (*types.LogRootV1, error) {
+	// Check the stored state, in case tree is out of date.
+	current, err := storage.GetTree(ctx, m.admin, tree.TreeId)
+	if err != nil {
+		return nil, err
+	}
+	if current.TreeState == trillian.TreeState_ACTIVE {
+		return nil, status.Errorf(codes.FailedPrecondition, "tree %d is ACTIVE, freeze it first", tree.TreeId)
+	}
+	var root *types.LogRootV1
+	err = m.ReadWriteTransaction(ctx, current, func(ctx context.Context, tx storage.LogTreeTX) error {
+		var err error
+		root, err = tx.(*logTreeTX).recomputeAndStoreRoot(ctx, time.Now())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// livenessTimeout bounds the query made by Ping.
+const livenessTimeout = 500 * time.Millisecond
+
+// Ping is a cheap liveness check, suitable for frequent probes. Unlike Ready,
+// it doesn't try to connect to the database, but fails unless the pool
+// already has an open connection, which it runs a trivial query on.
+func (m *mySQLLogStorage) Ping(ctx context.Context) error {
+	if m.db.Stats().OpenConnections == 0 {
+		return status.Error(codes.Unavailable, "no open database connections")
+	}
+	ctx, cancel := context.WithTimeout(ctx, livenessTimeout)
+	defer cancel()
+	var one int
+	return m.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+// Ready is a full readiness check, which connects to the database if needed.
+// It's the same as CheckDatabaseAccessible.
+func (m *mySQLLogStorage) Ready(ctx context.Context) error {
+	return m.CheckDatabaseAccessible(ctx)
+}
+
 func (m *mySQLLogStorage) getLeavesByMerkleHashStmt(ctx context.Context, num int, orderBySequence bool) (*sql.Stmt, error) {
 	if orderBySequence {
 		return m.getStmt(ctx, selectLeavesByMerkleHashOrderedBySequenceSQL, num, "?", "?")
@@ -152,17 +588,59 @@ func (m *mySQLLogStorage) getLeavesByMerkleHashStmt(ctx context.Context, num int
 	return m.getStmt(ctx, selectLeavesByMerkleHashSQL, num, "?", "?")
 }
 
-func (m *mySQLLogStorage) getLeavesByLeafIdentityHashStmt(ctx context.Context, num int) (*sql.Stmt, error) {
-	return m.getStmt(ctx, selectLeavesByLeafIdentityHashSQL, num, "?", "?")
+func (m *mySQLLogStorage) getLeavesByMerkleHashPageStmt(ctx context.Context, num int) (*sql.Stmt, error) {
+	return m.getStmt(ctx, selectLeavesByMerkleHashPageSQL, num, "?", "?")
+}
+
+func (m *mySQLLogStorage) getLeafDataByIdentityHashStmt(ctx context.Context, num int) (*sql.Stmt, error) {
+	return m.getStmt(ctx, selectLeafDataByIdentityHashSQL, num, "?", "?")
 }
 
 func (m *mySQLLogStorage) GetActiveLogIDs(ctx context.Context) ([]int64, error) {
 	// Include logs that are DRAINING in the active list as we're still
 	// integrating leaves into them.
-	rows, err := m.db.QueryContext(
-		ctx, selectNonDeletedTreeIDByTypeAndStateSQL,
-		trillian.TreeType_LOG.String(), trillian.TreeType_PREORDERED_LOG.String(),
-		trillian.TreeState_ACTIVE.String(), trillian.TreeState_DRAINING.String())
+	return m.GetActiveLogIDsByState(ctx, trillian.TreeState_ACTIVE, trillian.TreeState_DRAINING)
+}
+
+// GetActiveLogIDsByState returns the IDs of all non-deleted log trees that
+// are in one of the given states.
+func (m *mySQLLogStorage) GetActiveLogIDsByState(ctx context.Context, states ...trillian.TreeState) ([]int64, error) {
+	if len(states) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no tree states given")
+	}
+	args := []interface{}{trillian.TreeType_LOG.String(), trillian.TreeType_PREORDERED_LOG.String()}
+	for _, state := range states {
+		args = append(args, state.String())
+	}
+	stmt, err := m.getStmt(ctx, selectNonDeletedTreeIDByTypeAndStateSQL, len(states), "?", "?")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+	ids := []int64{}
+	for rows.Next() {
+		var treeID int64
+		if err := rows.Scan(&treeID); err != nil {
+			return nil, err
+		}
+		ids = append(ids, treeID)
+	}
+	return ids, rows.Err()
+}
+
+// ListStorageTreeIDs returns, in ascending order, the distinct IDs of trees
+// with rows in any of the Trees, LeafData, SequencedLeafData and Unsequenced
+// tables. IDs missing from ListTrees belong to orphaned data.
+func (m *mySQLLogStorage) ListStorageTreeIDs(ctx context.Context) ([]int64, error) {
+	rows, err := m.db.QueryContext(ctx, selectStorageTreeIDsSQL)
 	if err != nil {
 		return nil, err
 	}
@@ -182,16 +660,337 @@ func (m *mySQLLogStorage) GetActiveLogIDs(ctx context.Context) ([]int64, error)
 	return ids, rows.Err()
 }
 
-func (m *mySQLLogStorage) beginInternal(ctx context.Context, tree *trillian.Tree) (*logTreeTX, error) {
+// estimatedRowOverheadBytes approximates the per-row cost of fixed-width
+// columns, row headers and index entries, which EstimateTreeStorageBytes adds
+// to the length of each row's variable-length columns.
+const estimatedRowOverheadBytes = 64
+
+// EstimateTreeStorageBytes returns an estimate of the number of bytes used by
+// the given tree's leaves, queued leaves, subtrees and tree heads. It's the
+// total length of each row's variable-length columns, plus
+// estimatedRowOverheadBytes per row, and so ignores storage engine details
+// such as page fill, compression and secondary index sizes. It's intended for
+// capacity planning, not exact accounting.
+//
+// Each table is read by a single aggregate query, outside of any transaction,
+// so the estimate isn't a consistent snapshot of a tree that's being written.
+func (m *mySQLLogStorage) EstimateTreeStorageBytes(ctx context.Context, treeID int64) (int64, error) {
+	var total int64
+	for _, query := range []string{
+		estimateLeafDataBytesSQL,
+		estimateSequencedLeafDataBytesSQL,
+		estimateUnsequencedBytesSQL,
+		estimateSubtreeBytesSQL,
+		estimateTreeHeadBytesSQL,
+	} {
+		var rows, bytes int64
+		if err := m.db.QueryRowContext(ctx, query, treeID).Scan(&rows, &bytes); err != nil {
+			klog.Warningf("%sFailed to estimate tree storage: %s", requestIDPrefix(ctx), err)
+			return 0, err
+		}
+		total += bytes + rows*estimatedRowOverheadBytes
+	}
+	return total, nil
+}
+
+// BackfillIntegrateTimestamps sets the IntegrateTimestampNanos of the given
+// tree's sequenced leaves which have none, i.e. zero, to value, e.g. the
+// timestamp of the tree's first root. Leaves are updated batchSize at a time,
+// in SequenceNumber order, and each batch is committed on its own, so that no
+// transaction holds the locks of the whole tree. If a batch fails, the earlier
+// ones stay committed, and calling this again resumes where it stopped. It
+// returns the number of leaves updated. This repairs leaves added by
+// AddSequencedLeaves without ServerIntegrateTimestamp, and fails with
+// FailedPrecondition unless AllowTimestampBackfill is set.
+func (m *mySQLLogStorage) BackfillIntegrateTimestamps(ctx context.Context, treeID, value int64, batchSize int) (int64, error) {
+	if !m.opts.AllowTimestampBackfill {
+		return 0, status.Error(codes.FailedPrecondition, "integrate timestamp backfill is disabled, see AllowTimestampBackfill")
+	}
+	if value <= 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid value %d, want > 0", value)
+	}
+	if batchSize <= 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid batch size %d, want > 0", batchSize)
+	}
+
+	klog.Warningf("%sBackfilling zero IntegrateTimestampNanos of tree %d with %d", requestIDPrefix(ctx), treeID, value)
+	var total int64
+	for {
+		// Outside of a transaction, each batch is committed by itself.
+		res, err := m.db.ExecContext(ctx, backfillIntegrateTimestampsSQL, value, treeID, batchSize)
+		if err != nil {
+			klog.Warningf("%sFailed to backfill integrate timestamps of tree %d after %d leaves: %s", requestIDPrefix(ctx), treeID, total, err)
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		klog.V(1).Infof("%sBackfilled integrate timestamps of %d leaves of tree %d, %d so far", requestIDPrefix(ctx), n, treeID, total)
+		if n < int64(batchSize) {
+			break
+		}
+	}
+	klog.Warningf("%sBackfilled integrate timestamps of %d leaves of tree %d", requestIDPrefix(ctx), total, treeID)
+	return total, nil
+}
+
+// DequeueLeavesMulti dequeues up to perTreeLimit leaves from each of the
+// given trees, for a sequencer shared by many trees with mostly empty queues.
+// The trees with work are found with a single statement per chunk of trees,
+// so that trees without work don't need a transaction: LOG trees with leaves
+// queued before cutoff, which aren't leased if HonorLeases is set, and
+// PREORDERED_LOG trees with a sequenced leaf following their latest root. For
+// each of those a read-write transaction is started and DequeueLeaves called
+// in it; if that returns any leaves, f is called with them and the
+// transaction, which is committed if f returns nil. The leaves are tracked as
+// dequeued by the transaction, so f can pass them to UpdateSequencedLeaves.
+//
+// The leaves passed to f are returned, by tree ID. A tree which fails doesn't
+// stop the others from being processed: the errors of all failed trees are
+// returned together, along with the leaves of the trees which succeeded.
+func (m *mySQLLogStorage) DequeueLeavesMulti(ctx context.Context, trees []*trillian.Tree, perTreeLimit int, cutoff time.Time, f func(context.Context, *trillian.Tree, storage.LogTreeTX, []*trillian.LogLeaf) error) (map[int64][]*trillian.LogLeaf, error) {
+	if perTreeLimit <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid perTreeLimit %d, want > 0", perTreeLimit)
+	}
+	cutoff, err := m.dequeueCutoff(cutoff, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var logIDs, preorderedIDs []int64
+	seen := make(map[int64]bool)
+	for _, tree := range trees {
+		if !seen[tree.TreeId] {
+			switch tree.TreeType {
+			case trillian.TreeType_LOG:
+				logIDs = append(logIDs, tree.TreeId)
+			case trillian.TreeType_PREORDERED_LOG:
+				preorderedIDs = append(preorderedIDs, tree.TreeId)
+			}
+		}
+		seen[tree.TreeId] = true
+	}
+	queued, err := m.getTreesWithQueuedLeaves(ctx, logIDs, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := m.selectTreeIDs(ctx, selectPreorderedTreesWithWorkSQL, preorderedIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[int64][]*trillian.LogLeaf)
+	done := make(map[int64]bool)
+	var errs []error
+	for _, tree := range trees {
+		if done[tree.TreeId] || !(queued[tree.TreeId] || pending[tree.TreeId]) {
+			continue
+		}
+		done[tree.TreeId] = true
+		if err := m.ReadWriteTransaction(ctx, tree, func(ctx context.Context, tx storage.LogTreeTX) error {
+			leaves, err := tx.DequeueLeaves(ctx, perTreeLimit, cutoff)
+			if err != nil || len(leaves) == 0 {
+				return err
+			}
+			if err := f(ctx, tree, tx, leaves); err != nil {
+				return err
+			}
+			ret[tree.TreeId] = leaves
+			return nil
+		}); err != nil {
+			klog.Warningf("%sFailed to dequeue leaves of tree %d: %s", requestIDPrefix(ctx), tree.TreeId, err)
+			delete(ret, tree.TreeId)
+			errs = append(errs, fmt.Errorf("tree %d: %w", tree.TreeId, err))
+		}
+	}
+	return ret, errors.Join(errs...)
+}
+
+// getTreesWithQueuedLeaves returns the set of the given trees which have
+// leaves queued before cutoff, which aren't leased if HonorLeases is set.
+func (m *mySQLLogStorage) getTreesWithQueuedLeaves(ctx context.Context, treeIDs []int64, cutoff time.Time) (map[int64]bool, error) {
+	if m.opts.HonorLeases {
+		return m.selectTreeIDs(ctx, selectTreesWithUnleasedLeavesSQL, treeIDs, cutoff.UnixNano(), time.Now().UnixNano())
+	}
+	return m.selectTreeIDs(ctx, selectTreesWithQueuedLeavesSQL, treeIDs, cutoff.UnixNano())
+}
+
+// selectTreeIDs runs query, which selects tree IDs, over chunks of treeIDs
+// followed by extraArgs, and returns the set of selected trees.
+func (m *mySQLLogStorage) selectTreeIDs(ctx context.Context, query string, treeIDs []int64, extraArgs ...interface{}) (map[int64]bool, error) {
+	ret := make(map[int64]bool)
+	chunkSize := m.chunkSize(m.opts.MaxHashesPerQuery, "?", "?")
+	for start := 0; start < len(treeIDs); start += chunkSize {
+		chunk := treeIDs[start:min(start+chunkSize, len(treeIDs))]
+		stmt, err := m.getStmt(ctx, query, len(chunk), "?", "?")
+		if err != nil {
+			return nil, err
+		}
+		args := make([]interface{}, 0, len(chunk)+len(extraArgs))
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+		args = append(args, extraArgs...)
+		if err := func() error {
+			rows, err := stmt.QueryContext(ctx, args...)
+			if err != nil {
+				klog.Warningf("%sFailed to select trees with work: %s", requestIDPrefix(ctx), err)
+				return err
+			}
+			defer func() {
+				if err := rows.Close(); err != nil {
+					klog.Errorf("rows.Close(): %v", err)
+				}
+			}()
+			for rows.Next() {
+				var treeID int64
+				if err := rows.Scan(&treeID); err != nil {
+					return err
+				}
+				ret[treeID] = true
+			}
+			return rows.Err()
+		}(); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// dequeueCutoff returns the cutoff time to dequeue leaves with, given the one
+// requested at now. Future cutoffs are clamped to now, or rejected with
+// InvalidArgument if RejectFutureDequeueCutoff is set.
+func (m *mySQLLogStorage) dequeueCutoff(cutoff, now time.Time) (time.Time, error) {
+	if !cutoff.After(now) {
+		return cutoff, nil
+	}
+	if m.opts.RejectFutureDequeueCutoff {
+		return time.Time{}, status.Errorf(codes.InvalidArgument, "dequeue cutoff %v is in the future", cutoff)
+	}
+	return now, nil
+}
+
+// GetLeavesByIdentityHashAcrossTrees looks up the leaf with the given
+// identity hash in each of the given trees, in a single statement. The result
+// maps the IDs of the trees holding the leaf to it; other trees are absent.
+//
+// Leaves which haven't been sequenced have a LeafIndex of -1 and no
+// MerkleLeafHash or IntegrateTimestamp. If a PREORDERED_LOG tree holds the
+// leaf at several indices, the lowest is returned. The lookup isn't part of
+// any transaction, so the leaves may be newer than a tree's latest root.
+// LeafValue and ExtraData are decoded according to the storage settings of
+// each tree holding the leaf.
+func (m *mySQLLogStorage) GetLeavesByIdentityHashAcrossTrees(ctx context.Context, hash []byte, treeIDs []int64) (map[int64]*trillian.LogLeaf, error) {
+	if len(hash) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "empty identity hash")
+	}
+	ret := make(map[int64]*trillian.LogLeaf)
+	args := make([]interface{}, 0, len(treeIDs)+1)
+	args = append(args, hash)
+	seen := make(map[int64]bool)
+	for _, id := range treeIDs {
+		if !seen[id] {
+			seen[id] = true
+			args = append(args, id)
+		}
+	}
+	if len(seen) == 0 {
+		return ret, nil
+	}
+
+	stmt, err := m.getStmt(ctx, selectLeafByIdentityHashAcrossTreesSQL, len(seen), "?", "?")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		klog.Warningf("%sFailed to select leaf across %d trees: %s", requestIDPrefix(ctx), len(seen), err)
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+
+	for rows.Next() {
+		var treeID, queueTS int64
+		var seq, integrateTS sql.NullInt64
+		leaf := &trillian.LogLeaf{LeafIdentityHash: hash, LeafIndex: -1}
+		if err := rows.Scan(&treeID, &leaf.MerkleLeafHash, &leaf.LeafValue, &seq, &leaf.ExtraData, &queueTS, &integrateTS); err != nil {
+			klog.Warningf("%sError scanning leaf across trees: %s", requestIDPrefix(ctx), err)
+			return nil, err
+		}
+		if _, ok := ret[treeID]; ok {
+			continue
+		}
+		leaf.QueueTimestamp = timestamppb.New(time.Unix(0, queueTS))
+		if err := leaf.QueueTimestamp.CheckValid(); err != nil {
+			return nil, fmt.Errorf("got invalid queue timestamp: %w", err)
+		}
+		if seq.Valid {
+			leaf.LeafIndex = seq.Int64
+			leaf.IntegrateTimestamp = timestamppb.New(time.Unix(0, integrateTS.Int64))
+			if err := leaf.IntegrateTimestamp.CheckValid(); err != nil {
+				return nil, fmt.Errorf("got invalid integrate timestamp: %w", err)
+			}
+		}
+		ret[treeID] = leaf
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for treeID, leaf := range ret {
+		if err := m.decodeLeafOfTree(ctx, treeID, leaf); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// decodeLeafOfTree replaces the stored forms of leaf's LeafValue and
+// ExtraData, as read outside of a transaction, with the values they encode
+// according to the storage settings of the tree with ID treeID.
+func (m *mySQLLogStorage) decodeLeafOfTree(ctx context.Context, treeID int64, leaf *trillian.LogLeaf) error {
+	tree, err := storage.GetTree(ctx, m.admin, treeID)
+	if err != nil {
+		return fmt.Errorf("failed to get tree %d: %w", treeID, err)
+	}
+	o, err := storageOptions(tree)
+	if err != nil {
+		return err
+	}
+	// Only the codec fields of the treeTX are used to decode.
+	codec := &treeTX{
+		treeID:           treeID,
+		compressLeafData: o.CompressLeafData,
+		encryptLeafValue: o.EncryptLeafValue,
+		leafCrypter:      m.opts.LeafCrypter,
+	}
+	return codec.decodeLeaf(&leaf.LeafValue, &leaf.ExtraData)
+}
+
+// txOptions returns the options for a new transaction, which depend on
+// whether it is a read-only snapshot.
+func (m *mySQLLogStorage) txOptions(readOnly bool) *sql.TxOptions {
+	if readOnly {
+		return &sql.TxOptions{Isolation: m.opts.ReadOnlyIsolation}
+	}
+	return &sql.TxOptions{Isolation: m.opts.ReadWriteIsolation}
+}
+
+func (m *mySQLLogStorage) beginInternal(ctx context.Context, tree *trillian.Tree, readOnly bool) (*logTreeTX, error) {
 	once.Do(func() {
-		createMetrics(m.metricFactory)
+		createMetrics(m.opts.MetricFactory)
 	})
 
-	stCache := cache.NewLogSubtreeCache(rfc6962.DefaultHasher)
-	ttx, err := m.beginTreeTx(ctx, tree, rfc6962.DefaultHasher.Size(), stCache)
+	ttx, err := m.beginTreeTx(ctx, tree, m.txOptions(readOnly))
 	if err != nil && err != storage.ErrTreeNeedsInit {
 		return nil, err
 	}
+	ttx.leafCrypter = m.opts.LeafCrypter
 
 	ltx := &logTreeTX{
 		treeTX:   ttx,
@@ -220,14 +1019,56 @@ func (m *mySQLLogStorage) beginInternal(ctx context.Context, tree *trillian.Tree
 	return ltx, nil
 }
 
-// TODO(pavelkalinnikov): This and many other methods of this storage
-// implementation can leak a specific sql.ErrTxDone all the way to the client,
-// if the transaction is rolled back as a result of a canceled context. It must
-// return "generic" errors, and only log the specific ones for debugging.
+// observeTx records the duration of a read-write transaction that started at
+// start, and logs it if it exceeds SlowTxThreshold.
+func (m *mySQLLogStorage) observeTx(ctx context.Context, treeID int64, op string, start time.Time) {
+	d := time.Since(start)
+	once.Do(func() {
+		createMetrics(m.opts.MetricFactory)
+	})
+	txDuration.Observe(d.Seconds(), strconv.FormatInt(treeID, 10), op)
+	if m.opts.SlowTxThreshold > 0 && d > m.opts.SlowTxThreshold {
+		warnings.Warningf(treeID, "%sTreeID: %d slow %s transaction took %v", requestIDPrefix(ctx), treeID, op, d)
+	}
+}
+
+// ReadWriteTransaction runs f in a read-write transaction and commits it. If
+// ctx is done, the context's error is returned as a gRPC status rather than the
+// error from the rolled-back transaction.
 func (m *mySQLLogStorage) ReadWriteTransaction(ctx context.Context, tree *trillian.Tree, f storage.LogTXFunc) error {
-	tx, err := m.beginInternal(ctx, tree)
+	return m.ReadWriteTransactionWithBudget(ctx, tree, m.opts.ReadWriteTxBudget, f)
+}
+
+// ReadWriteTransactionWithBudget is like ReadWriteTransaction, but if budget
+// is positive the transaction, including its commit, must finish within it.
+// Otherwise it's rolled back, and DeadlineExceeded is returned. This bounds
+// how long a transaction can hold locks, rather than relying on server
+// timeouts such as innodb_lock_wait_timeout to end it.
+func (m *mySQLLogStorage) ReadWriteTransactionWithBudget(ctx context.Context, tree *trillian.Tree, budget time.Duration, f storage.LogTXFunc) error {
+	if budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, budget)
+		defer cancel()
+	}
+	b := newDeadlockBackoff()
+	for attempt := 0; ; attempt++ {
+		err := m.readWriteTransaction(ctx, tree, f)
+		if err == nil || attempt >= m.opts.DeadlockRetries || !isDeadlockErr(err) {
+			return err
+		}
+		klog.Warningf("%sRetrying transaction on tree %d after deadlock: %v", requestIDPrefix(ctx), tree.TreeId, err)
+		if err := b.Wait(ctx); err != nil {
+			return contextToGRPC(ctx, err)
+		}
+	}
+}
+
+// readWriteTransaction runs f in a single read-write transaction.
+func (m *mySQLLogStorage) readWriteTransaction(ctx context.Context, tree *trillian.Tree, f storage.LogTXFunc) error {
+	defer m.observeTx(ctx, tree.TreeId, "ReadWriteTransaction", time.Now())
+	tx, err := m.beginInternal(ctx, tree, false /* readOnly */)
 	if err != nil && err != storage.ErrTreeNeedsInit {
-		return err
+		return contextToGRPC(ctx, err)
 	}
 	defer func() {
 		if err := tx.Close(); err != nil {
@@ -235,13 +1076,40 @@ func (m *mySQLLogStorage) ReadWriteTransaction(ctx context.Context, tree *trilli
 		}
 	}()
 	if err := f(ctx, tx); err != nil {
-		return err
+		return contextToGRPC(ctx, err)
 	}
-	return tx.Commit(ctx)
+	return contextToGRPC(ctx, tx.Commit(ctx))
 }
 
+// AddSequencedLeaves adds leaves in a single transaction or, if
+// AddSequencedBatchSize is set, in a transaction per batch of that many
+// consecutive leaves. The call is then not atomic: if a batch fails, the
+// results of the batches already committed are returned along with the error,
+// so res[i] is the result of leaves[i] for each i < len(res), and the
+// remaining leaves can be retried.
 func (m *mySQLLogStorage) AddSequencedLeaves(ctx context.Context, tree *trillian.Tree, leaves []*trillian.LogLeaf, timestamp time.Time) ([]*trillian.QueuedLogLeaf, error) {
-	tx, err := m.beginInternal(ctx, tree)
+	batchSize := m.opts.AddSequencedBatchSize
+	if batchSize <= 0 || len(leaves) <= batchSize {
+		return m.addSequencedLeaves(ctx, tree, leaves, timestamp)
+	}
+	res := make([]*trillian.QueuedLogLeaf, 0, len(leaves))
+	for start := 0; start < len(leaves); start += batchSize {
+		batch, err := m.addSequencedLeaves(ctx, tree, leaves[start:min(start+batchSize, len(leaves))], timestamp)
+		if err != nil {
+			if start == 0 {
+				return nil, err
+			}
+			return res, fmt.Errorf("leaves[%d:] not added, earlier leaves were committed: %w", start, err)
+		}
+		res = append(res, batch...)
+	}
+	return res, nil
+}
+
+// addSequencedLeaves adds leaves in a single transaction.
+func (m *mySQLLogStorage) addSequencedLeaves(ctx context.Context, tree *trillian.Tree, leaves []*trillian.LogLeaf, timestamp time.Time) ([]*trillian.QueuedLogLeaf, error) {
+	defer m.observeTx(ctx, tree.TreeId, "AddSequencedLeaves", time.Now())
+	tx, err := m.beginInternal(ctx, tree, false /* readOnly */)
 	if tx != nil {
 		// Ensure we don't leak the transaction. For example if we get an
 		// ErrTreeNeedsInit from beginInternal() or if AddSequencedLeaves fails
@@ -253,28 +1121,99 @@ func (m *mySQLLogStorage) AddSequencedLeaves(ctx context.Context, tree *trillian
 		}()
 	}
 	if err != nil {
-		return nil, err
+		return nil, contextToGRPC(ctx, err)
 	}
 	res, err := tx.AddSequencedLeaves(ctx, leaves, timestamp)
 	if err != nil {
-		return nil, err
+		return nil, contextToGRPC(ctx, err)
+	}
+	if m.opts.IntegrateImmediately && tree.TreeType == trillian.TreeType_PREORDERED_LOG {
+		if err := tx.integrateOrSkip(ctx, len(leaves), time.Now()); err != nil {
+			return nil, contextToGRPC(ctx, err)
+		}
 	}
 	if err := tx.Commit(ctx); err != nil {
-		return nil, err
+		return nil, contextToGRPC(ctx, err)
 	}
 	return res, nil
 }
 
 func (m *mySQLLogStorage) SnapshotForTree(ctx context.Context, tree *trillian.Tree) (storage.ReadOnlyLogTreeTX, error) {
-	tx, err := m.beginInternal(ctx, tree)
+	tx, err := m.beginInternal(ctx, tree, true /* readOnly */)
 	if err != nil && err != storage.ErrTreeNeedsInit {
 		return nil, err
 	}
 	return tx, err
 }
 
+// SnapshotForTreeAtRevision is like SnapshotForTree, but reads the tree as it
+// was at the given revision rather than the latest one: the returned
+// transaction's log root is the one stored at revision, and its Merkle nodes are
+// read at that revision. Only trees with subtree revisions keep the history
+// needed for this, so other trees return FailedPrecondition.
+func (m *mySQLLogStorage) SnapshotForTreeAtRevision(ctx context.Context, tree *trillian.Tree, revision int64) (storage.ReadOnlyLogTreeTX, error) {
+	tx, err := m.beginInternal(ctx, tree, true /* readOnly */)
+	if tx != nil && err != nil {
+		if err := tx.Close(); err != nil {
+			klog.Errorf("tx.Close(): %v", err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.pinRevision(ctx, revision); err != nil {
+		if err := tx.Close(); err != nil {
+			klog.Errorf("tx.Close(): %v", err)
+		}
+		return nil, err
+	}
+	return tx, nil
+}
+
 func (m *mySQLLogStorage) QueueLeaves(ctx context.Context, tree *trillian.Tree, leaves []*trillian.LogLeaf, queueTimestamp time.Time) ([]*trillian.QueuedLogLeaf, error) {
-	tx, err := m.beginInternal(ctx, tree)
+	return m.queueLeaves(ctx, tree, leaves, queueTimestamp, nil, false /* withPositions */)
+}
+
+// QueueLeavesWithPositions is like QueueLeaves, but in the same transaction
+// also looks up the LeafIndex and MerkleLeafHash of each duplicate leaf that
+// has already been sequenced. Duplicates which are still queued have a
+// LeafIndex of -1. Their statuses describe the existing leaves, as with
+// DuplicatePositionDetails.
+func (m *mySQLLogStorage) QueueLeavesWithPositions(ctx context.Context, tree *trillian.Tree, leaves []*trillian.LogLeaf, queueTimestamp time.Time) ([]*trillian.QueuedLogLeaf, error) {
+	return m.queueLeaves(ctx, tree, leaves, queueTimestamp, nil, true /* withPositions */)
+}
+
+// QueueLeavesInNamespace is like QueueLeaves, but leaves are only
+// deduplicated against other leaves queued in the same deduplication
+// namespace, so that several streams of leaves can share a tree. The
+// namespace is stored in the DedupNamespace column, which is part of the
+// uniqueness key of the leaf tables, and the empty namespace is the default
+// one used by QueueLeaves. Leaves keep their LeafIdentityHash, and lookups by
+// it find the leaf of any namespace. The sequencer finds the namespace of each
+// dequeued leaf from the leaves it dequeued, so this fails with
+// FailedPrecondition if SkipDequeueTracking is set.
+func (m *mySQLLogStorage) QueueLeavesInNamespace(ctx context.Context, tree *trillian.Tree, leaves []*trillian.LogLeaf, queueTimestamp time.Time, namespace []byte) ([]*trillian.QueuedLogLeaf, error) {
+	if len(namespace) > 0 && m.opts.SkipDequeueTracking {
+		return nil, status.Error(codes.FailedPrecondition, "deduplication namespaces require dequeue tracking, see SkipDequeueTracking")
+	}
+	if len(namespace) > maxDedupNamespaceLen {
+		return nil, status.Errorf(codes.InvalidArgument, "deduplication namespace has length %d, want <= %d", len(namespace), maxDedupNamespaceLen)
+	}
+	return m.queueLeaves(ctx, tree, leaves, queueTimestamp, namespace, false /* withPositions */)
+}
+
+// dedupNamespaceArg returns the query argument for a deduplication namespace,
+// which is never NULL.
+func dedupNamespaceArg(namespace []byte) []byte {
+	if namespace == nil {
+		return []byte{}
+	}
+	return namespace
+}
+
+func (m *mySQLLogStorage) queueLeaves(ctx context.Context, tree *trillian.Tree, leaves []*trillian.LogLeaf, queueTimestamp time.Time, namespace []byte, withPositions bool) ([]*trillian.QueuedLogLeaf, error) {
+	defer m.observeTx(ctx, tree.TreeId, "QueueLeaves", time.Now())
+	tx, err := m.beginInternal(ctx, tree, false /* readOnly */)
 	if tx != nil {
 		// Ensure we don't leak the transaction. For example if we get an
 		// ErrTreeNeedsInit from beginInternal() or if QueueLeaves fails
@@ -286,31 +1225,146 @@ func (m *mySQLLogStorage) QueueLeaves(ctx context.Context, tree *trillian.Tree,
 		}()
 	}
 	if err != nil {
-		return nil, err
+		return nil, contextToGRPC(ctx, err)
 	}
-	existing, err := tx.QueueLeaves(ctx, leaves, queueTimestamp)
+	existing, err := tx.queueLeaves(ctx, leaves, queueTimestamp, namespace)
 	if err != nil {
-		return nil, err
+		return nil, contextToGRPC(ctx, err)
+	}
+	// With positions or DuplicatePositionDetails, the statuses of duplicates
+	// describe the existing leaves' positions. Unless they're returned with the leaves,
+	// they're looked up on stubs.
+	details := withPositions || m.opts.DuplicatePositionDetails
+	var positions []*trillian.LogLeaf
+	if withPositions {
+		positions = existing
+	} else if details {
+		positions = make([]*trillian.LogLeaf, len(existing))
+		for i, e := range existing {
+			if e != nil {
+				positions[i] = &trillian.LogLeaf{LeafIdentityHash: e.LeafIdentityHash, LeafIndex: -1}
+			}
+		}
+	}
+	if err := tx.fillSequencedPositions(ctx, namespace, positions); err != nil {
+		return nil, contextToGRPC(ctx, err)
 	}
 
 	if err := tx.Commit(ctx); err != nil {
-		return nil, err
+		return nil, contextToGRPC(ctx, err)
 	}
 
 	ret := make([]*trillian.QueuedLogLeaf, len(leaves))
 	for i, e := range existing {
-		if e != nil {
+		if e == nil {
+			ret[i] = &trillian.QueuedLogLeaf{Leaf: leaves[i]}
+			continue
+		}
+		if !details {
 			ret[i] = &trillian.QueuedLogLeaf{
 				Leaf:   e,
 				Status: status.Newf(codes.AlreadyExists, "leaf already exists: %v", e.LeafIdentityHash).Proto(),
 			}
 			continue
 		}
-		ret[i] = &trillian.QueuedLogLeaf{Leaf: leaves[i]}
+		st, err := duplicateLeafStatus(positions[i])
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = &trillian.QueuedLogLeaf{Leaf: e, Status: st}
 	}
 	return ret, nil
 }
 
+// duplicateLeafStatus returns the AlreadyExists status of a queued leaf which
+// duplicates the existing leaf. The status has a LogLeaf detail holding the
+// existing leaf's LeafIdentityHash and, if it has been sequenced, its
+// LeafIndex, MerkleLeafHash and IntegrateTimestamp, so that clients can find
+// it without parsing the message. The LeafIndex is -1 if it hasn't been.
+func duplicateLeafStatus(existing *trillian.LogLeaf) (*spb.Status, error) {
+	detail := &trillian.LogLeaf{
+		LeafIdentityHash: existing.LeafIdentityHash,
+		LeafIndex:        -1,
+	}
+	if existing.IntegrateTimestamp != nil {
+		detail.LeafIndex = existing.LeafIndex
+		detail.MerkleLeafHash = existing.MerkleLeafHash
+		detail.IntegrateTimestamp = existing.IntegrateTimestamp
+	}
+	st, err := status.Newf(codes.AlreadyExists, "leaf already exists: %v", existing.LeafIdentityHash).WithDetails(detail)
+	if err != nil {
+		return nil, err
+	}
+	return st.Proto(), nil
+}
+
+// LeafState describes how far a leaf has progressed through the log.
+type LeafState int
+
+const (
+	// LeafUnknown is returned by GetLeafStatus if the tree holds no leaf data
+	// with the given LeafIdentityHash, or if it holds the leaf data but, as
+	// seen by the transaction, the leaf neither has a sequence number nor is
+	// waiting in the queue. The latter happens when the transaction itself has
+	// dequeued the leaf but not yet stored its sequence number.
+	LeafUnknown LeafState = iota
+	// LeafQueued means that the leaf is waiting to be sequenced.
+	LeafQueued
+	// LeafSequenced means that the leaf has been assigned an index, but is not
+	// yet covered by the latest signed root.
+	LeafSequenced
+	// LeafIntegrated means that the leaf is covered by the latest signed root.
+	LeafIntegrated
+)
+
+// LeafStatus is the position of a leaf in the log's pipeline, as returned by
+// GetLeafStatus.
+type LeafStatus struct {
+	State LeafState
+	// LeafIndex is the sequence number of the leaf. It is only set for
+	// LeafSequenced and LeafIntegrated leaves.
+	LeafIndex int64
+	// TreeSize is the size of the latest signed root, which includes the leaf.
+	// It is only set for LeafIntegrated leaves.
+	TreeSize uint64
+}
+
+// LeafProvenance records when a leaf entered the log, as returned by
+// GetLeafProvenance.
+type LeafProvenance struct {
+	QueueTimestamp time.Time
+	// Sequenced reports whether the leaf has been assigned a LeafIndex. If so,
+	// IntegrateTimestamp is when that happened.
+	Sequenced          bool
+	LeafIndex          int64
+	IntegrateTimestamp time.Time
+	// Included reports whether a signed root covers the leaf. If so, Revision
+	// and TreeSize are those of the first such root.
+	Included bool
+	Revision int64
+	TreeSize uint64
+}
+
+// MerkleHashCollision is a MerkleLeafHash shared by sequenced leaves with
+// different LeafIdentityHashes, as returned by FindMerkleHashCollisions.
+type MerkleHashCollision struct {
+	MerkleLeafHash     []byte
+	LeafIdentityHashes [][]byte
+}
+
+// LeafGap is a range [Start, End) of indices with no sequenced leaves, as
+// returned by GetLeavesByRangeWithGaps.
+type LeafGap struct {
+	Start, End int64
+}
+
+// InclusionEntry is a leaf claimed to be at Index of a tree, as checked by
+// VerifyInclusionBatch. LeafHash is its Merkle leaf hash.
+type InclusionEntry struct {
+	Index    int64
+	LeafHash []byte
+}
+
 type logTreeTX struct {
 	treeTX
 	ls       *mySQLLogStorage
@@ -327,6 +1381,100 @@ func (t *logTreeTX) GetMerkleNodes(ctx context.Context, ids []compact.NodeID) ([
 	return t.subtreeCache.GetNodes(ids, t.getSubtreesAtRev(ctx, t.readRev))
 }
 
+// GetMerkleNodesBatch is like calling GetMerkleNodes with each of idSets, but
+// the subtrees covering all the requested nodes are read from the database at
+// most once, in a single batch, so overlapping sets such as the nodes of a
+// batch of proofs share their subtree reads. If any subtree can't be read, the
+// whole batch fails.
+func (t *logTreeTX) GetMerkleNodesBatch(ctx context.Context, idSets [][]compact.NodeID) ([][]tree.Node, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	var ids []compact.NodeID
+	seen := make(map[compact.NodeID]bool)
+	for _, set := range idSets {
+		for _, id := range set {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	nodes, err := t.subtreeCache.GetNodes(ids, t.getSubtreesAtRev(ctx, t.readRev))
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[compact.NodeID][]byte, len(nodes))
+	for _, node := range nodes {
+		hashes[node.ID] = node.Hash
+	}
+
+	// As with GetMerkleNodes, nodes without a hash are left out.
+	ret := make([][]tree.Node, len(idSets))
+	for i, set := range idSets {
+		ret[i] = make([]tree.Node, 0, len(set))
+		for _, id := range set {
+			if hash, ok := hashes[id]; ok {
+				ret[i] = append(ret[i], tree.Node{ID: id, Hash: hash})
+			}
+		}
+	}
+	return ret, nil
+}
+
+// GetNodeAt returns the Merkle node at the given level and index, where level
+// 0 holds the leaf hashes, for debugging proofs. Only nodes rooting perfect
+// subtrees are stored, so it fails with NotFound if the node isn't complete at
+// the tree size of the transaction's root.
+func (t *logTreeTX) GetNodeAt(ctx context.Context, level uint, index uint64) (tree.Node, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	if level >= 64 || index >= (math.MaxUint64>>level) {
+		return tree.Node{}, status.Errorf(codes.InvalidArgument, "node (%d, %d) is out of range", level, index)
+	}
+	if end := (index + 1) << level; end > t.root.TreeSize {
+		return tree.Node{}, status.Errorf(codes.NotFound, "node (%d, %d) needs tree size %d, have %d", level, index, end, t.root.TreeSize)
+	}
+	id := compact.NewNodeID(level, index)
+	nodes, err := t.subtreeCache.GetNodes([]compact.NodeID{id}, t.getSubtreesAtRev(ctx, t.readRev))
+	if err != nil {
+		return tree.Node{}, err
+	}
+	if len(nodes) == 0 {
+		return tree.Node{}, status.Errorf(codes.NotFound, "node (%d, %d) not found at tree size %d", level, index, t.root.TreeSize)
+	}
+	return nodes[0], nil
+}
+
+// PrefetchSubtrees loads the subtrees holding the inclusion proof nodes of the
+// leaves at the given indices, at the tree's current size, into the subtree
+// cache. Subsequent GetMerkleNodes calls for those proofs are then served
+// without reading storage.
+func (t *logTreeTX) PrefetchSubtrees(ctx context.Context, indices []int64) error {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	var ids []compact.NodeID
+	for _, index := range indices {
+		if index < 0 || uint64(index) >= t.root.TreeSize {
+			return status.Errorf(codes.InvalidArgument, "index %d is outside [0, %d)", index, t.root.TreeSize)
+		}
+		nodes, err := proof.Inclusion(uint64(index), t.root.TreeSize)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, nodes.IDs...)
+	}
+	return t.subtreeCache.Preload(ids, t.getSubtreesAtRev(ctx, t.readRev))
+}
+
+// DequeueLeaves returns up to limit queued leaves, queued no later than
+// cutoffTime, in FIFO order: the oldest leaves by QueueTimestamp come first,
+// with ties broken by LeafIdentityHash, so that they're integrated first.
+// If HonorLeases is set, leaves leased by DequeueLeavesLease are skipped until
+// their lease expires. Leaves with a LeafIdentityHash already dequeued by this
+// transaction, e.g. in another deduplication namespace, are skipped.
 func (t *logTreeTX) DequeueLeaves(ctx context.Context, limit int, cutoffTime time.Time) ([]*trillian.LogLeaf, error) {
 	t.treeTX.mu.Lock()
 	defer t.treeTX.mu.Unlock()
@@ -334,13 +1482,21 @@ func (t *logTreeTX) DequeueLeaves(ctx context.Context, limit int, cutoffTime tim
 	if t.treeType == trillian.TreeType_PREORDERED_LOG {
 		// TODO(pavelkalinnikov): Optimize this by fetching only the required
 		// fields of LogLeaf. We can avoid joining with LeafData table here.
-		return t.getLeavesByRangeInternal(ctx, int64(t.root.TreeSize), int64(limit))
+		return t.getLeavesByRangeInternal(ctx, int64(t.root.TreeSize), int64(limit), nil, nil)
 	}
 
 	start := time.Now()
-	stx, err := t.tx.PrepareContext(ctx, selectQueuedLeavesSQL)
+	cutoffTime, err := t.ls.dequeueCutoff(cutoffTime, start)
+	if err != nil {
+		return nil, err
+	}
+	query, args := selectQueuedLeavesSQL, []interface{}{t.treeID, cutoffTime.UnixNano(), limit}
+	if t.ls.opts.HonorLeases {
+		query, args = selectUnleasedQueuedLeavesSQL, []interface{}{t.treeID, cutoffTime.UnixNano(), start.UnixNano(), limit}
+	}
+	stx, err := t.tx.PrepareContext(ctx, query)
 	if err != nil {
-		klog.Warningf("Failed to prepare dequeue select: %s", err)
+		warnings.Warningf(t.treeID, "%sFailed to prepare dequeue select: %s", requestIDPrefix(ctx), err)
 		return nil, err
 	}
 	defer func() {
@@ -350,9 +1506,9 @@ func (t *logTreeTX) DequeueLeaves(ctx context.Context, limit int, cutoffTime tim
 	}()
 
 	leaves := make([]*trillian.LogLeaf, 0, limit)
-	rows, err := stx.QueryContext(ctx, t.treeID, cutoffTime.UnixNano(), limit)
+	rows, err := stx.QueryContext(ctx, args...)
 	if err != nil {
-		klog.Warningf("Failed to select rows for work: %s", err)
+		warnings.Warningf(t.treeID, "%sFailed to select rows for work: %s", requestIDPrefix(ctx), err)
 		return nil, err
 	}
 	defer func() {
@@ -364,7 +1520,7 @@ func (t *logTreeTX) DequeueLeaves(ctx context.Context, limit int, cutoffTime tim
 	for rows.Next() {
 		leaf, dqInfo, err := t.dequeueLeaf(rows)
 		if err != nil {
-			klog.Warningf("Error dequeuing leaf: %v", err)
+			warnings.Warningf(t.treeID, "%sError dequeuing leaf: %v", requestIDPrefix(ctx), err)
 			return nil, err
 		}
 
@@ -372,12 +1528,9 @@ func (t *logTreeTX) DequeueLeaves(ctx context.Context, limit int, cutoffTime tim
 			return nil, errors.New("dequeued a leaf with incorrect hash size")
 		}
 
-		k := string(leaf.LeafIdentityHash)
-		if _, ok := t.dequeued[k]; ok {
-			// dupe, user probably called DequeueLeaves more than once.
+		if !t.markDequeued(leaf, dqInfo) {
 			continue
 		}
-		t.dequeued[k] = dqInfo
 		leaves = append(leaves, leaf)
 	}
 
@@ -392,6 +1545,190 @@ func (t *logTreeTX) DequeueLeaves(ctx context.Context, limit int, cutoffTime tim
 	return leaves, nil
 }
 
+// ListStaleQueuedLeaves returns up to limit leaves that were queued before
+// olderThan and are still waiting to be sequenced, oldest first, so that
+// operators can inspect leaves which are stuck. Only the LeafIdentityHash,
+// MerkleLeafHash and QueueTimestamp of the leaves are set. Unlike
+// DequeueLeaves, the leaves aren't marked as dequeued.
+func (t *logTreeTX) ListStaleQueuedLeaves(ctx context.Context, olderThan time.Time, limit int) ([]*trillian.LogLeaf, error) {
+	if limit <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid limit %d, want > 0", limit)
+	}
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	rows, err := t.tx.QueryContext(ctx, selectStaleQueuedLeavesSQL, t.treeID, olderThan.UnixNano(), limit)
+	if err != nil {
+		klog.Warningf("%sFailed to list stale queued leaves: %s", requestIDPrefix(ctx), err)
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+
+	leaves := []*trillian.LogLeaf{}
+	for rows.Next() {
+		leaf := &trillian.LogLeaf{}
+		var queueNanos int64
+		if err := rows.Scan(&leaf.LeafIdentityHash, &leaf.MerkleLeafHash, &queueNanos); err != nil {
+			klog.Warningf("%sFailed to scan queued leaf: %s", requestIDPrefix(ctx), err)
+			return nil, err
+		}
+		leaf.QueueTimestamp = timestamppb.New(time.Unix(0, queueNanos))
+		if err := leaf.QueueTimestamp.CheckValid(); err != nil {
+			return nil, fmt.Errorf("got invalid queue timestamp: %w", err)
+		}
+		leaves = append(leaves, leaf)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return leaves, nil
+}
+
+// Lease identifies the queued leaves leased by a call to DequeueLeavesLease.
+type Lease struct {
+	// ID is chosen at random by DequeueLeavesLease, and stored with each of
+	// the leased leaves.
+	ID int64
+	// Until is when the lease expires.
+	Until time.Time
+}
+
+// DequeueLeavesLease leases up to limit queued leaves for leaseDuration, so
+// that once this transaction commits, other sequencer workers using storage
+// with HonorLeases set skip them until the lease expires. Leaves whose lease
+// has expired can be leased again. Only LOG trees have queued leaves to lease.
+//
+// The leaves aren't dequeued by this transaction. To sequence them, the lease
+// holder passes the returned Lease to DequeueLeasedLeaves in a later
+// transaction, before the lease expires.
+func (t *logTreeTX) DequeueLeavesLease(ctx context.Context, limit int, leaseDuration time.Duration) (Lease, []*trillian.LogLeaf, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	if err := t.checkLeasable(); err != nil {
+		return Lease{}, nil, err
+	}
+	if limit <= 0 {
+		return Lease{}, nil, status.Errorf(codes.InvalidArgument, "invalid limit %d, want > 0", limit)
+	}
+	if leaseDuration <= 0 {
+		return Lease{}, nil, status.Errorf(codes.InvalidArgument, "invalid lease duration %v, want > 0", leaseDuration)
+	}
+
+	now := time.Now()
+	leaves, dqInfos, err := t.selectLeaseRows(ctx, selectLeasableLeavesSQL, t.treeID, now.UnixNano(), now.UnixNano(), limit)
+	if err != nil {
+		warnings.Warningf(t.treeID, "%sFailed to select rows to lease: %s", requestIDPrefix(ctx), err)
+		return Lease{}, nil, err
+	}
+
+	lease := Lease{ID: rand.Int63n(math.MaxInt64) + 1, Until: now.Add(leaseDuration)}
+	for i, leaf := range leaves {
+		if _, err := t.tx.ExecContext(ctx, updateUnsequencedLeaseSQL,
+			lease.Until.UnixNano(), lease.ID, t.treeID, leaf.QueueTimestamp.AsTime().UnixNano(), leaf.LeafIdentityHash,
+			dedupNamespaceArg(dqInfos[i].dedupNamespace)); err != nil {
+			klog.Warningf("%sFailed to lease leaf: %s", requestIDPrefix(ctx), err)
+			return Lease{}, nil, mysqlToGRPC(err)
+		}
+	}
+	return lease, leaves, nil
+}
+
+// DequeueLeasedLeaves dequeues the leaves of lease, as returned by
+// DequeueLeavesLease, which haven't been sequenced yet, so that they can be
+// passed to UpdateSequencedLeaves, which removes them from the queue. The
+// leaves are locked until this transaction ends. If the lease has expired it
+// fails with FailedPrecondition, as the leaves may have been leased by another
+// worker since.
+func (t *logTreeTX) DequeueLeasedLeaves(ctx context.Context, lease Lease) ([]*trillian.LogLeaf, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	if err := t.checkLeasable(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !now.Before(lease.Until) {
+		return nil, status.Errorf(codes.FailedPrecondition, "lease %d expired at %v", lease.ID, lease.Until)
+	}
+
+	leaves, dqInfos, err := t.selectLeaseRows(ctx, selectLeasedLeavesSQL, t.treeID, lease.ID, now.UnixNano())
+	if err != nil {
+		warnings.Warningf(t.treeID, "%sFailed to select leased rows: %s", requestIDPrefix(ctx), err)
+		return nil, err
+	}
+	dequeued := make([]*trillian.LogLeaf, 0, len(leaves))
+	for i, leaf := range leaves {
+		if t.markDequeued(leaf, dqInfos[i]) {
+			dequeued = append(dequeued, leaf)
+		}
+	}
+	return dequeued, nil
+}
+
+// markDequeued records that leaf has been dequeued by this transaction, unless
+// SkipDequeueTracking is set. It returns false if a leaf with the same
+// LeafIdentityHash has already been dequeued, either because the caller
+// dequeued more than once or because the hash is queued in several
+// deduplication namespaces, in which case leaf is left in the queue for a
+// later transaction.
+func (t *logTreeTX) markDequeued(leaf *trillian.LogLeaf, dqInfo dequeuedLeaf) bool {
+	if t.ls.opts.SkipDequeueTracking {
+		return true
+	}
+	k := string(leaf.LeafIdentityHash)
+	if _, ok := t.dequeued[k]; ok {
+		return false
+	}
+	t.dequeued[k] = dqInfo
+	return true
+}
+
+// checkLeasable returns an error if the tree has no queued leaves to lease.
+func (t *logTreeTX) checkLeasable() error {
+	if t.treeType != trillian.TreeType_LOG {
+		return status.Errorf(codes.FailedPrecondition, "tree %d of type %v has no queued leaves to lease", t.treeID, t.treeType)
+	}
+	return nil
+}
+
+// selectLeaseRows runs one of the lease queries, which select the same
+// columns as selectQueuedLeavesSQL, and returns the leaves with their queue
+// entries.
+func (t *logTreeTX) selectLeaseRows(ctx context.Context, query string, args ...interface{}) ([]*trillian.LogLeaf, []dequeuedLeaf, error) {
+	rows, err := t.tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+
+	var leaves []*trillian.LogLeaf
+	var dqInfos []dequeuedLeaf
+	for rows.Next() {
+		leaf, dqInfo, err := t.dequeueLeaf(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(leaf.LeafIdentityHash) != t.hashSizeBytes {
+			return nil, nil, errors.New("leased a leaf with incorrect hash size")
+		}
+		leaves = append(leaves, leaf)
+		dqInfos = append(dqInfos, dqInfo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	return leaves, dqInfos, nil
+}
+
 // sortLeavesForInsert returns a slice containing the passed in leaves sorted
 // by LeafIdentityHash, and paired with their original positions.
 // QueueLeaves and AddSequencedLeaves use this to make the order that LeafData
@@ -406,15 +1743,28 @@ func sortLeavesForInsert(leaves []*trillian.LogLeaf) []leafAndPosition {
 }
 
 func (t *logTreeTX) QueueLeaves(ctx context.Context, leaves []*trillian.LogLeaf, queueTimestamp time.Time) ([]*trillian.LogLeaf, error) {
+	return t.queueLeaves(ctx, leaves, queueTimestamp, nil)
+}
+
+// queueLeaves is QueueLeaves for leaves in the given deduplication namespace.
+func (t *logTreeTX) queueLeaves(ctx context.Context, leaves []*trillian.LogLeaf, queueTimestamp time.Time, namespace []byte) ([]*trillian.LogLeaf, error) {
 	t.treeTX.mu.Lock()
 	defer t.treeTX.mu.Unlock()
 
 	// Don't accept batches if any of the leaves are invalid.
-	for _, leaf := range leaves {
-		if len(leaf.LeafIdentityHash) != t.hashSizeBytes {
-			return nil, fmt.Errorf("queued leaf must have a leaf ID hash of length %d", t.hashSizeBytes)
+	for i, leaf := range leaves {
+		if err := t.checkHashSize(leaf.LeafIdentityHash, "leaves[%d].LeafIdentityHash", i); err != nil {
+			return nil, err
+		}
+		if len(leaf.IndexKey) > maxIndexKeyLen {
+			return nil, status.Errorf(codes.InvalidArgument, "queued leaf has IndexKey of length %d, want <= %d", len(leaf.IndexKey), maxIndexKeyLen)
 		}
-		leaf.QueueTimestamp = timestamppb.New(queueTimestamp)
+		if t.ls.opts.VerifyMerkleLeafHash && t.treeType == trillian.TreeType_LOG {
+			if want := t.hasher.HashLeaf(leaf.LeafValue); !bytes.Equal(leaf.MerkleLeafHash, want) {
+				return nil, status.Errorf(codes.InvalidArgument, "queued leaf has MerkleLeafHash %x, want %x", leaf.MerkleLeafHash, want)
+			}
+		}
+		leaf.QueueTimestamp = timestamppb.New(t.truncateTimestamp(queueTimestamp))
 		if err := leaf.QueueTimestamp.CheckValid(); err != nil {
 			return nil, fmt.Errorf("got invalid queue timestamp: %w", err)
 		}
@@ -426,47 +1776,53 @@ func (t *logTreeTX) QueueLeaves(ctx context.Context, leaves []*trillian.LogLeaf,
 	existingCount := 0
 	existingLeaves := make([]*trillian.LogLeaf, len(leaves))
 
-	for _, ol := range ordLeaves {
+	// Leaves whose Unsequenced rows are inserted after all LeafData rows, if
+	// PhasedQueueInserts is set. They're still in LeafIdentityHash order.
+	var deferred []*trillian.LogLeaf
+	for j, ol := range ordLeaves {
 		i, leaf := ol.idx, ol.leaf
 
 		leafStart := time.Now()
 		if err := leaf.QueueTimestamp.CheckValid(); err != nil {
 			return nil, fmt.Errorf("got invalid queue timestamp: %w", err)
 		}
+		// Leaves are sorted, so duplicates within the batch are adjacent.
+		intraBatch := j > 0 && bytes.Equal(ordLeaves[j-1].leaf.LeafIdentityHash, leaf.LeafIdentityHash)
 		qTimestamp := leaf.QueueTimestamp.AsTime()
-		_, err := t.tx.ExecContext(ctx, insertLeafDataSQL, t.treeID, leaf.LeafIdentityHash, leaf.LeafValue, leaf.ExtraData, qTimestamp.UnixNano())
-		insertDuration := time.Since(leafStart)
-		observe(queueInsertLeafLatency, insertDuration, label)
+		value, extra, err := t.encodeLeaf(leaf.LeafValue, leaf.ExtraData)
+		if err != nil {
+			return nil, err
+		}
+		err = t.insertLeafData(ctx, leaf, namespace, value, extra, qTimestamp.UnixNano())
+		observe(queueInsertLeafLatency, time.Since(leafStart), label)
 		if isDuplicateErr(err) {
 			// Remember the duplicate leaf, using the requested leaf for now.
 			existingLeaves[i] = leaf
 			existingCount++
-			queuedDupCounter.Inc(label)
+			if intraBatch {
+				queuedDupCounter.Inc(label, intraBatchDup)
+			} else {
+				queuedDupCounter.Inc(label, existingDup)
+			}
 			continue
 		}
 		if err != nil {
-			klog.Warningf("Error inserting %d into LeafData: %s", i, err)
+			warnings.Warningf(t.treeID, "%sError inserting %d into LeafData: %s", requestIDPrefix(ctx), i, err)
 			return nil, mysqlToGRPC(err)
 		}
 
-		// Create the work queue entry
-		args := []interface{}{
-			t.treeID,
-			leaf.LeafIdentityHash,
-			leaf.MerkleLeafHash,
+		if t.ls.opts.PhasedQueueInserts {
+			deferred = append(deferred, leaf)
+			continue
 		}
-		args = append(args, queueArgs(t.treeID, leaf.LeafIdentityHash, qTimestamp)...)
-		_, err = t.tx.ExecContext(
-			ctx,
-			insertUnsequencedEntrySQL,
-			args...,
-		)
-		if err != nil {
-			klog.Warningf("Error inserting into Unsequenced: %s", err)
-			return nil, mysqlToGRPC(err)
+		if err := t.insertUnsequencedEntry(ctx, leaf, namespace, label); err != nil {
+			return nil, err
+		}
+	}
+	for _, leaf := range deferred {
+		if err := t.insertUnsequencedEntry(ctx, leaf, namespace, label); err != nil {
+			return nil, err
 		}
-		leafDuration := time.Since(leafStart)
-		observe(queueInsertEntryLatency, (leafDuration - insertDuration), label)
 	}
 	insertDuration := time.Since(start)
 	observe(queueInsertLatency, insertDuration, label)
@@ -483,22 +1839,30 @@ func (t *logTreeTX) QueueLeaves(ctx context.Context, leaves []*trillian.LogLeaf,
 			toRetrieve = append(toRetrieve, existing.LeafIdentityHash)
 		}
 	}
-	results, err := t.getLeafDataByIdentityHash(ctx, toRetrieve)
+	results, err := t.getLeafDataByIdentityHash(ctx, namespace, toRetrieve)
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve existing leaves: %v", err)
 	}
 	if len(results) != len(toRetrieve) {
 		return nil, fmt.Errorf("failed to retrieve all existing leaves: got %d, want %d", len(results), len(toRetrieve))
 	}
-	// Replace the requested leaves with the actual leaves.
+	// Replace the requested leaves with the actual leaves. Their positions
+	// aren't known here, so LeafIndex is -1 and the other sequencing fields
+	// are left unset.
 	for i, requested := range existingLeaves {
 		if requested == nil {
 			continue
 		}
 		found := false
 		for _, result := range results {
-			if bytes.Equal(result.LeafIdentityHash, requested.LeafIdentityHash) {
-				existingLeaves[i] = result
+			if bytes.Equal(result.identityHash, requested.LeafIdentityHash) {
+				existingLeaves[i] = &trillian.LogLeaf{
+					LeafIdentityHash: result.identityHash,
+					LeafValue:        result.value,
+					ExtraData:        result.extraData,
+					LeafIndex:        -1,
+					QueueTimestamp:   timestamppb.New(result.queueTimestamp),
+				}
 				found = true
 				break
 			}
@@ -515,19 +1879,163 @@ func (t *logTreeTX) QueueLeaves(ctx context.Context, leaves []*trillian.LogLeaf,
 	return existingLeaves, nil
 }
 
+// insertUnsequencedEntry creates the work queue entry of a queued leaf whose
+// LeafData row has been inserted in the given deduplication namespace.
+func (t *logTreeTX) insertUnsequencedEntry(ctx context.Context, leaf *trillian.LogLeaf, namespace []byte, label string) error {
+	entryStart := time.Now()
+	args := []interface{}{
+		t.treeID,
+		leaf.LeafIdentityHash,
+		leaf.MerkleLeafHash,
+		dedupNamespaceArg(namespace),
+	}
+	args = append(args, queueArgs(t.treeID, leaf.LeafIdentityHash, namespace, leaf.QueueTimestamp.AsTime())...)
+	if _, err := t.tx.ExecContext(ctx, insertUnsequencedEntrySQL, args...); err != nil {
+		warnings.Warningf(t.treeID, "%sError inserting into Unsequenced: %s", requestIDPrefix(ctx), err)
+		return mysqlToGRPC(err)
+	}
+	observe(queueInsertEntryLatency, time.Since(entryStart), label)
+	return nil
+}
+
+// fillSequencedPositions sets the LeafIndex, MerkleLeafHash and
+// IntegrateTimestamp of each non-nil leaf which has been sequenced, looking them up by LeafIdentityHash in the
+// given deduplication namespace. If a leaf has been sequenced more than once, its lowest LeafIndex is used.
+func (t *logTreeTX) fillSequencedPositions(ctx context.Context, namespace []byte, leaves []*trillian.LogLeaf) error {
+	byHash := make(map[string][]*trillian.LogLeaf)
+	var hashes [][]byte
+	for _, leaf := range leaves {
+		if leaf == nil {
+			continue
+		}
+		if _, ok := byHash[string(leaf.LeafIdentityHash)]; !ok {
+			hashes = append(hashes, leaf.LeafIdentityHash)
+		}
+		byHash[string(leaf.LeafIdentityHash)] = append(byHash[string(leaf.LeafIdentityHash)], leaf)
+	}
+
+	// The leaves were already accepted, so chunk them to fit the placeholder
+	// cap rather than fail.
+	chunkSize := t.ls.chunkSize(t.ls.opts.MaxHashesPerQuery, "?", "?")
+	for start := 0; start < len(hashes); start += chunkSize {
+		chunk := hashes[start:min(start+chunkSize, len(hashes))]
+		args := make([]interface{}, 0, len(chunk)+2)
+		args = append(args, t.treeID, dedupNamespaceArg(namespace))
+		for _, hash := range chunk {
+			args = append(args, hash)
+		}
+		if err := t.fillSequencedPositionsChunk(ctx, args, byHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *logTreeTX) fillSequencedPositionsChunk(ctx context.Context, args []interface{}, byHash map[string][]*trillian.LogLeaf) error {
+	tmpl, err := t.ls.getStmt(ctx, selectSequenceNumbersByIdentityHashSQL, len(args)-2, "?", "?")
+	if err != nil {
+		return err
+	}
+	stx := t.tx.StmtContext(ctx, tmpl)
+	defer func() {
+		if err := stx.Close(); err != nil {
+			klog.Errorf("stx.Close(): %v", err)
+		}
+	}()
+	rows, err := stx.QueryContext(ctx, args...)
+	if err != nil {
+		klog.Warningf("%sFailed to select sequence numbers: %s", requestIDPrefix(ctx), err)
+		return err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+	done := make(map[string]bool)
+	for rows.Next() {
+		var identityHash, merkleHash []byte
+		var seq, integrateNanos int64
+		if err := rows.Scan(&identityHash, &merkleHash, &seq, &integrateNanos); err != nil {
+			return err
+		}
+		// Rows are ordered by SequenceNumber, so the first is the lowest.
+		if done[string(identityHash)] {
+			continue
+		}
+		done[string(identityHash)] = true
+		for _, leaf := range byHash[string(identityHash)] {
+			leaf.LeafIndex = seq
+			leaf.MerkleLeafHash = merkleHash
+			leaf.IntegrateTimestamp = timestamppb.New(time.Unix(0, integrateNanos))
+		}
+	}
+	return rows.Err()
+}
+
+// truncateTimestamp returns ts truncated to the configured
+// TimestampResolution, which is the form in which it's stored.
+func (t *logTreeTX) truncateTimestamp(ts time.Time) time.Time {
+	if res := t.ls.opts.TimestampResolution; res > time.Nanosecond {
+		return ts.Truncate(res)
+	}
+	return ts
+}
+
+// sequencedLeafValues returns the VALUES tuple and arguments inserting leaf
+// of the given deduplication namespace into SequencedLeafData, with
+// integrateNanos as its IntegrateTimestampNanos unless ServerIntegrateTimestamp
+// is set.
+func (t *logTreeTX) sequencedLeafValues(leaf *trillian.LogLeaf, namespace []byte, integrateNanos int64) (string, []interface{}) {
+	if t.ls.opts.ServerIntegrateTimestamp {
+		return serverIntegrateValuesSQL, []interface{}{t.treeID, leaf.LeafIdentityHash, leaf.MerkleLeafHash, leaf.LeafIndex, dedupNamespaceArg(namespace)}
+	}
+	return valuesPlaceholder6, []interface{}{t.treeID, leaf.LeafIdentityHash, leaf.MerkleLeafHash, leaf.LeafIndex, dedupNamespaceArg(namespace), integrateNanos}
+}
+
+// insertLeafData inserts a LeafData row for leaf in the given deduplication
+// namespace, with the given stored forms of its LeafValue and ExtraData.
+func (t *logTreeTX) insertLeafData(ctx context.Context, leaf *trillian.LogLeaf, namespace, value, extra []byte, queueNanos int64) error {
+	if extra == nil && t.ls.opts.NormalizeEmptyExtraData {
+		extra = []byte{}
+	}
+	if len(leaf.IndexKey) == 0 && !t.ls.opts.RecordMerkleLeafHash && len(namespace) == 0 {
+		_, err := t.tx.ExecContext(ctx, insertLeafDataSQL, t.treeID, leaf.LeafIdentityHash, value, extra, queueNanos)
+		return err
+	}
+	query := insertLeafDataColumnsSQL
+	args := []interface{}{t.treeID, leaf.LeafIdentityHash, value, extra, queueNanos}
+	if len(leaf.IndexKey) > 0 {
+		query += ",LeafIndexKey"
+		args = append(args, leaf.IndexKey)
+	}
+	if t.ls.opts.RecordMerkleLeafHash {
+		query += ",MerkleLeafHash"
+		args = append(args, leaf.MerkleLeafHash)
+	}
+	if len(namespace) > 0 {
+		query += ",DedupNamespace"
+		args = append(args, namespace)
+	}
+	query += ") VALUES(?" + strings.Repeat(",?", len(args)-1) + ")"
+	_, err := t.tx.ExecContext(ctx, query, args...)
+	return err
+}
+
 func (t *logTreeTX) AddSequencedLeaves(ctx context.Context, leaves []*trillian.LogLeaf, timestamp time.Time) ([]*trillian.QueuedLogLeaf, error) {
 	t.treeTX.mu.Lock()
 	defer t.treeTX.mu.Unlock()
 
 	res := make([]*trillian.QueuedLogLeaf, len(leaves))
 	ok := status.New(codes.OK, "OK").Proto()
+	timestamp = t.truncateTimestamp(timestamp)
 
 	// Leaves in this transaction are inserted in two tables. For each leaf, if
 	// one of the two inserts fails, we remove the side effect by rolling back to
 	// a savepoint installed before the first insert of the two.
-	const savepoint = "SAVEPOINT AddSequencedLeaves"
-	if _, err := t.tx.ExecContext(ctx, savepoint); err != nil {
-		klog.Errorf("Error adding savepoint: %s", err)
+	sp := newSavepoint(t.tx, "AddSequencedLeaves")
+	if err := sp.Set(ctx); err != nil {
+		klog.Errorf("%sError adding savepoint: %s", requestIDPrefix(ctx), err)
 		return nil, mysqlToGRPC(err)
 	}
 	// TODO(pavelkalinnikov): Consider performance implication of executing this
@@ -543,20 +2051,31 @@ func (t *logTreeTX) AddSequencedLeaves(ctx context.Context, leaves []*trillian.L
 		i, leaf := ol.idx, ol.leaf
 
 		// This should fail on insert, but catch it early.
-		if got, want := len(leaf.LeafIdentityHash), t.hashSizeBytes; got != want {
-			return nil, status.Errorf(codes.FailedPrecondition, "leaves[%d] has incorrect hash size %d, want %d", i, got, want)
+		if err := t.checkHashSize(leaf.LeafIdentityHash, "leaves[%d].LeafIdentityHash", i); err != nil {
+			return nil, err
+		}
+		if idx, max := leaf.LeafIndex, t.ls.opts.MaxSequencedLeafIndex; idx < 0 || (max > 0 && idx >= max) {
+			res[i] = &trillian.QueuedLogLeaf{Status: status.Newf(codes.FailedPrecondition, "leaves[%d] has invalid LeafIndex %d", i, idx).Proto()}
+			continue
+		}
+		if got := len(leaf.IndexKey); got > maxIndexKeyLen {
+			res[i] = &trillian.QueuedLogLeaf{Status: status.Newf(codes.FailedPrecondition, "leaves[%d] has IndexKey of length %d, want <= %d", i, got, maxIndexKeyLen).Proto()}
+			continue
 		}
 
-		if _, err := t.tx.ExecContext(ctx, savepoint); err != nil {
-			klog.Errorf("Error updating savepoint: %s", err)
+		if err := sp.Set(ctx); err != nil {
+			klog.Errorf("%sError updating savepoint: %s", requestIDPrefix(ctx), err)
 			return nil, mysqlToGRPC(err)
 		}
 
 		res[i] = &trillian.QueuedLogLeaf{Status: ok}
 
 		// TODO(pavelkalinnikov): Measure latencies.
-		_, err := t.tx.ExecContext(ctx, insertLeafDataSQL,
-			t.treeID, leaf.LeafIdentityHash, leaf.LeafValue, leaf.ExtraData, timestamp.UnixNano())
+		value, extra, err := t.encodeLeaf(leaf.LeafValue, leaf.ExtraData)
+		if err != nil {
+			return nil, err
+		}
+		err = t.insertLeafData(ctx, leaf, nil, value, extra, timestamp.UnixNano())
 		// TODO(pavelkalinnikov): Detach PREORDERED_LOG integration latency metric.
 
 		// TODO(pavelkalinnikov): Support opting out from duplicates detection.
@@ -565,30 +2084,30 @@ func (t *logTreeTX) AddSequencedLeaves(ctx context.Context, leaves []*trillian.L
 			// Note: No rolling back to savepoint because there is no side effect.
 			continue
 		} else if err != nil {
-			klog.Errorf("Error inserting leaves[%d] into LeafData: %s", i, err)
+			klog.Errorf("%sError inserting leaves[%d] into LeafData: %s", requestIDPrefix(ctx), i, err)
 			return nil, mysqlToGRPC(err)
 		}
 
-		_, err = t.tx.ExecContext(ctx, insertSequencedLeafSQL+valuesPlaceholder5,
-			t.treeID, leaf.LeafIdentityHash, leaf.MerkleLeafHash, leaf.LeafIndex, 0)
+		values, args := t.sequencedLeafValues(leaf, nil, 0)
+		_, err = t.tx.ExecContext(ctx, insertSequencedLeafSQL+values, args...)
 		// TODO(pavelkalinnikov): Update IntegrateTimestamp on integrating the leaf.
 
 		if isDuplicateErr(err) {
 			res[i].Status = status.New(codes.FailedPrecondition, "conflicting LeafIndex").Proto()
-			if _, err := t.tx.ExecContext(ctx, "ROLLBACK TO "+savepoint); err != nil {
-				klog.Errorf("Error rolling back to savepoint: %s", err)
+			if err := sp.Rollback(ctx); err != nil {
+				klog.Errorf("%sError rolling back to savepoint: %s", requestIDPrefix(ctx), err)
 				return nil, mysqlToGRPC(err)
 			}
 		} else if err != nil {
-			klog.Errorf("Error inserting leaves[%d] into SequencedLeafData: %s", i, err)
+			klog.Errorf("%sError inserting leaves[%d] into SequencedLeafData: %s", requestIDPrefix(ctx), i, err)
 			return nil, mysqlToGRPC(err)
 		}
 
 		// TODO(pavelkalinnikov): Load LeafData for conflicting entries.
 	}
 
-	if _, err := t.tx.ExecContext(ctx, "RELEASE "+savepoint); err != nil {
-		klog.Errorf("Error releasing savepoint: %s", err)
+	if err := sp.Release(ctx); err != nil {
+		klog.Errorf("%sError releasing savepoint: %s", requestIDPrefix(ctx), err)
 		return nil, mysqlToGRPC(err)
 	}
 
@@ -598,22 +2117,225 @@ func (t *logTreeTX) AddSequencedLeaves(ctx context.Context, leaves []*trillian.L
 func (t *logTreeTX) GetLeavesByRange(ctx context.Context, start, count int64) ([]*trillian.LogLeaf, error) {
 	t.treeTX.mu.Lock()
 	defer t.treeTX.mu.Unlock()
-	return t.getLeavesByRangeInternal(ctx, start, count)
+	return t.getLeavesByRangeInternal(ctx, start, count, nil, nil)
 }
 
-func (t *logTreeTX) getLeavesByRangeInternal(ctx context.Context, start, count int64) ([]*trillian.LogLeaf, error) {
-	if count <= 0 {
-		return nil, status.Errorf(codes.InvalidArgument, "invalid count %d, want > 0", count)
+// GetLeavesByRangeWithGaps is like GetLeavesByRange, but instead of stopping
+// at the first missing index it returns all the leaves present in the range,
+// with their actual indices, and the gaps between them. This gives visibility
+// into partially imported ranges of PREORDERED_LOG trees.
+func (t *logTreeTX) GetLeavesByRangeWithGaps(ctx context.Context, start, count int64) ([]*trillian.LogLeaf, []LeafGap, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+	gaps := []LeafGap{}
+	leaves, err := t.getLeavesByRangeInternal(ctx, start, count, nil, &gaps)
+	if err != nil {
+		return nil, nil, err
 	}
-	if start < 0 {
-		return nil, status.Errorf(codes.InvalidArgument, "invalid start %d, want >= 0", start)
+	return leaves, gaps, nil
+}
+
+// GetLeavesByRangeWithChecksum is like GetLeavesByRange, but also returns the
+// SHA-256 hash of the concatenated MerkleLeafHashes of the returned leaves, in
+// order. Mirrors can compare checksums of a range instead of the leaves.
+func (t *logTreeTX) GetLeavesByRangeWithChecksum(ctx context.Context, start, count int64) ([]*trillian.LogLeaf, []byte, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+	h := sha256.New()
+	leaves, err := t.getLeavesByRangeInternal(ctx, start, count, h, nil)
+	if err != nil {
+		return nil, nil, err
 	}
+	return leaves, h.Sum(nil), nil
+}
 
-	if t.treeType == trillian.TreeType_LOG {
-		treeSize := int64(t.root.TreeSize)
-		if treeSize <= 0 {
-			return nil, status.Errorf(codes.OutOfRange, "empty tree")
-		} else if start >= treeSize {
+// StreamAllLeaves calls cb with each leaf of the tree covered by the
+// transaction's log root, in order, starting at index fromSeq. Leaves are read
+// a page of StreamLeavesPageSize at a time, so the tree needn't fit in memory,
+// and a failed export can be resumed by passing the index after the last leaf
+// it processed. If fromSeq is at or beyond the tree size there's nothing to
+// stream. If cb returns an error, streaming stops and the error is returned.
+//
+// The transaction isn't locked while cb runs, so cb may use it, e.g. to read
+// proofs for the leaves.
+func (t *logTreeTX) StreamAllLeaves(ctx context.Context, fromSeq int64, cb func(*trillian.LogLeaf) error) error {
+	if fromSeq < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid fromSeq %d, want >= 0", fromSeq)
+	}
+	size := int64(t.root.TreeSize)
+	pageSize := int64(t.ls.opts.StreamLeavesPageSize)
+	for start := fromSeq; start < size; {
+		t.treeTX.mu.Lock()
+		leaves, err := t.getLeavesByRangeInternal(ctx, start, min(pageSize, size-start), nil, nil)
+		t.treeTX.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if len(leaves) == 0 {
+			return status.Errorf(codes.DataLoss, "no leaf at index %d of tree of size %d", start, size)
+		}
+		for _, leaf := range leaves {
+			if err := cb(leaf); err != nil {
+				return err
+			}
+		}
+		start += int64(len(leaves))
+	}
+	return nil
+}
+
+// GetLeafAndProof returns the leaf at index together with its inclusion proof
+// in the tree of size treeSize. Both are read within this transaction, at its
+// read revision, so they're consistent with each other and with the
+// transaction's log root, which treeSize mustn't exceed.
+func (t *logTreeTX) GetLeafAndProof(ctx context.Context, index, treeSize int64) (*trillian.LogLeaf, *trillian.Proof, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	if index < 0 || index >= treeSize {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "invalid index %d, want in [0, %d)", index, treeSize)
+	}
+	if uint64(treeSize) > t.root.TreeSize {
+		return nil, nil, status.Errorf(codes.OutOfRange, "tree size %d is beyond the current tree size %d", treeSize, t.root.TreeSize)
+	}
+
+	leaves, err := t.getLeavesByRangeInternal(ctx, index, 1, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(leaves) != 1 || leaves[0].LeafIndex != index {
+		return nil, nil, status.Errorf(codes.NotFound, "leaf %d not found", index)
+	}
+
+	pn, err := proof.Inclusion(uint64(index), uint64(treeSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes, err := t.subtreeCache.GetNodes(pn.IDs, t.getSubtreesAtRev(ctx, t.readRev))
+	if err != nil {
+		return nil, nil, err
+	}
+	if got, want := len(nodes), len(pn.IDs); got != want {
+		return nil, nil, fmt.Errorf("expected %d nodes from storage but got %d", want, got)
+	}
+	hashes := make([][]byte, len(nodes))
+	for i, node := range nodes {
+		if got, want := node.ID, pn.IDs[i]; got != want {
+			return nil, nil, fmt.Errorf("expected node %v at proof pos %d but got %v", want, i, got)
+		}
+		hashes[i] = node.Hash
+	}
+	path, err := pn.Rehash(hashes, t.hasher.HashChildren)
+	if err != nil {
+		return nil, nil, err
+	}
+	return leaves[0], &trillian.Proof{LeafIndex: index, Hashes: path}, nil
+}
+
+// VerifyInclusionBatch reports, for each entry, whether its leaf hash is
+// included at its index in the tree of size treeSize, whose root is the one
+// stored for that size. The proofs are built from nodes read in a single
+// batch, and verified against the root, within this transaction. Entries with
+// an index at or beyond treeSize aren't included. Fails with NotFound if no
+// root of size treeSize is stored.
+func (t *logTreeTX) VerifyInclusionBatch(ctx context.Context, treeSize int64, entries []InclusionEntry) ([]bool, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	if treeSize <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid tree size %d, want > 0", treeSize)
+	}
+	if uint64(treeSize) > t.root.TreeSize {
+		return nil, status.Errorf(codes.OutOfRange, "tree size %d is beyond the current tree size %d", treeSize, t.root.TreeSize)
+	}
+	for i, e := range entries {
+		if e.Index < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "entries[%d] has invalid index %d, want >= 0", i, e.Index)
+		}
+	}
+
+	rootHash := t.root.RootHash
+	if uint64(treeSize) != t.root.TreeSize {
+		if err := t.tx.QueryRowContext(ctx, selectRootHashAtSizeSQL, t.treeID, treeSize, t.readRev).Scan(&rootHash); err == sql.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "no root of size %d is stored", treeSize)
+		} else if err != nil {
+			klog.Warningf("%sFailed to get root hash at size %d: %s", requestIDPrefix(ctx), treeSize, err)
+			return nil, err
+		}
+	}
+
+	// Read the nodes of all the proofs at once, so that the subtrees they
+	// share are only read once.
+	nodeSets := make([]proof.Nodes, len(entries))
+	var ids []compact.NodeID
+	seen := make(map[compact.NodeID]bool)
+	for i, e := range entries {
+		if e.Index >= treeSize {
+			continue
+		}
+		pn, err := proof.Inclusion(uint64(e.Index), uint64(treeSize))
+		if err != nil {
+			return nil, err
+		}
+		nodeSets[i] = pn
+		for _, id := range pn.IDs {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	nodes, err := t.subtreeCache.GetNodes(ids, t.getSubtreesAtRev(ctx, t.readRev))
+	if err != nil {
+		return nil, err
+	}
+	if got, want := len(nodes), len(ids); got != want {
+		return nil, fmt.Errorf("expected %d nodes from storage but got %d", want, got)
+	}
+	hashes := make(map[compact.NodeID][]byte, len(nodes))
+	for i, node := range nodes {
+		if got, want := node.ID, ids[i]; got != want {
+			return nil, fmt.Errorf("expected node %v at position %d but got %v", want, i, got)
+		}
+		hashes[node.ID] = node.Hash
+	}
+
+	ret := make([]bool, len(entries))
+	for i, e := range entries {
+		if e.Index >= treeSize {
+			continue
+		}
+		pn := nodeSets[i]
+		proofHashes := make([][]byte, len(pn.IDs))
+		for j, id := range pn.IDs {
+			proofHashes[j] = hashes[id]
+		}
+		path, err := pn.Rehash(proofHashes, t.hasher.HashChildren)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = proof.VerifyInclusion(t.hasher, uint64(e.Index), uint64(treeSize), e.LeafHash, path, rootHash) == nil
+	}
+	return ret, nil
+}
+
+// getLeavesByRangeInternal returns the leaves in [start, start+count). If
+// checksum is not nil, the MerkleLeafHash of each returned leaf is written to
+// it as the rows are scanned. If gaps is not nil, missing indices don't end
+// the range but are appended to it instead.
+func (t *logTreeTX) getLeavesByRangeInternal(ctx context.Context, start, count int64, checksum hash.Hash, gaps *[]LeafGap) ([]*trillian.LogLeaf, error) {
+	if count <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid count %d, want > 0", count)
+	}
+	if start < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid start %d, want >= 0", start)
+	}
+
+	if t.treeType == trillian.TreeType_LOG {
+		treeSize := int64(t.root.TreeSize)
+		if treeSize <= 0 {
+			return nil, status.Errorf(codes.OutOfRange, "empty tree")
+		} else if start >= treeSize {
 			return nil, status.Errorf(codes.OutOfRange, "invalid start %d, want < TreeSize(%d)", start, treeSize)
 		}
 		// Ensure no entries queried/returned beyond the tree.
@@ -626,7 +2348,7 @@ func (t *logTreeTX) getLeavesByRangeInternal(ctx context.Context, start, count i
 	args := []interface{}{start, start + count, t.treeID}
 	rows, err := t.tx.QueryContext(ctx, selectLeavesByRangeSQL, args...)
 	if err != nil {
-		klog.Warningf("Failed to get leaves by range: %s", err)
+		klog.Warningf("%sFailed to get leaves by range: %s", requestIDPrefix(ctx), err)
 		return nil, err
 	}
 	defer func() {
@@ -636,7 +2358,8 @@ func (t *logTreeTX) getLeavesByRangeInternal(ctx context.Context, start, count i
 	}()
 
 	ret := make([]*trillian.LogLeaf, 0, count)
-	for wantIndex := start; rows.Next(); wantIndex++ {
+	wantIndex := start
+	for ; rows.Next(); wantIndex++ {
 		leaf := &trillian.LogLeaf{}
 		var qTimestamp, iTimestamp int64
 		if err := rows.Scan(
@@ -647,12 +2370,19 @@ func (t *logTreeTX) getLeavesByRangeInternal(ctx context.Context, start, count i
 			&leaf.ExtraData,
 			&qTimestamp,
 			&iTimestamp); err != nil {
-			klog.Warningf("Failed to scan merkle leaves: %s", err)
+			klog.Warningf("%sFailed to scan merkle leaves: %s", requestIDPrefix(ctx), err)
+			return nil, err
+		}
+		if err := t.decodeLeaf(&leaf.LeafValue, &leaf.ExtraData); err != nil {
 			return nil, err
 		}
+		if gaps != nil && leaf.LeafIndex > wantIndex {
+			*gaps = append(*gaps, LeafGap{Start: wantIndex, End: leaf.LeafIndex})
+			wantIndex = leaf.LeafIndex
+		}
 		if leaf.LeafIndex != wantIndex {
 			if wantIndex < int64(t.root.TreeSize) {
-				return nil, fmt.Errorf("got unexpected index %d, want %d", leaf.LeafIndex, wantIndex)
+				return nil, &UnexpectedIndexError{TreeID: t.treeID, Got: leaf.LeafIndex, Want: wantIndex}
 			}
 			break
 		}
@@ -664,37 +2394,747 @@ func (t *logTreeTX) getLeavesByRangeInternal(ctx context.Context, start, count i
 		if err := leaf.IntegrateTimestamp.CheckValid(); err != nil {
 			return nil, fmt.Errorf("got invalid integrate timestamp: %w", err)
 		}
+		if checksum != nil {
+			checksum.Write(leaf.MerkleLeafHash)
+		}
 		ret = append(ret, leaf)
 	}
 	if err := rows.Err(); err != nil {
-		klog.Warningf("Failed to read returned leaves: %s", err)
+		klog.Warningf("%sFailed to read returned leaves: %s", requestIDPrefix(ctx), err)
 		return nil, err
 	}
+	if gaps != nil && wantIndex < start+count {
+		*gaps = append(*gaps, LeafGap{Start: wantIndex, End: start + count})
+	}
 
 	return ret, nil
 }
 
+// GetExtraDataByIndex returns the ExtraData of the leaf at the given index,
+// without reading the rest of the leaf.
+func (t *logTreeTX) GetExtraDataByIndex(ctx context.Context, index int64) ([]byte, error) {
+	if treeSize := int64(t.root.TreeSize); index < 0 || index >= treeSize {
+		return nil, status.Errorf(codes.OutOfRange, "invalid index %d, want in [0, %d)", index, treeSize)
+	}
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	var extraData []byte
+	err := t.tx.QueryRowContext(ctx, selectExtraDataByIndexSQL, t.treeID, index).Scan(&extraData)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, status.Errorf(codes.NotFound, "leaf %d not found", index)
+	case err != nil:
+		klog.Warningf("%sFailed to get extra data by index: %s", requestIDPrefix(ctx), err)
+		return nil, err
+	}
+	return decodeLeafData(t.compressLeafData, extraData)
+}
+
+// CountLeavesInRange returns the number of sequenced leaves with indices in
+// [start, end), without reading them. A count of end-start means the range has
+// no gaps.
+func (t *logTreeTX) CountLeavesInRange(ctx context.Context, start, end int64) (int64, error) {
+	if start < 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid start %d, want >= 0", start)
+	}
+	if end < start {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid end %d, want >= start(%d)", end, start)
+	}
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	var count int64
+	if err := t.tx.QueryRowContext(ctx, countLeavesInRangeSQL, t.treeID, start, end).Scan(&count); err != nil {
+		klog.Warningf("%sFailed to count leaves in range: %s", requestIDPrefix(ctx), err)
+		return 0, err
+	}
+	return count, nil
+}
+
+// CanAdvanceToSize reports whether the tree has a sequenced leaf, with its
+// LeafData, at every index in [0, n), so that a root of size n can be built.
+// If not, it also returns up to the first 10 missing indices.
+func (t *logTreeTX) CanAdvanceToSize(ctx context.Context, n int64) (bool, []int64, error) {
+	if n < 0 {
+		return false, nil, status.Errorf(codes.InvalidArgument, "invalid size %d, want >= 0", n)
+	}
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	var count int64
+	if err := t.tx.QueryRowContext(ctx, countLeavesWithDataSQL, t.treeID, n).Scan(&count); err != nil {
+		klog.Warningf("%sFailed to count leaves: %s", requestIDPrefix(ctx), err)
+		return false, nil, err
+	}
+	if count == n {
+		return true, nil, nil
+	}
+
+	// Find the first gaps by walking the present indices in order.
+	rows, err := t.tx.QueryContext(ctx, selectLeafIndicesWithDataSQL, t.treeID, n)
+	if err != nil {
+		klog.Warningf("%sFailed to read leaf indices: %s", requestIDPrefix(ctx), err)
+		return false, nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+	missing := []int64{}
+	next := int64(0)
+	for len(missing) < maxMissingIndices && rows.Next() {
+		var seq int64
+		if err := rows.Scan(&seq); err != nil {
+			return false, nil, err
+		}
+		for ; next < seq && len(missing) < maxMissingIndices; next++ {
+			missing = append(missing, next)
+		}
+		next = seq + 1
+	}
+	if err := rows.Err(); err != nil {
+		return false, nil, err
+	}
+	for ; next < n && len(missing) < maxMissingIndices; next++ {
+		missing = append(missing, next)
+	}
+	return false, missing, nil
+}
+
+// GetLeavesIntegratedSince returns up to limit leaves in the tree with an
+// IntegrateTimestamp after sinceNanos, ordered by IntegrateTimestamp and then
+// by LeafIndex. Since the sequencer integrates a whole batch of leaves with
+// the same timestamp, if the limit splits a batch then the rest of it is
+// returned too, so that the IntegrateTimestamp of the last leaf can be used as
+// the next watermark without missing any leaves.
+//
+// The leaves are read using the SequencedLeafIntegrateIdx index, without
+// which each call reads all of the tree's sequenced leaves.
+func (t *logTreeTX) GetLeavesIntegratedSince(ctx context.Context, sinceNanos int64, limit int) ([]*trillian.LogLeaf, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	if limit <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid limit %d, want > 0", limit)
+	}
+	leaves, err := t.getLeavesIntegratedAfter(ctx, sinceNanos, math.MaxInt64, limit)
+	if err != nil || len(leaves) < limit {
+		return leaves, err
+	}
+	// Fetch the remainder of the last batch.
+	last := leaves[len(leaves)-1]
+	lastNanos := last.IntegrateTimestamp.AsTime().UnixNano()
+	rest, err := t.queryLeavesIntegrated(ctx, selectLeavesIntegratedAtSQL, lastNanos, t.treeID, int64(t.root.TreeSize), lastNanos, last.LeafIndex)
+	if err != nil {
+		return nil, err
+	}
+	return append(leaves, rest...), nil
+}
+
+// getLeavesIntegratedAfter returns up to limit leaves in the tree that come
+// after (afterNanos, afterIndex) in (IntegrateTimestamp, LeafIndex) order.
+func (t *logTreeTX) getLeavesIntegratedAfter(ctx context.Context, afterNanos, afterIndex int64, limit int) ([]*trillian.LogLeaf, error) {
+	return t.queryLeavesIntegrated(ctx, selectLeavesIntegratedSinceSQL, afterNanos, t.treeID, int64(t.root.TreeSize), afterNanos, afterNanos, afterIndex, limit)
+}
+
+// queryLeavesIntegrated returns the leaves selected by query, which is one of
+// the selectLeavesIntegrated statements, for the watermark sinceNanos.
+func (t *logTreeTX) queryLeavesIntegrated(ctx context.Context, query string, sinceNanos int64, args ...interface{}) ([]*trillian.LogLeaf, error) {
+	rows, err := t.tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		klog.Warningf("%sFailed to get leaves integrated since %d: %s", requestIDPrefix(ctx), sinceNanos, err)
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+	return t.scanLeaves(rows, "integrated-since", nil)
+}
+
+// StreamIdentityHashes calls cb with the sequence number and LeafIdentityHash
+// of every sequenced leaf at or after fromSeq, in sequence number order. Only
+// the two columns are read from SequencedLeafData, which makes this much
+// cheaper than GetLeavesByRange for building external indices. For LOG trees
+// the stream stops at the current tree size. If cb returns an error the
+// iteration stops and the error is returned.
+func (t *logTreeTX) StreamIdentityHashes(ctx context.Context, fromSeq int64, cb func(seq int64, hash []byte) error) error {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	if fromSeq < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid fromSeq %d, want >= 0", fromSeq)
+	}
+	end := int64(math.MaxInt64)
+	if t.treeType == trillian.TreeType_LOG {
+		end = int64(t.root.TreeSize)
+	}
+
+	rows, err := t.tx.QueryContext(ctx, selectIdentityHashesFromSQL, t.treeID, fromSeq, end)
+	if err != nil {
+		klog.Warningf("%sFailed to stream identity hashes: %s", requestIDPrefix(ctx), err)
+		return err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+
+	for rows.Next() {
+		var seq int64
+		var hash []byte
+		if err := rows.Scan(&seq, &hash); err != nil {
+			klog.Warningf("%sFailed to scan identity hash: %s", requestIDPrefix(ctx), err)
+			return err
+		}
+		if err := cb(seq, hash); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// LeafSizeHistogram counts the tree's leaves by the stored size of their
+// LeafValue, which is the compressed size for trees with CompressLeafData
+// set, and includes the encryption overhead for trees with EncryptLeafValue
+// set. buckets are the inclusive upper bounds of the histogram's buckets, in
+// increasing order, and the count of leaves larger than the last bound is
+// keyed by math.MaxInt64. Buckets without any leaves are absent from the
+// result.
+func (t *logTreeTX) LeafSizeHistogram(ctx context.Context, buckets []int64) (map[int64]int64, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	if len(buckets) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no buckets given")
+	}
+	var sb strings.Builder
+	sb.WriteString("SELECT CASE")
+	args := make([]interface{}, 0, 2*len(buckets)+2)
+	for i, bound := range buckets {
+		if i > 0 && bound <= buckets[i-1] {
+			return nil, status.Errorf(codes.InvalidArgument, "bucket bounds must increase, got %d after %d", bound, buckets[i-1])
+		}
+		sb.WriteString(" WHEN LENGTH(LeafValue) <= ? THEN ?")
+		args = append(args, bound, bound)
+	}
+	sb.WriteString(" ELSE ? END AS Bucket,COUNT(*) FROM LeafData WHERE TreeId = ? GROUP BY Bucket")
+	args = append(args, int64(math.MaxInt64), t.treeID)
+
+	rows, err := t.tx.QueryContext(ctx, sb.String(), args...)
+	if err != nil {
+		klog.Warningf("%sFailed to count leaf sizes: %s", requestIDPrefix(ctx), err)
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+
+	hist := make(map[int64]int64)
+	for rows.Next() {
+		var bucket, count int64
+		if err := rows.Scan(&bucket, &count); err != nil {
+			klog.Warningf("%sFailed to scan leaf size count: %s", requestIDPrefix(ctx), err)
+			return nil, err
+		}
+		hist[bucket] = count
+	}
+	return hist, rows.Err()
+}
+
+// FindMerkleHashCollisions returns up to limit MerkleLeafHashes which are
+// shared by sequenced leaves with different LeafIdentityHashes, in hash
+// order, together with those identity hashes. Each MerkleLeafHash should
+// belong to a single leaf, so any results indicate corrupt data.
+func (t *logTreeTX) FindMerkleHashCollisions(ctx context.Context, limit int) ([]MerkleHashCollision, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	if limit <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid limit %d, want > 0", limit)
+	}
+	rows, err := t.tx.QueryContext(ctx, selectMerkleHashCollisionsSQL, t.treeID, limit, t.treeID)
+	if err != nil {
+		klog.Warningf("%sFailed to find Merkle hash collisions: %s", requestIDPrefix(ctx), err)
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+
+	var ret []MerkleHashCollision
+	for rows.Next() {
+		var merkleHash, identityHash []byte
+		if err := rows.Scan(&merkleHash, &identityHash); err != nil {
+			klog.Warningf("%sFailed to scan Merkle hash collision: %s", requestIDPrefix(ctx), err)
+			return nil, err
+		}
+		if n := len(ret); n == 0 || !bytes.Equal(ret[n-1].MerkleLeafHash, merkleHash) {
+			ret = append(ret, MerkleHashCollision{MerkleLeafHash: merkleHash})
+		}
+		c := &ret[len(ret)-1]
+		c.LeafIdentityHashes = append(c.LeafIdentityHashes, identityHash)
+	}
+	return ret, rows.Err()
+}
+
+// DumpSubtrees calls cb with the ID and stored Nodes bytes of each of the
+// tree's subtrees, as of the given revision, in subtree ID order. The bytes
+// are passed on as stored, without being decoded or checked, so that storage
+// can be compared against expected contents when debugging. Trees without
+// subtree revisions only store the latest version of each subtree, which is
+// dumped regardless of revision. If cb returns an error the iteration stops
+// and the error is returned.
+func (t *logTreeTX) DumpSubtrees(ctx context.Context, revision int64, cb func(subtreeID []byte, nodes []byte) error) error {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	var rows *sql.Rows
+	var err error
+	if t.subtreeRevs {
+		if revision < 0 {
+			return status.Errorf(codes.InvalidArgument, "invalid revision %d, want >= 0", revision)
+		}
+		rows, err = t.tx.QueryContext(ctx, dumpSubtreesAtRevisionSQL, t.treeID, revision, t.treeID)
+	} else {
+		rows, err = t.tx.QueryContext(ctx, dumpSubtreesNoRevSQL, t.treeID)
+	}
+	if err != nil {
+		klog.Warningf("%sFailed to dump subtrees: %s", requestIDPrefix(ctx), err)
+		return err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+
+	for rows.Next() {
+		var subtreeID, nodes []byte
+		if err := rows.Scan(&subtreeID, &nodes); err != nil {
+			klog.Warningf("%sFailed to scan subtree: %s", requestIDPrefix(ctx), err)
+			return err
+		}
+		if err := cb(subtreeID, nodes); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
 func (t *logTreeTX) GetLeavesByHash(ctx context.Context, leafHashes [][]byte, orderBySequence bool) ([]*trillian.LogLeaf, error) {
 	t.treeTX.mu.Lock()
 	defer t.treeTX.mu.Unlock()
 
-	tmpl, err := t.ls.getLeavesByMerkleHashStmt(ctx, len(leafHashes), orderBySequence)
+	return t.getLeavesByMerkleHash(ctx, leafHashes, orderBySequence, nil)
+}
+
+// GetLeavesByHashBestEffort is like GetLeavesByHash, but a leaf which can't be
+// read, e.g. because its stored data is corrupt, doesn't fail the whole call.
+// Instead, the leaves which were read are returned along with a map from the
+// MerkleLeafHash of each unreadable leaf to its error. Hashes of the wrong
+// size are reported in the map too. Failures of the query itself are still
+// returned as an error.
+func (t *logTreeTX) GetLeavesByHashBestEffort(ctx context.Context, leafHashes [][]byte, orderBySequence bool) ([]*trillian.LogLeaf, map[string]error, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	errs := make(map[string]error)
+	leaves, err := t.getLeavesByMerkleHash(ctx, leafHashes, orderBySequence, errs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return leaves, errs, nil
+}
+
+// GetLeavesByHashPage returns up to limit of the leaves with the given
+// MerkleLeafHashes, ordered by LeafIndex and skipping the first offset of
+// them, so that callers can page through hashes which match many leaves. Unlike
+// GetLeavesByHash, the hashes must fit in a single query.
+func (t *logTreeTX) GetLeavesByHashPage(ctx context.Context, leafHashes [][]byte, limit, offset int64) ([]*trillian.LogLeaf, error) {
+	if limit <= 0 || offset < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid limit %d or offset %d", limit, offset)
+	}
+	if max := t.ls.opts.MaxHashesPerQuery; max > 0 && len(leafHashes) > max {
+		return nil, status.Errorf(codes.InvalidArgument, "got %d hashes, want at most %d", len(leafHashes), max)
+	}
+	if len(leafHashes) == 0 {
+		return nil, nil
+	}
+	for i, hash := range leafHashes {
+		if err := t.checkHashSize(hash, "leafHashes[%d]", i); err != nil {
+			return nil, err
+		}
+	}
+
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	tmpl, err := t.ls.getLeavesByMerkleHashPageStmt(ctx, len(leafHashes))
 	if err != nil {
+		return nil, tooLargeToGRPC(err, len(leafHashes))
+	}
+	return t.getLeavesByHashInternal(ctx, leafHashes, tmpl, "merkle-page", nil, limit, offset)
+}
+
+// getLeavesByMerkleHash implements GetLeavesByHash, collecting per-row errors
+// in errs if it's non-nil.
+func (t *logTreeTX) getLeavesByMerkleHash(ctx context.Context, leafHashes [][]byte, orderBySequence bool, errs map[string]error) ([]*trillian.LogLeaf, error) {
+	valid := make([][]byte, 0, len(leafHashes))
+	for i, hash := range leafHashes {
+		if err := t.checkHashSize(hash, "leafHashes[%d]", i); err != nil {
+			if errs == nil {
+				return nil, err
+			}
+			errs[string(hash)] = err
+			continue
+		}
+		valid = append(valid, hash)
+	}
+	leafHashes = valid
+	leaves, chunked, err := t.getLeavesByHashChunked(ctx, leafHashes, func(num int) (*sql.Stmt, error) {
+		return t.ls.getLeavesByMerkleHashStmt(ctx, num, orderBySequence)
+	}, "merkle", errs)
+	if err != nil {
+		return nil, err
+	}
+	if orderBySequence && chunked {
+		// Each chunk is ordered, but the concatenation of them is not.
+		sort.SliceStable(leaves, func(i, j int) bool { return leaves[i].LeafIndex < leaves[j].LeafIndex })
+	}
+	return leaves, nil
+}
+
+// GetLeavesByIndexKey returns the sequenced leaves which were queued with the
+// given IndexKey, ordered by LeafIndex.
+func (t *logTreeTX) GetLeavesByIndexKey(ctx context.Context, key []byte) ([]*trillian.LogLeaf, error) {
+	if len(key) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "index key must not be empty")
+	}
+
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	rows, err := t.tx.QueryContext(ctx, selectLeavesByIndexKeySQL, t.treeID, key)
+	if err != nil {
+		klog.Warningf("%sFailed to get leaves by index key: %s", requestIDPrefix(ctx), err)
 		return nil, err
 	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+	leaves, err := t.scanLeaves(rows, "index-key", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, leaf := range leaves {
+		leaf.IndexKey = key
+	}
+	return leaves, nil
+}
+
+// GetLeafStatus reports where the leaf with the given LeafIdentityHash is in
+// the queue / sequence / integrate pipeline, as seen by this transaction.
+func (t *logTreeTX) GetLeafStatus(ctx context.Context, identityHash []byte) (LeafStatus, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	var seq sql.NullInt64
+	var queued bool
+	err := t.tx.QueryRowContext(ctx, selectLeafStatusSQL, t.treeID, identityHash).Scan(&seq, &queued)
+	switch {
+	case err == sql.ErrNoRows:
+		return LeafStatus{State: LeafUnknown}, nil
+	case err != nil:
+		klog.Warningf("%sFailed to get leaf status: %s", requestIDPrefix(ctx), err)
+		return LeafStatus{}, err
+	}
+
+	switch {
+	case seq.Valid && uint64(seq.Int64) < t.root.TreeSize:
+		return LeafStatus{State: LeafIntegrated, LeafIndex: seq.Int64, TreeSize: t.root.TreeSize}, nil
+	case seq.Valid:
+		return LeafStatus{State: LeafSequenced, LeafIndex: seq.Int64}, nil
+	case queued:
+		return LeafStatus{State: LeafQueued}, nil
+	}
+	return LeafStatus{State: LeafUnknown}, nil
+}
+
+// GetLeafProvenance returns when the leaf with the given LeafIdentityHash was
+// queued and sequenced, and the first signed root which included it, as seen by
+// this transaction. It returns NotFound if there is no such leaf.
+func (t *logTreeTX) GetLeafProvenance(ctx context.Context, identityHash []byte) (LeafProvenance, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	var queueTS int64
+	var seq, integrateTS sql.NullInt64
+	err := t.tx.QueryRowContext(ctx, selectLeafProvenanceSQL, t.treeID, identityHash).Scan(&queueTS, &seq, &integrateTS)
+	switch {
+	case err == sql.ErrNoRows:
+		return LeafProvenance{}, status.Errorf(codes.NotFound, "leaf %x not found", identityHash)
+	case err != nil:
+		klog.Warningf("%sFailed to get leaf provenance: %s", requestIDPrefix(ctx), err)
+		return LeafProvenance{}, err
+	}
+
+	p := LeafProvenance{QueueTimestamp: time.Unix(0, queueTS)}
+	if !seq.Valid {
+		return p, nil
+	}
+	p.Sequenced = true
+	p.LeafIndex = seq.Int64
+	p.IntegrateTimestamp = time.Unix(0, integrateTS.Int64)
+
+	_, root, rev, err := scanSignedLogRoot(t.tx.QueryRowContext(ctx, selectFirstCoveringTreeHeadSQL, t.treeID, seq.Int64, t.readRev))
+	switch {
+	case err == sql.ErrNoRows:
+		return p, nil
+	case err != nil:
+		klog.Warningf("%sFailed to get first covering tree head: %s", requestIDPrefix(ctx), err)
+		return LeafProvenance{}, err
+	}
+	p.Included = true
+	p.Revision = rev
+	p.TreeSize = root.TreeSize
+	return p, nil
+}
+
+// OldestQueuedLeafAge returns how long the oldest leaf in the tree's queue has
+// been waiting to be sequenced, or zero if the queue is empty.
+func (t *logTreeTX) OldestQueuedLeafAge(ctx context.Context) (time.Duration, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	var oldest sql.NullInt64
+	if err := t.tx.QueryRowContext(ctx, selectOldestQueueTimestampSQL, t.treeID).Scan(&oldest); err != nil {
+		klog.Warningf("%sFailed to get oldest queue timestamp: %s", requestIDPrefix(ctx), err)
+		return 0, err
+	}
+	if !oldest.Valid {
+		return 0, nil
+	}
+	return time.Since(time.Unix(0, oldest.Int64)), nil
+}
+
+// RequeueOrphanedDequeued re-inserts Unsequenced entries for leaves queued
+// before cutoff that are neither sequenced nor queued, e.g. because they were
+// lost after being dequeued by a sequencer that crashed. It returns the number
+// of leaves requeued. Requeued entries keep their original queue timestamp
+// and MerkleLeafHash, so calling this again requeues nothing.
+//
+// The MerkleLeafHash is read from LeafData, so this fails with
+// FailedPrecondition unless RecordMerkleLeafHash is set, and leaves queued
+// before it was set are skipped. The candidate rows are locked, so leaves
+// dequeued by a sequencer which hasn't committed yet are waited for rather
+// than requeued. Leaves dequeued by this transaction are skipped.
+func (t *logTreeTX) RequeueOrphanedDequeued(ctx context.Context, cutoff time.Time) (int, error) {
+	if !t.ls.opts.RecordMerkleLeafHash {
+		return 0, status.Error(codes.FailedPrecondition, "requeuing orphaned leaves requires RecordMerkleLeafHash")
+	}
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	type orphan struct {
+		identityHash   []byte
+		merkleHash     []byte
+		queueTimestamp int64
+		dedupNamespace []byte
+	}
+	var orphans []orphan
+	var unhashed int
+	err := func() error {
+		rows, err := t.tx.QueryContext(ctx, selectOrphanedLeavesSQL, t.treeID, cutoff.UnixNano())
+		if err != nil {
+			klog.Warningf("%sFailed to select orphaned leaves: %s", requestIDPrefix(ctx), err)
+			return err
+		}
+		defer func() {
+			if err := rows.Close(); err != nil {
+				klog.Errorf("rows.Close(): %v", err)
+			}
+		}()
+		for rows.Next() {
+			var o orphan
+			if err := rows.Scan(&o.identityHash, &o.merkleHash, &o.queueTimestamp, &o.dedupNamespace); err != nil {
+				klog.Warningf("%sFailed to scan orphaned leaf: %s", requestIDPrefix(ctx), err)
+				return err
+			}
+			if dq, ok := t.dequeued[string(o.identityHash)]; ok && bytes.Equal(dq.dedupNamespace, o.dedupNamespace) {
+				continue
+			}
+			if o.merkleHash == nil {
+				unhashed++
+				continue
+			}
+			orphans = append(orphans, o)
+		}
+		return rows.Err()
+	}()
+	if err != nil {
+		return 0, err
+	}
+	if unhashed > 0 {
+		klog.Warningf("%sSkipped %d orphaned leaves of tree %d without a stored MerkleLeafHash", requestIDPrefix(ctx), unhashed, t.treeID)
+	}
+
+	for _, o := range orphans {
+		args := []interface{}{t.treeID, o.identityHash, o.merkleHash, dedupNamespaceArg(o.dedupNamespace)}
+		args = append(args, queueArgs(t.treeID, o.identityHash, o.dedupNamespace, time.Unix(0, o.queueTimestamp))...)
+		if _, err := t.tx.ExecContext(ctx, insertUnsequencedEntrySQL, args...); err != nil {
+			klog.Warningf("%sError requeuing orphaned leaf %x: %s", requestIDPrefix(ctx), o.identityHash, err)
+			return 0, err
+		}
+	}
+	return len(orphans), nil
+}
+
+// leafData is the LeafData row of a leaf, which is all that's known about a
+// leaf before it's sequenced. Unlike a LogLeaf, it has no fields for a Merkle
+// leaf hash, index or integrate timestamp, so they can't be mistaken for real
+// values.
+type leafData struct {
+	identityHash   []byte
+	value          []byte
+	extraData      []byte
+	queueTimestamp time.Time
+}
+
+// getLeafDataByIdentityHash retrieves the LeafData rows of the leaves with the
+// given LeafIdentityHash values in the given deduplication namespace, in no
+// particular order. Hashes without a row are skipped, and repeated hashes are
+// only looked up once. The hashes are looked up in chunks of at most
+// MaxHashesPerQuery.
+func (t *logTreeTX) getLeafDataByIdentityHash(ctx context.Context, namespace []byte, leafHashes [][]byte) ([]leafData, error) {
+	seen := make(map[string]bool, len(leafHashes))
+	unique := make([][]byte, 0, len(leafHashes))
+	for _, hash := range leafHashes {
+		if !seen[string(hash)] {
+			seen[string(hash)] = true
+			unique = append(unique, hash)
+		}
+	}
+	chunkSize := t.ls.opts.MaxHashesPerQuery
+	if chunkSize <= 0 {
+		chunkSize = len(unique)
+	}
 
-	return t.getLeavesByHashInternal(ctx, leafHashes, tmpl, "merkle")
+	var ret []leafData
+	for start := 0; start < len(unique); start += chunkSize {
+		chunk := unique[start:min(start+chunkSize, len(unique))]
+		data, err := t.getLeafDataChunk(ctx, namespace, chunk)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, data...)
+	}
+	return ret, nil
 }
 
-// getLeafDataByIdentityHash retrieves leaf data by LeafIdentityHash, returned
-// as a slice of LogLeaf objects for convenience.  However, note that the
-// returned LogLeaf objects will not have a valid MerkleLeafHash, LeafIndex, or IntegrateTimestamp.
-func (t *logTreeTX) getLeafDataByIdentityHash(ctx context.Context, leafHashes [][]byte) ([]*trillian.LogLeaf, error) {
-	tmpl, err := t.ls.getLeavesByLeafIdentityHashStmt(ctx, len(leafHashes))
+func (t *logTreeTX) getLeafDataChunk(ctx context.Context, namespace []byte, leafHashes [][]byte) ([]leafData, error) {
+	tmpl, err := t.ls.getLeafDataByIdentityHashStmt(ctx, len(leafHashes))
+	if err != nil {
+		return nil, tooLargeToGRPC(err, len(leafHashes))
+	}
+	stx := t.tx.StmtContext(ctx, tmpl)
+	defer func() {
+		if err := stx.Close(); err != nil {
+			klog.Errorf("stx.Close(): %v", err)
+		}
+	}()
+
+	args := make([]interface{}, 0, len(leafHashes)+2)
+	for _, hash := range leafHashes {
+		args = append(args, hash)
+	}
+	args = append(args, t.treeID, dedupNamespaceArg(namespace))
+	rows, err := stx.QueryContext(ctx, args...)
 	if err != nil {
+		warnings.Warningf(t.treeID, "%sQuery() leaf-data hash = %v", requestIDPrefix(ctx), err)
+		return nil, tooLargeToGRPC(err, len(leafHashes))
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+
+	var ret []leafData
+	for rows.Next() {
+		var d leafData
+		var queueTS int64
+		if err := rows.Scan(&d.identityHash, &d.value, &d.extraData, &queueTS); err != nil {
+			warnings.Warningf(t.treeID, "LogID: %d Scan() leaf-data = %s", t.treeID, err)
+			return nil, err
+		}
+		if err := t.decodeLeaf(&d.value, &d.extraData); err != nil {
+			return nil, err
+		}
+		d.queueTimestamp = time.Unix(0, queueTS)
+		ret = append(ret, d)
+	}
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-	return t.getLeavesByHashInternal(ctx, leafHashes, tmpl, "leaf-identity")
+	return ret, nil
+}
+
+// getLeavesByHashChunked runs the hash-selection statement returned by
+// getStmt over leafHashes, splitting the hashes into chunks of at most
+// MaxHashesPerQuery so that the statement stays within MySQL's limits on
+// placeholders and packet size. Repeated hashes are only looked up once, which
+// matches the semantics of a single IN clause. The returned bool reports
+// whether more than one query was needed, in which case the results are not
+// ordered across chunks. Per-row errors are collected in errs, if non-nil, as
+// described for scanLeaves.
+func (t *logTreeTX) getLeavesByHashChunked(ctx context.Context, leafHashes [][]byte, getStmt func(num int) (*sql.Stmt, error), desc string, errs map[string]error) ([]*trillian.LogLeaf, bool, error) {
+	if len(leafHashes) == 0 {
+		return nil, false, nil
+	}
+	chunkSize := t.ls.opts.MaxHashesPerQuery
+	if chunkSize <= 0 || len(leafHashes) <= chunkSize {
+		tmpl, err := getStmt(len(leafHashes))
+		if err != nil {
+			return nil, false, tooLargeToGRPC(err, len(leafHashes))
+		}
+		leaves, err := t.getLeavesByHashInternal(ctx, leafHashes, tmpl, desc, errs)
+		return leaves, false, err
+	}
+
+	seen := make(map[string]bool, len(leafHashes))
+	unique := make([][]byte, 0, len(leafHashes))
+	for _, hash := range leafHashes {
+		if !seen[string(hash)] {
+			seen[string(hash)] = true
+			unique = append(unique, hash)
+		}
+	}
+
+	var ret []*trillian.LogLeaf
+	for start := 0; start < len(unique); start += chunkSize {
+		chunk := unique[start:min(start+chunkSize, len(unique))]
+		tmpl, err := getStmt(len(chunk))
+		if err != nil {
+			return nil, false, tooLargeToGRPC(err, len(chunk))
+		}
+		leaves, err := t.getLeavesByHashInternal(ctx, chunk, tmpl, desc, errs)
+		if err != nil {
+			return nil, false, err
+		}
+		ret = append(ret, leaves...)
+	}
+	return ret, len(unique) > chunkSize, nil
 }
 
 func (t *logTreeTX) LatestSignedLogRoot(ctx context.Context) (*trillian.SignedLogRoot, error) {
@@ -708,29 +3148,212 @@ func (t *logTreeTX) LatestSignedLogRoot(ctx context.Context) (*trillian.SignedLo
 	return t.slr, nil
 }
 
+// Checkpoint returns the body of a checkpoint for the latest root, in the
+// transparency-dev signed note format:
+//
+//	<origin>
+//	<tree size>
+//	<base64 root hash>
+//
+// The body is terminated by a newline, and is ready to be signed by the
+// caller. The origin must be non-empty and must not contain a newline.
+func (t *logTreeTX) Checkpoint(ctx context.Context, origin string) ([]byte, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	if origin == "" || strings.Contains(origin, "\n") {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid checkpoint origin %q", origin)
+	}
+	if t.slr == nil {
+		return nil, storage.ErrTreeNeedsInit
+	}
+	return []byte(fmt.Sprintf("%s\n%d\n%s\n", origin, t.root.TreeSize, base64.StdEncoding.EncodeToString(t.root.RootHash))), nil
+}
+
+// ExportTreeHeads calls cb with the size, timestamp, root hash and signature
+// of every stored root of the tree at or after fromRevision, in revision
+// order. Rows are streamed, so the whole history isn't held in memory. If cb
+// returns an error the iteration stops and the error is returned.
+func (t *logTreeTX) ExportTreeHeads(ctx context.Context, fromRevision int64, cb func(size int64, timestampNanos int64, rootHash, signature []byte) error) error {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	rows, err := t.tx.QueryContext(ctx, selectTreeHeadsFromRevisionSQL, t.treeID, fromRevision)
+	if err != nil {
+		klog.Warningf("%sFailed to export tree heads: %s", requestIDPrefix(ctx), err)
+		return err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+
+	for rows.Next() {
+		var size, timestamp int64
+		var rootHash, signature []byte
+		if err := rows.Scan(&size, &timestamp, &rootHash, &signature); err != nil {
+			klog.Warningf("%sFailed to scan tree head: %s", requestIDPrefix(ctx), err)
+			return err
+		}
+		if err := cb(size, timestamp, rootHash, signature); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// VerifyRevisionContinuity checks that the revisions of the tree's TreeHead
+// rows, taken in timestamp order, increase by exactly one from each root to
+// the next. It returns a DataLoss error describing every gap or non-increasing
+// step it finds. It's read-only and is intended for use by storage operators.
+func (t *logTreeTX) VerifyRevisionContinuity(ctx context.Context) error {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	rows, err := t.tx.QueryContext(ctx, selectTreeHeadRevisionsSQL, t.treeID)
+	if err != nil {
+		klog.Warningf("%sFailed to read tree head revisions: %s", requestIDPrefix(ctx), err)
+		return err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			klog.Errorf("rows.Close(): %v", err)
+		}
+	}()
+
+	var problems []string
+	var prevTimestamp, prevRev int64
+	first := true
+	for rows.Next() {
+		var timestamp, rev int64
+		if err := rows.Scan(&timestamp, &rev); err != nil {
+			klog.Warningf("%sFailed to scan tree head revision: %s", requestIDPrefix(ctx), err)
+			return err
+		}
+		if !first {
+			switch {
+			case rev <= prevRev:
+				problems = append(problems, fmt.Sprintf("revision %d at timestamp %d does not increase on revision %d at timestamp %d", rev, timestamp, prevRev, prevTimestamp))
+			case rev != prevRev+1:
+				problems = append(problems, fmt.Sprintf("revisions %d to %d missing between timestamps %d and %d", prevRev+1, rev-1, prevTimestamp, timestamp))
+			}
+		}
+		first = false
+		prevTimestamp, prevRev = timestamp, rev
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return status.Errorf(codes.DataLoss, "tree %d has %d TreeHead revision discontinuities: %s", t.treeID, len(problems), strings.Join(problems, "; "))
+	}
+	return nil
+}
+
 // fetchLatestRoot reads the latest root and the revision from the DB.
 func (t *logTreeTX) fetchLatestRoot(ctx context.Context) (*trillian.SignedLogRoot, int64, error) {
-	var timestamp, treeSize, treeRevision int64
-	var rootHash, rootSignatureBytes []byte
-	if err := t.tx.QueryRowContext(
-		ctx, selectLatestSignedLogRootSQL, t.treeID).Scan(
-		&timestamp, &treeSize, &rootHash, &treeRevision, &rootSignatureBytes,
-	); err == sql.ErrNoRows {
+	slr, _, treeRevision, err := scanSignedLogRoot(t.tx.QueryRowContext(ctx, selectLatestSignedLogRootSQL, t.treeID))
+	if err == sql.ErrNoRows {
 		// It's possible there are no roots for this tree yet
 		return nil, 0, storage.ErrTreeNeedsInit
+	} else if err != nil {
+		return nil, 0, err
+	}
+	return slr, treeRevision, nil
+}
+
+// scanSignedLogRoot scans a TreeHead row of TreeHeadTimestamp, TreeSize,
+// RootHash, TreeRevision and RootSignature, as selected by the log root
+// statements, and puts the log root back together. It returns the root, both
+// signed and parsed, and its revision. Scan errors, including sql.ErrNoRows,
+// are returned as-is.
+func scanSignedLogRoot(row *sql.Row) (*trillian.SignedLogRoot, types.LogRootV1, int64, error) {
+	var timestamp, treeSize, treeRevision int64
+	var rootHash, rootSignatureBytes []byte
+	if err := row.Scan(&timestamp, &treeSize, &rootHash, &treeRevision, &rootSignatureBytes); err != nil {
+		return nil, types.LogRootV1{}, 0, err
 	}
 
 	// Put logRoot back together. Fortunately LogRoot has a deterministic serialization.
-	logRoot, err := (&types.LogRootV1{
+	root := types.LogRootV1{
 		RootHash:       rootHash,
 		TimestampNanos: uint64(timestamp),
 		TreeSize:       uint64(treeSize),
-	}).MarshalBinary()
+	}
+	logRoot, err := root.MarshalBinary()
 	if err != nil {
-		return nil, 0, err
+		return nil, types.LogRootV1{}, 0, err
+	}
+	return &trillian.SignedLogRoot{LogRoot: logRoot}, root, treeRevision, nil
+}
+
+// FirstRootCovering returns the earliest stored log root, by revision, whose
+// tree includes the leaf at index, i.e. the first checkpoint of size greater
+// than index. Only roots visible at the transaction's read revision are
+// considered, so it fails with NotFound if index isn't below the size of the
+// transaction's root.
+func (t *logTreeTX) FirstRootCovering(ctx context.Context, index int64) (*trillian.SignedLogRoot, error) {
+	t.treeTX.mu.Lock()
+	defer t.treeTX.mu.Unlock()
+
+	if index < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid index %d, want >= 0", index)
+	}
+	slr, _, _, err := scanSignedLogRoot(t.tx.QueryRowContext(ctx, selectFirstCoveringTreeHeadSQL, t.treeID, index, t.readRev))
+	if err == sql.ErrNoRows {
+		return nil, status.Errorf(codes.NotFound, "no log root covers index %d", index)
+	} else if err != nil {
+		klog.Warningf("%sFailed to get first log root covering %d: %s", requestIDPrefix(ctx), index, err)
+		return nil, err
+	}
+	return slr, nil
+}
+
+// pinRevision makes t read the tree at the given revision, which must be no
+// later than its current read revision.
+func (t *logTreeTX) pinRevision(ctx context.Context, revision int64) error {
+	if !t.subtreeRevs {
+		return status.Errorf(codes.FailedPrecondition, "tree %d doesn't store subtree revisions", t.treeID)
 	}
+	if revision < 0 || revision > t.readRev {
+		return status.Errorf(codes.OutOfRange, "revision %d is outside [0, %d]", revision, t.readRev)
+	}
+
+	slr, root, treeRevision, err := scanSignedLogRoot(t.tx.QueryRowContext(ctx, selectSignedLogRootAtRevisionSQL, t.treeID, revision))
+	if err == sql.ErrNoRows {
+		return status.Errorf(codes.NotFound, "no log root at revision %d", revision)
+	} else if err != nil {
+		return mysqlToGRPC(err)
+	}
+	t.slr = slr
+	t.root = root
+	t.readRev = treeRevision
+	t.treeTX.writeRevision = treeRevision + 1
+	return nil
+}
 
-	return &trillian.SignedLogRoot{LogRoot: logRoot}, treeRevision, nil
+// checkMonotonicRoot returns FailedPrecondition if root would move the tree
+// backwards relative to the latest stored root, i.e. if it's smaller or not
+// newer.
+func (t *logTreeTX) checkMonotonicRoot(ctx context.Context, root *types.LogRootV1) error {
+	slr, _, err := t.fetchLatestRoot(ctx)
+	if err == storage.ErrTreeNeedsInit {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var latest types.LogRootV1
+	if err := latest.UnmarshalBinary(slr.LogRoot); err != nil {
+		return err
+	}
+	if root.TreeSize < latest.TreeSize {
+		return status.Errorf(codes.FailedPrecondition, "root has TreeSize %d, less than latest %d", root.TreeSize, latest.TreeSize)
+	}
+	if root.TimestampNanos <= latest.TimestampNanos {
+		return status.Errorf(codes.FailedPrecondition, "root has TimestampNanos %d, not after latest %d", root.TimestampNanos, latest.TimestampNanos)
+	}
+	return nil
 }
 
 func (t *logTreeTX) StoreSignedLogRoot(ctx context.Context, root *trillian.SignedLogRoot) error {
@@ -739,12 +3362,17 @@ func (t *logTreeTX) StoreSignedLogRoot(ctx context.Context, root *trillian.Signe
 
 	var logRoot types.LogRootV1
 	if err := logRoot.UnmarshalBinary(root.LogRoot); err != nil {
-		klog.Warningf("Failed to parse log root: %x %v", root.LogRoot, err)
+		klog.Warningf("%sFailed to parse log root: %x %v", requestIDPrefix(ctx), root.LogRoot, err)
 		return err
 	}
 	if len(logRoot.Metadata) != 0 {
 		return fmt.Errorf("unimplemented: mysql storage does not support log root metadata")
 	}
+	if t.ls.opts.EnforceMonotonicRoots {
+		if err := t.checkMonotonicRoot(ctx, &logRoot); err != nil {
+			return err
+		}
+	}
 
 	res, err := t.tx.ExecContext(
 		ctx,
@@ -756,13 +3384,15 @@ func (t *logTreeTX) StoreSignedLogRoot(ctx context.Context, root *trillian.Signe
 		t.treeTX.writeRevision,
 		[]byte{})
 	if err != nil {
-		klog.Warningf("Failed to store signed root: %s", err)
+		klog.Warningf("%sFailed to store signed root: %s", requestIDPrefix(ctx), err)
 	}
 
 	return checkResultOkAndRowCountIs(res, err, 1)
 }
 
-func (t *logTreeTX) getLeavesByHashInternal(ctx context.Context, leafHashes [][]byte, tmpl *sql.Stmt, desc string) ([]*trillian.LogLeaf, error) {
+// getLeavesByHashInternal runs tmpl with leafHashes, the tree ID and then
+// extraArgs as its arguments, and scans the resulting leaves.
+func (t *logTreeTX) getLeavesByHashInternal(ctx context.Context, leafHashes [][]byte, tmpl *sql.Stmt, desc string, errs map[string]error, extraArgs ...interface{}) ([]*trillian.LogLeaf, error) {
 	stx := t.tx.StmtContext(ctx, tmpl)
 	defer func() {
 		if err := stx.Close(); err != nil {
@@ -775,48 +3405,38 @@ func (t *logTreeTX) getLeavesByHashInternal(ctx context.Context, leafHashes [][]
 		args = append(args, []byte(hash))
 	}
 	args = append(args, t.treeID)
+	args = append(args, extraArgs...)
 	rows, err := stx.QueryContext(ctx, args...)
 	if err != nil {
-		klog.Warningf("Query() %s hash = %v", desc, err)
-		return nil, err
+		warnings.Warningf(t.treeID, "%sQuery() %s hash = %v", requestIDPrefix(ctx), desc, err)
+		return nil, tooLargeToGRPC(err, len(leafHashes))
 	}
 	defer func() {
 		if err := rows.Close(); err != nil {
 			klog.Errorf("rows.Close(): %v", err)
 		}
 	}()
+	return t.scanLeaves(rows, desc, errs)
+}
 
+// scanLeaves reads leaves from rows, which must have the columns selected by
+// selectLeavesByMerkleHashSQL. If errs is non-nil, a row which can't be read
+// is recorded in errs against its MerkleLeafHash and skipped, rather than
+// failing the whole scan.
+func (t *logTreeTX) scanLeaves(rows *sql.Rows, desc string, errs map[string]error) ([]*trillian.LogLeaf, error) {
 	// The tree could include duplicates so we don't know how many results will be returned
 	var ret []*trillian.LogLeaf
 	for rows.Next() {
-		leaf := &trillian.LogLeaf{}
-		// We might be using a LEFT JOIN in our statement, so leaves which are
-		// queued but not yet integrated will have a NULL IntegrateTimestamp
-		// when there's no corresponding entry in SequencedLeafData, even though
-		// the table definition forbids that, so we use a nullable type here and
-		// check its validity below.
-		var integrateTS sql.NullInt64
-		var queueTS int64
-
-		if err := rows.Scan(&leaf.MerkleLeafHash, &leaf.LeafIdentityHash, &leaf.LeafValue, &leaf.LeafIndex, &leaf.ExtraData, &queueTS, &integrateTS); err != nil {
-			klog.Warningf("LogID: %d Scan() %s = %s", t.treeID, desc, err)
-			return nil, err
-		}
-		leaf.QueueTimestamp = timestamppb.New(time.Unix(0, queueTS))
-		if err := leaf.QueueTimestamp.CheckValid(); err != nil {
-			return nil, fmt.Errorf("got invalid queue timestamp: %w", err)
-		}
-		if integrateTS.Valid {
-			leaf.IntegrateTimestamp = timestamppb.New(time.Unix(0, integrateTS.Int64))
-			if err := leaf.IntegrateTimestamp.CheckValid(); err != nil {
-				return nil, fmt.Errorf("got invalid integrate timestamp: %w", err)
+		leaf, err := t.scanLeaf(rows, desc)
+		if err != nil {
+			// The hash is the first column scanned, so it's usually available
+			// even when a later column failed.
+			if errs != nil && len(leaf.MerkleLeafHash) > 0 {
+				errs[string(leaf.MerkleLeafHash)] = err
+				continue
 			}
+			return nil, err
 		}
-
-		if got, want := len(leaf.MerkleLeafHash), t.hashSizeBytes; got != want {
-			return nil, fmt.Errorf("LogID: %d Scanned leaf %s does not have hash length %d, got %d", t.treeID, desc, want, got)
-		}
-
 		ret = append(ret, leaf)
 	}
 	if err := rows.Err(); err != nil {
@@ -827,6 +3447,44 @@ func (t *logTreeTX) getLeavesByHashInternal(ctx context.Context, leafHashes [][]
 	return ret, nil
 }
 
+// scanLeaf reads the current row of rows for scanLeaves. The leaf is returned
+// even on error, with whatever fields could be read.
+func (t *logTreeTX) scanLeaf(rows *sql.Rows, desc string) (*trillian.LogLeaf, error) {
+	leaf := &trillian.LogLeaf{}
+	// We might be using a LEFT JOIN in our statement, so leaves which are
+	// queued but not yet integrated will have a NULL IntegrateTimestamp
+	// when there's no corresponding entry in SequencedLeafData, even though
+	// the table definition forbids that, so we use a nullable type here and
+	// check its validity below.
+	var integrateTS sql.NullInt64
+	var queueTS int64
+
+	if err := rows.Scan(&leaf.MerkleLeafHash, &leaf.LeafIdentityHash, &leaf.LeafValue, &leaf.LeafIndex, &leaf.ExtraData, &queueTS, &integrateTS); err != nil {
+		warnings.Warningf(t.treeID, "LogID: %d Scan() %s = %s", t.treeID, desc, err)
+		return leaf, err
+	}
+	if err := t.decodeLeaf(&leaf.LeafValue, &leaf.ExtraData); err != nil {
+		return leaf, err
+	}
+	leaf.QueueTimestamp = timestamppb.New(time.Unix(0, queueTS))
+	if err := leaf.QueueTimestamp.CheckValid(); err != nil {
+		return leaf, fmt.Errorf("got invalid queue timestamp: %w", err)
+	}
+	if integrateTS.Valid {
+		leaf.IntegrateTimestamp = timestamppb.New(time.Unix(0, integrateTS.Int64))
+		if err := leaf.IntegrateTimestamp.CheckValid(); err != nil {
+			return leaf, fmt.Errorf("got invalid integrate timestamp: %w", err)
+		}
+	}
+
+	if !t.ls.opts.SkipReadHashValidation {
+		if got, want := len(leaf.MerkleLeafHash), t.hashSizeBytes; got != want {
+			return leaf, fmt.Errorf("LogID: %d Scanned leaf %s does not have hash length %d, got %d", t.treeID, desc, want, got)
+		}
+	}
+	return leaf, nil
+}
+
 // leafAndPosition records original position before sort.
 type leafAndPosition struct {
 	leaf *trillian.LogLeaf
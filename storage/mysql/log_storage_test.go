@@ -19,25 +19,40 @@ import (
 	"context"
 	"crypto/sha256"
 	"database/sql"
+	"errors"
 	"fmt"
+	"math"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/google/trillian"
 	"github.com/google/trillian/integration/storagetest"
 	"github.com/google/trillian/storage"
+	"github.com/google/trillian/storage/mysql/mysqlpb"
+	"github.com/google/trillian/storage/storagepb"
 	"github.com/google/trillian/storage/testonly"
+	stree "github.com/google/trillian/storage/tree"
 	"github.com/google/trillian/types"
+	"github.com/transparency-dev/merkle/compact"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"k8s.io/klog/v2"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
-var allTables = []string{"Unsequenced", "TreeHead", "SequencedLeafData", "LeafData", "Subtree", "TreeControl", "Trees"}
+var allTables = []string{"Unsequenced", "TreeHead", "SequencedLeafData", "LeafData", "Subtree", "TreeControl", "TreeAnnotations", "TreeAudit", "Trees"}
 
 // Must be 32 bytes to match sha256 length if it was a real hash
 var (
@@ -224,6 +239,705 @@ func TestQueueLeaves(t *testing.T) {
 	}
 }
 
+func TestQueueLeavesNormalizeEmptyExtraData(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		desc      string
+		normalize bool
+		wantNulls int
+	}{
+		{desc: "default", normalize: false, wantNulls: 1},
+		{desc: "normalized", normalize: true, wantNulls: 0},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			cleanTestDB(DB)
+			as := NewAdminStorage(DB)
+			tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+			s := NewLogStorageWithOptions(DB, LogStorageOptions{NormalizeEmptyExtraData: tc.normalize})
+			mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+			leaves := createTestLeaves(2, 0)
+			leaves[0].ExtraData = nil
+			leaves[1].ExtraData = []byte{}
+			if _, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
+				t.Fatalf("Failed to queue leaves: %v", err)
+			}
+
+			var nulls int
+			if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM LeafData WHERE TreeId=? AND ExtraData IS NULL", tree.TreeId).Scan(&nulls); err != nil {
+				t.Fatalf("Could not query NULL count: %v", err)
+			}
+			if nulls != tc.wantNulls {
+				t.Errorf("Got %d rows with NULL ExtraData, want %d", nulls, tc.wantNulls)
+			}
+		})
+	}
+}
+
+func TestQueueLeavesTimestampResolution(t *testing.T) {
+	ctx := context.Background()
+
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{TimestampResolution: time.Microsecond})
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	queueTime := fakeQueueTime.Add(1234 * time.Nanosecond)
+	wantTime := queueTime.Truncate(time.Microsecond)
+	leaves := createTestLeaves(2, 0)
+	if _, err := s.QueueLeaves(ctx, tree, leaves, queueTime); err != nil {
+		t.Fatalf("Failed to queue leaves: %v", err)
+	}
+	for _, table := range []string{"LeafData", "Unsequenced"} {
+		var nanos int64
+		if err := DB.QueryRowContext(ctx, "SELECT DISTINCT QueueTimestampNanos FROM "+table+" WHERE TreeId=?", tree.TreeId).Scan(&nanos); err != nil {
+			t.Fatalf("Could not query %s timestamp: %v", table, err)
+		}
+		if got, want := nanos, wantTime.UnixNano(); got != want {
+			t.Errorf("%s QueueTimestampNanos = %d, want %d", table, got, want)
+		}
+	}
+	for i, leaf := range leaves {
+		if got := leaf.QueueTimestamp.AsTime(); !got.Equal(wantTime) {
+			t.Errorf("leaves[%d].QueueTimestamp = %v, want %v", i, got, wantTime)
+		}
+	}
+}
+
+func TestAddSequencedLeavesServerIntegrateTimestamp(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.PreorderedLogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{ServerIntegrateTimestamp: true})
+
+	if _, err := s.AddSequencedLeaves(ctx, tree, createTestLeaves(2, 0), fakeQueueTime); err != nil {
+		t.Fatalf("AddSequencedLeaves(): %v", err)
+	}
+	rows, err := DB.QueryContext(ctx, "SELECT IntegrateTimestampNanos FROM SequencedLeafData WHERE TreeId=?", tree.TreeId)
+	if err != nil {
+		t.Fatalf("Could not query integrate timestamps: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var nanos int64
+		if err := rows.Scan(&nanos); err != nil {
+			t.Fatalf("Scan(): %v", err)
+		}
+		// The database's clock needn't match ours exactly.
+		if got := time.Unix(0, nanos); time.Since(got).Abs() > time.Hour {
+			t.Errorf("IntegrateTimestampNanos = %v, want about %v", got, time.Now())
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("rows.Err(): %v", err)
+	}
+}
+
+func TestQueueLeavesInNamespace(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil).(*mySQLLogStorage)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	leaf := createTestLeaves(1, 0)[0]
+	idHash := leaf.LeafIdentityHash
+	for _, tc := range []struct {
+		namespace string
+		want      codes.Code
+	}{
+		{namespace: "", want: codes.OK},
+		{namespace: "a", want: codes.OK},
+		{namespace: "b", want: codes.OK},
+		{namespace: "a", want: codes.AlreadyExists},
+		{namespace: "", want: codes.AlreadyExists},
+	} {
+		res, err := s.QueueLeavesInNamespace(ctx, tree, []*trillian.LogLeaf{leaf}, fakeQueueTime, []byte(tc.namespace))
+		if err != nil {
+			t.Fatalf("QueueLeavesInNamespace(%q): %v", tc.namespace, err)
+		}
+		if got := codes.Code(res[0].Status.GetCode()); got != tc.want {
+			t.Errorf("QueueLeavesInNamespace(%q): got code %v, want %v", tc.namespace, got, tc.want)
+		}
+		if got := res[0].Leaf.LeafIdentityHash; !bytes.Equal(got, idHash) {
+			t.Errorf("QueueLeavesInNamespace(%q): got LeafIdentityHash %x, want %x", tc.namespace, got, idHash)
+		}
+	}
+	if _, err := s.QueueLeavesInNamespace(ctx, tree, []*trillian.LogLeaf{leaf}, fakeQueueTime, make([]byte, maxDedupNamespaceLen+1)); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("QueueLeavesInNamespace() with long namespace = %v, want code %v", err, codes.InvalidArgument)
+	}
+	skip := NewLogStorageWithOptions(DB, LogStorageOptions{SkipDequeueTracking: true}).(*mySQLLogStorage)
+	if _, err := skip.QueueLeavesInNamespace(ctx, tree, []*trillian.LogLeaf{leaf}, fakeQueueTime, []byte("c")); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("QueueLeavesInNamespace() with SkipDequeueTracking = %v, want code %v", err, codes.FailedPrecondition)
+	}
+
+	// Each transaction dequeues the leaf of only one namespace, as they share
+	// an identity hash.
+	var sequenced int64
+	for i := 0; i < 4; i++ {
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			dequeued, err := tx.DequeueLeaves(ctx, 10, fakeDequeueCutoffTime)
+			if err != nil {
+				t.Fatalf("DequeueLeaves(): %v", err)
+			}
+			if len(dequeued) > 1 {
+				t.Errorf("DequeueLeaves() returned %d leaves, want <= 1", len(dequeued))
+			}
+			for _, leaf := range dequeued {
+				leaf.LeafIndex = sequenced
+				leaf.IntegrateTimestamp = timestamppb.Now()
+				sequenced++
+			}
+			return tx.UpdateSequencedLeaves(ctx, dequeued)
+		})
+	}
+	if got, want := sequenced, int64(3); got != want {
+		t.Fatalf("Sequenced %d leaves, want %d", got, want)
+	}
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		return storeLogRoot(ctx, tx, uint64(sequenced), 1, []byte{1})
+	})
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		leaves, err := tx.GetLeavesByRange(ctx, 0, sequenced)
+		if err != nil {
+			t.Fatalf("GetLeavesByRange(): %v", err)
+		}
+		if got, want := len(leaves), int(sequenced); got != want {
+			t.Fatalf("GetLeavesByRange() returned %d leaves, want %d", got, want)
+		}
+		for _, l := range leaves {
+			if !bytes.Equal(l.LeafIdentityHash, idHash) || !bytes.Equal(l.LeafValue, leaf.LeafValue) {
+				t.Errorf("GetLeavesByRange() returned leaf (%x, %q), want (%x, %q)", l.LeafIdentityHash, l.LeafValue, idHash, leaf.LeafValue)
+			}
+		}
+		return nil
+	})
+	got, err := s.GetLeavesByIdentityHashAcrossTrees(ctx, idHash, []int64{tree.TreeId})
+	if err != nil {
+		t.Fatalf("GetLeavesByIdentityHashAcrossTrees(): %v", err)
+	}
+	if l := got[tree.TreeId]; l == nil || l.LeafIndex != 0 {
+		t.Errorf("GetLeavesByIdentityHashAcrossTrees() = %v, want the leaf at index 0", got)
+	}
+}
+
+func TestQueueLeavesWithPositions(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil).(*mySQLLogStorage)
+	createFakeLeaf(ctx, DB, tree.TreeId, dummyRawHash, dummyHash, []byte("data"), nil, 5, t)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 6)
+
+	leaves := createTestLeaves(3, 100)
+	// leaves[0] duplicates the sequenced leaf, and leaves[2] duplicates
+	// leaves[1], which is new.
+	leaves[0].LeafIdentityHash = dummyRawHash
+	leaves[2] = leaves[1]
+	res, err := s.QueueLeavesWithPositions(ctx, tree, leaves, fakeQueueTime)
+	if err != nil {
+		t.Fatalf("QueueLeavesWithPositions(): %v", err)
+	}
+	for i, want := range []struct {
+		code      codes.Code
+		leafIndex int64
+	}{
+		{code: codes.AlreadyExists, leafIndex: 5},
+		{code: codes.OK},
+		{code: codes.AlreadyExists, leafIndex: -1},
+	} {
+		if got := codes.Code(res[i].Status.GetCode()); got != want.code {
+			t.Errorf("QueueLeavesWithPositions(): leaves[%d] status %v, want %v", i, got, want.code)
+		}
+		if want.code == codes.AlreadyExists && res[i].Leaf.LeafIndex != want.leafIndex {
+			t.Errorf("QueueLeavesWithPositions(): leaves[%d] LeafIndex %d, want %d", i, res[i].Leaf.LeafIndex, want.leafIndex)
+		}
+	}
+	if got := res[0].Leaf.MerkleLeafHash; !bytes.Equal(got, dummyHash) {
+		t.Errorf("QueueLeavesWithPositions(): leaves[0] MerkleLeafHash %x, want %x", got, dummyHash)
+	}
+}
+
+func TestQueueLeavesDuplicateStatusDetails(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{DuplicatePositionDetails: true})
+	createFakeLeaf(ctx, DB, tree.TreeId, dummyRawHash, dummyHash, []byte("data"), nil, 5, t)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 6)
+
+	leaves := createTestLeaves(3, 100)
+	// leaves[0] duplicates the sequenced leaf, and leaves[2] duplicates
+	// leaves[1], which is new.
+	leaves[0].LeafIdentityHash = dummyRawHash
+	leaves[2] = leaves[1]
+	res, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime)
+	if err != nil {
+		t.Fatalf("QueueLeaves(): %v", err)
+	}
+	for i, want := range []*trillian.LogLeaf{
+		{LeafIdentityHash: dummyRawHash, MerkleLeafHash: dummyHash, LeafIndex: 5, IntegrateTimestamp: timestamppb.New(fakeIntegrateTime)},
+		nil,
+		{LeafIdentityHash: leaves[1].LeafIdentityHash, LeafIndex: -1},
+	} {
+		st := status.FromProto(res[i].Status)
+		if want == nil {
+			if st.Code() != codes.OK {
+				t.Errorf("QueueLeaves(): leaves[%d] status %v, want OK", i, st.Code())
+			}
+			continue
+		}
+		if st.Code() != codes.AlreadyExists {
+			t.Errorf("QueueLeaves(): leaves[%d] status %v, want %v", i, st.Code(), codes.AlreadyExists)
+		}
+		details := st.Details()
+		if len(details) != 1 {
+			t.Fatalf("QueueLeaves(): leaves[%d] status has %d details, want 1", i, len(details))
+		}
+		got, ok := details[0].(*trillian.LogLeaf)
+		if !ok {
+			t.Fatalf("QueueLeaves(): leaves[%d] status detail is %T, want *trillian.LogLeaf", i, details[0])
+		}
+		if !proto.Equal(got, want) {
+			t.Errorf("QueueLeaves(): leaves[%d] status detail %v, want %v", i, got, want)
+		}
+	}
+
+	// By default, duplicates' positions aren't looked up.
+	res, err = NewLogStorage(DB, nil).QueueLeaves(ctx, tree, leaves[:1], fakeQueueTime)
+	if err != nil {
+		t.Fatalf("QueueLeaves() without details: %v", err)
+	}
+	if st := status.FromProto(res[0].Status); st.Code() != codes.AlreadyExists || len(st.Details()) != 0 {
+		t.Errorf("QueueLeaves() without details: status %v with %d details, want %v with none", st.Code(), len(st.Details()), codes.AlreadyExists)
+	}
+}
+
+func TestQueueLeavesConcurrent(t *testing.T) {
+	for _, phased := range []bool{false, true} {
+		t.Run(fmt.Sprintf("phased=%v", phased), func(t *testing.T) {
+			ctx := context.Background()
+			cleanTestDB(DB)
+			as := NewAdminStorage(DB)
+			tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+			s := NewLogStorageWithOptions(DB, LogStorageOptions{PhasedQueueInserts: phased})
+			mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+			// Each worker queues a batch overlapping those of its neighbours,
+			// retrying batches aborted by deadlocks as clients would.
+			const workers, batchSize, stride, maxAttempts = 8, 50, 10, 10
+			var wg sync.WaitGroup
+			var retries atomic.Int64
+			errs := make(chan error, workers)
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					leaves := createTestLeaves(batchSize, int64(w*stride))
+					var err error
+					for attempt := 0; attempt < maxAttempts; attempt++ {
+						if _, err = s.QueueLeaves(ctx, tree, leaves, fakeQueueTime); status.Code(err) != codes.Aborted {
+							break
+						}
+						retries.Add(1)
+					}
+					errs <- err
+				}(w)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Errorf("QueueLeaves(): %v", err)
+				}
+			}
+			t.Logf("%d batches retried after deadlocks", retries.Load())
+
+			for _, table := range []string{"LeafData", "Unsequenced"} {
+				var count int
+				if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+" WHERE TreeId=?", tree.TreeId).Scan(&count); err != nil {
+					t.Fatalf("Could not query %s row count: %v", table, err)
+				}
+				if got, want := count, (workers-1)*stride+batchSize; got != want {
+					t.Errorf("Got %d %s rows, want %d", got, table, want)
+				}
+			}
+		})
+	}
+}
+
+func TestQueueLeavesVerifyMerkleLeafHash(t *testing.T) {
+	ctx := context.Background()
+
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{VerifyMerkleLeafHash: true})
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	// createTestLeaves sets MerkleLeafHash to the identity hash.
+	bad := createTestLeaves(1, 0)
+	if _, err := s.QueueLeaves(ctx, tree, bad, fakeQueueTime); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("QueueLeaves() with bad MerkleLeafHash = %v, want InvalidArgument", err)
+	}
+
+	good := createTestLeaves(1, 1)
+	good[0].MerkleLeafHash = rfc6962.DefaultHasher.HashLeaf(good[0].LeafValue)
+	if _, err := s.QueueLeaves(ctx, tree, good, fakeQueueTime); err != nil {
+		t.Errorf("QueueLeaves() with good MerkleLeafHash = %v, want nil", err)
+	}
+}
+
+func TestHashSizeValidation(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	preordered := mustCreateTree(ctx, t, as, testonly.PreorderedLogTree)
+	s := NewLogStorage(DB, nil)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	leaves := createTestLeaves(2, 0)
+	leaves[1].LeafIdentityHash = leaves[1].LeafIdentityHash[:10]
+	_, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("QueueLeaves() with short identity hash = %v, want code %v", err, codes.InvalidArgument)
+	} else if !strings.Contains(err.Error(), "leaves[1].LeafIdentityHash") {
+		t.Errorf("QueueLeaves() error %q doesn't name leaves[1].LeafIdentityHash", err)
+	}
+	if _, err := s.AddSequencedLeaves(ctx, preordered, leaves, fakeQueueTime); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("AddSequencedLeaves() with short identity hash = %v, want code %v", err, codes.InvalidArgument)
+	}
+
+	short := dummyHash[:10]
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		if _, err := tx.GetLeavesByHash(ctx, [][]byte{dummyHash, short}, false); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("GetLeavesByHash() with short hash = %v, want code %v", err, codes.InvalidArgument)
+		}
+		_, errs, err := tx.(*logTreeTX).GetLeavesByHashBestEffort(ctx, [][]byte{dummyHash, short}, false)
+		if err != nil {
+			t.Fatalf("GetLeavesByHashBestEffort(): %v", err)
+		}
+		if got := status.Code(errs[string(short)]); got != codes.InvalidArgument {
+			t.Errorf("GetLeavesByHashBestEffort() error for short hash has code %v, want %v", got, codes.InvalidArgument)
+		}
+		return nil
+	})
+}
+
+func TestReadWriteTransactionCanceled(t *testing.T) {
+	ctx := context.Background()
+
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	cctx, cancel := context.WithCancel(ctx)
+	err := s.ReadWriteTransaction(cctx, tree, func(ctx context.Context, tx storage.LogTreeTX) error {
+		cancel()
+		_, err := tx.(*logTreeTX).QueueLeaves(ctx, createTestLeaves(leavesToInsert, 20), fakeQueueTime)
+		return err
+	})
+	if got, want := status.Code(err), codes.Canceled; got != want {
+		t.Errorf("ReadWriteTransaction() = %v, want code %v", err, want)
+	}
+
+	dctx, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := s.QueueLeaves(dctx, tree, createTestLeaves(leavesToInsert, 20), fakeQueueTime); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("QueueLeaves() = %v, want code %v", err, codes.DeadlineExceeded)
+	}
+	if _, err := s.AddSequencedLeaves(dctx, tree, createTestLeaves(leavesToInsert, 20), fakeQueueTime); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("AddSequencedLeaves() = %v, want code %v", err, codes.DeadlineExceeded)
+	}
+
+	var count int
+	if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM Unsequenced WHERE TreeID=?", tree.TreeId).Scan(&count); err != nil {
+		t.Fatalf("Could not query row count: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Got %d unsequenced rows after canceled transactions, want 0", count)
+	}
+}
+
+func TestReadWriteTransactionBudget(t *testing.T) {
+	ctx := context.Background()
+
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{ReadWriteTxBudget: 50 * time.Millisecond})
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	// The body overruns the budget after writing, so its writes are rolled
+	// back.
+	err := s.ReadWriteTransaction(ctx, tree, func(ctx context.Context, tx storage.LogTreeTX) error {
+		if _, err := tx.(*logTreeTX).QueueLeaves(ctx, createTestLeaves(leavesToInsert, 20), fakeQueueTime); err != nil {
+			return err
+		}
+		<-ctx.Done()
+		return nil
+	})
+	if got, want := status.Code(err), codes.DeadlineExceeded; got != want {
+		t.Errorf("ReadWriteTransaction() = %v, want code %v", err, want)
+	}
+	var count int
+	if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM Unsequenced WHERE TreeID=?", tree.TreeId).Scan(&count); err != nil {
+		t.Fatalf("Could not query row count: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Got %d unsequenced rows after overrunning transaction, want 0", count)
+	}
+
+	// An explicit budget overrides the default one.
+	ls := s.(*mySQLLogStorage)
+	err = ls.ReadWriteTransactionWithBudget(ctx, tree, time.Minute, func(ctx context.Context, tx storage.LogTreeTX) error {
+		time.Sleep(100 * time.Millisecond)
+		_, err := tx.(*logTreeTX).QueueLeaves(ctx, createTestLeaves(leavesToInsert, 20), fakeQueueTime)
+		return err
+	})
+	if err != nil {
+		t.Errorf("ReadWriteTransactionWithBudget() = %v, want nil", err)
+	}
+}
+
+func TestReadWriteTransactionDeadlockRetries(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	mustSignAndStoreLogRoot(ctx, t, NewLogStorage(DB, nil), tree, 0)
+
+	// The first run of the transaction queues leaves and then deadlocks.
+	deadlock := status.Error(codes.Aborted, "MySQL: deadlock")
+	run := func(s storage.LogStorage, calls *int) error {
+		return s.ReadWriteTransaction(ctx, tree, func(ctx context.Context, tx storage.LogTreeTX) error {
+			*calls++
+			if _, err := tx.(*logTreeTX).QueueLeaves(ctx, createTestLeaves(leavesToInsert, 20), fakeQueueTime); err != nil {
+				return err
+			}
+			if *calls == 1 {
+				return deadlock
+			}
+			return nil
+		})
+	}
+	countQueued := func() int {
+		t.Helper()
+		var n int
+		if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM Unsequenced WHERE TreeId=?", tree.TreeId).Scan(&n); err != nil {
+			t.Fatalf("Failed to count queued leaves: %v", err)
+		}
+		return n
+	}
+
+	var calls int
+	if err := run(NewLogStorage(DB, nil), &calls); status.Code(err) != codes.Aborted {
+		t.Errorf("ReadWriteTransaction() without retries = %v, want code %v", err, codes.Aborted)
+	}
+	if calls != 1 || countQueued() != 0 {
+		t.Errorf("Without retries, got %d calls and %d queued leaves, want 1 and 0", calls, countQueued())
+	}
+
+	calls = 0
+	if err := run(NewLogStorageWithOptions(DB, LogStorageOptions{DeadlockRetries: 1}), &calls); err != nil {
+		t.Errorf("ReadWriteTransaction() with retries = %v, want nil", err)
+	}
+	if calls != 2 || countQueued() != leavesToInsert {
+		t.Errorf("With retries, got %d calls and %d queued leaves, want 2 and %d", calls, countQueued(), leavesToInsert)
+	}
+}
+
+func TestAddSequencedLeavesInvalidIndex(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.PreorderedLogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{MaxSequencedLeafIndex: 10})
+
+	leaves := createTestLeaves(3, 8)
+	leaves[0].LeafIndex = -1
+	// leaves[1] has LeafIndex 9, which is in range, and leaves[2] has 10, which
+	// isn't.
+	res, err := s.AddSequencedLeaves(ctx, tree, leaves, fakeQueueTime)
+	if err != nil {
+		t.Fatalf("AddSequencedLeaves(): %v", err)
+	}
+	for i, want := range []codes.Code{codes.FailedPrecondition, codes.OK, codes.FailedPrecondition} {
+		if got := codes.Code(res[i].Status.GetCode()); got != want {
+			t.Errorf("AddSequencedLeaves(): leaves[%d] status %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestAddSequencedLeavesBatched(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.PreorderedLogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{AddSequencedBatchSize: 3})
+
+	// leaves[4] reuses the index of leaves[0], so fails in the second batch.
+	leaves := createTestLeaves(8, 0)
+	leaves[4].LeafIndex = 0
+	res, err := s.AddSequencedLeaves(ctx, tree, leaves, fakeQueueTime)
+	if err != nil {
+		t.Fatalf("AddSequencedLeaves(): %v", err)
+	}
+	if got, want := len(res), len(leaves); got != want {
+		t.Fatalf("AddSequencedLeaves() returned %d results, want %d", got, want)
+	}
+	for i := range leaves {
+		want := codes.OK
+		if i == 4 {
+			want = codes.FailedPrecondition
+		}
+		if got := codes.Code(res[i].Status.GetCode()); got != want {
+			t.Errorf("AddSequencedLeaves(): leaves[%d] status %v, want %v", i, got, want)
+		}
+	}
+
+	var count int
+	if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM SequencedLeafData WHERE TreeId=?", tree.TreeId).Scan(&count); err != nil {
+		t.Fatalf("Could not query row count: %v", err)
+	}
+	if got, want := count, len(leaves)-1; got != want {
+		t.Errorf("Got %d sequenced leaves, want %d", got, want)
+	}
+
+	// leaves[4] has an invalid identity hash, so the second batch fails, but
+	// the results of the first are still returned.
+	tree = mustCreateTree(ctx, t, as, testonly.PreorderedLogTree)
+	leaves = createTestLeaves(8, 0)
+	leaves[4].LeafIdentityHash = []byte("short")
+	res, err = s.AddSequencedLeaves(ctx, tree, leaves, fakeQueueTime)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("AddSequencedLeaves() = %v, want %v", err, codes.InvalidArgument)
+	}
+	if got, want := len(res), 3; got != want {
+		t.Fatalf("AddSequencedLeaves() returned %d results, want %d", got, want)
+	}
+	for i, r := range res {
+		if got := codes.Code(r.Status.GetCode()); got != codes.OK {
+			t.Errorf("AddSequencedLeaves(): leaves[%d] status %v, want %v", i, got, codes.OK)
+		}
+	}
+	if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM SequencedLeafData WHERE TreeId=? AND SequenceNumber<3", tree.TreeId).Scan(&count); err != nil {
+		t.Fatalf("Could not query row count: %v", err)
+	}
+	if got, want := count, 3; got != want {
+		t.Errorf("Got %d sequenced leaves in the first batch, want %d", got, want)
+	}
+}
+
+func TestAddSequencedLeavesIntegrateImmediately(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.PreorderedLogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{IntegrateImmediately: true})
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	// The leaf at index 5 follows a gap, so isn't integrated.
+	leaves := append(createTestLeaves(3, 0), createTestLeaves(1, 5)...)
+	if _, err := s.AddSequencedLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
+		t.Fatalf("AddSequencedLeaves(): %v", err)
+	}
+
+	cr := (&compact.RangeFactory{Hash: rfc6962.DefaultHasher.HashChildren}).NewEmptyRange(0)
+	for _, leaf := range leaves[:3] {
+		if err := cr.Append(leaf.MerkleLeafHash, nil); err != nil {
+			t.Fatalf("Append(): %v", err)
+		}
+	}
+	wantHash, err := cr.GetRootHash(nil)
+	if err != nil {
+		t.Fatalf("GetRootHash(): %v", err)
+	}
+
+	tx, err := s.SnapshotForTree(ctx, tree)
+	if err != nil {
+		t.Fatalf("SnapshotForTree(): %v", err)
+	}
+	defer tx.Close()
+	root, err := tx.LatestSignedLogRoot(ctx)
+	if err != nil {
+		t.Fatalf("LatestSignedLogRoot(): %v", err)
+	}
+	var logRoot types.LogRootV1
+	if err := logRoot.UnmarshalBinary(root.LogRoot); err != nil {
+		t.Fatalf("UnmarshalBinary(): %v", err)
+	}
+	if got, want := logRoot.TreeSize, uint64(3); got != want {
+		t.Errorf("TreeSize = %d, want %d", got, want)
+	}
+	if !bytes.Equal(logRoot.RootHash, wantHash) {
+		t.Errorf("RootHash = %x, want %x", logRoot.RootHash, wantHash)
+	}
+}
+
+func TestAddSequencedLeavesIntegrateImmediatelySkipped(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.PreorderedLogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{IntegrateImmediately: true})
+
+	// A root from the future can't be followed by an integrated one.
+	future := uint64(time.Now().Add(time.Hour).UnixNano())
+	if err := s.ReadWriteTransaction(ctx, tree, func(ctx context.Context, tx storage.LogTreeTX) error {
+		logRoot, err := (&types.LogRootV1{RootHash: []byte{0}, TimestampNanos: future}).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		return tx.StoreSignedLogRoot(ctx, &trillian.SignedLogRoot{LogRoot: logRoot})
+	}); err != nil {
+		t.Fatalf("ReadWriteTransaction(): %v", err)
+	}
+
+	leaves := createTestLeaves(3, 0)
+	if _, err := s.AddSequencedLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
+		t.Fatalf("AddSequencedLeaves(): %v", err)
+	}
+
+	var count int
+	if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM SequencedLeafData WHERE TreeId=?", tree.TreeId).Scan(&count); err != nil {
+		t.Fatalf("Could not query row count: %v", err)
+	}
+	if got, want := count, len(leaves); got != want {
+		t.Errorf("Got %d sequenced leaves, want %d", got, want)
+	}
+
+	tx, err := s.SnapshotForTree(ctx, tree)
+	if err != nil {
+		t.Fatalf("SnapshotForTree(): %v", err)
+	}
+	defer tx.Close()
+	root, err := tx.LatestSignedLogRoot(ctx)
+	if err != nil {
+		t.Fatalf("LatestSignedLogRoot(): %v", err)
+	}
+	var logRoot types.LogRootV1
+	if err := logRoot.UnmarshalBinary(root.LogRoot); err != nil {
+		t.Fatalf("UnmarshalBinary(): %v", err)
+	}
+	if got, want := logRoot.TreeSize, uint64(0); got != want {
+		t.Errorf("TreeSize = %d, want %d", got, want)
+	}
+	if got, want := logRoot.TimestampNanos, future; got != want {
+		t.Errorf("TimestampNanos = %d, want %d", got, want)
+	}
+}
+
 func TestQueueLeavesDuplicateBigBatch(t *testing.T) {
 	t.Skip("Known Issue: https://github.com/google/trillian/issues/1845")
 	ctx := context.Background()
@@ -232,105 +946,2205 @@ func TestQueueLeavesDuplicateBigBatch(t *testing.T) {
 	as := NewAdminStorage(DB)
 	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
 	s := NewLogStorage(DB, nil)
-	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
-
-	const leafCount = 999 + 1
-	leaves := createTestLeaves(leafCount, 20)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	const leafCount = 999 + 1
+	leaves := createTestLeaves(leafCount, 20)
+
+	if _, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
+		t.Fatalf("Failed to queue leaves: %v", err)
+	}
+
+	if _, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
+		t.Fatalf("Failed to queue leaves: %v", err)
+	}
+
+	// Should see the leaves in the database. There is no API to read from the unsequenced data.
+	var count int
+	if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM Unsequenced WHERE TreeID=?", tree.TreeId).Scan(&count); err != nil {
+		t.Fatalf("Could not query row count: %v", err)
+	}
+	if leafCount != count {
+		t.Fatalf("Expected %d unsequenced rows but got: %d", leafCount, count)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+func TestPrefetchSubtrees(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	const size = 871
+	nodes, err := createLogNodesForTreeAtSize(t, size, 0)
+	if err != nil {
+		t.Fatalf("createLogNodesForTreeAtSize(): %v", err)
+	}
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		if err := tx.SetMerkleNodes(ctx, nodes); err != nil {
+			t.Fatalf("SetMerkleNodes(): %v", err)
+		}
+		return storeLogRoot(ctx, tx, size, 0, []byte{1, 2, 3})
+	})
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		ltx := tx.(*logTreeTX)
+		if err := ltx.PrefetchSubtrees(ctx, []int64{size}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("PrefetchSubtrees(%d) = %v, want code %v", size, err, codes.InvalidArgument)
+		}
+		if err := ltx.PrefetchSubtrees(ctx, []int64{0, 500, size - 1}); err != nil {
+			t.Fatalf("PrefetchSubtrees(): %v", err)
+		}
+		ids := make([]compact.NodeID, len(nodes))
+		for i := range nodes {
+			ids[i] = nodes[i].ID
+		}
+		got, err := tx.GetMerkleNodes(ctx, ids)
+		if err != nil {
+			t.Fatalf("GetMerkleNodes(): %v", err)
+		}
+		if err := nodesAreEqual(got, nodes); err != nil {
+			t.Errorf("GetMerkleNodes(): %v", err)
+		}
+		return nil
+	})
+}
+
+func TestBackfillIntegrateTimestamps(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.PreorderedLogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{AllowTimestampBackfill: true})
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	// AddSequencedLeaves stores zero integrate timestamps.
+	if _, err := s.AddSequencedLeaves(ctx, tree, createTestLeaves(5, 0), fakeQueueTime); err != nil {
+		t.Fatalf("AddSequencedLeaves(): %v", err)
+	}
+	createFakeLeaf(ctx, DB, tree.TreeId, dummyRawHash, dummyHash, []byte("data"), nil, 5, t)
+
+	value := fakeQueueTime.UnixNano()
+	n, err := s.(*mySQLLogStorage).BackfillIntegrateTimestamps(ctx, tree.TreeId, value, 2)
+	if err != nil {
+		t.Fatalf("BackfillIntegrateTimestamps(): %v", err)
+	}
+	if n != 5 {
+		t.Errorf("BackfillIntegrateTimestamps() = %d, want 5", n)
+	}
+
+	rows, err := DB.QueryContext(ctx, "SELECT SequenceNumber,IntegrateTimestampNanos FROM SequencedLeafData WHERE TreeId=?", tree.TreeId)
+	if err != nil {
+		t.Fatalf("Failed to read integrate timestamps: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var seq, got int64
+		if err := rows.Scan(&seq, &got); err != nil {
+			t.Fatalf("Scan(): %v", err)
+		}
+		want := value
+		if seq == 5 {
+			want = fakeIntegrateTime.UnixNano()
+		}
+		if got != want {
+			t.Errorf("Leaf %d has IntegrateTimestampNanos %d, want %d", seq, got, want)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("rows.Err(): %v", err)
+	}
+
+	for _, tc := range []struct {
+		desc      string
+		allow     bool
+		value     int64
+		batchSize int
+		want      codes.Code
+	}{
+		{desc: "disabled", allow: false, value: value, batchSize: 2, want: codes.FailedPrecondition},
+		{desc: "zero-value", allow: true, value: 0, batchSize: 2, want: codes.InvalidArgument},
+		{desc: "zero-batch", allow: true, value: value, batchSize: 0, want: codes.InvalidArgument},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			s := NewLogStorageWithOptions(DB, LogStorageOptions{AllowTimestampBackfill: tc.allow})
+			if _, err := s.(*mySQLLogStorage).BackfillIntegrateTimestamps(ctx, tree.TreeId, tc.value, tc.batchSize); status.Code(err) != tc.want {
+				t.Errorf("BackfillIntegrateTimestamps() = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetMerkleNodesBatch(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	const size = 871
+	nodes, err := createLogNodesForTreeAtSize(t, size, 0)
+	if err != nil {
+		t.Fatalf("createLogNodesForTreeAtSize(): %v", err)
+	}
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		if err := tx.SetMerkleNodes(ctx, nodes); err != nil {
+			t.Fatalf("SetMerkleNodes(): %v", err)
+		}
+		return storeLogRoot(ctx, tx, size, 0, []byte{1, 2, 3})
+	})
+
+	// The nodes of proofs for neighbouring leaves overlap.
+	var idSets [][]compact.NodeID
+	for _, index := range []uint64{0, 1, 300, 301, size - 1} {
+		pn, err := proof.Inclusion(index, size)
+		if err != nil {
+			t.Fatalf("proof.Inclusion(%d): %v", index, err)
+		}
+		idSets = append(idSets, pn.IDs)
+	}
+	idSets = append(idSets, nil)
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		got, err := tx.(*logTreeTX).GetMerkleNodesBatch(ctx, idSets)
+		if err != nil {
+			t.Fatalf("GetMerkleNodesBatch(): %v", err)
+		}
+		if len(got) != len(idSets) {
+			t.Fatalf("GetMerkleNodesBatch() returned %d sets, want %d", len(got), len(idSets))
+		}
+		for i, ids := range idSets {
+			want, err := tx.GetMerkleNodes(ctx, ids)
+			if err != nil {
+				t.Fatalf("GetMerkleNodes(): %v", err)
+			}
+			if diff := cmp.Diff(want, got[i], cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("GetMerkleNodesBatch() set %d diff (-want +got):\n%s", i, diff)
+			}
+		}
+		return nil
+	})
+}
+
+func TestGetNodeAt(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	const size = 871
+	nodes, err := createLogNodesForTreeAtSize(t, size, 0)
+	if err != nil {
+		t.Fatalf("createLogNodesForTreeAtSize(): %v", err)
+	}
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		if err := tx.SetMerkleNodes(ctx, nodes); err != nil {
+			t.Fatalf("SetMerkleNodes(): %v", err)
+		}
+		return storeLogRoot(ctx, tx, size, 0, []byte{1, 2, 3})
+	})
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		ltx := tx.(*logTreeTX)
+		for _, want := range nodes {
+			got, err := ltx.GetNodeAt(ctx, want.ID.Level, want.ID.Index)
+			if err != nil {
+				t.Fatalf("GetNodeAt(%d, %d): %v", want.ID.Level, want.ID.Index, err)
+			}
+			if !bytes.Equal(got.Hash, want.Hash) {
+				t.Errorf("GetNodeAt(%d, %d) = %x, want %x", want.ID.Level, want.ID.Index, got.Hash, want.Hash)
+			}
+		}
+		for _, tc := range []struct {
+			level uint
+			index uint64
+			want  codes.Code
+		}{
+			{level: 0, index: size, want: codes.NotFound},
+			// The perfect subtree [864, 872) isn't complete at size 871.
+			{level: 3, index: 108, want: codes.NotFound},
+			{level: 64, index: 0, want: codes.InvalidArgument},
+			{level: 1, index: math.MaxUint64 >> 1, want: codes.InvalidArgument},
+		} {
+			if _, err := ltx.GetNodeAt(ctx, tc.level, tc.index); status.Code(err) != tc.want {
+				t.Errorf("GetNodeAt(%d, %d) = %v, want code %v", tc.level, tc.index, err, tc.want)
+			}
+		}
+		return nil
+	})
+}
+
+func TestGetLeafAndProof(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	const size = 7
+	var nodes []stree.Node
+	cr := (&compact.RangeFactory{Hash: rfc6962.DefaultHasher.HashChildren}).NewEmptyRange(0)
+	for i := int64(0); i < size; i++ {
+		data := []byte(fmt.Sprintf("data %d", i))
+		leafHash := rfc6962.DefaultHasher.HashLeaf(data)
+		createFakeLeaf(ctx, DB, tree.TreeId, leafHash, leafHash, data, someExtraData, i, t)
+		if err := cr.Append(leafHash, func(id compact.NodeID, hash []byte) {
+			nodes = append(nodes, stree.Node{ID: id, Hash: hash})
+		}); err != nil {
+			t.Fatalf("Append(): %v", err)
+		}
+	}
+	root, err := cr.GetRootHash(nil)
+	if err != nil {
+		t.Fatalf("GetRootHash(): %v", err)
+	}
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		if err := tx.SetMerkleNodes(ctx, nodes); err != nil {
+			t.Fatalf("SetMerkleNodes(): %v", err)
+		}
+		return storeLogRoot(ctx, tx, size, 0, root)
+	})
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		ltx := tx.(*logTreeTX)
+		for _, index := range []int64{0, 3, size - 1} {
+			leaf, p, err := ltx.GetLeafAndProof(ctx, index, size)
+			if err != nil {
+				t.Fatalf("GetLeafAndProof(%d): %v", index, err)
+			}
+			if leaf.LeafIndex != index || p.LeafIndex != index {
+				t.Errorf("GetLeafAndProof(%d): got leaf %d and proof for %d", index, leaf.LeafIndex, p.LeafIndex)
+			}
+			if err := proof.VerifyInclusion(rfc6962.DefaultHasher, uint64(index), size, leaf.MerkleLeafHash, p.Hashes, root); err != nil {
+				t.Errorf("GetLeafAndProof(%d): proof doesn't verify: %v", index, err)
+			}
+		}
+		for _, tc := range []struct {
+			index, size int64
+			want        codes.Code
+		}{
+			{index: -1, size: size, want: codes.InvalidArgument},
+			{index: size, size: size, want: codes.InvalidArgument},
+			{index: 0, size: size + 1, want: codes.OutOfRange},
+		} {
+			if _, _, err := ltx.GetLeafAndProof(ctx, tc.index, tc.size); status.Code(err) != tc.want {
+				t.Errorf("GetLeafAndProof(%d, %d) = %v, want code %v", tc.index, tc.size, err, tc.want)
+			}
+		}
+		return nil
+	})
+}
+
+func TestVerifyInclusionBatch(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	// Store roots of size 4 and 7, in separate revisions.
+	const oldSize, size = 4, 7
+	var leafHashes [][]byte
+	cr := (&compact.RangeFactory{Hash: rfc6962.DefaultHasher.HashChildren}).NewEmptyRange(0)
+	for _, end := range []int64{oldSize, size} {
+		var nodes []stree.Node
+		for i := int64(len(leafHashes)); i < end; i++ {
+			leafHash := rfc6962.DefaultHasher.HashLeaf([]byte(fmt.Sprintf("data %d", i)))
+			leafHashes = append(leafHashes, leafHash)
+			if err := cr.Append(leafHash, func(id compact.NodeID, hash []byte) {
+				nodes = append(nodes, stree.Node{ID: id, Hash: hash})
+			}); err != nil {
+				t.Fatalf("Append(): %v", err)
+			}
+		}
+		root, err := cr.GetRootHash(nil)
+		if err != nil {
+			t.Fatalf("GetRootHash(): %v", err)
+		}
+		logRoot, err := (&types.LogRootV1{TreeSize: uint64(end), RootHash: root, TimestampNanos: uint64(end)}).MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary(): %v", err)
+		}
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			if err := tx.SetMerkleNodes(ctx, nodes); err != nil {
+				t.Fatalf("SetMerkleNodes(): %v", err)
+			}
+			return tx.StoreSignedLogRoot(ctx, &trillian.SignedLogRoot{LogRoot: logRoot})
+		})
+	}
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		ltx := tx.(*logTreeTX)
+		for _, treeSize := range []int64{oldSize, size} {
+			entries := []InclusionEntry{
+				{Index: 0, LeafHash: leafHashes[0]},
+				{Index: 3, LeafHash: leafHashes[3]},
+				{Index: 2, LeafHash: leafHashes[3]},
+				{Index: treeSize - 1, LeafHash: leafHashes[treeSize-1]},
+				{Index: treeSize, LeafHash: leafHashes[0]},
+			}
+			got, err := ltx.VerifyInclusionBatch(ctx, treeSize, entries)
+			if err != nil {
+				t.Fatalf("VerifyInclusionBatch(%d): %v", treeSize, err)
+			}
+			if diff := cmp.Diff([]bool{true, true, false, true, false}, got); diff != "" {
+				t.Errorf("VerifyInclusionBatch(%d) diff (-want +got):\n%s", treeSize, diff)
+			}
+		}
+		for _, tc := range []struct {
+			size    int64
+			entries []InclusionEntry
+			want    codes.Code
+		}{
+			{size: 0, want: codes.InvalidArgument},
+			{size: size + 1, want: codes.OutOfRange},
+			{size: 5, want: codes.NotFound},
+			{size: size, entries: []InclusionEntry{{Index: -1}}, want: codes.InvalidArgument},
+		} {
+			if _, err := ltx.VerifyInclusionBatch(ctx, tc.size, tc.entries); status.Code(err) != tc.want {
+				t.Errorf("VerifyInclusionBatch(%d, %v) = %v, want code %v", tc.size, tc.entries, err, tc.want)
+			}
+		}
+		return nil
+	})
+}
+
+func TestGetLeafAndProofNonRevisioned(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	const size, staleSize = 7, 3
+	var nodes []stree.Node
+	cr := (&compact.RangeFactory{Hash: rfc6962.DefaultHasher.HashChildren}).NewEmptyRange(0)
+	for i := int64(0); i < size; i++ {
+		data := []byte(fmt.Sprintf("data %d", i))
+		leafHash := rfc6962.DefaultHasher.HashLeaf(data)
+		createFakeLeaf(ctx, DB, tree.TreeId, leafHash, leafHash, data, someExtraData, i, t)
+		if err := cr.Append(leafHash, func(id compact.NodeID, hash []byte) {
+			nodes = append(nodes, stree.Node{ID: id, Hash: hash})
+		}); err != nil {
+			t.Fatalf("Append(): %v", err)
+		}
+		if i == staleSize-1 {
+			// Leave the subtrees of a smaller tree behind at a later revision,
+			// where a revisioned read would prefer them.
+			runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+				return tx.SetMerkleNodes(ctx, nodes)
+			})
+			if _, err := DB.ExecContext(ctx, "UPDATE Subtree SET SubtreeRevision = 5 WHERE TreeId = ?", tree.TreeId); err != nil {
+				t.Fatalf("Failed to update subtree revisions: %v", err)
+			}
+		}
+	}
+	root, err := cr.GetRootHash(nil)
+	if err != nil {
+		t.Fatalf("GetRootHash(): %v", err)
+	}
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		if err := tx.SetMerkleNodes(ctx, nodes); err != nil {
+			t.Fatalf("SetMerkleNodes(): %v", err)
+		}
+		return storeLogRoot(ctx, tx, size, 0, root)
+	})
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		for index := int64(0); index < size; index++ {
+			leaf, p, err := tx.(*logTreeTX).GetLeafAndProof(ctx, index, size)
+			if err != nil {
+				t.Fatalf("GetLeafAndProof(%d): %v", index, err)
+			}
+			if err := proof.VerifyInclusion(rfc6962.DefaultHasher, uint64(index), size, leaf.MerkleLeafHash, p.Hashes, root); err != nil {
+				t.Errorf("GetLeafAndProof(%d): proof doesn't verify: %v", index, err)
+			}
+		}
+		return nil
+	})
+}
+
+func TestRecomputeAndStoreRoot(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil).(*mySQLLogStorage)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	// Backfill leaves 0 to 4, and leaf 6 past a gap.
+	const size = 5
+	cr := (&compact.RangeFactory{Hash: rfc6962.DefaultHasher.HashChildren}).NewEmptyRange(0)
+	for _, i := range []int64{0, 1, 2, 3, 4, 6} {
+		data := []byte(fmt.Sprintf("data %d", i))
+		leafHash := rfc6962.DefaultHasher.HashLeaf(data)
+		createFakeLeaf(ctx, DB, tree.TreeId, leafHash, leafHash, data, someExtraData, i, t)
+		if i < size {
+			if err := cr.Append(leafHash, nil); err != nil {
+				t.Fatalf("Append(): %v", err)
+			}
+		}
+	}
+	wantHash, err := cr.GetRootHash(nil)
+	if err != nil {
+		t.Fatalf("GetRootHash(): %v", err)
+	}
+
+	if _, err := s.RecomputeAndStoreRoot(ctx, tree); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("RecomputeAndStoreRoot() on ACTIVE tree = %v, want code %v", err, codes.FailedPrecondition)
+	}
+	frozen, err := storage.UpdateTree(ctx, as, tree.TreeId, func(tree *trillian.Tree) {
+		tree.TreeState = trillian.TreeState_FROZEN
+	})
+	if err != nil {
+		t.Fatalf("UpdateTree(): %v", err)
+	}
+	root, err := s.RecomputeAndStoreRoot(ctx, frozen)
+	if err != nil {
+		t.Fatalf("RecomputeAndStoreRoot(): %v", err)
+	}
+	if root.TreeSize != size || !bytes.Equal(root.RootHash, wantHash) {
+		t.Errorf("RecomputeAndStoreRoot() = size %d, hash %x, want size %d, hash %x", root.TreeSize, root.RootHash, size, wantHash)
+	}
+
+	runLogTX(s, frozen, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		leaf, p, err := tx.(*logTreeTX).GetLeafAndProof(ctx, 3, size)
+		if err != nil {
+			t.Fatalf("GetLeafAndProof(): %v", err)
+		}
+		if err := proof.VerifyInclusion(rfc6962.DefaultHasher, 3, size, leaf.MerkleLeafHash, p.Hashes, wantHash); err != nil {
+			t.Errorf("GetLeafAndProof(): proof doesn't verify against recomputed root: %v", err)
+		}
+		return nil
+	})
+}
+
+func TestDequeueLeavesHaveQueueTimestamp(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	leaves := createTestLeaves(leavesToInsert, 20)
+	if _, err := s.QueueLeaves(ctx, tree, leaves, fakeDequeueCutoffTime); err != nil {
+		t.Fatalf("Failed to queue leaves: %v", err)
+	}
+
+	{
+		// Now try to dequeue them
+		runLogTX(s, tree, t, func(ctx context.Context, tx2 storage.LogTreeTX) error {
+			leaves2, err := tx2.DequeueLeaves(ctx, 99, fakeDequeueCutoffTime)
+			if err != nil {
+				t.Fatalf("Failed to dequeue leaves: %v", err)
+			}
+			if len(leaves2) != leavesToInsert {
+				t.Fatalf("Dequeued %d leaves but expected to get %d", len(leaves2), leavesToInsert)
+			}
+			ensureLeavesHaveQueueTimestamp(t, leaves2, fakeDequeueCutoffTime)
+			return nil
+		})
+	}
+}
+
+func TestDequeueLeavesOldestFirst(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	// Queue leaves newest first, each at an earlier time than the last.
+	leaves := createTestLeaves(5, 0)
+	for i, leaf := range leaves {
+		queueTime := fakeQueueTime.Add(-time.Duration(i) * time.Second)
+		if _, err := s.QueueLeaves(ctx, tree, []*trillian.LogLeaf{leaf}, queueTime); err != nil {
+			t.Fatalf("Failed to queue leaves: %v", err)
+		}
+	}
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		got, err := tx.DequeueLeaves(ctx, 3, fakeDequeueCutoffTime)
+		if err != nil {
+			t.Fatalf("DequeueLeaves(): %v", err)
+		}
+		// The oldest 3 leaves, oldest first.
+		want := [][]byte{leaves[4].LeafIdentityHash, leaves[3].LeafIdentityHash, leaves[2].LeafIdentityHash}
+		var gotHashes [][]byte
+		for _, leaf := range got {
+			gotHashes = append(gotHashes, leaf.LeafIdentityHash)
+		}
+		if diff := cmp.Diff(want, gotHashes); diff != "" {
+			t.Errorf("DequeueLeaves() diff (-want +got):\n%s", diff)
+		}
+		return nil
+	})
+}
+
+func TestListStaleQueuedLeaves(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	leaves := createTestLeaves(3, 0)
+	for i, leaf := range leaves {
+		queueTime := fakeQueueTime.Add(time.Duration(i) * time.Minute)
+		if _, err := s.QueueLeaves(ctx, tree, []*trillian.LogLeaf{leaf}, queueTime); err != nil {
+			t.Fatalf("Failed to queue leaves: %v", err)
+		}
+	}
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		ltx := tx.(*logTreeTX)
+		for _, tc := range []struct {
+			olderThan time.Time
+			limit     int
+			want      int
+		}{
+			{olderThan: fakeQueueTime, limit: 10, want: 0},
+			{olderThan: fakeQueueTime.Add(90 * time.Second), limit: 10, want: 2},
+			{olderThan: fakeQueueTime.Add(time.Hour), limit: 10, want: 3},
+			{olderThan: fakeQueueTime.Add(time.Hour), limit: 1, want: 1},
+		} {
+			got, err := ltx.ListStaleQueuedLeaves(ctx, tc.olderThan, tc.limit)
+			if err != nil {
+				t.Fatalf("ListStaleQueuedLeaves(%v, %d): %v", tc.olderThan, tc.limit, err)
+			}
+			if len(got) != tc.want {
+				t.Fatalf("ListStaleQueuedLeaves(%v, %d) returned %d leaves, want %d", tc.olderThan, tc.limit, len(got), tc.want)
+			}
+			for i, leaf := range got {
+				if !bytes.Equal(leaf.LeafIdentityHash, leaves[i].LeafIdentityHash) {
+					t.Errorf("ListStaleQueuedLeaves(%v, %d)[%d] = %x, want %x", tc.olderThan, tc.limit, i, leaf.LeafIdentityHash, leaves[i].LeafIdentityHash)
+				}
+			}
+		}
+		if _, err := ltx.ListStaleQueuedLeaves(ctx, fakeQueueTime, 0); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListStaleQueuedLeaves() with limit 0 = %v, want code %v", err, codes.InvalidArgument)
+		}
+		return nil
+	})
+}
+
+func TestDequeueLeavesLease(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{HonorLeases: true})
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	if _, err := s.QueueLeaves(ctx, tree, createTestLeaves(3, 0), fakeQueueTime); err != nil {
+		t.Fatalf("Failed to queue leaves: %v", err)
+	}
+	lease := func(limit int) (Lease, []*trillian.LogLeaf) {
+		t.Helper()
+		var l Lease
+		var leased []*trillian.LogLeaf
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			var err error
+			if l, leased, err = tx.(*logTreeTX).DequeueLeavesLease(ctx, limit, time.Hour); err != nil {
+				t.Fatalf("DequeueLeavesLease(): %v", err)
+			}
+			return nil
+		})
+		return l, leased
+	}
+	dequeue := func(s storage.LogStorage) int {
+		t.Helper()
+		var n int
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			dequeued, err := tx.DequeueLeaves(ctx, 10, fakeDequeueCutoffTime)
+			if err != nil {
+				t.Fatalf("DequeueLeaves(): %v", err)
+			}
+			n = len(dequeued)
+			return nil
+		})
+		return n
+	}
+	countQueued := func() int {
+		t.Helper()
+		var n int
+		if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM Unsequenced WHERE TreeId=?", tree.TreeId).Scan(&n); err != nil {
+			t.Fatalf("Failed to count queued leaves: %v", err)
+		}
+		return n
+	}
+
+	l, leased := lease(2)
+	if got, want := len(leased), 2; got != want {
+		t.Fatalf("DequeueLeavesLease(2) leased %d leaves, want %d", got, want)
+	}
+	// Storage honoring leases skips leased leaves, other storage doesn't.
+	if got, want := dequeue(s), 1; got != want {
+		t.Errorf("DequeueLeaves() with HonorLeases and 2 leased returned %d leaves, want %d", got, want)
+	}
+	if got, want := dequeue(NewLogStorage(DB, nil)), 3; got != want {
+		t.Errorf("DequeueLeaves() without HonorLeases returned %d leaves, want %d", got, want)
+	}
+	// Only the leaf without a lease can be leased.
+	_, other := lease(10)
+	if got, want := len(other), 1; got != want {
+		t.Errorf("DequeueLeavesLease(10) leased %d leaves, want %d", got, want)
+	}
+
+	// The lease holder sequences its leaves in a later transaction.
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		dequeued, err := tx.(*logTreeTX).DequeueLeasedLeaves(ctx, l)
+		if err != nil {
+			t.Fatalf("DequeueLeasedLeaves(): %v", err)
+		}
+		if got, want := len(dequeued), len(leased); got != want {
+			t.Fatalf("DequeueLeasedLeaves() returned %d leaves, want %d", got, want)
+		}
+		for i, leaf := range dequeued {
+			if !bytes.Equal(leaf.LeafIdentityHash, leased[i].LeafIdentityHash) {
+				t.Errorf("DequeueLeasedLeaves()[%d] has identity hash %x, want %x", i, leaf.LeafIdentityHash, leased[i].LeafIdentityHash)
+			}
+			leaf.LeafIndex = int64(i)
+			leaf.IntegrateTimestamp = timestamppb.Now()
+		}
+		return tx.UpdateSequencedLeaves(ctx, dequeued)
+	})
+	if got, want := countQueued(), 1; got != want {
+		t.Errorf("Got %d queued leaves after sequencing the lease, want %d", got, want)
+	}
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		dequeued, err := tx.(*logTreeTX).DequeueLeasedLeaves(ctx, l)
+		if err != nil {
+			t.Fatalf("DequeueLeasedLeaves(): %v", err)
+		}
+		if len(dequeued) != 0 {
+			t.Errorf("DequeueLeasedLeaves() after sequencing returned %d leaves, want none", len(dequeued))
+		}
+		return nil
+	})
+
+	// Expired leases can be taken over.
+	if _, err := DB.ExecContext(ctx, "UPDATE Unsequenced SET LeasedUntilNanos=1 WHERE TreeId=?", tree.TreeId); err != nil {
+		t.Fatalf("Failed to expire leases: %v", err)
+	}
+	if _, got := lease(10); len(got) != 1 {
+		t.Errorf("DequeueLeavesLease(10) after expiry leased %d leaves, want 1", len(got))
+	}
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		ltx := tx.(*logTreeTX)
+		if _, _, err := ltx.DequeueLeavesLease(ctx, 0, time.Hour); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("DequeueLeavesLease() with limit 0 = %v, want code %v", err, codes.InvalidArgument)
+		}
+		if _, _, err := ltx.DequeueLeavesLease(ctx, 1, 0); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("DequeueLeavesLease() with no duration = %v, want code %v", err, codes.InvalidArgument)
+		}
+		expired := Lease{ID: l.ID, Until: time.Now().Add(-time.Second)}
+		if _, err := ltx.DequeueLeasedLeaves(ctx, expired); status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("DequeueLeasedLeaves() with expired lease = %v, want code %v", err, codes.FailedPrecondition)
+		}
+		return nil
+	})
+}
+
+// Queues leaves and attempts to dequeue before the guard cutoff allows it. This should
+// return nothing. Then retry with an inclusive guard cutoff and ensure the leaves
+// are returned.
+func TestDequeueLeavesGuardInterval(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	leaves := createTestLeaves(leavesToInsert, 20)
+	if _, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
+		t.Fatalf("Failed to queue leaves: %v", err)
+	}
+
+	{
+		// Now try to dequeue them using a cutoff that means we should get none
+		runLogTX(s, tree, t, func(ctx context.Context, tx2 storage.LogTreeTX) error {
+			leaves2, err := tx2.DequeueLeaves(ctx, 99, fakeQueueTime.Add(-time.Second))
+			if err != nil {
+				t.Fatalf("Failed to dequeue leaves: %v", err)
+			}
+			if len(leaves2) != 0 {
+				t.Fatalf("Dequeued %d leaves when they all should be in guard interval", len(leaves2))
+			}
+
+			// Try to dequeue again using a cutoff that should include them
+			leaves2, err = tx2.DequeueLeaves(ctx, 99, fakeQueueTime.Add(time.Second))
+			if err != nil {
+				t.Fatalf("Failed to dequeue leaves: %v", err)
+			}
+			if len(leaves2) != leavesToInsert {
+				t.Fatalf("Dequeued %d leaves but expected to get %d", len(leaves2), leavesToInsert)
+			}
+			ensureAllLeavesDistinct(leaves2, t)
+			return nil
+		})
+	}
+}
+
+func TestDequeueLeavesFutureCutoff(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	// Leaves queued in the future must not be dequeued yet, however late the
+	// cutoff.
+	queueTime := time.Now().Add(time.Hour)
+	if _, err := s.QueueLeaves(ctx, tree, createTestLeaves(leavesToInsert, 20), queueTime); err != nil {
+		t.Fatalf("Failed to queue leaves: %v", err)
+	}
+	cutoff := queueTime.Add(time.Hour)
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		leaves, err := tx.DequeueLeaves(ctx, 99, cutoff)
+		if err != nil {
+			t.Fatalf("DequeueLeaves(): %v", err)
+		}
+		if len(leaves) != 0 {
+			t.Errorf("DequeueLeaves() returned %d leaves, want 0 with clamped cutoff", len(leaves))
+		}
+		return nil
+	})
+
+	s = NewLogStorageWithOptions(DB, LogStorageOptions{RejectFutureDequeueCutoff: true})
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		if _, err := tx.DequeueLeaves(ctx, 99, cutoff); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("DequeueLeaves() = %v, want code %v", err, codes.InvalidArgument)
+		}
+		return nil
+	})
+}
+
+func TestDequeueLeavesTimeOrdering(t *testing.T) {
+	// Queue two small batches of leaves at different timestamps. Do two separate dequeue
+	// transactions and make sure the returned leaves are respecting the time ordering of the
+	// queue.
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	batchSize := 2
+	leaves := createTestLeaves(int64(batchSize), 0)
+	leaves2 := createTestLeaves(int64(batchSize), int64(batchSize))
+
+	if _, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
+		t.Fatalf("QueueLeaves(1st batch) = %v", err)
+	}
+	// These are one second earlier so should be dequeued first
+	if _, err := s.QueueLeaves(ctx, tree, leaves2, fakeQueueTime.Add(-time.Second)); err != nil {
+		t.Fatalf("QueueLeaves(2nd batch) = %v", err)
+	}
+
+	{
+		// Now try to dequeue two leaves and we should get the second batch
+		runLogTX(s, tree, t, func(ctx context.Context, tx2 storage.LogTreeTX) error {
+			dequeue1, err := tx2.DequeueLeaves(ctx, batchSize, fakeQueueTime)
+			if err != nil {
+				t.Fatalf("DequeueLeaves(1st) = %v", err)
+			}
+			if got, want := len(dequeue1), batchSize; got != want {
+				t.Fatalf("Dequeue count mismatch (1st) got: %d, want: %d", got, want)
+			}
+			ensureAllLeavesDistinct(dequeue1, t)
+
+			// Ensure this is the second batch queued by comparing leaf hashes (must be distinct as
+			// the leaf data was).
+			if !leafInBatch(dequeue1[0], leaves2) || !leafInBatch(dequeue1[1], leaves2) {
+				t.Fatalf("Got leaf from wrong batch (1st dequeue): %v", dequeue1)
+			}
+			iTimestamp := timestamppb.Now()
+			for i, l := range dequeue1 {
+				l.IntegrateTimestamp = iTimestamp
+				l.LeafIndex = int64(i)
+			}
+			if err := tx2.UpdateSequencedLeaves(ctx, dequeue1); err != nil {
+				t.Fatalf("UpdateSequencedLeaves(): %v", err)
+			}
+
+			return nil
+		})
+
+		// Try to dequeue again and we should get the batch that was queued first, though at a later time
+		runLogTX(s, tree, t, func(ctx context.Context, tx3 storage.LogTreeTX) error {
+			dequeue2, err := tx3.DequeueLeaves(ctx, batchSize, fakeQueueTime)
+			if err != nil {
+				t.Fatalf("DequeueLeaves(2nd) = %v", err)
+			}
+			if got, want := len(dequeue2), batchSize; got != want {
+				t.Fatalf("Dequeue count mismatch (2nd) got: %d, want: %d", got, want)
+			}
+			ensureAllLeavesDistinct(dequeue2, t)
+
+			// Ensure this is the first batch by comparing leaf hashes.
+			if !leafInBatch(dequeue2[0], leaves) || !leafInBatch(dequeue2[1], leaves) {
+				t.Fatalf("Got leaf from wrong batch (2nd dequeue): %v", dequeue2)
+			}
+			return nil
+		})
+	}
+}
+
+func TestDequeueLeavesSkipTracking(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{SkipDequeueTracking: true})
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	const leafCount = 3
+	if _, err := s.QueueLeaves(ctx, tree, createTestLeaves(leafCount, 0), fakeQueueTime); err != nil {
+		t.Fatalf("QueueLeaves() = %v", err)
+	}
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		dequeued, err := tx.DequeueLeaves(ctx, 99, fakeDequeueCutoffTime)
+		if err != nil {
+			t.Fatalf("DequeueLeaves() = %v", err)
+		}
+		if got, want := len(dequeued), leafCount; got != want {
+			t.Fatalf("DequeueLeaves() returned %d leaves, want %d", got, want)
+		}
+		if got := len(tx.(*logTreeTX).dequeued); got != 0 {
+			t.Errorf("DequeueLeaves() tracked %d leaves, want none", got)
+		}
+		iTimestamp := timestamppb.Now()
+		for i, l := range dequeued {
+			l.IntegrateTimestamp = iTimestamp
+			l.LeafIndex = int64(i)
+		}
+		if err := tx.UpdateSequencedLeaves(ctx, dequeued); err != nil {
+			t.Fatalf("UpdateSequencedLeaves(): %v", err)
+		}
+		return nil
+	})
+
+	var count int
+	if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM Unsequenced WHERE TreeID=?", tree.TreeId).Scan(&count); err != nil {
+		t.Fatalf("Could not query row count: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Got %d unsequenced rows after sequencing, want 0", count)
+	}
+}
+
+func TestCompressLeafData(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	settings, err := anypb.New(&mysqlpb.StorageOptions{CompressLeafData: true})
+	if err != nil {
+		t.Fatalf("Error marshaling proto: %v", err)
+	}
+	treeProto := proto.Clone(testonly.LogTree).(*trillian.Tree)
+	treeProto.StorageSettings = settings
+	tree := mustCreateTree(ctx, t, as, treeProto)
+	s := NewLogStorage(DB, nil)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	leaves := createTestLeaves(2, 0)
+	leaves[0].LeafValue = bytes.Repeat([]byte(`{"key":"value"}`), 100)
+	if _, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
+		t.Fatalf("QueueLeaves(): %v", err)
+	}
+
+	var stored []byte
+	if err := DB.QueryRowContext(ctx, "SELECT LeafValue FROM LeafData WHERE TreeId=? AND LeafIdentityHash=?", tree.TreeId, leaves[0].LeafIdentityHash).Scan(&stored); err != nil {
+		t.Fatalf("Failed to read stored LeafValue: %v", err)
+	}
+	if len(stored) >= len(leaves[0].LeafValue) || stored[0] != codecGzip {
+		t.Errorf("Stored LeafValue is %d bytes with codec %d, want < %d bytes with codec %d", len(stored), stored[0], len(leaves[0].LeafValue), codecGzip)
+	}
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		got, err := tx.(*logTreeTX).getLeafDataByIdentityHash(ctx, nil, [][]byte{leaves[0].LeafIdentityHash, leaves[1].LeafIdentityHash})
+		if err != nil {
+			t.Fatalf("getLeafDataByIdentityHash(): %v", err)
+		}
+		sort.Slice(got, func(i, j int) bool { return bytes.Compare(got[i].identityHash, got[j].identityHash) < 0 })
+		sort.Slice(leaves, func(i, j int) bool { return bytes.Compare(leaves[i].LeafIdentityHash, leaves[j].LeafIdentityHash) < 0 })
+		for i := range leaves {
+			if !bytes.Equal(got[i].value, leaves[i].LeafValue) || !bytes.Equal(got[i].extraData, leaves[i].ExtraData) {
+				t.Errorf("Leaf %x read back as (%q, %q), want (%q, %q)", leaves[i].LeafIdentityHash, got[i].value, got[i].extraData, leaves[i].LeafValue, leaves[i].ExtraData)
+			}
+		}
+		return nil
+	})
+}
+
+func TestEncryptLeafValue(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	settings, err := anypb.New(&mysqlpb.StorageOptions{CompressLeafData: true, EncryptLeafValue: true})
+	if err != nil {
+		t.Fatalf("Error marshaling proto: %v", err)
+	}
+	treeProto := proto.Clone(testonly.LogTree).(*trillian.Tree)
+	treeProto.StorageSettings = settings
+	tree := mustCreateTree(ctx, t, as, treeProto)
+	if got, err := storage.GetTree(ctx, as, tree.TreeId); err != nil {
+		t.Fatalf("GetTree(): %v", err)
+	} else if !proto.Equal(got.StorageSettings, settings) {
+		t.Errorf("GetTree() StorageSettings = %v, want %v", got.StorageSettings, settings)
+	}
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{LeafCrypter: xorCrypter{}})
+	// A server without a crypter can neither write nor read the tree.
+	plain := NewLogStorage(DB, nil)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	leaves := createTestLeaves(2, 0)
+	if _, err := plain.QueueLeaves(ctx, tree, leaves, fakeQueueTime); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("QueueLeaves() without crypter = %v, want %v", err, codes.FailedPrecondition)
+	}
+	if _, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
+		t.Fatalf("QueueLeaves(): %v", err)
+	}
+	for i, leaf := range leaves {
+		var stored []byte
+		if err := DB.QueryRowContext(ctx, "SELECT LeafValue FROM LeafData WHERE TreeId=? AND LeafIdentityHash=?", tree.TreeId, leaf.LeafIdentityHash).Scan(&stored); err != nil {
+			t.Fatalf("Failed to read stored LeafValue: %v", err)
+		}
+		if stored[0] != leafValueEncrypted {
+			t.Errorf("Stored LeafValue of leaves[%d] has version %d, want %d", i, stored[0], leafValueEncrypted)
+		}
+	}
+
+	hashes := [][]byte{leaves[0].LeafIdentityHash, leaves[1].LeafIdentityHash}
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		got, err := tx.(*logTreeTX).getLeafDataByIdentityHash(ctx, nil, hashes)
+		if err != nil {
+			t.Fatalf("getLeafDataByIdentityHash(): %v", err)
+		}
+		sort.Slice(got, func(i, j int) bool { return bytes.Compare(got[i].identityHash, got[j].identityHash) < 0 })
+		sort.Slice(leaves, func(i, j int) bool { return bytes.Compare(leaves[i].LeafIdentityHash, leaves[j].LeafIdentityHash) < 0 })
+		for i := range leaves {
+			if !bytes.Equal(got[i].value, leaves[i].LeafValue) {
+				t.Errorf("Leaf %x read back as %q, want %q", leaves[i].LeafIdentityHash, got[i].value, leaves[i].LeafValue)
+			}
+		}
+		return nil
+	})
+	runLogTX(plain, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		if _, err := tx.(*logTreeTX).getLeafDataByIdentityHash(ctx, nil, hashes); status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("getLeafDataByIdentityHash() without crypter = %v, want %v", err, codes.FailedPrecondition)
+		}
+		return nil
+	})
+}
+
+func TestTreeHasher(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	newTree := func(h mysqlpb.LogHasher) *trillian.Tree {
+		settings, err := anypb.New(&mysqlpb.StorageOptions{Hasher: h})
+		if err != nil {
+			t.Fatalf("Error marshaling proto: %v", err)
+		}
+		treeProto := proto.Clone(testonly.LogTree).(*trillian.Tree)
+		treeProto.StorageSettings = settings
+		return treeProto
+	}
+
+	if _, err := storage.CreateTree(ctx, as, newTree(mysqlpb.LogHasher(99))); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateTree() with unknown hasher = %v, want code %v", err, codes.InvalidArgument)
+	}
+
+	tree := mustCreateTree(ctx, t, as, newTree(mysqlpb.LogHasher_RFC6962_SHA512_256))
+	o := &mysqlpb.StorageOptions{}
+	if err := anypb.UnmarshalTo(tree.StorageSettings, o, proto.UnmarshalOptions{}); err != nil {
+		t.Fatalf("Failed to unmarshal StorageSettings: %v", err)
+	}
+	if got, want := o.Hasher, mysqlpb.LogHasher_RFC6962_SHA512_256; got != want {
+		t.Errorf("Hasher = %v, want %v", got, want)
+	}
+
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{VerifyMerkleLeafHash: true})
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+	leaves := createTestLeaves(1, 0)
+	if _, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("QueueLeaves() with SHA-256 leaf hash = %v, want code %v", err, codes.InvalidArgument)
+	}
+	leaves[0].MerkleLeafHash = sha512_256Hasher.HashLeaf(leaves[0].LeafValue)
+	if _, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
+		t.Errorf("QueueLeaves() with SHA-512/256 leaf hash = %v", err)
+	}
+}
+
+func TestDequeueLeavesMulti(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	s := NewLogStorage(DB, nil)
+	busy := mustCreateTree(ctx, t, as, testonly.LogTree)
+	quiet := mustCreateTree(ctx, t, as, testonly.LogTree)
+	idle := mustCreateTree(ctx, t, as, testonly.LogTree)
+	preordered := mustCreateTree(ctx, t, as, testonly.PreorderedLogTree)
+	idlePreordered := mustCreateTree(ctx, t, as, testonly.PreorderedLogTree)
+	for _, tree := range []*trillian.Tree{busy, quiet, idle, preordered, idlePreordered} {
+		mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+	}
+
+	if _, err := s.QueueLeaves(ctx, busy, createTestLeaves(5, 0), fakeQueueTime); err != nil {
+		t.Fatalf("QueueLeaves(busy): %v", err)
+	}
+	if _, err := s.QueueLeaves(ctx, quiet, createTestLeaves(1, 10), fakeQueueTime); err != nil {
+		t.Fatalf("QueueLeaves(quiet): %v", err)
+	}
+	if _, err := s.AddSequencedLeaves(ctx, preordered, createTestLeaves(2, 0), fakeQueueTime); err != nil {
+		t.Fatalf("AddSequencedLeaves(preordered): %v", err)
+	}
+
+	// Sequence the leaves of LOG trees, which requires them to be tracked as
+	// dequeued by the transaction.
+	var visited []int64
+	next := make(map[int64]int64)
+	sequence := func(ctx context.Context, tree *trillian.Tree, tx storage.LogTreeTX, leaves []*trillian.LogLeaf) error {
+		visited = append(visited, tree.TreeId)
+		if tree.TreeType != trillian.TreeType_LOG {
+			return nil
+		}
+		for _, leaf := range leaves {
+			leaf.LeafIndex = next[tree.TreeId]
+			leaf.IntegrateTimestamp = timestamppb.New(fakeIntegrateTime)
+			next[tree.TreeId]++
+		}
+		return tx.UpdateSequencedLeaves(ctx, leaves)
+	}
+	trees := []*trillian.Tree{busy, quiet, idle, preordered, idlePreordered, busy}
+	got, err := s.(*mySQLLogStorage).DequeueLeavesMulti(ctx, trees, 3, fakeDequeueCutoffTime, sequence)
+	if err != nil {
+		t.Fatalf("DequeueLeavesMulti(): %v", err)
+	}
+	want := map[int64]int{busy.TreeId: 3, quiet.TreeId: 1, preordered.TreeId: 2}
+	gotCounts := make(map[int64]int)
+	for id, leaves := range got {
+		gotCounts[id] = len(leaves)
+	}
+	if diff := cmp.Diff(want, gotCounts); diff != "" {
+		t.Errorf("DequeueLeavesMulti() leaf counts diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]int64{busy.TreeId, quiet.TreeId, preordered.TreeId}, visited); diff != "" {
+		t.Errorf("DequeueLeavesMulti() visited trees diff (-want +got):\n%s", diff)
+	}
+	var count int
+	if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM Unsequenced WHERE TreeId=?", busy.TreeId).Scan(&count); err != nil {
+		t.Fatalf("Could not query row count: %v", err)
+	}
+	if got, want := count, 2; got != want {
+		t.Errorf("Got %d unsequenced rows in busy tree, want %d", got, want)
+	}
+
+	// Nothing is queued before fakeQueueTime, so no tree is visited.
+	visited = nil
+	if _, err := s.(*mySQLLogStorage).DequeueLeavesMulti(ctx, []*trillian.Tree{busy, quiet}, 3, fakeQueueTime.Add(-time.Second), sequence); err != nil {
+		t.Fatalf("DequeueLeavesMulti(): %v", err)
+	}
+	if len(visited) != 0 {
+		t.Errorf("DequeueLeavesMulti() before queue time visited %v, want none", visited)
+	}
+
+	// Future cutoffs are clamped, so the remaining leaves are dequeued.
+	got, err = s.(*mySQLLogStorage).DequeueLeavesMulti(ctx, []*trillian.Tree{busy}, 3, time.Now().Add(time.Hour), sequence)
+	if err != nil {
+		t.Fatalf("DequeueLeavesMulti() with future cutoff: %v", err)
+	}
+	if got, want := len(got[busy.TreeId]), 2; got != want {
+		t.Errorf("DequeueLeavesMulti() with future cutoff returned %d leaves, want %d", got, want)
+	}
+
+	// A failing tree doesn't stop the others from being processed.
+	if _, err := s.QueueLeaves(ctx, busy, createTestLeaves(1, 20), fakeQueueTime); err != nil {
+		t.Fatalf("QueueLeaves(busy): %v", err)
+	}
+	if _, err := s.QueueLeaves(ctx, quiet, createTestLeaves(1, 30), fakeQueueTime); err != nil {
+		t.Fatalf("QueueLeaves(quiet): %v", err)
+	}
+	errFail := errors.New("sequencing failed")
+	failBusy := func(ctx context.Context, tree *trillian.Tree, tx storage.LogTreeTX, leaves []*trillian.LogLeaf) error {
+		if tree.TreeId == busy.TreeId {
+			return errFail
+		}
+		return sequence(ctx, tree, tx, leaves)
+	}
+	got, err = s.(*mySQLLogStorage).DequeueLeavesMulti(ctx, []*trillian.Tree{busy, quiet}, 3, fakeDequeueCutoffTime, failBusy)
+	if !errors.Is(err, errFail) {
+		t.Errorf("DequeueLeavesMulti() with failing tree: %v, want %v", err, errFail)
+	}
+	if _, ok := got[busy.TreeId]; ok {
+		t.Errorf("DequeueLeavesMulti() with failing tree returned leaves of the failed tree")
+	}
+	if got, want := len(got[quiet.TreeId]), 1; got != want {
+		t.Errorf("DequeueLeavesMulti() with failing tree returned %d leaves of the other tree, want %d", got, want)
+	}
+}
+
+func TestGetLeavesByIdentityHashAcrossTrees(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	s := NewLogStorage(DB, nil).(*mySQLLogStorage)
+	sequenced := mustCreateTree(ctx, t, as, testonly.LogTree)
+	queued := mustCreateTree(ctx, t, as, testonly.LogTree)
+	absent := mustCreateTree(ctx, t, as, testonly.LogTree)
+
+	want := createFakeLeaf(ctx, DB, sequenced.TreeId, dummyRawHash, dummyHash, []byte("data"), []byte("extra"), 7, t)
+	leaves := createTestLeaves(1, 0)
+	leaves[0].LeafIdentityHash = dummyRawHash
+	if _, err := s.QueueLeaves(ctx, queued, leaves, fakeQueueTime); err != nil {
+		t.Fatalf("QueueLeaves(): %v", err)
+	}
+
+	got, err := s.GetLeavesByIdentityHashAcrossTrees(ctx, dummyRawHash, []int64{sequenced.TreeId, queued.TreeId, absent.TreeId, queued.TreeId})
+	if err != nil {
+		t.Fatalf("GetLeavesByIdentityHashAcrossTrees(): %v", err)
+	}
+	if len(got) != 2 {
+		t.Errorf("GetLeavesByIdentityHashAcrossTrees() found leaf in %d trees, want 2", len(got))
+	}
+	if leaf := got[sequenced.TreeId]; !proto.Equal(leaf, want) {
+		t.Errorf("GetLeavesByIdentityHashAcrossTrees() sequenced leaf = %v, want %v", leaf, want)
+	}
+	if leaf := got[queued.TreeId]; leaf == nil || leaf.LeafIndex != -1 || leaf.IntegrateTimestamp != nil || !bytes.Equal(leaf.LeafValue, leaves[0].LeafValue) {
+		t.Errorf("GetLeavesByIdentityHashAcrossTrees() queued leaf = %v, want unsequenced leaf with value %x", leaf, leaves[0].LeafValue)
+	}
+
+	if got, err := s.GetLeavesByIdentityHashAcrossTrees(ctx, dummyRawHash, nil); err != nil || len(got) != 0 {
+		t.Errorf("GetLeavesByIdentityHashAcrossTrees(no trees) = %v, %v, want empty", got, err)
+	}
+	if _, err := s.GetLeavesByIdentityHashAcrossTrees(ctx, nil, []int64{queued.TreeId}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("GetLeavesByIdentityHashAcrossTrees(no hash) = %v, want %v", err, codes.InvalidArgument)
+	}
+}
+
+func TestGetLeavesByHashNotPresent(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		hashes := [][]byte{[]byte("thisdoesn'texist")}
+		leaves, err := tx.GetLeavesByHash(ctx, hashes, false)
+		if err != nil {
+			t.Fatalf("Error getting leaves by hash: %v", err)
+		}
+		if len(leaves) != 0 {
+			t.Fatalf("Expected no leaves returned but got %d", len(leaves))
+		}
+		return nil
+	})
+}
+
+func TestGetLeavesByRangeWithChecksum(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	const leafCount = 4
+	var merkleHashes [][]byte
+	for i := 0; i < leafCount; i++ {
+		data := []byte(fmt.Sprintf("data %d", i))
+		idHash := sha256.Sum256(data)
+		merkleHash := sha256.Sum256(idHash[:])
+		merkleHashes = append(merkleHashes, merkleHash[:])
+		createFakeLeaf(ctx, DB, tree.TreeId, merkleHash[:], idHash[:], data, someExtraData, int64(i), t)
+	}
+	mustSignAndStoreLogRoot(ctx, t, s, tree, leafCount)
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		leaves, checksum, err := tx.(*logTreeTX).GetLeavesByRangeWithChecksum(ctx, 1, 2)
+		if err != nil {
+			t.Fatalf("GetLeavesByRangeWithChecksum(): %v", err)
+		}
+		if got, want := len(leaves), 2; got != want {
+			t.Fatalf("GetLeavesByRangeWithChecksum() returned %d leaves, want %d", got, want)
+		}
+		want := sha256.Sum256(bytes.Join(merkleHashes[1:3], nil))
+		if !bytes.Equal(checksum, want[:]) {
+			t.Errorf("GetLeavesByRangeWithChecksum() checksum = %x, want %x", checksum, want)
+		}
+		return nil
+	})
+}
+
+func TestGetLeavesByHash(t *testing.T) {
+	ctx := context.Background()
+
+	// Create fake leaf as if it had been sequenced
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	data := []byte("some data")
+	createFakeLeaf(ctx, DB, tree.TreeId, dummyRawHash, dummyHash, data, someExtraData, sequenceNumber, t)
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		hashes := [][]byte{dummyHash}
+		leaves, err := tx.GetLeavesByHash(ctx, hashes, false)
+		if err != nil {
+			t.Fatalf("Unexpected error getting leaf by hash: %v", err)
+		}
+		if len(leaves) != 1 {
+			t.Fatalf("Got %d leaves but expected one", len(leaves))
+		}
+		checkLeafContents(leaves[0], sequenceNumber, dummyRawHash, dummyHash, data, someExtraData, t)
+		return nil
+	})
+}
+
+func TestSkipReadHashValidation(t *testing.T) {
+	ctx := context.Background()
+
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	shortHash := []byte("short")
+	createFakeLeaf(ctx, DB, tree.TreeId, dummyRawHash, shortHash, []byte("some data"), someExtraData, 0, t)
+	mustSignAndStoreLogRoot(ctx, t, NewLogStorage(DB, nil), tree, 1)
+
+	for _, tc := range []struct {
+		skip    bool
+		wantErr bool
+	}{
+		{skip: false, wantErr: true},
+		{skip: true, wantErr: false},
+	} {
+		s := NewLogStorageWithOptions(DB, LogStorageOptions{SkipReadHashValidation: tc.skip})
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			// Only the hashes of leaves read back are unchecked.
+			leaves, err := tx.(*logTreeTX).GetLeavesIntegratedSince(ctx, 0, 10)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("SkipReadHashValidation=%t: GetLeavesIntegratedSince() = %v, wantErr %t", tc.skip, err, tc.wantErr)
+			}
+			if !tc.wantErr && len(leaves) != 1 {
+				t.Errorf("SkipReadHashValidation=%t: got %d leaves, want 1", tc.skip, len(leaves))
+			}
+			// Hashes passed in are always checked.
+			if _, err := tx.GetLeavesByHash(ctx, [][]byte{shortHash}, false); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("SkipReadHashValidation=%t: GetLeavesByHash() = %v, want %v", tc.skip, err, codes.InvalidArgument)
+			}
+			if _, err := tx.(*logTreeTX).GetLeavesByHashPage(ctx, [][]byte{shortHash}, 1, 0); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("SkipReadHashValidation=%t: GetLeavesByHashPage() = %v, want %v", tc.skip, err, codes.InvalidArgument)
+			}
+			return nil
+		})
+	}
+}
+
+func TestGetLeavesByHashBestEffort(t *testing.T) {
+	ctx := context.Background()
+
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+	shortHash := []byte("short")
+	createFakeLeaf(ctx, DB, tree.TreeId, dummyRawHash, dummyHash, []byte("good data"), someExtraData, sequenceNumber, t)
+	createFakeLeaf(ctx, DB, tree.TreeId, dummyHash2, shortHash, []byte("bad data"), someExtraData, sequenceNumber+1, t)
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		if _, err := tx.GetLeavesByHash(ctx, [][]byte{dummyHash, shortHash}, false); err == nil {
+			t.Error("GetLeavesByHash(): got nil error, want error for bad leaf")
+		}
+
+		leaves, errs, err := tx.(*logTreeTX).GetLeavesByHashBestEffort(ctx, [][]byte{dummyHash, shortHash}, false)
+		if err != nil {
+			t.Fatalf("GetLeavesByHashBestEffort(): %v", err)
+		}
+		if len(leaves) != 1 || !bytes.Equal(leaves[0].MerkleLeafHash, dummyHash) {
+			t.Errorf("GetLeavesByHashBestEffort(): got leaves %v, want only the leaf with hash %x", leaves, dummyHash)
+		}
+		if len(errs) != 1 || errs[string(shortHash)] == nil {
+			t.Errorf("GetLeavesByHashBestEffort(): got errs %v, want only an error for hash %x", errs, shortHash)
+		}
+		return nil
+	})
+}
+
+func TestGetLeavesByHashBigBatch(t *testing.T) {
+	t.Skip("Known Issue: https://github.com/google/trillian/issues/1845")
+	ctx := context.Background()
+
+	// Create fake leaf as if it had been sequenced
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	const leafCount = 999 + 1
+	hashes := make([][]byte, leafCount)
+	for i := 0; i < leafCount; i++ {
+		data := []byte(fmt.Sprintf("data %d", i))
+		hash := sha256.Sum256(data)
+		hashes[i] = hash[:]
+		createFakeLeaf(ctx, DB, tree.TreeId, hash[:], hash[:], data, someExtraData, sequenceNumber+int64(i), t)
+	}
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		leaves, err := tx.GetLeavesByHash(ctx, hashes, false)
+		if err != nil {
+			t.Fatalf("Unexpected error getting leaf by hash: %v", err)
+		}
+		if got, want := len(leaves), leafCount; got != want {
+			t.Fatalf("Got %d leaves, expected %d", got, want)
+		}
+		return nil
+	})
+}
+
+func TestGetLeavesByHashChunked(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{MaxHashesPerQuery: 2})
+
+	const leafCount = 5
+	var hashes [][]byte
+	for i := leafCount - 1; i >= 0; i-- {
+		data := []byte(fmt.Sprintf("data %d", i))
+		hash := sha256.Sum256(data)
+		hashes = append(hashes, hash[:])
+		createFakeLeaf(ctx, DB, tree.TreeId, hash[:], hash[:], data, someExtraData, sequenceNumber+int64(i), t)
+	}
+	// Request every hash twice, which should not produce duplicate results.
+	hashes = append(hashes, hashes...)
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		leaves, err := tx.GetLeavesByHash(ctx, hashes, true)
+		if err != nil {
+			t.Fatalf("GetLeavesByHash(): %v", err)
+		}
+		if got, want := len(leaves), leafCount; got != want {
+			t.Fatalf("GetLeavesByHash() returned %d leaves, want %d", got, want)
+		}
+		for i, leaf := range leaves {
+			if got, want := leaf.LeafIndex, sequenceNumber+int64(i); got != want {
+				t.Errorf("GetLeavesByHash()[%d].LeafIndex = %d, want %d", i, got, want)
+			}
+		}
+		return nil
+	})
+}
+
+func TestGetLeavesByHashPage(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	// All the leaves have the same MerkleLeafHash.
+	const leafCount = 5
+	for i := leafCount - 1; i >= 0; i-- {
+		data := []byte(fmt.Sprintf("data %d", i))
+		id := sha256.Sum256(data)
+		createFakeLeaf(ctx, DB, tree.TreeId, id[:], dummyHash, data, someExtraData, sequenceNumber+int64(i), t)
+	}
+
+	for _, tc := range []struct {
+		limit, offset int64
+		want          []int64
+		wantCode      codes.Code
+	}{
+		{limit: 2, offset: 0, want: []int64{0, 1}},
+		{limit: 2, offset: 2, want: []int64{2, 3}},
+		{limit: 2, offset: 4, want: []int64{4}},
+		{limit: 2, offset: 5, want: nil},
+		{limit: 10, offset: 0, want: []int64{0, 1, 2, 3, 4}},
+		{limit: 0, offset: 0, wantCode: codes.InvalidArgument},
+		{limit: 1, offset: -1, wantCode: codes.InvalidArgument},
+	} {
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			leaves, err := tx.(*logTreeTX).GetLeavesByHashPage(ctx, [][]byte{dummyHash}, tc.limit, tc.offset)
+			if status.Code(err) != tc.wantCode {
+				t.Fatalf("GetLeavesByHashPage(%d, %d) = %v, want code %v", tc.limit, tc.offset, err, tc.wantCode)
+			}
+			var got []int64
+			for _, leaf := range leaves {
+				got = append(got, leaf.LeafIndex-sequenceNumber)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("GetLeavesByHashPage(%d, %d) diff (-want +got):\n%s", tc.limit, tc.offset, diff)
+			}
+			return nil
+		})
+	}
+}
+
+func TestLogStoragePingAndReady(t *testing.T) {
+	ctx := context.Background()
+	s := NewLogStorage(DB, nil).(*mySQLLogStorage)
+	if err := s.Ready(ctx); err != nil {
+		t.Errorf("Ready() = %v, want nil", err)
+	}
+	if err := s.Ping(ctx); err != nil {
+		t.Errorf("Ping() = %v, want nil", err)
+	}
+
+	db, done := openTestDBOrDie()
+	closed := NewLogStorage(db, nil).(*mySQLLogStorage)
+	done(ctx)
+	if err := closed.Ping(ctx); err == nil {
+		t.Error("Ping() on closed database = nil, want err")
+	}
+	if err := closed.Ready(ctx); err == nil {
+		t.Error("Ready() on closed database = nil, want err")
+	}
+}
+
+func TestLatestSignedLogRootFrom(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	// The test database stands in for a replica of itself.
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{Replicas: map[string]*sql.DB{"replica-a": DB}}).(*mySQLLogStorage)
+
+	if _, err := s.LatestSignedLogRootFrom(ctx, tree, "replica-a"); err != storage.ErrTreeNeedsInit {
+		t.Errorf("LatestSignedLogRootFrom() before any root = %v, want %v", err, storage.ErrTreeNeedsInit)
+	}
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 3)
+
+	slr, err := s.LatestSignedLogRootFrom(ctx, tree, "replica-a")
+	if err != nil {
+		t.Fatalf("LatestSignedLogRootFrom(): %v", err)
+	}
+	var root types.LogRootV1
+	if err := root.UnmarshalBinary(slr.LogRoot); err != nil {
+		t.Fatalf("UnmarshalBinary(): %v", err)
+	}
+	if got, want := root.TreeSize, uint64(3); got != want {
+		t.Errorf("LatestSignedLogRootFrom(): TreeSize = %d, want %d", got, want)
+	}
+	if _, err := s.LatestSignedLogRootFrom(ctx, tree, "replica-b"); status.Code(err) != codes.NotFound {
+		t.Errorf("LatestSignedLogRootFrom() from unknown replica = %v, want code %v", err, codes.NotFound)
+	}
+}
+
+func TestGetLeavesByRangeUnexpectedIndex(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	// Leaf 2 is missing from a tree of size 4.
+	for _, index := range []int64{0, 1, 3} {
+		data := []byte(fmt.Sprintf("data %d", index))
+		hash := rfc6962.DefaultHasher.HashLeaf(data)
+		createFakeLeaf(ctx, DB, tree.TreeId, hash, hash, data, someExtraData, index, t)
+	}
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 4)
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		_, err := tx.GetLeavesByRange(ctx, 0, 4)
+		var indexErr *UnexpectedIndexError
+		if !errors.As(err, &indexErr) {
+			t.Fatalf("GetLeavesByRange() = %v, want UnexpectedIndexError", err)
+		}
+		want := UnexpectedIndexError{TreeID: tree.TreeId, Got: 3, Want: 2}
+		if *indexErr != want {
+			t.Errorf("GetLeavesByRange() = %+v, want %+v", *indexErr, want)
+		}
+		if got, want := err.Error(), "got unexpected index 3, want 2"; got != want {
+			t.Errorf("GetLeavesByRange() error = %q, want %q", got, want)
+		}
+		return nil
+	})
+}
+
+func TestMaxStatementPlaceholders(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{MaxStatementPlaceholders: MinStatementPlaceholders})
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	var hashes [][]byte
+	for i := 0; i < MinStatementPlaceholders+1; i++ {
+		hash := sha256.Sum256([]byte{byte(i)})
+		hashes = append(hashes, hash[:])
+	}
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		ltx := tx.(*logTreeTX)
+		if _, err := ltx.GetLeavesByHashPage(ctx, hashes[:MinStatementPlaceholders], 10, 0); err != nil {
+			t.Errorf("GetLeavesByHashPage() with %d hashes: %v", MinStatementPlaceholders, err)
+		}
+		if _, err := ltx.GetLeavesByHashPage(ctx, hashes, 10, 0); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("GetLeavesByHashPage() with %d hashes = %v, want code %v", len(hashes), err, codes.InvalidArgument)
+		}
+		// Statements made by storage itself are split to fit the cap instead.
+		var leaves []*trillian.LogLeaf
+		for _, hash := range hashes {
+			leaves = append(leaves, &trillian.LogLeaf{LeafIdentityHash: hash})
+		}
+		if err := ltx.fillSequencedPositions(ctx, nil, leaves); err != nil {
+			t.Errorf("fillSequencedPositions() with %d hashes: %v", len(hashes), err)
+		}
+		if _, err := ltx.getSubtrees(ctx, 0, hashes); err != nil {
+			t.Errorf("getSubtrees() with %d IDs: %v", len(hashes), err)
+		}
+		// Each subtree takes four placeholders, so they're stored one by one.
+		subtrees := []*storagepb.SubtreeProto{{Prefix: []byte{}, Depth: 8}, {Prefix: []byte{1}, Depth: 8}}
+		if err := ltx.storeSubtrees(ctx, subtrees); err != nil {
+			t.Errorf("storeSubtrees() with %d subtrees: %v", len(subtrees), err)
+		}
+		return nil
+	})
+
+	states := []trillian.TreeState{
+		trillian.TreeState_ACTIVE, trillian.TreeState_DRAINING, trillian.TreeState_FROZEN,
+		trillian.TreeState_DEPRECATED_SOFT_DELETED, trillian.TreeState_DEPRECATED_HARD_DELETED,
+	}
+	if _, err := s.(*mySQLLogStorage).GetActiveLogIDsByState(ctx, states...); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("GetActiveLogIDsByState() with %d states = %v, want code %v", len(states), err, codes.InvalidArgument)
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	for _, tc := range []struct {
+		desc            string
+		maxPlaceholders int
+		n               int
+		first, rest     string
+		want            int
+	}{
+		{desc: "no-cap", n: 10, first: "?", rest: "?", want: 10},
+		{desc: "within-cap", maxPlaceholders: 10, n: 10, first: "?", rest: "?", want: 10},
+		{desc: "hashes", maxPlaceholders: 4, n: 10, first: "?", rest: "?", want: 4},
+		{desc: "subtrees", maxPlaceholders: 9, n: 10, first: insertSubtreeFirstSQL, rest: insertSubtreeRestSQL, want: 2},
+		{desc: "too-small", maxPlaceholders: 3, n: 10, first: insertSubtreeFirstSQL, rest: insertSubtreeRestSQL, want: 1},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			m := &mySQLTreeStorage{maxPlaceholders: tc.maxPlaceholders}
+			if got := m.chunkSize(tc.n, tc.first, tc.rest); got != tc.want {
+				t.Errorf("chunkSize(%d, %q, %q) = %d, want %d", tc.n, tc.first, tc.rest, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStreamAllLeaves(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{StreamLeavesPageSize: 2})
+
+	const leafCount = 5
+	for i := 0; i < leafCount; i++ {
+		data := []byte(fmt.Sprintf("data %d", i))
+		idHash := sha256.Sum256(data)
+		merkleHash := sha256.Sum256(idHash[:])
+		createFakeLeaf(ctx, DB, tree.TreeId, merkleHash[:], idHash[:], data, someExtraData, int64(i), t)
+	}
+	mustSignAndStoreLogRoot(ctx, t, s, tree, leafCount)
+
+	errStop := errors.New("stop")
+	for _, tc := range []struct {
+		desc    string
+		fromSeq int64
+		stopAt  int64
+		want    []int64
+		wantErr error
+	}{
+		{desc: "all", fromSeq: 0, stopAt: -1, want: []int64{0, 1, 2, 3, 4}},
+		{desc: "resume", fromSeq: 3, stopAt: -1, want: []int64{3, 4}},
+		{desc: "done", fromSeq: leafCount, stopAt: -1},
+		{desc: "callback-error", fromSeq: 0, stopAt: 2, want: []int64{0, 1, 2}, wantErr: errStop},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+				var got []int64
+				err := tx.(*logTreeTX).StreamAllLeaves(ctx, tc.fromSeq, func(leaf *trillian.LogLeaf) error {
+					got = append(got, leaf.LeafIndex)
+					if leaf.LeafIndex == tc.stopAt {
+						return errStop
+					}
+					return nil
+				})
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("StreamAllLeaves() = %v, want %v", err, tc.wantErr)
+				}
+				if diff := cmp.Diff(tc.want, got); diff != "" {
+					t.Errorf("StreamAllLeaves() streamed indices diff (-want +got):\n%s", diff)
+				}
+				return nil
+			})
+		})
+	}
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		err := tx.(*logTreeTX).StreamAllLeaves(ctx, -1, func(*trillian.LogLeaf) error { return nil })
+		if got, want := status.Code(err), codes.InvalidArgument; got != want {
+			t.Errorf("StreamAllLeaves(-1) = %v, want %v", err, want)
+		}
+		return nil
+	})
+}
+
+func TestGetLeavesByRangeWithGaps(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.PreorderedLogTree)
+	s := NewLogStorage(DB, nil)
+
+	leaves := append(createTestLeaves(2, 0), createTestLeaves(2, 4)...)
+	if _, err := s.AddSequencedLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
+		t.Fatalf("AddSequencedLeaves(): %v", err)
+	}
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		ltx := tx.(*logTreeTX)
+		strict, err := ltx.GetLeavesByRange(ctx, 0, 8)
+		if err != nil {
+			t.Fatalf("GetLeavesByRange(): %v", err)
+		}
+		if got, want := len(strict), 2; got != want {
+			t.Errorf("GetLeavesByRange(): got %d leaves, want %d", got, want)
+		}
+
+		for _, tc := range []struct {
+			start, count int64
+			wantIndices  []int64
+			wantGaps     []LeafGap
+		}{
+			{start: 0, count: 8, wantIndices: []int64{0, 1, 4, 5}, wantGaps: []LeafGap{{Start: 2, End: 4}, {Start: 6, End: 8}}},
+			{start: 1, count: 5, wantIndices: []int64{1, 4, 5}, wantGaps: []LeafGap{{Start: 2, End: 4}}},
+			{start: 2, count: 2, wantIndices: nil, wantGaps: []LeafGap{{Start: 2, End: 4}}},
+			{start: 0, count: 2, wantIndices: []int64{0, 1}, wantGaps: []LeafGap{}},
+		} {
+			got, gaps, err := ltx.GetLeavesByRangeWithGaps(ctx, tc.start, tc.count)
+			if err != nil {
+				t.Fatalf("GetLeavesByRangeWithGaps(%d, %d): %v", tc.start, tc.count, err)
+			}
+			var gotIndices []int64
+			for _, leaf := range got {
+				gotIndices = append(gotIndices, leaf.LeafIndex)
+			}
+			if diff := cmp.Diff(tc.wantIndices, gotIndices); diff != "" {
+				t.Errorf("GetLeavesByRangeWithGaps(%d, %d) leaves diff (-want +got):\n%s", tc.start, tc.count, diff)
+			}
+			if diff := cmp.Diff(tc.wantGaps, gaps); diff != "" {
+				t.Errorf("GetLeavesByRangeWithGaps(%d, %d) gaps diff (-want +got):\n%s", tc.start, tc.count, diff)
+			}
+		}
+		return nil
+	})
+}
+
+func TestGetLeavesByIndexKey(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.PreorderedLogTree)
+	s := NewLogStorage(DB, nil)
+
+	leaves := createTestLeaves(4, 0)
+	for i, key := range []string{"a", "b", "a", ""} {
+		leaves[i].IndexKey = []byte(key)
+	}
+	if _, err := s.AddSequencedLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
+		t.Fatalf("AddSequencedLeaves(): %v", err)
+	}
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		ltx := tx.(*logTreeTX)
+		for _, tc := range []struct {
+			key  string
+			want []int64
+		}{
+			{key: "a", want: []int64{0, 2}},
+			{key: "b", want: []int64{1}},
+			{key: "c", want: nil},
+		} {
+			got, err := ltx.GetLeavesByIndexKey(ctx, []byte(tc.key))
+			if err != nil {
+				t.Fatalf("GetLeavesByIndexKey(%q): %v", tc.key, err)
+			}
+			var gotIndices []int64
+			for _, leaf := range got {
+				if !bytes.Equal(leaf.IndexKey, []byte(tc.key)) {
+					t.Errorf("GetLeavesByIndexKey(%q): got leaf with IndexKey %q", tc.key, leaf.IndexKey)
+				}
+				gotIndices = append(gotIndices, leaf.LeafIndex)
+			}
+			if diff := cmp.Diff(tc.want, gotIndices); diff != "" {
+				t.Errorf("GetLeavesByIndexKey(%q) diff (-want +got):\n%s", tc.key, diff)
+			}
+		}
+		if _, err := ltx.GetLeavesByIndexKey(ctx, nil); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("GetLeavesByIndexKey(nil) = %v, want code %v", err, codes.InvalidArgument)
+		}
+		return nil
+	})
+}
+
+func TestQueueLeavesIndexKeyTooLong(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
+
+	leaves := createTestLeaves(1, 0)
+	leaves[0].IndexKey = make([]byte, maxIndexKeyLen+1)
+	if _, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("QueueLeaves() = %v, want code %v", err, codes.InvalidArgument)
+	}
+}
+
+func TestGetLeafDataByIdentityHash(t *testing.T) {
+	ctx := context.Background()
+
+	// Create fake leaf as if it had been sequenced
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+	data := []byte("some data")
+	createFakeLeaf(ctx, DB, tree.TreeId, dummyRawHash, dummyHash, data, someExtraData, sequenceNumber, t)
+	createFakeLeaf(ctx, DB, tree.TreeId, dummyHash2, dummyHash2, data, someExtraData, sequenceNumber+1, t)
+	leaf := leafData{identityHash: dummyRawHash, value: data, extraData: someExtraData, queueTimestamp: fakeQueueTime}
+	leaf2 := leafData{identityHash: dummyHash2, value: data, extraData: someExtraData, queueTimestamp: fakeQueueTime}
+
+	tests := []struct {
+		hashes [][]byte
+		want   []leafData
+	}{
+		{
+			hashes: [][]byte{dummyRawHash},
+			want:   []leafData{leaf},
+		},
+		{
+			hashes: [][]byte{{0x01, 0x02}},
+		},
+		{
+			hashes: [][]byte{
+				dummyRawHash,
+				{0x01, 0x02},
+				dummyHash2,
+				{0x01, 0x02},
+			},
+			want: []leafData{leaf, leaf2},
+		},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+				got, err := tx.(*logTreeTX).getLeafDataByIdentityHash(ctx, nil, test.hashes)
+				if err != nil {
+					t.Fatalf("getLeafDataByIdentityHash(_) = (_,%v); want (_,nil)", err)
+				}
+				// Note: leaves not necessarily returned in order requested.
+				sort.Slice(got, func(i, j int) bool { return bytes.Compare(got[i].identityHash, got[j].identityHash) < 0 })
+				sort.Slice(test.want, func(i, j int) bool { return bytes.Compare(test.want[i].identityHash, test.want[j].identityHash) < 0 })
+				if diff := cmp.Diff(test.want, got, cmp.AllowUnexported(leafData{}), cmpopts.EquateEmpty()); diff != "" {
+					t.Errorf("getLeafDataByIdentityHash() diff (-want +got):\n%s", diff)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestGetExtraDataByIndex(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	createFakeLeaf(ctx, DB, tree.TreeId, dummyRawHash, dummyHash, []byte("value"), someExtraData, 0, t)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 1)
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		got, err := tx.(*logTreeTX).GetExtraDataByIndex(ctx, 0)
+		if err != nil {
+			t.Fatalf("GetExtraDataByIndex(0): %v", err)
+		}
+		if !bytes.Equal(got, someExtraData) {
+			t.Errorf("GetExtraDataByIndex(0) = %x, want %x", got, someExtraData)
+		}
+		for _, index := range []int64{-1, 1} {
+			if _, err := tx.(*logTreeTX).GetExtraDataByIndex(ctx, index); status.Code(err) != codes.OutOfRange {
+				t.Errorf("GetExtraDataByIndex(%d) = %v, want OutOfRange", index, err)
+			}
+		}
+		return nil
+	})
+}
+
+func TestCountLeavesInRange(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	// Leaves 0, 1, 2 and 4 are present; 3 is a gap.
+	for _, seq := range []int64{0, 1, 2, 4} {
+		data := []byte(fmt.Sprintf("data %d", seq))
+		hash := sha256.Sum256(data)
+		createFakeLeaf(ctx, DB, tree.TreeId, hash[:], hash[:], data, someExtraData, seq, t)
+	}
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 5)
+
+	for _, tc := range []struct {
+		start, end int64
+		want       int64
+		wantErr    bool
+	}{
+		{start: 0, end: 3, want: 3},
+		{start: 0, end: 5, want: 4},
+		{start: 3, end: 4, want: 0},
+		{start: 2, end: 2, want: 0},
+		{start: 4, end: 100, want: 1},
+		{start: -1, end: 3, wantErr: true},
+		{start: 3, end: 2, wantErr: true},
+	} {
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			got, err := tx.(*logTreeTX).CountLeavesInRange(ctx, tc.start, tc.end)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("CountLeavesInRange(%d, %d) = %v, wantErr %t", tc.start, tc.end, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("CountLeavesInRange(%d, %d) = %d, want %d", tc.start, tc.end, got, tc.want)
+			}
+			return nil
+		})
+	}
+}
+
+func TestCanAdvanceToSize(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	for _, seq := range []int64{0, 1, 2, 4, 7} {
+		data := []byte(fmt.Sprintf("data %d", seq))
+		hash := sha256.Sum256(data)
+		createFakeLeaf(ctx, DB, tree.TreeId, hash[:], hash[:], data, someExtraData, seq, t)
+	}
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 3)
+
+	for _, tc := range []struct {
+		n           int64
+		want        bool
+		wantMissing []int64
+	}{
+		{n: 0, want: true},
+		{n: 3, want: true},
+		{n: 5, want: false, wantMissing: []int64{3}},
+		{n: 8, want: false, wantMissing: []int64{3, 5, 6}},
+		{n: 20, want: false, wantMissing: []int64{3, 5, 6, 8, 9, 10, 11, 12, 13, 14}},
+	} {
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			got, missing, err := tx.(*logTreeTX).CanAdvanceToSize(ctx, tc.n)
+			if err != nil {
+				t.Fatalf("CanAdvanceToSize(%d): %v", tc.n, err)
+			}
+			if got != tc.want {
+				t.Errorf("CanAdvanceToSize(%d) = %t, want %t", tc.n, got, tc.want)
+			}
+			if diff := cmp.Diff(tc.wantMissing, missing, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("CanAdvanceToSize(%d) missing diff (-want +got):\n%s", tc.n, diff)
+			}
+			return nil
+		})
+	}
+}
+
+func TestGetLeavesIntegratedSince(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
 
-	if _, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
-		t.Fatalf("Failed to queue leaves: %v", err)
+	const leafCount = 5
+	for i := 0; i < leafCount; i++ {
+		data := []byte(fmt.Sprintf("data %d", i))
+		hash := sha256.Sum256(data)
+		createFakeLeaf(ctx, DB, tree.TreeId, hash[:], hash[:], data, someExtraData, int64(i), t)
 	}
+	// Leaves 0-2 are integrated in one batch, leaf 3 in a later one, and leaf 4
+	// is not yet covered by the tree.
+	integrated := fakeIntegrateTime.UnixNano()
+	later := integrated + int64(time.Second)
+	if _, err := DB.ExecContext(ctx, "UPDATE SequencedLeafData SET IntegrateTimestampNanos=? WHERE TreeId=? AND SequenceNumber>=3", later, tree.TreeId); err != nil {
+		t.Fatalf("Failed to update IntegrateTimestampNanos: %v", err)
+	}
+	mustSignAndStoreLogRoot(ctx, t, s, tree, leafCount-1)
 
-	if _, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
-		t.Fatalf("Failed to queue leaves: %v", err)
+	for _, tc := range []struct {
+		desc       string
+		sinceNanos int64
+		limit      int
+		want       []int64
+	}{
+		{desc: "all", sinceNanos: 0, limit: 10, want: []int64{0, 1, 2, 3}},
+		{desc: "split-batch", sinceNanos: 0, limit: 2, want: []int64{0, 1, 2}},
+		{desc: "watermark", sinceNanos: integrated, limit: 10, want: []int64{3}},
+		{desc: "up-to-date", sinceNanos: later, limit: 10, want: nil},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+				leaves, err := tx.(*logTreeTX).GetLeavesIntegratedSince(ctx, tc.sinceNanos, tc.limit)
+				if err != nil {
+					t.Fatalf("GetLeavesIntegratedSince(): %v", err)
+				}
+				var got []int64
+				for _, leaf := range leaves {
+					got = append(got, leaf.LeafIndex)
+				}
+				if diff := cmp.Diff(tc.want, got); diff != "" {
+					t.Errorf("GetLeavesIntegratedSince() diff (-want +got):\n%s", diff)
+				}
+				return nil
+			})
+		})
 	}
+}
 
-	// Should see the leaves in the database. There is no API to read from the unsequenced data.
-	var count int
-	if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM Unsequenced WHERE TreeID=?", tree.TreeId).Scan(&count); err != nil {
-		t.Fatalf("Could not query row count: %v", err)
+func TestStreamIdentityHashes(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	const leafCount = 5
+	hashes := make([][]byte, leafCount)
+	for i := 0; i < leafCount; i++ {
+		data := []byte(fmt.Sprintf("data %d", i))
+		hash := sha256.Sum256(data)
+		hashes[i] = hash[:]
+		createFakeLeaf(ctx, DB, tree.TreeId, hash[:], hash[:], data, someExtraData, int64(i), t)
 	}
-	if leafCount != count {
-		t.Fatalf("Expected %d unsequenced rows but got: %d", leafCount, count)
+	// Only the first leafCount-1 leaves are covered by the tree.
+	mustSignAndStoreLogRoot(ctx, t, s, tree, leafCount-1)
+
+	for _, tc := range []struct {
+		desc    string
+		fromSeq int64
+		want    []int64
+		wantErr bool
+	}{
+		{desc: "all", fromSeq: 0, want: []int64{0, 1, 2, 3}},
+		{desc: "from-middle", fromSeq: 2, want: []int64{2, 3}},
+		{desc: "beyond-tree", fromSeq: leafCount, want: nil},
+		{desc: "negative", fromSeq: -1, wantErr: true},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+				var got []int64
+				err := tx.(*logTreeTX).StreamIdentityHashes(ctx, tc.fromSeq, func(seq int64, hash []byte) error {
+					if !bytes.Equal(hash, hashes[seq]) {
+						t.Errorf("StreamIdentityHashes(): hash at %d = %x, want %x", seq, hash, hashes[seq])
+					}
+					got = append(got, seq)
+					return nil
+				})
+				if gotErr := err != nil; gotErr != tc.wantErr {
+					t.Fatalf("StreamIdentityHashes() = %v, wantErr %v", err, tc.wantErr)
+				}
+				if diff := cmp.Diff(tc.want, got); diff != "" {
+					t.Errorf("StreamIdentityHashes() diff (-want +got):\n%s", diff)
+				}
+				return nil
+			})
+		})
 	}
 }
 
-// -----------------------------------------------------------------------------
-
-func TestDequeueLeavesHaveQueueTimestamp(t *testing.T) {
+func TestGetLeafStatus(t *testing.T) {
 	ctx := context.Background()
 	cleanTestDB(DB)
 	as := NewAdminStorage(DB)
 	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
 	s := NewLogStorage(DB, nil)
-	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
 
-	leaves := createTestLeaves(leavesToInsert, 20)
-	if _, err := s.QueueLeaves(ctx, tree, leaves, fakeDequeueCutoffTime); err != nil {
-		t.Fatalf("Failed to queue leaves: %v", err)
+	integrated := createFakeLeaf(ctx, DB, tree.TreeId, dummyRawHash, dummyHash, []byte("data"), nil, 0, t)
+	sequenced := createFakeLeaf(ctx, DB, tree.TreeId, dummyHash2, dummyHash2, []byte("data2"), nil, 1, t)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 1)
+	queued := createTestLeaves(1, 10)
+	if _, err := s.QueueLeaves(ctx, tree, queued, fakeQueueTime); err != nil {
+		t.Fatalf("QueueLeaves(): %v", err)
 	}
 
-	{
-		// Now try to dequeue them
-		runLogTX(s, tree, t, func(ctx context.Context, tx2 storage.LogTreeTX) error {
-			leaves2, err := tx2.DequeueLeaves(ctx, 99, fakeDequeueCutoffTime)
-			if err != nil {
-				t.Fatalf("Failed to dequeue leaves: %v", err)
-			}
-			if len(leaves2) != leavesToInsert {
-				t.Fatalf("Dequeued %d leaves but expected to get %d", len(leaves2), leavesToInsert)
-			}
-			ensureLeavesHaveQueueTimestamp(t, leaves2, fakeDequeueCutoffTime)
-			return nil
+	for _, tc := range []struct {
+		desc string
+		hash []byte
+		want LeafStatus
+	}{
+		{desc: "unknown", hash: []byte("thisdoesn'texist"), want: LeafStatus{State: LeafUnknown}},
+		{desc: "queued", hash: queued[0].LeafIdentityHash, want: LeafStatus{State: LeafQueued}},
+		{desc: "sequenced", hash: sequenced.LeafIdentityHash, want: LeafStatus{State: LeafSequenced, LeafIndex: 1}},
+		{desc: "integrated", hash: integrated.LeafIdentityHash, want: LeafStatus{State: LeafIntegrated, LeafIndex: 0, TreeSize: 1}},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+				got, err := tx.(*logTreeTX).GetLeafStatus(ctx, tc.hash)
+				if err != nil {
+					t.Fatalf("GetLeafStatus(): %v", err)
+				}
+				if got != tc.want {
+					t.Errorf("GetLeafStatus() = %+v, want %+v", got, tc.want)
+				}
+				return nil
+			})
 		})
 	}
 }
 
-// Queues leaves and attempts to dequeue before the guard cutoff allows it. This should
-// return nothing. Then retry with an inclusive guard cutoff and ensure the leaves
-// are returned.
-func TestDequeueLeavesGuardInterval(t *testing.T) {
+func TestFirstRootCovering(t *testing.T) {
 	ctx := context.Background()
 	cleanTestDB(DB)
 	as := NewAdminStorage(DB)
 	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
 	s := NewLogStorage(DB, nil)
-	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
 
-	leaves := createTestLeaves(leavesToInsert, 20)
-	if _, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
-		t.Fatalf("Failed to queue leaves: %v", err)
+	// Roots of sizes 2, 2 and 5 are stored at revisions 0, 1 and 2.
+	var roots []*trillian.SignedLogRoot
+	for i, size := range []uint64{2, 2, 5} {
+		root, err := SignLogRoot(&types.LogRootV1{TimestampNanos: 1000 + uint64(i), TreeSize: size, RootHash: dummyHash})
+		if err != nil {
+			t.Fatalf("SignLogRoot(): %v", err)
+		}
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			return tx.StoreSignedLogRoot(ctx, root)
+		})
+		roots = append(roots, root)
 	}
 
-	{
-		// Now try to dequeue them using a cutoff that means we should get none
-		runLogTX(s, tree, t, func(ctx context.Context, tx2 storage.LogTreeTX) error {
-			leaves2, err := tx2.DequeueLeaves(ctx, 99, fakeQueueTime.Add(-time.Second))
-			if err != nil {
-				t.Fatalf("Failed to dequeue leaves: %v", err)
-			}
-			if len(leaves2) != 0 {
-				t.Fatalf("Dequeued %d leaves when they all should be in guard interval", len(leaves2))
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		ltx := tx.(*logTreeTX)
+		for _, tc := range []struct {
+			index    int64
+			want     *trillian.SignedLogRoot
+			wantCode codes.Code
+		}{
+			{index: 0, want: roots[0]},
+			{index: 1, want: roots[0]},
+			{index: 2, want: roots[2]},
+			{index: 4, want: roots[2]},
+			{index: 5, wantCode: codes.NotFound},
+			{index: -1, wantCode: codes.InvalidArgument},
+		} {
+			got, err := ltx.FirstRootCovering(ctx, tc.index)
+			if status.Code(err) != tc.wantCode {
+				t.Errorf("FirstRootCovering(%d) = %v, want code %v", tc.index, err, tc.wantCode)
+				continue
 			}
-
-			// Try to dequeue again using a cutoff that should include them
-			leaves2, err = tx2.DequeueLeaves(ctx, 99, fakeQueueTime.Add(time.Second))
 			if err != nil {
-				t.Fatalf("Failed to dequeue leaves: %v", err)
+				continue
 			}
-			if len(leaves2) != leavesToInsert {
-				t.Fatalf("Dequeued %d leaves but expected to get %d", len(leaves2), leavesToInsert)
+			if !bytes.Equal(got.LogRoot, tc.want.LogRoot) {
+				t.Errorf("FirstRootCovering(%d) = %x, want %x", tc.index, got.LogRoot, tc.want.LogRoot)
 			}
-			ensureAllLeavesDistinct(leaves2, t)
-			return nil
+		}
+		return nil
+	})
+}
+
+func TestGetLeafProvenance(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	first := createFakeLeaf(ctx, DB, tree.TreeId, dummyRawHash, dummyHash, []byte("data"), nil, 0, t)
+	second := createFakeLeaf(ctx, DB, tree.TreeId, dummyHash2, dummyHash2, []byte("data2"), nil, 1, t)
+	otherHash := []byte("HASHyyyyhashxxxxhashxxxxhashxxxx")
+	sequenced := createFakeLeaf(ctx, DB, tree.TreeId, otherHash, otherHash, []byte("data3"), nil, 2, t)
+	// Roots of sizes 1 and 2 are stored at revisions 0 and 1.
+	for size := uint64(1); size <= 2; size++ {
+		root, err := SignLogRoot(&types.LogRootV1{TimestampNanos: 1000 + size, TreeSize: size, RootHash: dummyHash})
+		if err != nil {
+			t.Fatalf("SignLogRoot(): %v", err)
+		}
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			return tx.StoreSignedLogRoot(ctx, root)
+		})
+	}
+	queued := createTestLeaves(1, 10)
+	if _, err := s.QueueLeaves(ctx, tree, queued, fakeQueueTime); err != nil {
+		t.Fatalf("QueueLeaves(): %v", err)
+	}
+
+	for _, tc := range []struct {
+		desc     string
+		hash     []byte
+		want     LeafProvenance
+		wantCode codes.Code
+	}{
+		{desc: "unknown", hash: []byte("thisdoesn'texist"), wantCode: codes.NotFound},
+		{desc: "queued", hash: queued[0].LeafIdentityHash, want: LeafProvenance{QueueTimestamp: fakeQueueTime}},
+		{
+			desc: "sequenced",
+			hash: sequenced.LeafIdentityHash,
+			want: LeafProvenance{QueueTimestamp: fakeQueueTime, Sequenced: true, LeafIndex: 2, IntegrateTimestamp: fakeIntegrateTime},
+		},
+		{
+			desc: "first",
+			hash: first.LeafIdentityHash,
+			want: LeafProvenance{QueueTimestamp: fakeQueueTime, Sequenced: true, LeafIndex: 0, IntegrateTimestamp: fakeIntegrateTime, Included: true, Revision: 0, TreeSize: 1},
+		},
+		{
+			desc: "second",
+			hash: second.LeafIdentityHash,
+			want: LeafProvenance{QueueTimestamp: fakeQueueTime, Sequenced: true, LeafIndex: 1, IntegrateTimestamp: fakeIntegrateTime, Included: true, Revision: 1, TreeSize: 2},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+				got, err := tx.(*logTreeTX).GetLeafProvenance(ctx, tc.hash)
+				if status.Code(err) != tc.wantCode {
+					t.Fatalf("GetLeafProvenance() = %v, want code %v", err, tc.wantCode)
+				}
+				if diff := cmp.Diff(tc.want, got); diff != "" {
+					t.Errorf("GetLeafProvenance() diff (-want +got):\n%s", diff)
+				}
+				return nil
+			})
 		})
 	}
 }
 
-func TestDequeueLeavesTimeOrdering(t *testing.T) {
-	// Queue two small batches of leaves at different timestamps. Do two separate dequeue
-	// transactions and make sure the returned leaves are respecting the time ordering of the
-	// queue.
+func TestOldestQueuedLeafAge(t *testing.T) {
 	ctx := context.Background()
 	cleanTestDB(DB)
 	as := NewAdminStorage(DB)
@@ -338,232 +3152,364 @@ func TestDequeueLeavesTimeOrdering(t *testing.T) {
 	s := NewLogStorage(DB, nil)
 	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
 
-	batchSize := 2
-	leaves := createTestLeaves(int64(batchSize), 0)
-	leaves2 := createTestLeaves(int64(batchSize), int64(batchSize))
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		age, err := tx.(*logTreeTX).OldestQueuedLeafAge(ctx)
+		if err != nil {
+			t.Fatalf("OldestQueuedLeafAge(): %v", err)
+		}
+		if age != 0 {
+			t.Errorf("OldestQueuedLeafAge() of empty queue = %v, want 0", age)
+		}
+		return nil
+	})
+
+	queueTime := time.Now().Add(-time.Hour)
+	if _, err := s.QueueLeaves(ctx, tree, createTestLeaves(2, 0), queueTime); err != nil {
+		t.Fatalf("QueueLeaves(): %v", err)
+	}
+	if _, err := s.QueueLeaves(ctx, tree, createTestLeaves(2, 2), queueTime.Add(time.Minute)); err != nil {
+		t.Fatalf("QueueLeaves(): %v", err)
+	}
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		age, err := tx.(*logTreeTX).OldestQueuedLeafAge(ctx)
+		if err != nil {
+			t.Fatalf("OldestQueuedLeafAge(): %v", err)
+		}
+		if age < time.Hour || age > 2*time.Hour {
+			t.Errorf("OldestQueuedLeafAge() = %v, want about 1h", age)
+		}
+		return nil
+	})
+}
+
+func TestRequeueOrphanedDequeued(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{RecordMerkleLeafHash: true})
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
 
+	const leafCount = 3
+	leaves := createTestLeaves(leafCount, 0)
 	if _, err := s.QueueLeaves(ctx, tree, leaves, fakeQueueTime); err != nil {
-		t.Fatalf("QueueLeaves(1st batch) = %v", err)
+		t.Fatalf("QueueLeaves(): %v", err)
 	}
-	// These are one second earlier so should be dequeued first
-	if _, err := s.QueueLeaves(ctx, tree, leaves2, fakeQueueTime.Add(-time.Second)); err != nil {
-		t.Fatalf("QueueLeaves(2nd batch) = %v", err)
+	// A leaf queued without its MerkleLeafHash recorded can't be requeued.
+	unhashed := createTestLeaves(1, leafCount)
+	if _, err := NewLogStorage(DB, nil).QueueLeaves(ctx, tree, unhashed, fakeQueueTime); err != nil {
+		t.Fatalf("QueueLeaves(): %v", err)
+	}
+	// Simulate a lost dequeue of every leaf but the last.
+	for _, leaf := range append(leaves[:leafCount-1:leafCount-1], unhashed...) {
+		if _, err := DB.ExecContext(ctx, "DELETE FROM Unsequenced WHERE TreeId=? AND LeafIdentityHash=?", tree.TreeId, leaf.LeafIdentityHash); err != nil {
+			t.Fatalf("Failed to delete Unsequenced entry: %v", err)
+		}
 	}
 
-	{
-		// Now try to dequeue two leaves and we should get the second batch
-		runLogTX(s, tree, t, func(ctx context.Context, tx2 storage.LogTreeTX) error {
-			dequeue1, err := tx2.DequeueLeaves(ctx, batchSize, fakeQueueTime)
-			if err != nil {
-				t.Fatalf("DequeueLeaves(1st) = %v", err)
-			}
-			if got, want := len(dequeue1), batchSize; got != want {
-				t.Fatalf("Dequeue count mismatch (1st) got: %d, want: %d", got, want)
-			}
-			ensureAllLeavesDistinct(dequeue1, t)
+	runLogTX(NewLogStorage(DB, nil), tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		if _, err := tx.(*logTreeTX).RequeueOrphanedDequeued(ctx, fakeDequeueCutoffTime); status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("RequeueOrphanedDequeued() without RecordMerkleLeafHash = %v, want code %v", err, codes.FailedPrecondition)
+		}
+		return nil
+	})
+	// Leaves dequeued by the same transaction aren't orphans.
+	errRollback := errors.New("roll back")
+	if err := s.ReadWriteTransaction(ctx, tree, func(ctx context.Context, tx storage.LogTreeTX) error {
+		ltx := tx.(*logTreeTX)
+		dequeued, err := ltx.DequeueLeaves(ctx, 1, fakeDequeueCutoffTime)
+		if err != nil || len(dequeued) != 1 {
+			t.Fatalf("DequeueLeaves() = %d leaves, %v, want 1 leaf", len(dequeued), err)
+		}
+		if _, err := ltx.tx.ExecContext(ctx, "DELETE FROM Unsequenced WHERE TreeId=? AND LeafIdentityHash=?", tree.TreeId, dequeued[0].LeafIdentityHash); err != nil {
+			t.Fatalf("Failed to delete Unsequenced entry: %v", err)
+		}
+		got, err := ltx.RequeueOrphanedDequeued(ctx, fakeDequeueCutoffTime)
+		if err != nil {
+			t.Fatalf("RequeueOrphanedDequeued(): %v", err)
+		}
+		if want := leafCount - 1; got != want {
+			t.Errorf("RequeueOrphanedDequeued() after dequeuing = %d, want %d", got, want)
+		}
+		return errRollback
+	}); !errors.Is(err, errRollback) {
+		t.Fatalf("ReadWriteTransaction() = %v, want %v", err, errRollback)
+	}
 
-			// Ensure this is the second batch queued by comparing leaf hashes (must be distinct as
-			// the leaf data was).
-			if !leafInBatch(dequeue1[0], leaves2) || !leafInBatch(dequeue1[1], leaves2) {
-				t.Fatalf("Got leaf from wrong batch (1st dequeue): %v", dequeue1)
-			}
-			iTimestamp := timestamppb.Now()
-			for i, l := range dequeue1 {
-				l.IntegrateTimestamp = iTimestamp
-				l.LeafIndex = int64(i)
+	for _, tc := range []struct {
+		desc   string
+		cutoff time.Time
+		want   int
+	}{
+		{desc: "before-queue-time", cutoff: fakeQueueTime, want: 0},
+		{desc: "requeue", cutoff: fakeDequeueCutoffTime, want: leafCount - 1},
+		{desc: "idempotent", cutoff: fakeDequeueCutoffTime, want: 0},
+	} {
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			got, err := tx.(*logTreeTX).RequeueOrphanedDequeued(ctx, tc.cutoff)
+			if err != nil {
+				t.Fatalf("%s: RequeueOrphanedDequeued(): %v", tc.desc, err)
 			}
-			if err := tx2.UpdateSequencedLeaves(ctx, dequeue1); err != nil {
-				t.Fatalf("UpdateSequencedLeaves(): %v", err)
+			if got != tc.want {
+				t.Errorf("%s: RequeueOrphanedDequeued() = %d, want %d", tc.desc, got, tc.want)
 			}
-
 			return nil
 		})
+	}
 
-		// Try to dequeue again and we should get the batch that was queued first, though at a later time
-		runLogTX(s, tree, t, func(ctx context.Context, tx3 storage.LogTreeTX) error {
-			dequeue2, err := tx3.DequeueLeaves(ctx, batchSize, fakeQueueTime)
-			if err != nil {
-				t.Fatalf("DequeueLeaves(2nd) = %v", err)
-			}
-			if got, want := len(dequeue2), batchSize; got != want {
-				t.Fatalf("Dequeue count mismatch (2nd) got: %d, want: %d", got, want)
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		dequeued, err := tx.DequeueLeaves(ctx, leafCount+1, fakeDequeueCutoffTime)
+		if err != nil {
+			t.Fatalf("DequeueLeaves(): %v", err)
+		}
+		if got, want := len(dequeued), leafCount; got != want {
+			t.Errorf("DequeueLeaves() returned %d leaves, want %d", got, want)
+		}
+		// The leaves are requeued with the MerkleLeafHash they were queued with.
+		want := make(map[string][]byte)
+		for _, leaf := range leaves {
+			want[string(leaf.LeafIdentityHash)] = leaf.MerkleLeafHash
+		}
+		for _, leaf := range dequeued {
+			if w := want[string(leaf.LeafIdentityHash)]; !bytes.Equal(leaf.MerkleLeafHash, w) {
+				t.Errorf("Dequeued leaf %x has MerkleLeafHash %x, want %x", leaf.LeafIdentityHash, leaf.MerkleLeafHash, w)
 			}
-			ensureAllLeavesDistinct(dequeue2, t)
+		}
+		return nil
+	})
+}
 
-			// Ensure this is the first batch by comparing leaf hashes.
-			if !leafInBatch(dequeue2[0], leaves) || !leafInBatch(dequeue2[1], leaves) {
-				t.Fatalf("Got leaf from wrong batch (2nd dequeue): %v", dequeue2)
-			}
-			return nil
-		})
+func leavesEquivalent(t *testing.T, gotLeaves, wantLeaves []*trillian.LogLeaf) {
+	t.Helper()
+	want := make(map[string]*trillian.LogLeaf)
+	for _, w := range wantLeaves {
+		k := sha256.Sum256([]byte(w.String()))
+		want[string(k[:])] = w
+	}
+	got := make(map[string]*trillian.LogLeaf)
+	for _, g := range gotLeaves {
+		k := sha256.Sum256([]byte(g.String()))
+		got[string(k[:])] = g
+	}
+	if diff := cmp.Diff(want, got, cmp.Comparer(proto.Equal)); diff != "" {
+		t.Errorf("leaves not equivalent: diff -want,+got:\n%v", diff)
 	}
 }
 
-func TestGetLeavesByHashNotPresent(t *testing.T) {
+// -----------------------------------------------------------------------------
+
+func TestLatestSignedRootNoneWritten(t *testing.T) {
 	ctx := context.Background()
+
 	cleanTestDB(DB)
 	as := NewAdminStorage(DB)
 	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
 	s := NewLogStorage(DB, nil)
 
-	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
-		hashes := [][]byte{[]byte("thisdoesn'texist")}
-		leaves, err := tx.GetLeavesByHash(ctx, hashes, false)
-		if err != nil {
-			t.Fatalf("Error getting leaves by hash: %v", err)
-		}
-		if len(leaves) != 0 {
-			t.Fatalf("Expected no leaves returned but got %d", len(leaves))
-		}
-		return nil
-	})
+	tx, err := s.SnapshotForTree(ctx, tree)
+	if err != storage.ErrTreeNeedsInit {
+		t.Fatalf("SnapshotForTree gave %v, want %v", err, storage.ErrTreeNeedsInit)
+	}
+	commit(ctx, tx, t)
 }
 
-func TestGetLeavesByHash(t *testing.T) {
+func TestLeafSizeHistogram(t *testing.T) {
 	ctx := context.Background()
-
-	// Create fake leaf as if it had been sequenced
 	cleanTestDB(DB)
 	as := NewAdminStorage(DB)
 	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
 	s := NewLogStorage(DB, nil)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
 
-	data := []byte("some data")
-	createFakeLeaf(ctx, DB, tree.TreeId, dummyRawHash, dummyHash, data, someExtraData, sequenceNumber, t)
+	for i, size := range []int{10, 100, 101, 5000} {
+		hash := sha256.Sum256([]byte(fmt.Sprintf("leaf %d", i)))
+		createFakeLeaf(ctx, DB, tree.TreeId, hash[:], hash[:], make([]byte, size), nil, int64(i), t)
+	}
 
 	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
-		hashes := [][]byte{dummyHash}
-		leaves, err := tx.GetLeavesByHash(ctx, hashes, false)
+		ltx := tx.(*logTreeTX)
+		got, err := ltx.LeafSizeHistogram(ctx, []int64{100, 1000, 2000})
 		if err != nil {
-			t.Fatalf("Unexpected error getting leaf by hash: %v", err)
+			t.Fatalf("LeafSizeHistogram(): %v", err)
 		}
-		if len(leaves) != 1 {
-			t.Fatalf("Got %d leaves but expected one", len(leaves))
+		want := map[int64]int64{100: 2, 1000: 1, math.MaxInt64: 1}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("LeafSizeHistogram() diff (-want +got):\n%s", diff)
+		}
+		for _, buckets := range [][]int64{nil, {100, 100}, {100, 10}} {
+			if _, err := ltx.LeafSizeHistogram(ctx, buckets); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("LeafSizeHistogram(%v) = %v, want code %v", buckets, err, codes.InvalidArgument)
+			}
 		}
-		checkLeafContents(leaves[0], sequenceNumber, dummyRawHash, dummyHash, data, someExtraData, t)
 		return nil
 	})
 }
 
-func TestGetLeavesByHashBigBatch(t *testing.T) {
-	t.Skip("Known Issue: https://github.com/google/trillian/issues/1845")
+func TestFindMerkleHashCollisions(t *testing.T) {
 	ctx := context.Background()
-
-	// Create fake leaf as if it had been sequenced
 	cleanTestDB(DB)
 	as := NewAdminStorage(DB)
 	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
 	s := NewLogStorage(DB, nil)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
 
-	const leafCount = 999 + 1
-	hashes := make([][]byte, leafCount)
-	for i := 0; i < leafCount; i++ {
-		data := []byte(fmt.Sprintf("data %d", i))
-		hash := sha256.Sum256(data)
-		hashes[i] = hash[:]
-		createFakeLeaf(ctx, DB, tree.TreeId, hash[:], hash[:], data, someExtraData, sequenceNumber+int64(i), t)
+	hash := func(s string) []byte {
+		h := sha256.Sum256([]byte(s))
+		return h[:]
+	}
+	shared, id1, id2 := hash("shared"), hash("id 1"), hash("id 2")
+	if bytes.Compare(id1, id2) > 0 {
+		id1, id2 = id2, id1
 	}
+	createFakeLeaf(ctx, DB, tree.TreeId, id1, shared, []byte("data 1"), nil, 0, t)
+	createFakeLeaf(ctx, DB, tree.TreeId, id2, shared, []byte("data 2"), nil, 1, t)
+	createFakeLeaf(ctx, DB, tree.TreeId, hash("id 3"), hash("unique"), []byte("data 3"), nil, 2, t)
 
 	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
-		leaves, err := tx.GetLeavesByHash(ctx, hashes, false)
+		ltx := tx.(*logTreeTX)
+		got, err := ltx.FindMerkleHashCollisions(ctx, 10)
 		if err != nil {
-			t.Fatalf("Unexpected error getting leaf by hash: %v", err)
+			t.Fatalf("FindMerkleHashCollisions(): %v", err)
 		}
-		if got, want := len(leaves), leafCount; got != want {
-			t.Fatalf("Got %d leaves, expected %d", got, want)
+		want := []MerkleHashCollision{{MerkleLeafHash: shared, LeafIdentityHashes: [][]byte{id1, id2}}}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("FindMerkleHashCollisions() diff (-want +got):\n%s", diff)
+		}
+		if _, err := ltx.FindMerkleHashCollisions(ctx, 0); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("FindMerkleHashCollisions(0) = %v, want code %v", err, codes.InvalidArgument)
 		}
 		return nil
 	})
 }
 
-func TestGetLeafDataByIdentityHash(t *testing.T) {
+func TestDumpSubtrees(t *testing.T) {
 	ctx := context.Background()
-
-	// Create fake leaf as if it had been sequenced
 	cleanTestDB(DB)
 	as := NewAdminStorage(DB)
-	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	tree := mustCreateTree(ctx, t, as, RevisionedLogTree)
 	s := NewLogStorage(DB, nil)
-	data := []byte("some data")
-	leaf := createFakeLeaf(ctx, DB, tree.TreeId, dummyRawHash, dummyHash, data, someExtraData, sequenceNumber, t)
-	leaf.LeafIndex = -1
-	leaf.MerkleLeafHash = []byte(dummyMerkleLeafHash)
-	leaf2 := createFakeLeaf(ctx, DB, tree.TreeId, dummyHash2, dummyHash2, data, someExtraData, sequenceNumber+1, t)
-	leaf2.LeafIndex = -1
-	leaf2.MerkleLeafHash = []byte(dummyMerkleLeafHash)
+	mustSignAndStoreLogRoot(ctx, t, s, tree, 0)
 
-	tests := []struct {
-		hashes [][]byte
-		want   []*trillian.LogLeaf
+	// The bytes needn't be valid SubtreeProtos, as they aren't decoded.
+	for _, row := range []struct {
+		id    string
+		nodes string
+		rev   int64
 	}{
-		{
-			hashes: [][]byte{dummyRawHash},
-			want:   []*trillian.LogLeaf{leaf},
-		},
-		{
-			hashes: [][]byte{{0x01, 0x02}},
-		},
-		{
-			hashes: [][]byte{
-				dummyRawHash,
-				{0x01, 0x02},
-				dummyHash2,
-				{0x01, 0x02},
-			},
-			// Note: leaves not necessarily returned in order requested.
-			want: []*trillian.LogLeaf{leaf2, leaf},
-		},
+		{id: "a", nodes: "a1", rev: 1},
+		{id: "a", nodes: "a3", rev: 3},
+		{id: "b", nodes: "b2", rev: 2},
+	} {
+		if _, err := DB.ExecContext(ctx, "INSERT INTO Subtree(TreeId,SubtreeId,Nodes,SubtreeRevision) VALUES(?,?,?,?)",
+			tree.TreeId, []byte(row.id), []byte(row.nodes), row.rev); err != nil {
+			t.Fatalf("Failed to insert subtree: %v", err)
+		}
 	}
-	for i, test := range tests {
-		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+
+	for _, tc := range []struct {
+		desc     string
+		revision int64
+		want     []string
+		wantErr  bool
+	}{
+		{desc: "before-all", revision: 0, want: nil},
+		{desc: "rev-1", revision: 1, want: []string{"a=a1"}},
+		{desc: "rev-2", revision: 2, want: []string{"a=a1", "b=b2"}},
+		{desc: "latest", revision: 5, want: []string{"a=a3", "b=b2"}},
+		{desc: "negative", revision: -1, wantErr: true},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
 			runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
-				leaves, err := tx.(*logTreeTX).getLeafDataByIdentityHash(ctx, test.hashes)
-				if err != nil {
-					t.Fatalf("getLeavesByIdentityHash(_) = (_,%v); want (_,nil)", err)
+				var got []string
+				err := tx.(*logTreeTX).DumpSubtrees(ctx, tc.revision, func(id, nodes []byte) error {
+					got = append(got, fmt.Sprintf("%s=%s", id, nodes))
+					return nil
+				})
+				if gotErr := err != nil; gotErr != tc.wantErr {
+					t.Fatalf("DumpSubtrees() = %v, wantErr %v", err, tc.wantErr)
 				}
-
-				if len(leaves) != len(test.want) {
-					t.Fatalf("getLeavesByIdentityHash(_) = (|%d|,nil); want (|%d|,nil)", len(leaves), len(test.want))
+				if diff := cmp.Diff(tc.want, got); diff != "" {
+					t.Errorf("DumpSubtrees() diff (-want +got):\n%s", diff)
 				}
-				leavesEquivalent(t, leaves, test.want)
 				return nil
 			})
 		})
 	}
 }
 
-func leavesEquivalent(t *testing.T, gotLeaves, wantLeaves []*trillian.LogLeaf) {
-	t.Helper()
-	want := make(map[string]*trillian.LogLeaf)
-	for _, w := range wantLeaves {
-		k := sha256.Sum256([]byte(w.String()))
-		want[string(k[:])] = w
-	}
-	got := make(map[string]*trillian.LogLeaf)
-	for _, g := range gotLeaves {
-		k := sha256.Sum256([]byte(g.String()))
-		got[string(k[:])] = g
-	}
-	if diff := cmp.Diff(want, got, cmp.Comparer(proto.Equal)); diff != "" {
-		t.Errorf("leaves not equivalent: diff -want,+got:\n%v", diff)
-	}
-}
-
-// -----------------------------------------------------------------------------
-
-func TestLatestSignedRootNoneWritten(t *testing.T) {
+func TestSnapshotForTreeAtRevision(t *testing.T) {
 	ctx := context.Background()
-
 	cleanTestDB(DB)
 	as := NewAdminStorage(DB)
-	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
-	s := NewLogStorage(DB, nil)
+	tree := mustCreateTree(ctx, t, as, RevisionedLogTree)
+	s := NewLogStorage(DB, nil).(*mySQLLogStorage)
 
-	tx, err := s.SnapshotForTree(ctx, tree)
-	if err != storage.ErrTreeNeedsInit {
-		t.Fatalf("SnapshotForTree gave %v, want %v", err, storage.ErrTreeNeedsInit)
+	nodes := createSomeNodes(4)
+	nodeIDs := make([]compact.NodeID, len(nodes))
+	for i := range nodes {
+		nodeIDs[i] = nodes[i].ID
+	}
+	// Revision 1 has the first 2 nodes, and revision 2 has all 4.
+	for rev := int64(1); rev <= 2; rev++ {
+		size := 2 * rev
+		root, err := SignLogRoot(&types.LogRootV1{TimestampNanos: uint64(1000 + rev), TreeSize: uint64(size), RootHash: dummyHash})
+		if err != nil {
+			t.Fatalf("SignLogRoot(): %v", err)
+		}
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			forceWriteRevision(rev, tx)
+			if err := tx.SetMerkleNodes(ctx, nodes[:size]); err != nil {
+				t.Fatalf("SetMerkleNodes(): %v", err)
+			}
+			return tx.StoreSignedLogRoot(ctx, root)
+		})
+	}
+
+	for _, tc := range []struct {
+		rev      int64
+		wantSize uint64
+		wantCode codes.Code
+	}{
+		{rev: 1, wantSize: 2},
+		{rev: 2, wantSize: 4},
+		{rev: 0, wantCode: codes.NotFound},
+		{rev: 3, wantCode: codes.OutOfRange},
+	} {
+		tx, err := s.SnapshotForTreeAtRevision(ctx, tree, tc.rev)
+		if got := status.Code(err); got != tc.wantCode {
+			t.Fatalf("SnapshotForTreeAtRevision(%d) = %v, want code %v", tc.rev, err, tc.wantCode)
+		}
+		if err != nil {
+			continue
+		}
+		slr, err := tx.LatestSignedLogRoot(ctx)
+		if err != nil {
+			t.Fatalf("LatestSignedLogRoot(): %v", err)
+		}
+		var root types.LogRootV1
+		if err := root.UnmarshalBinary(slr.LogRoot); err != nil {
+			t.Fatalf("UnmarshalBinary(): %v", err)
+		}
+		if root.TreeSize != tc.wantSize {
+			t.Errorf("revision %d: TreeSize = %d, want %d", tc.rev, root.TreeSize, tc.wantSize)
+		}
+		got, err := tx.GetMerkleNodes(ctx, nodeIDs)
+		if err != nil {
+			t.Fatalf("GetMerkleNodes(): %v", err)
+		}
+		if err := nodesAreEqual(got, nodes[:tc.wantSize]); err != nil {
+			t.Errorf("revision %d: %v", tc.rev, err)
+		}
+		commit(ctx, tx, t)
+	}
+
+	unrevisioned := mustCreateTree(ctx, t, as, testonly.LogTree)
+	runLogTX(s, unrevisioned, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		return storeLogRoot(ctx, tx, 0, 0, dummyHash)
+	})
+	if _, err := s.SnapshotForTreeAtRevision(ctx, unrevisioned, 0); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("SnapshotForTreeAtRevision() on unrevisioned tree = %v, want code %v", err, codes.FailedPrecondition)
 	}
-	commit(ctx, tx, t)
 }
 
 func SignLogRoot(root *types.LogRootV1) (*trillian.SignedLogRoot, error) {
@@ -611,6 +3557,135 @@ func TestLatestSignedLogRoot(t *testing.T) {
 	}
 }
 
+func TestCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	root, err := SignLogRoot(&types.LogRootV1{
+		TimestampNanos: 98765,
+		TreeSize:       16,
+		RootHash:       []byte(dummyHash),
+	})
+	if err != nil {
+		t.Fatalf("SignLogRoot(): %v", err)
+	}
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		return tx.StoreSignedLogRoot(ctx, root)
+	})
+
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		got, err := tx.(*logTreeTX).Checkpoint(ctx, "example.com/log")
+		if err != nil {
+			t.Fatalf("Checkpoint(): %v", err)
+		}
+		want := "example.com/log\n16\naGFzaHh4eHhoYXNoeHh4eGhhc2h4eHh4aGFzaHh4eHg=\n"
+		if string(got) != want {
+			t.Errorf("Checkpoint() = %q, want %q", got, want)
+		}
+		if _, err := tx.(*logTreeTX).Checkpoint(ctx, "bad\norigin"); err == nil {
+			t.Error("Checkpoint() with multi-line origin = nil, want err")
+		}
+		return nil
+	})
+}
+
+func TestExportTreeHeads(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	// Roots are stored at revisions 0, 1 and 2.
+	for i := 0; i < 3; i++ {
+		root, err := SignLogRoot(&types.LogRootV1{
+			TimestampNanos: uint64(1000 + i),
+			TreeSize:       uint64(i),
+			RootHash:       []byte(dummyHash),
+		})
+		if err != nil {
+			t.Fatalf("SignLogRoot(): %v", err)
+		}
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			return tx.StoreSignedLogRoot(ctx, root)
+		})
+	}
+
+	for _, tc := range []struct {
+		fromRevision int64
+		wantSizes    []int64
+	}{
+		{fromRevision: 0, wantSizes: []int64{0, 1, 2}},
+		{fromRevision: 1, wantSizes: []int64{1, 2}},
+		{fromRevision: 3, wantSizes: nil},
+	} {
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			var gotSizes []int64
+			err := tx.(*logTreeTX).ExportTreeHeads(ctx, tc.fromRevision, func(size, timestampNanos int64, rootHash, signature []byte) error {
+				if got, want := timestampNanos, 1000+size; got != want {
+					t.Errorf("ExportTreeHeads(): timestamp of size %d = %d, want %d", size, got, want)
+				}
+				if !bytes.Equal(rootHash, dummyHash) {
+					t.Errorf("ExportTreeHeads(): root hash = %x, want %x", rootHash, dummyHash)
+				}
+				gotSizes = append(gotSizes, size)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("ExportTreeHeads(%d): %v", tc.fromRevision, err)
+			}
+			if diff := cmp.Diff(tc.wantSizes, gotSizes); diff != "" {
+				t.Errorf("ExportTreeHeads(%d) diff (-want +got):\n%s", tc.fromRevision, diff)
+			}
+			return nil
+		})
+	}
+}
+
+func TestVerifyRevisionContinuity(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil)
+
+	for i := 0; i < 3; i++ {
+		root, err := SignLogRoot(&types.LogRootV1{
+			TimestampNanos: uint64(1000 + i),
+			TreeSize:       uint64(i),
+			RootHash:       []byte(dummyHash),
+		})
+		if err != nil {
+			t.Fatalf("SignLogRoot(): %v", err)
+		}
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			return tx.StoreSignedLogRoot(ctx, root)
+		})
+	}
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		if err := tx.(*logTreeTX).VerifyRevisionContinuity(ctx); err != nil {
+			t.Errorf("VerifyRevisionContinuity(): %v", err)
+		}
+		return nil
+	})
+
+	// Simulate a botched failover that skipped a few revisions.
+	if _, err := DB.ExecContext(ctx, "INSERT INTO TreeHead(TreeId,TreeHeadTimestamp,TreeSize,RootHash,TreeRevision,RootSignature) VALUES(?,?,?,?,?,?)",
+		tree.TreeId, 2000, 3, dummyHash, 10, []byte{}); err != nil {
+		t.Fatalf("Failed to insert TreeHead: %v", err)
+	}
+	runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+		err := tx.(*logTreeTX).VerifyRevisionContinuity(ctx)
+		if got, want := status.Code(err), codes.DataLoss; got != want {
+			t.Errorf("VerifyRevisionContinuity() = %v, want code %v", err, want)
+		}
+		return nil
+	})
+}
+
 func TestDuplicateSignedLogRoot(t *testing.T) {
 	ctx := context.Background()
 	cleanTestDB(DB)
@@ -639,6 +3714,39 @@ func TestDuplicateSignedLogRoot(t *testing.T) {
 	})
 }
 
+func TestStoreSignedLogRootEnforceMonotonic(t *testing.T) {
+	ctx := context.Background()
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorageWithOptions(DB, LogStorageOptions{EnforceMonotonicRoots: true})
+
+	for _, tc := range []struct {
+		desc      string
+		size      uint64
+		timestamp uint64
+		wantCode  codes.Code
+	}{
+		{desc: "first", size: 16, timestamp: 1000},
+		{desc: "smaller", size: 15, timestamp: 2000, wantCode: codes.FailedPrecondition},
+		{desc: "same-timestamp", size: 17, timestamp: 1000, wantCode: codes.FailedPrecondition},
+		{desc: "older", size: 17, timestamp: 999, wantCode: codes.FailedPrecondition},
+		{desc: "same-size", size: 16, timestamp: 2000},
+		{desc: "larger", size: 17, timestamp: 3000},
+	} {
+		root, err := SignLogRoot(&types.LogRootV1{TimestampNanos: tc.timestamp, TreeSize: tc.size, RootHash: dummyHash})
+		if err != nil {
+			t.Fatalf("SignLogRoot(): %v", err)
+		}
+		runLogTX(s, tree, t, func(ctx context.Context, tx storage.LogTreeTX) error {
+			if err := tx.StoreSignedLogRoot(ctx, root); status.Code(err) != tc.wantCode {
+				t.Errorf("%s: StoreSignedLogRoot() = %v, want code %v", tc.desc, err, tc.wantCode)
+			}
+			return nil
+		})
+	}
+}
+
 func TestLogRootUpdate(t *testing.T) {
 	ctx := context.Background()
 	// Write two roots for a log and make sure the one with the newest timestamp supersedes
@@ -745,6 +3853,27 @@ func TestGetActiveLogIDs(t *testing.T) {
 	if diff := cmp.Diff(got, want); diff != "" {
 		t.Errorf("post-GetActiveLogIDs diff (-got +want):\n%v", diff)
 	}
+
+	for _, tc := range []struct {
+		states []trillian.TreeState
+		want   []int64
+	}{
+		{states: []trillian.TreeState{trillian.TreeState_ACTIVE}, want: []int64{log1.TreeId, log2.TreeId, log3.TreeId}},
+		{states: []trillian.TreeState{trillian.TreeState_DRAINING, trillian.TreeState_FROZEN}, want: []int64{drainingLog.TreeId, frozenLog.TreeId}},
+	} {
+		got, err := s.(*mySQLLogStorage).GetActiveLogIDsByState(ctx, tc.states...)
+		if err != nil {
+			t.Fatalf("GetActiveLogIDsByState(%v) returns err = %v", tc.states, err)
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		sort.Slice(tc.want, func(i, j int) bool { return tc.want[i] < tc.want[j] })
+		if diff := cmp.Diff(got, tc.want); diff != "" {
+			t.Errorf("GetActiveLogIDsByState(%v) diff (-got +want):\n%v", tc.states, diff)
+		}
+	}
+	if _, err := s.(*mySQLLogStorage).GetActiveLogIDsByState(ctx); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("GetActiveLogIDsByState() with no states returned err = %v, want InvalidArgument", err)
+	}
 }
 
 func TestGetActiveLogIDsEmpty(t *testing.T) {
@@ -763,6 +3892,67 @@ func TestGetActiveLogIDsEmpty(t *testing.T) {
 	}
 }
 
+func TestListStorageTreeIDs(t *testing.T) {
+	ctx := context.Background()
+
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil).(*mySQLLogStorage)
+	createFakeLeaf(ctx, DB, tree.TreeId, dummyRawHash, dummyHash, []byte("data"), nil, 0, t)
+
+	// Unsequenced has no foreign key on Trees, so can hold orphaned rows.
+	const orphanID = int64(1)
+	if _, err := DB.ExecContext(ctx, "INSERT INTO Unsequenced(TreeId,Bucket,LeafIdentityHash,MerkleLeafHash,QueueTimestampNanos) VALUES(?,0,?,?,?)",
+		orphanID, dummyRawHash, dummyHash, fakeQueueTime.UnixNano()); err != nil {
+		t.Fatalf("Failed to insert orphaned row: %v", err)
+	}
+
+	got, err := s.ListStorageTreeIDs(ctx)
+	if err != nil {
+		t.Fatalf("ListStorageTreeIDs(): %v", err)
+	}
+	want := []int64{orphanID, tree.TreeId}
+	if tree.TreeId < orphanID {
+		want = []int64{tree.TreeId, orphanID}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ListStorageTreeIDs() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestEstimateTreeStorageBytes(t *testing.T) {
+	ctx := context.Background()
+
+	cleanTestDB(DB)
+	as := NewAdminStorage(DB)
+	tree := mustCreateTree(ctx, t, as, testonly.LogTree)
+	s := NewLogStorage(DB, nil).(*mySQLLogStorage)
+
+	empty, err := s.EstimateTreeStorageBytes(ctx, tree.TreeId)
+	if err != nil {
+		t.Fatalf("EstimateTreeStorageBytes(): %v", err)
+	}
+
+	value := make([]byte, 1000)
+	createFakeLeaf(ctx, DB, tree.TreeId, dummyRawHash, dummyHash, value, nil, 0, t)
+	got, err := s.EstimateTreeStorageBytes(ctx, tree.TreeId)
+	if err != nil {
+		t.Fatalf("EstimateTreeStorageBytes(): %v", err)
+	}
+	if min := empty + int64(len(value)); got < min {
+		t.Errorf("EstimateTreeStorageBytes() = %d, want >= %d", got, min)
+	}
+
+	other, err := s.EstimateTreeStorageBytes(ctx, tree.TreeId+1)
+	if err != nil {
+		t.Fatalf("EstimateTreeStorageBytes(other tree): %v", err)
+	}
+	if other != 0 {
+		t.Errorf("EstimateTreeStorageBytes(other tree) = %d, want 0", other)
+	}
+}
+
 func ensureAllLeavesDistinct(leaves []*trillian.LogLeaf, t *testing.T) {
 	t.Helper()
 	// All the leaf value hashes should be distinct because the leaves were created with distinct
@@ -34,6 +34,55 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+// LogHasher identifies the RFC 6962 compatible hashers trees can use.
+type LogHasher int32
+
+const (
+	// RFC6962_SHA256 is the RFC 6962 hasher using SHA-256.
+	LogHasher_RFC6962_SHA256 LogHasher = 0
+	// RFC6962_SHA512_256 is the RFC 6962 hasher using SHA-512/256.
+	LogHasher_RFC6962_SHA512_256 LogHasher = 1
+)
+
+// Enum value maps for LogHasher.
+var (
+	LogHasher_name = map[int32]string{
+		0: "RFC6962_SHA256",
+		1: "RFC6962_SHA512_256",
+	}
+	LogHasher_value = map[string]int32{
+		"RFC6962_SHA256":     0,
+		"RFC6962_SHA512_256": 1,
+	}
+)
+
+func (x LogHasher) Enum() *LogHasher {
+	p := new(LogHasher)
+	*p = x
+	return p
+}
+
+func (x LogHasher) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (LogHasher) Descriptor() protoreflect.EnumDescriptor {
+	return file_options_proto_enumTypes[0].Descriptor()
+}
+
+func (LogHasher) Type() protoreflect.EnumType {
+	return &file_options_proto_enumTypes[0]
+}
+
+func (x LogHasher) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use LogHasher.Descriptor instead.
+func (LogHasher) EnumDescriptor() ([]byte, []int) {
+	return file_options_proto_rawDescGZIP(), []int{0}
+}
+
 // StorageOptions contains configuration parameters for MySQL implementation
 // of the storage backend. This is envisioned only to be used for changes that
 // would be breaking, but need to support old behaviour for backwards compatibility.
@@ -45,6 +94,21 @@ type StorageOptions struct {
 	// subtreeRevisions being explicitly set to false will skip writing subtree revisions.
 	// https://github.com/google/trillian/pull/3201
 	SubtreeRevisions bool `protobuf:"varint,1,opt,name=subtreeRevisions,proto3" json:"subtreeRevisions,omitempty"`
+	// compressLeafData enables compression of LeafValue and ExtraData when they
+	// are written. Stored values are prefixed with a codec identifier byte, so
+	// that values which don't compress can be stored as-is. This can only be set
+	// when the tree is created, as values stored without the prefix couldn't be
+	// told apart from those with it.
+	CompressLeafData bool `protobuf:"varint,2,opt,name=compressLeafData,proto3" json:"compressLeafData,omitempty"`
+	// hasher is the hasher used for the tree's Merkle nodes, and so determines
+	// their size. This can only be set when the tree is created.
+	Hasher LogHasher `protobuf:"varint,3,opt,name=hasher,proto3,enum=mysqlpb.LogHasher" json:"hasher,omitempty"`
+	// encryptLeafValue enables encryption of LeafValue at rest, with the
+	// per-tree keys of the storage's LeafCrypter. Leaves can't be written or
+	// read without a LeafCrypter. Stored values are prefixed with a version
+	// byte. This can only be set when the tree is created, as values stored
+	// before it was set couldn't be told apart from encrypted ones.
+	EncryptLeafValue bool `protobuf:"varint,4,opt,name=encryptLeafValue,proto3" json:"encryptLeafValue,omitempty"`
 }
 
 func (x *StorageOptions) Reset() {
@@ -86,19 +150,51 @@ func (x *StorageOptions) GetSubtreeRevisions() bool {
 	return false
 }
 
+func (x *StorageOptions) GetCompressLeafData() bool {
+	if x != nil {
+		return x.CompressLeafData
+	}
+	return false
+}
+
+func (x *StorageOptions) GetHasher() LogHasher {
+	if x != nil {
+		return x.Hasher
+	}
+	return LogHasher_RFC6962_SHA256
+}
+
+func (x *StorageOptions) GetEncryptLeafValue() bool {
+	if x != nil {
+		return x.EncryptLeafValue
+	}
+	return false
+}
+
 var File_options_proto protoreflect.FileDescriptor
 
 var file_options_proto_rawDesc = []byte{
 	0x0a, 0x0d, 0x6f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
-	0x07, 0x6d, 0x79, 0x73, 0x71, 0x6c, 0x70, 0x62, 0x22, 0x3c, 0x0a, 0x0e, 0x53, 0x74, 0x6f, 0x72,
-	0x61, 0x67, 0x65, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x2a, 0x0a, 0x10, 0x73, 0x75,
-	0x62, 0x74, 0x72, 0x65, 0x65, 0x52, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x08, 0x52, 0x10, 0x73, 0x75, 0x62, 0x74, 0x72, 0x65, 0x65, 0x52, 0x65, 0x76,
-	0x69, 0x73, 0x69, 0x6f, 0x6e, 0x73, 0x42, 0x32, 0x5a, 0x30, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62,
-	0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x74, 0x72, 0x69, 0x6c,
-	0x6c, 0x69, 0x61, 0x6e, 0x2f, 0x73, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65, 0x2f, 0x6d, 0x79, 0x73,
-	0x71, 0x6c, 0x2f, 0x6d, 0x79, 0x73, 0x71, 0x6c, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74,
-	0x6f, 0x33,
+	0x07, 0x6d, 0x79, 0x73, 0x71, 0x6c, 0x70, 0x62, 0x22, 0xc0, 0x01, 0x0a, 0x0e, 0x53, 0x74, 0x6f,
+	0x72, 0x61, 0x67, 0x65, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x2a, 0x0a, 0x10, 0x73,
+	0x75, 0x62, 0x74, 0x72, 0x65, 0x65, 0x52, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x73, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x08, 0x52, 0x10, 0x73, 0x75, 0x62, 0x74, 0x72, 0x65, 0x65, 0x52, 0x65,
+	0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x2a, 0x0a, 0x10, 0x63, 0x6f, 0x6d, 0x70, 0x72,
+	0x65, 0x73, 0x73, 0x4c, 0x65, 0x61, 0x66, 0x44, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x08, 0x52, 0x10, 0x63, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x4c, 0x65, 0x61, 0x66, 0x44,
+	0x61, 0x74, 0x61, 0x12, 0x2a, 0x0a, 0x06, 0x68, 0x61, 0x73, 0x68, 0x65, 0x72, 0x18, 0x03, 0x20,
+	0x01, 0x28, 0x0e, 0x32, 0x12, 0x2e, 0x6d, 0x79, 0x73, 0x71, 0x6c, 0x70, 0x62, 0x2e, 0x4c, 0x6f,
+	0x67, 0x48, 0x61, 0x73, 0x68, 0x65, 0x72, 0x52, 0x06, 0x68, 0x61, 0x73, 0x68, 0x65, 0x72, 0x12,
+	0x2a, 0x0a, 0x10, 0x65, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x4c, 0x65, 0x61, 0x66, 0x56, 0x61,
+	0x6c, 0x75, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x08, 0x52, 0x10, 0x65, 0x6e, 0x63, 0x72, 0x79,
+	0x70, 0x74, 0x4c, 0x65, 0x61, 0x66, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x2a, 0x37, 0x0a, 0x09, 0x4c,
+	0x6f, 0x67, 0x48, 0x61, 0x73, 0x68, 0x65, 0x72, 0x12, 0x12, 0x0a, 0x0e, 0x52, 0x46, 0x43, 0x36,
+	0x39, 0x36, 0x32, 0x5f, 0x53, 0x48, 0x41, 0x32, 0x35, 0x36, 0x10, 0x00, 0x12, 0x16, 0x0a, 0x12,
+	0x52, 0x46, 0x43, 0x36, 0x39, 0x36, 0x32, 0x5f, 0x53, 0x48, 0x41, 0x35, 0x31, 0x32, 0x5f, 0x32,
+	0x35, 0x36, 0x10, 0x01, 0x42, 0x32, 0x5a, 0x30, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63,
+	0x6f, 0x6d, 0x2f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x74, 0x72, 0x69, 0x6c, 0x6c, 0x69,
+	0x61, 0x6e, 0x2f, 0x73, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65, 0x2f, 0x6d, 0x79, 0x73, 0x71, 0x6c,
+	0x2f, 0x6d, 0x79, 0x73, 0x71, 0x6c, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -113,16 +209,19 @@ func file_options_proto_rawDescGZIP() []byte {
 	return file_options_proto_rawDescData
 }
 
+var file_options_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
 var file_options_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
 var file_options_proto_goTypes = []interface{}{
-	(*StorageOptions)(nil), // 0: mysqlpb.StorageOptions
+	(LogHasher)(0),         // 0: mysqlpb.LogHasher
+	(*StorageOptions)(nil), // 1: mysqlpb.StorageOptions
 }
 var file_options_proto_depIdxs = []int32{
-	0, // [0:0] is the sub-list for method output_type
-	0, // [0:0] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	0, // 0: mysqlpb.StorageOptions.hasher:type_name -> mysqlpb.LogHasher
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
 }
 
 func init() { file_options_proto_init() }
@@ -149,13 +248,14 @@ func file_options_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_options_proto_rawDesc,
-			NumEnums:      0,
+			NumEnums:      1,
 			NumMessages:   1,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
 		GoTypes:           file_options_proto_goTypes,
 		DependencyIndexes: file_options_proto_depIdxs,
+		EnumInfos:         file_options_proto_enumTypes,
 		MessageInfos:      file_options_proto_msgTypes,
 	}.Build()
 	File_options_proto = out.File
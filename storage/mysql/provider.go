@@ -17,6 +17,8 @@ package mysql
 import (
 	"database/sql"
 	"flag"
+	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/google/trillian/monitoring"
@@ -32,6 +34,32 @@ var (
 	maxConns = flag.Int("mysql_max_conns", 0, "Maximum connections to the database")
 	maxIdle  = flag.Int("mysql_max_idle_conns", -1, "Maximum idle database connections in the connection pool")
 
+	snapshotIsolation  = flag.String("mysql_snapshot_isolation_level", "default", "Isolation level of read-only log transactions, e.g. 'read committed' or 'repeatable read'. 'default' uses the server setting")
+	readWriteIsolation = flag.String("mysql_tx_isolation_level", "repeatable read", "Isolation level of read-write log transactions")
+	maxHashesPerQuery  = flag.Int("mysql_max_hashes_per_query", DefaultMaxHashesPerQuery, "Maximum number of leaf hashes looked up by a single statement. Larger lookups are split into several statements")
+	slowTxThreshold    = flag.Duration("mysql_slow_tx_threshold", 0, "Log read-write log transactions taking longer than this. Zero disables logging")
+	readWriteTxBudget  = flag.Duration("mysql_read_write_tx_budget", 0, "Roll back read-write log transactions which don't finish within this, failing them with DeadlineExceeded. Zero disables the limit")
+	deadlockRetries    = flag.Int("mysql_deadlock_retries", 0, "Number of times to rerun read-write log transactions which fail because of a deadlock, with jittered backoff")
+	verifyLeafHash     = flag.Bool("mysql_verify_merkle_leaf_hash", false, "Reject queued leaves of LOG trees whose MerkleLeafHash isn't the RFC 6962 hash of their LeafValue")
+	skipHashValidation = flag.Bool("mysql_skip_read_hash_validation", false, "Don't check the length of Merkle leaf hashes read from the database")
+	maxSequencedIndex  = flag.Int64("mysql_max_sequenced_leaf_index", 0, "If positive, reject pre-ordered leaves with a LeafIndex at or above this")
+	rejectFutureCutoff = flag.Bool("mysql_reject_future_dequeue_cutoff", false, "Fail dequeues with a cutoff time in the future, rather than clamping the cutoff to the current time")
+	monotonicRoots     = flag.Bool("mysql_enforce_monotonic_roots", false, "Reject signed log roots which are smaller than, or not newer than, the latest stored root")
+	integrateNow       = flag.Bool("mysql_integrate_immediately", false, "Integrate leaves added to PREORDERED_LOG trees into the Merkle tree, and store a new root, in the same transaction")
+	normalizeExtraData = flag.Bool("mysql_normalize_empty_extra_data", false, "Store empty, rather than NULL, ExtraData for leaves without any")
+	timestampRes       = flag.Duration("mysql_timestamp_resolution", 0, "If set, e.g. to 1us or 1ms, truncate stored queue and integration timestamps to this resolution")
+	addSequencedBatch  = flag.Int("mysql_add_sequenced_leaves_batch_size", 0, "If positive, commit pre-ordered leaves in transactions of at most this many leaves")
+	serverIntegrateTS  = flag.Bool("mysql_server_integrate_timestamp", false, "Store the database's current time, rather than the sequencer's, as the integrate timestamp of leaves")
+	maxPlaceholders    = flag.Int("mysql_max_statement_placeholders", 0, "If positive, reject requests needing statements with more placeholders than this, e.g. lookups of more hashes, and split statements made by storage itself. Raised to at least 4")
+	phasedQueueInserts = flag.Bool("mysql_phased_queue_inserts", false, "Insert the LeafData rows of all leaves queued in a batch before their Unsequenced rows, rather than interleaving them")
+	streamPageSize     = flag.Int("mysql_stream_leaves_page_size", DefaultStreamLeavesPageSize, "Number of leaves read by each statement when streaming all the leaves of a tree")
+	noDequeueTracking  = flag.Bool("mysql_skip_dequeue_tracking", false, "Don't remember dequeued leaves in each transaction, to save memory. Only safe if leaves are dequeued at most once per transaction, as by the sequencer")
+	allowTSBackfill    = flag.Bool("mysql_allow_timestamp_backfill", false, "Allow BackfillIntegrateTimestamps to set the zero integrate timestamps of sequenced leaves")
+	recordMerkleHash   = flag.Bool("mysql_record_merkle_leaf_hash", false, "Store the MerkleLeafHash of queued leaves in LeafData, so that leaves which lose their queue entry can be requeued. Requires the LeafData.MerkleLeafHash column")
+	dupPositionDetails = flag.Bool("mysql_duplicate_position_details", false, "Attach the position of the existing leaf to the AlreadyExists status of each duplicate queued leaf, at the cost of a lookup for each batch with duplicates")
+	honorLeases        = flag.Bool("mysql_honor_leases", false, "Don't dequeue leaves leased by another sequencer worker until their lease expires. Requires the Unsequenced lease columns")
+	strictModeAssured  = flag.Bool("mysql_strict_mode_assured", false, "Skip reading back created trees to detect enum truncation. Only set if all connections are known to run in strict SQL mode")
+
 	mysqlMu              sync.Mutex
 	mysqlErr             error
 	mysqlDB              *sql.DB
@@ -55,8 +83,9 @@ func init() {
 }
 
 type mysqlProvider struct {
-	db *sql.DB
-	mf monitoring.MetricFactory
+	db        *sql.DB
+	logOpts   LogStorageOptions
+	adminOpts AdminStorageOptions
 }
 
 func newMySQLStorageProvider(mf monitoring.MetricFactory) (storage.Provider, error) {
@@ -67,9 +96,46 @@ func newMySQLStorageProvider(mf monitoring.MetricFactory) (storage.Provider, err
 		if err != nil {
 			return nil, err
 		}
+		roIsolation, err := parseIsolationLevel(*snapshotIsolation)
+		if err != nil {
+			return nil, err
+		}
+		rwIsolation, err := parseIsolationLevel(*readWriteIsolation)
+		if err != nil {
+			return nil, err
+		}
 		mysqlStorageInstance = &mysqlProvider{
 			db: db,
-			mf: mf,
+			logOpts: LogStorageOptions{
+				MetricFactory:             mf,
+				ReadOnlyIsolation:         roIsolation,
+				ReadWriteIsolation:        rwIsolation,
+				MaxHashesPerQuery:         *maxHashesPerQuery,
+				SlowTxThreshold:           *slowTxThreshold,
+				ReadWriteTxBudget:         *readWriteTxBudget,
+				DeadlockRetries:           *deadlockRetries,
+				VerifyMerkleLeafHash:      *verifyLeafHash,
+				SkipReadHashValidation:    *skipHashValidation,
+				EnforceMonotonicRoots:     *monotonicRoots,
+				MaxSequencedLeafIndex:     *maxSequencedIndex,
+				RejectFutureDequeueCutoff: *rejectFutureCutoff,
+				IntegrateImmediately:      *integrateNow,
+				NormalizeEmptyExtraData:   *normalizeExtraData,
+				TimestampResolution:       *timestampRes,
+				AddSequencedBatchSize:     *addSequencedBatch,
+				ServerIntegrateTimestamp:  *serverIntegrateTS,
+				MaxStatementPlaceholders:  *maxPlaceholders,
+				PhasedQueueInserts:        *phasedQueueInserts,
+				SkipDequeueTracking:       *noDequeueTracking,
+				StreamLeavesPageSize:      *streamPageSize,
+				AllowTimestampBackfill:    *allowTSBackfill,
+				RecordMerkleLeafHash:      *recordMerkleHash,
+				HonorLeases:               *honorLeases,
+				DuplicatePositionDetails:  *dupPositionDetails,
+			},
+			adminOpts: AdminStorageOptions{
+				StrictModeAssured: *strictModeAssured,
+			},
 		}
 	}
 	return mysqlStorageInstance, nil
@@ -96,12 +162,25 @@ func getMySQLDatabaseLocked() (*sql.DB, error) {
 	return db, nil
 }
 
+// parseIsolationLevel returns the sql.IsolationLevel named by level. Names
+// are case insensitive, and words may be separated by spaces, dashes or
+// underscores, so that MySQL spellings such as "REPEATABLE-READ" are accepted.
+func parseIsolationLevel(level string) (sql.IsolationLevel, error) {
+	name := strings.NewReplacer("-", " ", "_", " ").Replace(strings.TrimSpace(level))
+	for l := sql.LevelDefault; l <= sql.LevelLinearizable; l++ {
+		if strings.EqualFold(l.String(), name) {
+			return l, nil
+		}
+	}
+	return sql.LevelDefault, fmt.Errorf("unknown isolation level %q", level)
+}
+
 func (s *mysqlProvider) LogStorage() storage.LogStorage {
-	return NewLogStorage(s.db, s.mf)
+	return NewLogStorageWithOptions(s.db, s.logOpts)
 }
 
 func (s *mysqlProvider) AdminStorage() storage.AdminStorage {
-	return NewAdminStorage(s.db)
+	return NewAdminStorageWithOptions(s.db, s.adminOpts)
 }
 
 func (s *mysqlProvider) Close() error {
@@ -15,6 +15,7 @@
 package mysql
 
 import (
+	"database/sql"
 	"flag"
 	"testing"
 
@@ -44,3 +45,30 @@ func TestMySQLStorageProviderErrorPersistence(t *testing.T) {
 		t.Fatalf("Expected second call to 'storage.NewProvider' to fail with %q, instead got: %q", err1, err2)
 	}
 }
+
+func TestParseIsolationLevel(t *testing.T) {
+	for _, tc := range []struct {
+		level   string
+		want    sql.IsolationLevel
+		wantErr bool
+	}{
+		{level: "default", want: sql.LevelDefault},
+		{level: "Read Committed", want: sql.LevelReadCommitted},
+		{level: "read committed", want: sql.LevelReadCommitted},
+		{level: "REPEATABLE-READ", want: sql.LevelRepeatableRead},
+		{level: "serializable", want: sql.LevelSerializable},
+		{level: " read_uncommitted ", want: sql.LevelReadUncommitted},
+		{level: "", wantErr: true},
+		{level: "repeatable", wantErr: true},
+	} {
+		t.Run(tc.level, func(t *testing.T) {
+			got, err := parseIsolationLevel(tc.level)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("parseIsolationLevel(%q) = %v, wantErr %v", tc.level, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("parseIsolationLevel(%q) = %v, want %v", tc.level, got, tc.want)
+			}
+		})
+	}
+}
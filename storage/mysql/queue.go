@@ -30,33 +30,64 @@ import (
 )
 
 const (
-	// If this statement ORDER BY clause is changed refer to the comment in removeSequencedLeaves
-	selectQueuedLeavesSQL = `SELECT LeafIdentityHash,MerkleLeafHash,QueueTimestampNanos
+	// If this statement ORDER BY clause is changed refer to the comment in removeSequencedLeaves.
+	selectQueuedLeavesSQL = `SELECT LeafIdentityHash,MerkleLeafHash,QueueTimestampNanos,DedupNamespace
 			FROM Unsequenced
 			WHERE TreeID=?
 			AND Bucket=0
 			AND QueueTimestampNanos<=?
 			ORDER BY QueueTimestampNanos,LeafIdentityHash ASC LIMIT ?`
-	insertUnsequencedEntrySQL = `INSERT INTO Unsequenced(TreeId,Bucket,LeafIdentityHash,MerkleLeafHash,QueueTimestampNanos)
-			VALUES(?,0,?,?,?)`
-	deleteUnsequencedSQL = "DELETE FROM Unsequenced WHERE TreeId=? AND Bucket=0 AND QueueTimestampNanos=? AND LeafIdentityHash=?"
+	// selectUnleasedQueuedLeavesSQL is selectQueuedLeavesSQL for storage with
+	// HonorLeases set, which skips entries with an unexpired lease.
+	selectUnleasedQueuedLeavesSQL = `SELECT LeafIdentityHash,MerkleLeafHash,QueueTimestampNanos,DedupNamespace
+			FROM Unsequenced
+			WHERE TreeID=?
+			AND Bucket=0
+			AND QueueTimestampNanos<=?
+			AND LeasedUntilNanos<=?
+			ORDER BY QueueTimestampNanos,LeafIdentityHash ASC LIMIT ?`
+	// selectLeasableLeavesSQL is selectUnleasedQueuedLeavesSQL for
+	// DequeueLeavesLease, which locks the entries so that they can be leased.
+	selectLeasableLeavesSQL = `SELECT LeafIdentityHash,MerkleLeafHash,QueueTimestampNanos,DedupNamespace
+			FROM Unsequenced
+			WHERE TreeID=?
+			AND Bucket=0
+			AND QueueTimestampNanos<=?
+			AND LeasedUntilNanos<=?
+			ORDER BY QueueTimestampNanos,LeafIdentityHash ASC LIMIT ?
+			FOR UPDATE`
+	// selectLeasedLeavesSQL locks the entries of an unexpired lease for
+	// DequeueLeasedLeaves.
+	selectLeasedLeavesSQL = `SELECT LeafIdentityHash,MerkleLeafHash,QueueTimestampNanos,DedupNamespace
+			FROM Unsequenced
+			WHERE TreeID=?
+			AND Bucket=0
+			AND LeaseID=?
+			AND LeasedUntilNanos>?
+			ORDER BY QueueTimestampNanos,LeafIdentityHash ASC
+			FOR UPDATE`
+	insertUnsequencedEntrySQL = `INSERT INTO Unsequenced(TreeId,Bucket,LeafIdentityHash,MerkleLeafHash,DedupNamespace,QueueTimestampNanos)
+			VALUES(?,0,?,?,?,?)`
+	deleteUnsequencedSQL = "DELETE FROM Unsequenced WHERE TreeId=? AND Bucket=0 AND QueueTimestampNanos=? AND LeafIdentityHash=? AND DedupNamespace=?"
 )
 
 type dequeuedLeaf struct {
 	queueTimestampNanos int64
 	leafIdentityHash    []byte
+	dedupNamespace      []byte
 }
 
-func dequeueInfo(leafIDHash []byte, queueTimestamp int64) dequeuedLeaf {
-	return dequeuedLeaf{queueTimestampNanos: queueTimestamp, leafIdentityHash: leafIDHash}
+func dequeueInfo(leafIDHash, dedupNamespace []byte, queueTimestamp int64) dequeuedLeaf {
+	return dequeuedLeaf{queueTimestampNanos: queueTimestamp, leafIdentityHash: leafIDHash, dedupNamespace: dedupNamespace}
 }
 
 func (t *logTreeTX) dequeueLeaf(rows *sql.Rows) (*trillian.LogLeaf, dequeuedLeaf, error) {
 	var leafIDHash []byte
 	var merkleHash []byte
 	var queueTimestamp int64
+	var dedupNamespace []byte
 
-	err := rows.Scan(&leafIDHash, &merkleHash, &queueTimestamp)
+	err := rows.Scan(&leafIDHash, &merkleHash, &queueTimestamp, &dedupNamespace)
 	if err != nil {
 		klog.Warningf("Error scanning work rows: %s", err)
 		return nil, dequeuedLeaf{}, err
@@ -74,10 +105,10 @@ func (t *logTreeTX) dequeueLeaf(rows *sql.Rows) (*trillian.LogLeaf, dequeuedLeaf
 		MerkleLeafHash:   merkleHash,
 		QueueTimestamp:   queueTimestampProto,
 	}
-	return leaf, dequeueInfo(leafIDHash, queueTimestamp), nil
+	return leaf, dequeueInfo(leafIDHash, dedupNamespace, queueTimestamp), nil
 }
 
-func queueArgs(_ int64, _ []byte, queueTimestamp time.Time) []interface{} {
+func queueArgs(_ int64, _, _ []byte, queueTimestamp time.Time) []interface{} {
 	return []interface{}{queueTimestamp.UnixNano()}
 }
 
@@ -92,23 +123,15 @@ func (t *logTreeTX) UpdateSequencedLeaves(ctx context.Context, leaves []*trillia
 		if err := leaf.IntegrateTimestamp.CheckValid(); err != nil {
 			return fmt.Errorf("got invalid integrate timestamp: %w", err)
 		}
-		iTimestamp := leaf.IntegrateTimestamp.AsTime()
-		_, err := t.tx.ExecContext(
-			ctx,
-			insertSequencedLeafSQL+valuesPlaceholder5,
-			t.treeID,
-			leaf.LeafIdentityHash,
-			leaf.MerkleLeafHash,
-			leaf.LeafIndex,
-			iTimestamp.UnixNano())
+		qe, err := t.dequeuedLeafFor(leaf)
 		if err != nil {
-			klog.Warningf("Failed to update sequenced leaves: %s", err)
 			return err
 		}
-
-		qe, ok := t.dequeued[string(leaf.LeafIdentityHash)]
-		if !ok {
-			return fmt.Errorf("attempting to update leaf that wasn't dequeued. IdentityHash: %x", leaf.LeafIdentityHash)
+		iTimestamp := t.truncateTimestamp(leaf.IntegrateTimestamp.AsTime())
+		values, args := t.sequencedLeafValues(leaf, qe.dedupNamespace, iTimestamp.UnixNano())
+		if _, err := t.tx.ExecContext(ctx, insertSequencedLeafSQL+values, args...); err != nil {
+			klog.Warningf("%sFailed to update sequenced leaves: %s", requestIDPrefix(ctx), err)
+			return err
 		}
 		dequeuedLeaves = append(dequeuedLeaves, qe)
 	}
@@ -116,6 +139,24 @@ func (t *logTreeTX) UpdateSequencedLeaves(ctx context.Context, leaves []*trillia
 	return t.removeSequencedLeaves(ctx, dequeuedLeaves)
 }
 
+// dequeuedLeafFor returns the queue entry of a leaf passed to
+// UpdateSequencedLeaves. Unless SkipDequeueTracking is set, the leaf must have
+// been dequeued by this transaction. If it is set, the entry is assumed to be
+// in the default deduplication namespace.
+func (t *logTreeTX) dequeuedLeafFor(leaf *trillian.LogLeaf) (dequeuedLeaf, error) {
+	if t.ls.opts.SkipDequeueTracking {
+		if err := leaf.QueueTimestamp.CheckValid(); err != nil {
+			return dequeuedLeaf{}, fmt.Errorf("got invalid queue timestamp: %w", err)
+		}
+		return dequeueInfo(leaf.LeafIdentityHash, nil, leaf.QueueTimestamp.AsTime().UnixNano()), nil
+	}
+	qe, ok := t.dequeued[string(leaf.LeafIdentityHash)]
+	if !ok {
+		return dequeuedLeaf{}, fmt.Errorf("attempting to update leaf that wasn't dequeued. IdentityHash: %x", leaf.LeafIdentityHash)
+	}
+	return qe, nil
+}
+
 // removeSequencedLeaves removes the passed in leaves slice (which may be
 // modified as part of the operation).
 func (t *logTreeTX) removeSequencedLeaves(ctx context.Context, leaves []dequeuedLeaf) error {
@@ -125,7 +166,7 @@ func (t *logTreeTX) removeSequencedLeaves(ctx context.Context, leaves []dequeued
 	// QueueLeaves.
 	stx, err := t.tx.PrepareContext(ctx, deleteUnsequencedSQL)
 	if err != nil {
-		klog.Warningf("Failed to prep delete statement for sequenced work: %v", err)
+		klog.Warningf("%sFailed to prep delete statement for sequenced work: %v", requestIDPrefix(ctx), err)
 		return err
 	}
 	defer func() {
@@ -134,7 +175,7 @@ func (t *logTreeTX) removeSequencedLeaves(ctx context.Context, leaves []dequeued
 		}
 	}()
 	for _, dql := range leaves {
-		result, err := stx.ExecContext(ctx, t.treeID, dql.queueTimestampNanos, dql.leafIdentityHash)
+		result, err := stx.ExecContext(ctx, t.treeID, dql.queueTimestampNanos, dql.leafIdentityHash, dedupNamespaceArg(dql.dedupNamespace))
 		err = checkResultOkAndRowCountIs(result, err, int64(1))
 		if err != nil {
 			return err
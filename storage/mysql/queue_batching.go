@@ -32,21 +32,55 @@ import (
 )
 
 const (
-	// If this statement ORDER BY clause is changed refer to the comment in removeSequencedLeaves
-	selectQueuedLeavesSQL = `SELECT LeafIdentityHash,MerkleLeafHash,QueueTimestampNanos,QueueID
+	// If this statement ORDER BY clause is changed refer to the comment in removeSequencedLeaves.
+	selectQueuedLeavesSQL = `SELECT LeafIdentityHash,MerkleLeafHash,QueueTimestampNanos,QueueID,DedupNamespace
 			FROM Unsequenced
 			WHERE TreeID=?
 			AND Bucket=0
 			AND QueueTimestampNanos<=?
 			ORDER BY QueueTimestampNanos,LeafIdentityHash ASC LIMIT ?`
-	insertUnsequencedEntrySQL = `INSERT INTO Unsequenced(TreeId,Bucket,LeafIdentityHash,MerkleLeafHash,QueueTimestampNanos,QueueID) VALUES(?,0,?,?,?,?)`
-	deleteUnsequencedSQL      = "DELETE FROM Unsequenced WHERE QueueID IN (<placeholder>)"
+	// selectUnleasedQueuedLeavesSQL is selectQueuedLeavesSQL for storage with
+	// HonorLeases set, which skips entries with an unexpired lease.
+	selectUnleasedQueuedLeavesSQL = `SELECT LeafIdentityHash,MerkleLeafHash,QueueTimestampNanos,QueueID,DedupNamespace
+			FROM Unsequenced
+			WHERE TreeID=?
+			AND Bucket=0
+			AND QueueTimestampNanos<=?
+			AND LeasedUntilNanos<=?
+			ORDER BY QueueTimestampNanos,LeafIdentityHash ASC LIMIT ?`
+	// selectLeasableLeavesSQL is selectUnleasedQueuedLeavesSQL for
+	// DequeueLeavesLease, which locks the entries so that they can be leased.
+	selectLeasableLeavesSQL = `SELECT LeafIdentityHash,MerkleLeafHash,QueueTimestampNanos,QueueID,DedupNamespace
+			FROM Unsequenced
+			WHERE TreeID=?
+			AND Bucket=0
+			AND QueueTimestampNanos<=?
+			AND LeasedUntilNanos<=?
+			ORDER BY QueueTimestampNanos,LeafIdentityHash ASC LIMIT ?
+			FOR UPDATE`
+	// selectLeasedLeavesSQL locks the entries of an unexpired lease for
+	// DequeueLeasedLeaves.
+	selectLeasedLeavesSQL = `SELECT LeafIdentityHash,MerkleLeafHash,QueueTimestampNanos,QueueID,DedupNamespace
+			FROM Unsequenced
+			WHERE TreeID=?
+			AND Bucket=0
+			AND LeaseID=?
+			AND LeasedUntilNanos>?
+			ORDER BY QueueTimestampNanos,LeafIdentityHash ASC
+			FOR UPDATE`
+	insertUnsequencedEntrySQL = `INSERT INTO Unsequenced(TreeId,Bucket,LeafIdentityHash,MerkleLeafHash,DedupNamespace,QueueTimestampNanos,QueueID) VALUES(?,0,?,?,?,?,?)`
+	// The TreeId and Bucket conditions are redundant given the QueueID, but
+	// allow MySQL to prune to a single partition if Unsequenced is partitioned.
+	deleteUnsequencedSQL = "DELETE FROM Unsequenced WHERE TreeId=? AND Bucket=0 AND QueueID IN (<placeholder>)"
 )
 
-type dequeuedLeaf []byte
+type dequeuedLeaf struct {
+	queueID        []byte
+	dedupNamespace []byte
+}
 
-func dequeueInfo(_ []byte, queueID []byte) dequeuedLeaf {
-	return dequeuedLeaf(queueID)
+func dequeueInfo(_, dedupNamespace, queueID []byte) dequeuedLeaf {
+	return dequeuedLeaf{queueID: queueID, dedupNamespace: dedupNamespace}
 }
 
 func (t *logTreeTX) dequeueLeaf(rows *sql.Rows) (*trillian.LogLeaf, dequeuedLeaf, error) {
@@ -54,11 +88,12 @@ func (t *logTreeTX) dequeueLeaf(rows *sql.Rows) (*trillian.LogLeaf, dequeuedLeaf
 	var merkleHash []byte
 	var queueTimestamp int64
 	var queueID []byte
+	var dedupNamespace []byte
 
-	err := rows.Scan(&leafIDHash, &merkleHash, &queueTimestamp, &queueID)
+	err := rows.Scan(&leafIDHash, &merkleHash, &queueTimestamp, &queueID, &dedupNamespace)
 	if err != nil {
 		klog.Warningf("Error scanning work rows: %s", err)
-		return nil, nil, err
+		return nil, dequeuedLeaf{}, err
 	}
 
 	queueTimestampProto := timestamppb.New(time.Unix(0, queueTimestamp))
@@ -73,10 +108,13 @@ func (t *logTreeTX) dequeueLeaf(rows *sql.Rows) (*trillian.LogLeaf, dequeuedLeaf
 		MerkleLeafHash:   merkleHash,
 		QueueTimestamp:   queueTimestampProto,
 	}
-	return leaf, dequeueInfo(leafIDHash, queueID), nil
+	return leaf, dequeueInfo(leafIDHash, dedupNamespace, queueID), nil
 }
 
-func generateQueueID(treeID int64, leafIdentityHash []byte, timestamp int64) []byte {
+// generateQueueID returns the QueueID of a queue entry. The deduplication
+// namespace is only hashed if it isn't the default, so that the IDs of
+// entries in the default namespace are unchanged.
+func generateQueueID(treeID int64, leafIdentityHash, dedupNamespace []byte, timestamp int64) []byte {
 	h := sha256.New()
 	b := make([]byte, 10)
 	binary.PutVarint(b, treeID)
@@ -85,12 +123,15 @@ func generateQueueID(treeID int64, leafIdentityHash []byte, timestamp int64) []b
 	binary.PutVarint(b, timestamp)
 	h.Write(b)
 	h.Write(leafIdentityHash)
+	if len(dedupNamespace) > 0 {
+		h.Write(dedupNamespace)
+	}
 	return h.Sum(nil)
 }
 
-func queueArgs(treeID int64, identityHash []byte, queueTimestamp time.Time) []interface{} {
+func queueArgs(treeID int64, identityHash, dedupNamespace []byte, queueTimestamp time.Time) []interface{} {
 	timestamp := queueTimestamp.UnixNano()
-	return []interface{}{timestamp, generateQueueID(treeID, identityHash, timestamp)}
+	return []interface{}{timestamp, generateQueueID(treeID, identityHash, dedupNamespace, timestamp)}
 }
 
 func (t *logTreeTX) UpdateSequencedLeaves(ctx context.Context, leaves []*trillian.LogLeaf) error {
@@ -101,18 +142,19 @@ func (t *logTreeTX) UpdateSequencedLeaves(ctx context.Context, leaves []*trillia
 		if err := leaf.IntegrateTimestamp.CheckValid(); err != nil {
 			return fmt.Errorf("got invalid integrate timestamp: %w", err)
 		}
-		iTimestamp := leaf.IntegrateTimestamp.AsTime()
-		querySuffix = append(querySuffix, valuesPlaceholder5)
-		args = append(args, t.treeID, leaf.LeafIdentityHash, leaf.MerkleLeafHash, leaf.LeafIndex, iTimestamp.UnixNano())
-		qe, ok := t.dequeued[string(leaf.LeafIdentityHash)]
-		if !ok {
-			return fmt.Errorf("attempting to update leaf that wasn't dequeued. IdentityHash: %x", leaf.LeafIdentityHash)
+		qe, err := t.dequeuedLeafFor(leaf)
+		if err != nil {
+			return err
 		}
+		iTimestamp := t.truncateTimestamp(leaf.IntegrateTimestamp.AsTime())
+		values, leafArgs := t.sequencedLeafValues(leaf, qe.dedupNamespace, iTimestamp.UnixNano())
+		querySuffix = append(querySuffix, values)
+		args = append(args, leafArgs...)
 		dequeuedLeaves = append(dequeuedLeaves, qe)
 	}
 	result, err := t.tx.ExecContext(ctx, insertSequencedLeafSQL+strings.Join(querySuffix, ","), args...)
 	if err != nil {
-		klog.Warningf("Failed to update sequenced leaves: %s", err)
+		klog.Warningf("%sFailed to update sequenced leaves: %s", requestIDPrefix(ctx), err)
 	}
 	if err := checkResultOkAndRowCountIs(result, err, int64(len(leaves))); err != nil {
 		return err
@@ -121,6 +163,24 @@ func (t *logTreeTX) UpdateSequencedLeaves(ctx context.Context, leaves []*trillia
 	return t.removeSequencedLeaves(ctx, dequeuedLeaves)
 }
 
+// dequeuedLeafFor returns the queue entry of a leaf passed to
+// UpdateSequencedLeaves. Unless SkipDequeueTracking is set, the leaf must have
+// been dequeued by this transaction. If it is set, the entry is assumed to be
+// in the default deduplication namespace.
+func (t *logTreeTX) dequeuedLeafFor(leaf *trillian.LogLeaf) (dequeuedLeaf, error) {
+	if t.ls.opts.SkipDequeueTracking {
+		if err := leaf.QueueTimestamp.CheckValid(); err != nil {
+			return dequeuedLeaf{}, fmt.Errorf("got invalid queue timestamp: %w", err)
+		}
+		return dequeueInfo(leaf.LeafIdentityHash, nil, generateQueueID(t.treeID, leaf.LeafIdentityHash, nil, leaf.QueueTimestamp.AsTime().UnixNano())), nil
+	}
+	qe, ok := t.dequeued[string(leaf.LeafIdentityHash)]
+	if !ok {
+		return dequeuedLeaf{}, fmt.Errorf("attempting to update leaf that wasn't dequeued. IdentityHash: %x", leaf.LeafIdentityHash)
+	}
+	return qe, nil
+}
+
 func (m *mySQLLogStorage) getDeleteUnsequencedStmt(ctx context.Context, num int) (*sql.Stmt, error) {
 	return m.getStmt(ctx, deleteUnsequencedSQL, num, "?", "?")
 }
@@ -131,20 +191,34 @@ func (t *logTreeTX) removeSequencedLeaves(ctx context.Context, queueIDs []dequeu
 	// Don't need to re-sort because the query ordered by leaf hash. If that changes because
 	// the query is expensive then the sort will need to be done here. See comment in
 	// QueueLeaves.
+	//
+	// The leaves were already sequenced, so split them to fit the placeholder
+	// cap rather than fail.
+	chunkSize := t.ls.chunkSize(len(queueIDs), "?", "?")
+	for start := 0; start < len(queueIDs); start += chunkSize {
+		if err := t.removeSequencedLeavesChunk(ctx, queueIDs[start:min(start+chunkSize, len(queueIDs))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *logTreeTX) removeSequencedLeavesChunk(ctx context.Context, queueIDs []dequeuedLeaf) error {
 	tmpl, err := t.ls.getDeleteUnsequencedStmt(ctx, len(queueIDs))
 	if err != nil {
-		klog.Warningf("Failed to get delete statement for sequenced work: %s", err)
+		klog.Warningf("%sFailed to get delete statement for sequenced work: %s", requestIDPrefix(ctx), err)
 		return err
 	}
 	stx := t.tx.StmtContext(ctx, tmpl)
-	args := make([]interface{}, len(queueIDs))
-	for i, q := range queueIDs {
-		args[i] = []byte(q)
+	args := make([]interface{}, 0, len(queueIDs)+1)
+	args = append(args, t.treeID)
+	for _, q := range queueIDs {
+		args = append(args, q.queueID)
 	}
 	result, err := stx.ExecContext(ctx, args...)
 	if err != nil {
 		// Error is handled by checkResultOkAndRowCountIs() below
-		klog.Warningf("Failed to delete sequenced work: %s", err)
+		klog.Warningf("%sFailed to delete sequenced work: %s", requestIDPrefix(ctx), err)
 	}
 	return checkResultOkAndRowCountIs(result, err, int64(len(queueIDs)))
 }
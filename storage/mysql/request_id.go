@@ -0,0 +1,31 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/trillian/storage"
+)
+
+// requestIDPrefix returns a prefix for log messages identifying the request
+// carried by ctx, or the empty string if ctx doesn't carry a request ID.
+func requestIDPrefix(ctx context.Context) string {
+	if id, ok := storage.RequestIDFromContext(ctx); ok {
+		return fmt.Sprintf("[request_id=%s] ", id)
+	}
+	return ""
+}
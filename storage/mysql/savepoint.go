@@ -0,0 +1,56 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+)
+
+// savepointSeq makes savepoint names unique within the process, and hence
+// within any transaction, so that operations using savepoints can be nested.
+var savepointSeq atomic.Uint64
+
+// savepoint is a named SAVEPOINT within a transaction.
+type savepoint struct {
+	tx   *sql.Tx
+	name string
+}
+
+// newSavepoint returns a savepoint in tx whose name starts with prefix. It
+// isn't set until Set is called.
+func newSavepoint(tx *sql.Tx, prefix string) *savepoint {
+	return &savepoint{tx: tx, name: fmt.Sprintf("%s_%d", prefix, savepointSeq.Add(1))}
+}
+
+// Set sets the savepoint, moving it if it was already set.
+func (s *savepoint) Set(ctx context.Context) error {
+	_, err := s.tx.ExecContext(ctx, "SAVEPOINT "+s.name)
+	return err
+}
+
+// Rollback undoes the changes made since the savepoint was set.
+func (s *savepoint) Rollback(ctx context.Context) error {
+	_, err := s.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+s.name)
+	return err
+}
+
+// Release removes the savepoint, keeping the changes made since it was set.
+func (s *savepoint) Release(ctx context.Context) error {
+	_, err := s.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+s.name)
+	return err
+}
@@ -0,0 +1,34 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewSavepointUniqueNames(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		sp := newSavepoint(nil, "Test")
+		if !strings.HasPrefix(sp.name, "Test_") {
+			t.Errorf("newSavepoint(): name %q doesn't have prefix %q", sp.name, "Test_")
+		}
+		if seen[sp.name] {
+			t.Errorf("newSavepoint(): name %q reused", sp.name)
+		}
+		seen[sp.name] = true
+	}
+}
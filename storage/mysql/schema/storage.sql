@@ -36,6 +36,28 @@ CREATE TABLE IF NOT EXISTS TreeControl(
   FOREIGN KEY(TreeId) REFERENCES Trees(TreeId) ON DELETE CASCADE
 );
 
+-- Free-form operational notes attached to a tree, such as migration history or
+-- incident references. They are not interpreted by Trillian.
+CREATE TABLE IF NOT EXISTS TreeAnnotations(
+  TreeId                  BIGINT NOT NULL,
+  AnnotationKey           VARCHAR(255) NOT NULL,
+  AnnotationValue         TEXT NOT NULL,
+  PRIMARY KEY(TreeId, AnnotationKey),
+  FOREIGN KEY(TreeId) REFERENCES Trees(TreeId) ON DELETE CASCADE
+);
+
+-- History of admin mutations of each tree. There's deliberately no foreign key
+-- on TreeId so that the history outlives hard-deleted trees.
+CREATE TABLE IF NOT EXISTS TreeAudit(
+  AuditId                 BIGINT NOT NULL AUTO_INCREMENT,
+  TreeId                  BIGINT NOT NULL,
+  Op                      VARCHAR(32) NOT NULL,
+  AtMillis                BIGINT NOT NULL,
+  Details                 TEXT NOT NULL,
+  PRIMARY KEY(AuditId),
+  INDEX TreeAuditTreeIdx(TreeId, AuditId)
+);
+
 CREATE TABLE IF NOT EXISTS Subtree(
   TreeId               BIGINT NOT NULL,
   SubtreeId            VARBINARY(255) NOT NULL,
@@ -87,7 +109,17 @@ CREATE TABLE IF NOT EXISTS LeafData(
   ExtraData            LONGBLOB,
   -- The timestamp from when this leaf data was first queued for inclusion.
   QueueTimestampNanos  BIGINT NOT NULL,
-  PRIMARY KEY(TreeId, LeafIdentityHash),
+  -- An optional application-defined key by which leaves can be looked up.
+  LeafIndexKey         VARBINARY(255),
+  -- The MerkleLeafHash of the leaf, if the storage was configured to record
+  -- it, so that the leaf can be requeued if its Unsequenced entry is lost.
+  MerkleLeafHash       VARBINARY(255),
+  -- The deduplication namespace the leaf was queued in. Leaves are only
+  -- duplicates of leaves in the same namespace, and the empty namespace is
+  -- the default.
+  DedupNamespace       VARBINARY(255) NOT NULL DEFAULT '',
+  PRIMARY KEY(TreeId, LeafIdentityHash, DedupNamespace),
+  INDEX LeafDataIndexKeyIdx(TreeId, LeafIndexKey),
   FOREIGN KEY(TreeId) REFERENCES Trees(TreeId) ON DELETE CASCADE
 );
 
@@ -108,14 +140,20 @@ CREATE TABLE IF NOT EXISTS SequencedLeafData(
   -- CT this hash will include the leaf prefix byte as well as the leaf data.
   MerkleLeafHash       VARBINARY(255) NOT NULL,
   IntegrateTimestampNanos BIGINT NOT NULL,
+  -- The deduplication namespace of the LeafData row.
+  DedupNamespace       VARBINARY(255) NOT NULL DEFAULT '',
   PRIMARY KEY(TreeId, SequenceNumber),
   FOREIGN KEY(TreeId) REFERENCES Trees(TreeId) ON DELETE CASCADE,
-  FOREIGN KEY(TreeId, LeafIdentityHash) REFERENCES LeafData(TreeId, LeafIdentityHash) ON DELETE CASCADE
+  FOREIGN KEY(TreeId, LeafIdentityHash, DedupNamespace) REFERENCES LeafData(TreeId, LeafIdentityHash, DedupNamespace) ON DELETE CASCADE
 );
 
 CREATE INDEX SequencedLeafMerkleIdx
   ON SequencedLeafData(TreeId, MerkleLeafHash);
 
+-- Used by GetLeavesIntegratedSince to read leaves in integration order.
+CREATE INDEX SequencedLeafIntegrateIdx
+  ON SequencedLeafData(TreeId, IntegrateTimestampNanos, SequenceNumber);
+
 CREATE TABLE IF NOT EXISTS Unsequenced(
   TreeId               BIGINT NOT NULL,
   -- The bucket field is to allow the use of time based ring bucketed schemes if desired. If
@@ -133,5 +171,23 @@ CREATE TABLE IF NOT EXISTS Unsequenced(
   -- for batched deletes from the table when trillian_log_server and trillian_log_signer are
   -- built with the batched_queue tag.
   QueueID VARBINARY(32) DEFAULT NULL UNIQUE,
-  PRIMARY KEY (TreeId, Bucket, QueueTimestampNanos, LeafIdentityHash)
+  -- The time until which a sequencer worker has leased this entry, or zero.
+  LeasedUntilNanos     BIGINT NOT NULL DEFAULT 0,
+  -- The random ID of the lease on this entry, or zero if it was never leased.
+  LeaseID              BIGINT NOT NULL DEFAULT 0,
+  -- The deduplication namespace of the LeafData row.
+  DedupNamespace       VARBINARY(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (TreeId, Bucket, QueueTimestampNanos, LeafIdentityHash, DedupNamespace)
 );
+
+-- Unsequenced may be partitioned to spread the write load across trees. All
+-- statements that read from or delete from Unsequenced constrain both TreeId
+-- and Bucket with equality, so partitioning on TreeId allows MySQL to prune
+-- every dequeue to a single partition. MySQL requires every unique key to
+-- include the partitioning columns, so the QueueID key must be widened first:
+--
+--   ALTER TABLE Unsequenced DROP INDEX QueueID, ADD UNIQUE KEY (TreeId, Bucket, QueueID);
+--   ALTER TABLE Unsequenced PARTITION BY KEY(TreeId) PARTITIONS 16;
+--
+-- Partitioning by any other expression will not be pruned by the dequeue
+-- queries.
@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"encoding/gob"
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/google/trillian"
@@ -28,6 +29,11 @@ import (
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// DefaultMaxRootDuration is the MaxRootDuration of trees read from legacy rows
+// with a NULL MaxRootDurationMillis. It's the default of the createtree tool's
+// max_root_duration flag.
+const DefaultMaxRootDuration = time.Hour
+
 // toMillisSinceEpoch converts a timestamp into milliseconds since epoch
 func toMillisSinceEpoch(t time.Time) int64 {
 	return t.UnixNano() / 1000000
@@ -56,7 +62,8 @@ func readTree(r row) (*trillian.Tree, error) {
 
 	// Enums and Datetimes need an extra conversion step
 	var treeState, treeType, hashStrategy, hashAlgorithm, signatureAlgorithm string
-	var createMillis, updateMillis, maxRootDurationMillis int64
+	var createMillis, updateMillis int64
+	var maxRootDurationMillis sql.NullInt64
 	var displayName, description sql.NullString
 	var privateKey, publicKey []byte
 	var deleted sql.NullBool
@@ -118,7 +125,15 @@ func readTree(r row) (*trillian.Tree, error) {
 	if err := tree.UpdateTime.CheckValid(); err != nil {
 		return nil, fmt.Errorf("failed to parse update time: %w", err)
 	}
-	tree.MaxRootDuration = durationpb.New(time.Duration(maxRootDurationMillis * int64(time.Millisecond)))
+	// Legacy rows may have a NULL MaxRootDurationMillis, for which the default
+	// is used.
+	if !maxRootDurationMillis.Valid {
+		tree.MaxRootDuration = durationpb.New(DefaultMaxRootDuration)
+	} else if ms := maxRootDurationMillis.Int64; ms < 0 || ms > math.MaxInt64/int64(time.Millisecond) {
+		return nil, fmt.Errorf("invalid MaxRootDurationMillis: %d", ms)
+	} else {
+		tree.MaxRootDuration = durationpb.New(time.Duration(ms) * time.Millisecond)
+	}
 
 	tree.Deleted = deleted.Valid && deleted.Bool
 	if tree.Deleted && deleteMillis.Valid {
@@ -146,6 +161,9 @@ func readTree(r row) (*trillian.Tree, error) {
 	} else {
 		o = &mysqlpb.StorageOptions{
 			SubtreeRevisions: ss.Revisioned,
+			CompressLeafData: ss.CompressLeafData,
+			Hasher:           ss.Hasher,
+			EncryptLeafValue: ss.EncryptLeafValue,
 		}
 	}
 	tree.StorageSettings, err = anypb.New(o)
@@ -29,6 +29,9 @@ import (
 	"github.com/google/trillian/storage/mysql/mysqlpb"
 	"github.com/google/trillian/storage/storagepb"
 	"github.com/google/trillian/storage/tree"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
 	"k8s.io/klog/v2"
@@ -37,6 +40,10 @@ import (
 // These statements are fixed
 const (
 	insertSubtreeMultiSQL = `INSERT INTO Subtree(TreeId, SubtreeId, Nodes, SubtreeRevision) ` + placeholderSQL + ` ON DUPLICATE KEY UPDATE Nodes=VALUES(Nodes)`
+	// The placeholder of insertSubtreeMultiSQL expands to the first of these,
+	// followed by the rest of them, one per subtree.
+	insertSubtreeFirstSQL = "VALUES(?, ?, ?, ?)"
+	insertSubtreeRestSQL  = "(?, ?, ?, ?)"
 	insertTreeHeadSQL     = `INSERT INTO TreeHead(TreeId,TreeHeadTimestamp,TreeSize,RootHash,TreeRevision,RootSignature)
 		 VALUES(?,?,?,?,?,?)`
 
@@ -55,10 +62,13 @@ const (
  AND Subtree.TreeId = x.TreeId
  AND Subtree.TreeId = ?`
 
+	// Trees without subtree revisions only write the row at SubtreeRevision 0,
+	// so any other rows are stale and must not be read.
 	selectSubtreeSQLNoRev = `
  SELECT SubtreeId, Subtree.Nodes
  FROM Subtree
  WHERE Subtree.TreeId = ?
+   AND Subtree.SubtreeRevision = 0
    AND SubtreeId IN (` + placeholderSQL + `)`
 	placeholderSQL = "<placeholder>"
 )
@@ -74,6 +84,11 @@ type mySQLTreeStorage struct {
 	// in the query to the statement that should be used.
 	statementMutex sync.Mutex
 	statements     map[string]map[int]*sql.Stmt
+	// maxPlaceholders, if positive, caps the number of placeholders that
+	// statements may be expanded with. largestExpansion is the largest number
+	// expanded with so far. Both are guarded by statementMutex.
+	maxPlaceholders  int
+	largestExpansion int
 }
 
 // OpenDB opens a database connection for all MySQL-based storage implementations.
@@ -93,10 +108,11 @@ func OpenDB(dbURL string) (*sql.DB, error) {
 	return db, nil
 }
 
-func newTreeStorage(db *sql.DB) *mySQLTreeStorage {
+func newTreeStorage(db *sql.DB, maxPlaceholders int) *mySQLTreeStorage {
 	return &mySQLTreeStorage{
-		db:         db,
-		statements: make(map[string]map[int]*sql.Stmt),
+		db:              db,
+		statements:      make(map[string]map[int]*sql.Stmt),
+		maxPlaceholders: maxPlaceholders,
 	}
 }
 
@@ -112,6 +128,12 @@ func expandPlaceholderSQL(sql string, num int, first, rest string) string {
 	return strings.Replace(sql, placeholderSQL, parameters, 1)
 }
 
+// expandedPlaceholders returns the number of '?' placeholders that
+// expandPlaceholderSQL adds to a statement for the same arguments.
+func expandedPlaceholders(num int, first, rest string) int {
+	return strings.Count(first, "?") + (num-1)*strings.Count(rest, "?")
+}
+
 // getStmt creates and caches sql.Stmt structs based on the passed in statement
 // and number of bound arguments.
 // TODO(al,martin): consider pulling this all out as a separate unit for reuse
@@ -120,6 +142,12 @@ func (m *mySQLTreeStorage) getStmt(ctx context.Context, statement string, num in
 	m.statementMutex.Lock()
 	defer m.statementMutex.Unlock()
 
+	// Check the size before building the SQL, which could be huge.
+	expanded := expandedPlaceholders(num, first, rest)
+	if m.maxPlaceholders > 0 && expanded > m.maxPlaceholders {
+		return nil, status.Errorf(codes.InvalidArgument, "statement would have %d placeholders, want <= %d", expanded, m.maxPlaceholders)
+	}
+
 	if m.statements[statement] != nil {
 		if m.statements[statement][num] != nil {
 			// TODO(al,martin): we'll possibly need to expire Stmts from the cache,
@@ -132,15 +160,30 @@ func (m *mySQLTreeStorage) getStmt(ctx context.Context, statement string, num in
 
 	s, err := m.db.PrepareContext(ctx, expandPlaceholderSQL(statement, num, first, rest))
 	if err != nil {
-		klog.Warningf("Failed to prepare statement %d: %s", num, err)
+		klog.Warningf("%sFailed to prepare statement %d: %s", requestIDPrefix(ctx), num, err)
 		return nil, err
 	}
 
 	m.statements[statement][num] = s
+	if expanded > m.largestExpansion {
+		m.largestExpansion = expanded
+		stmtPlaceholdersGauge.Set(float64(expanded))
+	}
 
 	return s, nil
 }
 
+// chunkSize returns n, capped at the largest number of groups of first and
+// rest placeholders, as passed to getStmt, that fit within maxPlaceholders if
+// that's set. It's for callers which split their arguments between statements
+// rather than fail requests exceeding the cap. It's at least 1.
+func (m *mySQLTreeStorage) chunkSize(n int, first, rest string) int {
+	if m.maxPlaceholders <= 0 || expandedPlaceholders(n, first, rest) <= m.maxPlaceholders {
+		return n
+	}
+	return max(1, (m.maxPlaceholders-strings.Count(first, "?"))/strings.Count(rest, "?")+1)
+}
+
 func (m *mySQLTreeStorage) getSubtreeStmt(ctx context.Context, subtreeRevs bool, num int) (*sql.Stmt, error) {
 	if subtreeRevs {
 		return m.getStmt(ctx, selectSubtreeSQL, num, "?", "?")
@@ -150,31 +193,47 @@ func (m *mySQLTreeStorage) getSubtreeStmt(ctx context.Context, subtreeRevs bool,
 }
 
 func (m *mySQLTreeStorage) setSubtreeStmt(ctx context.Context, num int) (*sql.Stmt, error) {
-	return m.getStmt(ctx, insertSubtreeMultiSQL, num, "VALUES(?, ?, ?, ?)", "(?, ?, ?, ?)")
+	return m.getStmt(ctx, insertSubtreeMultiSQL, num, insertSubtreeFirstSQL, insertSubtreeRestSQL)
 }
 
-func (m *mySQLTreeStorage) beginTreeTx(ctx context.Context, tree *trillian.Tree, hashSizeBytes int, subtreeCache *cache.SubtreeCache) (treeTX, error) {
-	t, err := m.db.BeginTx(ctx, nil /* opts */)
+// storageOptions returns the MySQL storage options of tree.
+func storageOptions(tree *trillian.Tree) (*mysqlpb.StorageOptions, error) {
+	o := &mysqlpb.StorageOptions{}
+	if err := anypb.UnmarshalTo(tree.StorageSettings, o, proto.UnmarshalOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal StorageSettings: %v", err)
+	}
+	return o, nil
+}
+
+// beginTreeTx starts a transaction for tree, whose subtree cache and hash
+// size are those of the hasher selected by its StorageSettings.
+func (m *mySQLTreeStorage) beginTreeTx(ctx context.Context, tree *trillian.Tree, opts *sql.TxOptions) (treeTX, error) {
+	o, err := storageOptions(tree)
 	if err != nil {
-		klog.Warningf("Could not start tree TX: %s", err)
 		return treeTX{}, err
 	}
-	var subtreeRevisions bool
-	o := &mysqlpb.StorageOptions{}
-	if err := anypb.UnmarshalTo(tree.StorageSettings, o, proto.UnmarshalOptions{}); err != nil {
-		return treeTX{}, fmt.Errorf("failed to unmarshal StorageSettings: %v", err)
+	hasher, err := logHasher(o.Hasher)
+	if err != nil {
+		return treeTX{}, err
+	}
+	t, err := m.db.BeginTx(ctx, opts)
+	if err != nil {
+		klog.Warningf("%sCould not start tree TX: %s", requestIDPrefix(ctx), err)
+		return treeTX{}, err
 	}
-	subtreeRevisions = o.SubtreeRevisions
 	return treeTX{
-		tx:            t,
-		mu:            &sync.Mutex{},
-		ts:            m,
-		treeID:        tree.TreeId,
-		treeType:      tree.TreeType,
-		hashSizeBytes: hashSizeBytes,
-		subtreeCache:  subtreeCache,
-		writeRevision: -1,
-		subtreeRevs:   subtreeRevisions,
+		tx:               t,
+		mu:               &sync.Mutex{},
+		ts:               m,
+		treeID:           tree.TreeId,
+		treeType:         tree.TreeType,
+		hasher:           hasher,
+		hashSizeBytes:    hasher.Size(),
+		subtreeCache:     cache.NewLogSubtreeCache(hasher),
+		writeRevision:    -1,
+		subtreeRevs:      o.SubtreeRevisions,
+		compressLeafData: o.CompressLeafData,
+		encryptLeafValue: o.EncryptLeafValue,
 	}, nil
 }
 
@@ -186,10 +245,28 @@ type treeTX struct {
 	ts            *mySQLTreeStorage
 	treeID        int64
 	treeType      trillian.TreeType
+	hasher        *rfc6962.Hasher
 	hashSizeBytes int
 	subtreeCache  *cache.SubtreeCache
 	writeRevision int64
 	subtreeRevs   bool
+	// compressLeafData is whether LeafValue and ExtraData are stored encoded
+	// with a codec prefix. See encodeLeafData.
+	compressLeafData bool
+	// encryptLeafValue is whether LeafValue is stored encrypted by
+	// leafCrypter, with a version prefix. See encryptLeafValue.
+	encryptLeafValue bool
+	leafCrypter      LeafCrypter
+}
+
+// checkHashSize returns an InvalidArgument error if hash isn't the size of the
+// tree's hashes. The error names the hash by fmt.Sprintf(desc, i), e.g.
+// "leaves[3].LeafIdentityHash", so that callers can find the offending entry.
+func (t *treeTX) checkHashSize(hash []byte, desc string, i int) error {
+	if got, want := len(hash), t.hashSizeBytes; got != want {
+		return status.Errorf(codes.InvalidArgument, "%s has length %d, want %d", fmt.Sprintf(desc, i), got, want)
+	}
+	return nil
 }
 
 func (t *treeTX) getSubtrees(ctx context.Context, treeRevision int64, ids [][]byte) ([]*storagepb.SubtreeProto, error) {
@@ -199,6 +276,24 @@ func (t *treeTX) getSubtrees(ctx context.Context, treeRevision int64, ids [][]by
 		return nil, nil
 	}
 
+	// Subtrees are read by storage itself, so split them to fit the
+	// placeholder cap rather than fail.
+	chunkSize := t.ts.chunkSize(len(ids), "?", "?")
+	ret := make([]*storagepb.SubtreeProto, 0, len(ids))
+	for start := 0; start < len(ids); start += chunkSize {
+		subtrees, err := t.getSubtreesChunk(ctx, treeRevision, ids[start:min(start+chunkSize, len(ids))])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, subtrees...)
+	}
+
+	// The InternalNodes cache is possibly nil here, but the SubtreeCache (which called
+	// this method) will re-populate it.
+	return ret, nil
+}
+
+func (t *treeTX) getSubtreesChunk(ctx context.Context, treeRevision int64, ids [][]byte) ([]*storagepb.SubtreeProto, error) {
 	tmpl, err := t.ts.getSubtreeStmt(ctx, t.subtreeRevs, len(ids))
 	if err != nil {
 		return nil, err
@@ -234,7 +329,7 @@ func (t *treeTX) getSubtrees(ctx context.Context, treeRevision int64, ids [][]by
 
 	rows, err := stx.QueryContext(ctx, args...)
 	if err != nil {
-		klog.Warningf("Failed to get merkle subtrees: %s", err)
+		klog.Warningf("%sFailed to get merkle subtrees: %s", requestIDPrefix(ctx), err)
 		return nil, err
 	}
 	defer func() {
@@ -245,7 +340,7 @@ func (t *treeTX) getSubtrees(ctx context.Context, treeRevision int64, ids [][]by
 
 	if rows.Err() != nil {
 		// Nothing from the DB
-		klog.Warningf("Nothing from DB: %s", rows.Err())
+		klog.Warningf("%sNothing from DB: %s", requestIDPrefix(ctx), rows.Err())
 		return nil, rows.Err()
 	}
 
@@ -255,12 +350,12 @@ func (t *treeTX) getSubtrees(ctx context.Context, treeRevision int64, ids [][]by
 		var subtreeIDBytes []byte
 		var nodesRaw []byte
 		if err := rows.Scan(&subtreeIDBytes, &nodesRaw); err != nil {
-			klog.Warningf("Failed to scan merkle subtree: %s", err)
+			klog.Warningf("%sFailed to scan merkle subtree: %s", requestIDPrefix(ctx), err)
 			return nil, err
 		}
 		var subtree storagepb.SubtreeProto
 		if err := proto.Unmarshal(nodesRaw, &subtree); err != nil {
-			klog.Warningf("Failed to unmarshal SubtreeProto: %s", err)
+			klog.Warningf("%sFailed to unmarshal SubtreeProto: %s", requestIDPrefix(ctx), err)
 			return nil, err
 		}
 		if subtree.Prefix == nil {
@@ -284,9 +379,6 @@ func (t *treeTX) getSubtrees(ctx context.Context, treeRevision int64, ids [][]by
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-
-	// The InternalNodes cache is possibly nil here, but the SubtreeCache (which called
-	// this method) will re-populate it.
 	return ret, nil
 }
 
@@ -309,9 +401,19 @@ func (t *treeTX) storeSubtrees(ctx context.Context, subtrees []*storagepb.Subtre
 		return nil
 	}
 
-	// TODO(al): probably need to be able to batch this in the case where we have
-	// a really large number of subtrees to store.
-	args := make([]interface{}, 0, len(subtrees))
+	// Split large numbers of subtrees to fit the placeholder cap rather than
+	// fail the commit.
+	chunkSize := t.ts.chunkSize(len(subtrees), insertSubtreeFirstSQL, insertSubtreeRestSQL)
+	for start := 0; start < len(subtrees); start += chunkSize {
+		if err := t.storeSubtreesChunk(ctx, subtrees[start:min(start+chunkSize, len(subtrees))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *treeTX) storeSubtreesChunk(ctx context.Context, subtrees []*storagepb.SubtreeProto) error {
+	args := make([]interface{}, 0, 4*len(subtrees))
 
 	// If not using subtree revisions then default value of 0 is fine. There is no
 	// significance to this value, other than it cannot be NULL in the DB.
@@ -348,7 +450,7 @@ func (t *treeTX) storeSubtrees(ctx context.Context, subtrees []*storagepb.Subtre
 
 	r, err := stx.ExecContext(ctx, args...)
 	if err != nil {
-		klog.Warningf("Failed to set merkle subtrees: %s", err)
+		klog.Warningf("%sFailed to set merkle subtrees: %s", requestIDPrefix(ctx), err)
 		return err
 	}
 	_, _ = r.RowsAffected()
@@ -377,7 +479,12 @@ func checkResultOkAndRowCountIs(res sql.Result, err error, count int64) error {
 }
 
 // getSubtreesAtRev returns a GetSubtreesFunc which reads at the passed in rev.
+// Trees without subtree revisions have a single current row per subtree, which
+// is read regardless of rev.
 func (t *treeTX) getSubtreesAtRev(ctx context.Context, rev int64) cache.GetSubtreesFunc {
+	if !t.subtreeRevs {
+		rev = 0
+	}
 	return func(ids [][]byte) ([]*storagepb.SubtreeProto, error) {
 		return t.getSubtrees(ctx, rev, ids)
 	}
@@ -397,11 +504,11 @@ func (t *treeTX) Commit(ctx context.Context) error {
 	if t.writeRevision > -1 {
 		tiles, err := t.subtreeCache.UpdatedTiles()
 		if err != nil {
-			klog.Warningf("SubtreeCache updated tiles error: %v", err)
+			klog.Warningf("%sSubtreeCache updated tiles error: %v", requestIDPrefix(ctx), err)
 			return err
 		}
 		if err := t.storeSubtrees(ctx, tiles); err != nil {
-			klog.Warningf("TX commit flush error: %v", err)
+			klog.Warningf("%sTX commit flush error: %v", requestIDPrefix(ctx), err)
 			return err
 		}
 	}
@@ -0,0 +1,129 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// warnings samples the warnings logged on paths that can run for every
+// request, so that e.g. a client retry storm doesn't flood the logs.
+var warnings = newWarnSampler(time.Second, 1)
+
+// warnSampler rate-limits warnings using a token bucket per tree and format
+// string. Suppressed warnings are counted, and the count is reported with the
+// next warning which is logged for the same bucket. Buckets which have been
+// idle for long enough to refill are evicted, reporting any count left.
+type warnSampler struct {
+	every time.Duration
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[warnKey]*warnBucket
+	// lastEviction is when idle buckets were last evicted.
+	lastEviction time.Time
+}
+
+type warnKey struct {
+	treeID int64
+	format string
+}
+
+type warnBucket struct {
+	tokens     float64
+	last       time.Time
+	suppressed int
+}
+
+// newWarnSampler returns a warnSampler which allows bursts of up to burst
+// warnings per bucket, refilled at one per every.
+func newWarnSampler(every time.Duration, burst int) *warnSampler {
+	return &warnSampler{
+		every:   every,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[warnKey]*warnBucket),
+	}
+}
+
+// allow reports whether a warning for the given tree and format should be
+// logged and, if so, how many were suppressed since the last one that was.
+func (s *warnSampler) allow(treeID int64, format string) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	key := warnKey{treeID: treeID, format: format}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &warnBucket{tokens: s.burst, last: now}
+		s.buckets[key] = b
+	}
+	b.tokens += float64(now.Sub(b.last)) / float64(s.every)
+	if b.tokens > s.burst {
+		b.tokens = s.burst
+	}
+	b.last = now
+	s.evictIdleLocked(key, now)
+
+	if b.tokens < 1 {
+		b.suppressed++
+		return false, 0
+	}
+	b.tokens--
+	suppressed := b.suppressed
+	b.suppressed = 0
+	return true, suppressed
+}
+
+// evictIdleLocked drops the buckets other than keep which have been idle for
+// long enough to refill, since they behave the same as the full buckets that
+// replace them, logging the counts of warnings they suppressed. So that this
+// doesn't scan the buckets on every warning, it runs at most once per the
+// time it takes to refill an empty bucket. Requires s.mu to be locked.
+func (s *warnSampler) evictIdleLocked(keep warnKey, now time.Time) {
+	refill := time.Duration(s.burst * float64(s.every))
+	if now.Sub(s.lastEviction) < refill {
+		return
+	}
+	s.lastEviction = now
+	for key, b := range s.buckets {
+		if key == keep || now.Sub(b.last) < refill {
+			continue
+		}
+		if b.suppressed > 0 {
+			klog.Warningf("%d warnings about tree %d suppressed, like: %s", b.suppressed, key.treeID, key.format)
+		}
+		delete(s.buckets, key)
+	}
+}
+
+// Warningf logs a warning about the given tree unless its bucket is empty.
+func (s *warnSampler) Warningf(treeID int64, format string, args ...interface{}) {
+	ok, suppressed := s.allow(treeID, format)
+	if !ok {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if suppressed > 0 {
+		msg = fmt.Sprintf("%s (%d similar warnings suppressed)", msg, suppressed)
+	}
+	klog.WarningDepth(1, msg)
+}
@@ -0,0 +1,80 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWarnSampler(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := newWarnSampler(time.Second, 2)
+	s.now = func() time.Time { return now }
+
+	for _, tc := range []struct {
+		advance        time.Duration
+		treeID         int64
+		wantOK         bool
+		wantSuppressed int
+	}{
+		// The burst is allowed, then warnings are suppressed.
+		{wantOK: true},
+		{wantOK: true},
+		{wantOK: false},
+		{wantOK: false},
+		// Other trees have their own buckets.
+		{treeID: 2, wantOK: true},
+		// Half a token isn't enough.
+		{advance: 500 * time.Millisecond, wantOK: false},
+		// The next allowed warning reports the suppressed count.
+		{advance: 500 * time.Millisecond, wantOK: true, wantSuppressed: 3},
+		{wantOK: false},
+		// Tokens don't accumulate beyond the burst.
+		{advance: time.Hour, wantOK: true, wantSuppressed: 1},
+		{wantOK: true},
+		{wantOK: false},
+	} {
+		now = now.Add(tc.advance)
+		ok, suppressed := s.allow(tc.treeID, "format %d")
+		if ok != tc.wantOK || suppressed != tc.wantSuppressed {
+			t.Errorf("after %v, allow(%d) = %t, %d, want %t, %d", tc.advance, tc.treeID, ok, suppressed, tc.wantOK, tc.wantSuppressed)
+		}
+	}
+}
+
+func TestWarnSamplerEvictsIdleBuckets(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := newWarnSampler(time.Second, 2)
+	s.now = func() time.Time { return now }
+
+	s.allow(1, "format %d")
+	now = now.Add(time.Second)
+	s.allow(2, "format %d")
+	if got, want := len(s.buckets), 2; got != want {
+		t.Fatalf("Got %d buckets, want %d", got, want)
+	}
+
+	// The bucket of tree 1 has been idle for the two seconds it takes to
+	// refill, but that of tree 2 hasn't.
+	now = now.Add(time.Second)
+	s.allow(3, "format %d")
+	if _, ok := s.buckets[warnKey{treeID: 1, format: "format %d"}]; ok {
+		t.Error("Idle bucket of tree 1 wasn't evicted")
+	}
+	if _, ok := s.buckets[warnKey{treeID: 2, format: "format %d"}]; !ok {
+		t.Error("Bucket of tree 2 was evicted")
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2026 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	ctx := context.Background()
+	if id, ok := RequestIDFromContext(ctx); ok {
+		t.Errorf("RequestIDFromContext() = %q, true; want false", id)
+	}
+	if id, ok := RequestIDFromContext(WithRequestID(ctx, "")); ok {
+		t.Errorf("RequestIDFromContext() with empty ID = %q, true; want false", id)
+	}
+	if id, ok := RequestIDFromContext(WithRequestID(ctx, "req-1")); !ok || id != "req-1" {
+		t.Errorf("RequestIDFromContext() = %q, %t; want %q, true", id, ok, "req-1")
+	}
+}